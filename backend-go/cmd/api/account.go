@@ -0,0 +1,399 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/saiharsha/money-manager/internal/data"
+	jsonhelper "github.com/saiharsha/money-manager/pkg/json"
+	"github.com/saiharsha/money-manager/pkg/validator"
+)
+
+// exportAccountHandler returns a ZIP with everything stored about the user:
+// the profile and settings as JSON, records and comments as CSV.
+func (app *application) exportAccountHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readCurrentUser(w, r)
+	if !ok {
+		return
+	}
+
+	export, err := app.models.Accounts.Export(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	views, err := app.models.Views.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	tokens, err := app.models.AccessTokens.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	ledgers, err := app.models.Ledgers.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	sessions, err := app.models.Sessions.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	var buf bytes.Buffer
+	archive := zip.NewWriter(&buf)
+
+	err = writeZipJSON(archive, "profile.json", jsonhelper.Envelope{
+		"user":       user,
+		"identities": export.Identities,
+	})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = writeZipJSON(archive, "settings.json", jsonhelper.Envelope{
+		"timezone":      user.Timezone,
+		"currency_id":   user.CurrencyID,
+		"saved_views":   views,
+		"access_tokens": tokens,
+		"ledgers":       ledgers,
+		"sessions":      sessions,
+	})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	records := [][]string{{"id", "ledger_id", "ledger", "occurred_at", "amount", "currency", "type", "description", "timezone", "created_at", "updated_at", "deleted_at"}}
+	for _, record := range export.Records {
+		records = append(records, []string{
+			strconv.FormatInt(record.ID, 10),
+			strconv.FormatInt(record.LedgerID, 10),
+			record.Ledger,
+			record.OccurredAt.Format(time.RFC3339),
+			strconv.FormatInt(record.Amount, 10),
+			record.Currency,
+			record.Type,
+			record.Description,
+			record.Timezone,
+			record.CreatedAt.Format(time.RFC3339),
+			record.UpdatedAt.Format(time.RFC3339),
+			formatOptionalTime(record.DeletedAt),
+		})
+	}
+
+	err = writeZipCSV(archive, "records.csv", records)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	comments := [][]string{{"id", "record_id", "description", "created_at", "updated_at", "deleted_at"}}
+	for _, comment := range export.Comments {
+		comments = append(comments, []string{
+			strconv.FormatInt(comment.ID, 10),
+			strconv.FormatInt(comment.RecordID, 10),
+			comment.Description,
+			comment.CreatedAt.Format(time.RFC3339),
+			comment.UpdatedAt.Format(time.RFC3339),
+			formatOptionalTime(comment.DeletedAt),
+		})
+	}
+
+	err = writeZipCSV(archive, "comments.csv", comments)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = archive.Close()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.logger.PrintInfo(fmt.Sprintf("user %d exported their data", user.ID), nil)
+
+	filename := fmt.Sprintf("money-manager-export-%s.zip", time.Now().UTC().Format("2006-01-02"))
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+
+	_, err = buf.WriteTo(w)
+	if err != nil {
+		app.logError(r, err)
+	}
+}
+
+// deleteAccountHandler starts deleting the account by emailing a
+// confirmation link. Nothing changes until the link is opened.
+func (app *application) deleteAccountHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Password string `json:"password"`
+	}
+
+	err := jsonhelper.ReadJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.NewValidator()
+	v.Check(input.Password != "", "password", "must be provided")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, ok := app.readCurrentUser(w, r)
+	if !ok {
+		return
+	}
+
+	if !app.checkCurrentPassword(w, r, user, input.Password) {
+		return
+	}
+
+	err = app.models.Tokens.DeleteAllForUser(data.TokenScopeAccountDeletion, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	token, err := app.models.Tokens.New(user.ID, user.Email, data.AccountDeletionTokenTTL, data.TokenScopeAccountDeletion)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	confirmLink := fmt.Sprintf("http://%s:%d/users/delete/confirm/%s", app.config.host, app.config.port, token.Plaintext)
+
+	app.BackgroundEmailTask(func() {
+		err := app.mailer.SendAccountDeletionConfirmEmail([]string{user.Email}, user.Name, confirmLink, token.Expiry, app.config.accounts.deletionGrace)
+		if err != nil {
+			app.logger.PrintError(err, map[string]string{
+				"user_email": user.Email,
+				"operation":  "send_account_deletion_confirm_email",
+			})
+		}
+	})
+
+	envelope := jsonhelper.Envelope{
+		"message": fmt.Sprintf("a confirmation link has been sent to %s", user.Email),
+	}
+
+	err = jsonhelper.WriteJSON(w, http.StatusAccepted, envelope, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// checkAccountDeletionHandler is opened from the emailed link. It only tells
+// whether the link is still valid: mail scanners and link previews follow it
+// too, so the deletion is confirmed with a POST to the same url.
+func (app *application) checkAccountDeletionHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.NewValidator()
+
+	t, err := app.models.Tokens.Check(data.TokenScopeAccountDeletion, chi.URLParam(r, "token"))
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrExpiredToken):
+			v.AddError("token", "the confirmation link has expired, please request the deletion again")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or already used confirmation link")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	envelope := jsonhelper.Envelope{
+		"message":    "the confirmation link is valid, POST to this url to delete your account",
+		"expires_at": t.Expiry,
+	}
+
+	err = jsonhelper.WriteJSON(w, http.StatusOK, envelope, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// confirmAccountDeletionHandler confirms the deletion with the emailed link.
+// It schedules the deletion after the grace period and signs the user out
+// everywhere.
+func (app *application) confirmAccountDeletionHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.NewValidator()
+
+	t, err := app.models.Tokens.Use(data.TokenScopeAccountDeletion, chi.URLParam(r, "token"))
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrExpiredToken):
+			v.AddError("token", "the confirmation link has expired, please request the deletion again")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or already used confirmation link")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	user, err := app.models.Users.GetUserByID(t.UserID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or already used confirmation link")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	deleteAfter, err := app.models.Accounts.ScheduleDeletion(user.ID, time.Now().Add(app.config.accounts.deletionGrace))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	_, err = app.models.Users.RevokeTokens(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.logger.PrintInfo(fmt.Sprintf("user %d scheduled their account for deletion on %s", user.ID, deleteAfter.UTC().Format(time.RFC3339)), nil)
+
+	app.BackgroundEmailTask(func() {
+		err := app.mailer.SendAccountDeletionScheduledEmail([]string{user.Email}, user.Name, deleteAfter)
+		if err != nil {
+			app.logger.PrintError(err, map[string]string{
+				"user_email": user.Email,
+				"operation":  "send_account_deletion_scheduled_email",
+			})
+		}
+	})
+
+	envelope := jsonhelper.Envelope{
+		"message":      "your account will be deleted, log in before then to cancel",
+		"delete_after": deleteAfter,
+	}
+
+	err = jsonhelper.WriteJSON(w, http.StatusOK, envelope, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) cancelAccountDeletionHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	err := app.models.Accounts.CancelDeletion(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.Tokens.DeleteAllForUser(data.TokenScopeAccountDeletion, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = jsonhelper.WriteJSON(w, http.StatusOK, jsonhelper.Envelope{"message": "account deletion cancelled"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// purgeDeletedAccounts deletes the accounts whose grace period has passed
+// and the attachment content only they used. One failing account does not
+// hold up the others.
+func (app *application) purgeDeletedAccounts() error {
+	ids, err := app.models.Accounts.DueForDeletion()
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		orphans, err := app.models.Accounts.Purge(id)
+		if err != nil {
+			if !errors.Is(err, data.ErrRecordNotFound) {
+				app.logger.PrintError(err, map[string]string{"job": "purge_deleted_accounts", "user_id": strconv.FormatInt(id, 10)})
+			}
+			continue
+		}
+
+		for _, attachment := range orphans {
+			if err := app.deleteUnusedContent(context.Background(), attachment); err != nil {
+				app.logger.PrintError(err, map[string]string{"job": "purge_deleted_accounts", "sha256": attachment.SHA256})
+			}
+		}
+
+		app.logger.PrintInfo(fmt.Sprintf("purged the account of user %d", id), nil)
+	}
+
+	return nil
+}
+
+func writeZipJSON(archive *zip.Writer, name string, v interface{}) error {
+	f, err := archive.Create(name)
+	if err != nil {
+		return err
+	}
+
+	js, err := json.MarshalIndent(v, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(append(js, '\n'))
+	return err
+}
+
+func writeZipCSV(archive *zip.Writer, name string, rows [][]string) error {
+	f, err := archive.Create(name)
+	if err != nil {
+		return err
+	}
+
+	cw := csv.NewWriter(f)
+	err = cw.WriteAll(rows)
+	if err != nil {
+		return err
+	}
+
+	return cw.Error()
+}
+
+func formatOptionalTime(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
@@ -4,24 +4,17 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/saiharsha/money-manager/internal/data"
 	jsonhelper "github.com/saiharsha/money-manager/pkg/json"
 	"github.com/saiharsha/money-manager/pkg/validator"
 )
 
-type Role string
-
-const (
-	RoleUser      Role = "user"
-	RoleAdmin     Role = "admin"
-	RoleSuperUser Role = "superuser"
-)
-
 func (app *application) UpdateUserRoleHandler(w http.ResponseWriter, r *http.Request) {
 	var input struct {
 		Email string `json:"email"`
-		Role  Role   `json:"role"`
+		Role  string `json:"role"`
 	}
 
 	err := jsonhelper.ReadJSON(w, r, &input)
@@ -31,13 +24,29 @@ func (app *application) UpdateUserRoleHandler(w http.ResponseWriter, r *http.Req
 	}
 
 	v := validator.NewValidator()
-	v.Check(input.Role == "user" || input.Role == "superuser" || input.Role == "admin", "user", fmt.Sprintf("role type %v not allowed", input.Role))
+	v.Check(input.Role != "", "role", "must be provided")
 
 	if !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
 
+	role, err := app.models.Roles.Get(input.Role)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("role", fmt.Sprintf("role %v does not exist", input.Role))
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if !app.checkGrantable(w, r, role.Permissions) {
+		return
+	}
+
 	user, err := app.models.Users.GetUserByMail(input.Email)
 	if err != nil {
 		switch {
@@ -55,7 +64,19 @@ func (app *application) UpdateUserRoleHandler(w http.ResponseWriter, r *http.Req
 		"role": user.Role,
 	})
 
-	user.Role = string(input.Role)
+	// demoting someone takes the same permissions as promoting them
+	current, err := app.models.Roles.GetForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !app.checkGrantable(w, r, current) {
+		return
+	}
+
+	previousRole := user.Role
+	user.Role = role.Name
 	updateduser, err := app.models.Users.UpdateUser(user)
 
 	if err != nil {
@@ -68,6 +89,9 @@ func (app *application) UpdateUserRoleHandler(w http.ResponseWriter, r *http.Req
 		return
 	}
 
+	app.permissions.forget(user.ID)
+	app.auditUserChange(r, data.AuditUserRoleChange, user.ID, map[string]interface{}{"from": previousRole, "to": user.Role})
+
 	app.logger.PrintDebug("patched the user for update role succesfully", map[string]string{
 		"user": updateduser.Name,
 		"role": updateduser.Role,
@@ -78,3 +102,315 @@ func (app *application) UpdateUserRoleHandler(w http.ResponseWriter, r *http.Req
 		app.serverErrorResponse(w, r, err)
 	}
 }
+
+// adminUnlockUserHandler lifts a lockout from failed logins before it runs
+// out, e.g. after the user confirmed the attempts were their own.
+func (app *application) adminUnlockUserHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := jsonhelper.ReadIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	if !app.checkUserGrantable(w, r, id) {
+		return
+	}
+
+	err = app.models.Users.Unlock(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	admin := app.contextGetUser(r)
+	app.logger.PrintInfo(fmt.Sprintf("user %d unlocked by admin %d", id, admin.ID), nil)
+	app.auditUserChange(r, data.AuditUserUnlock, id, nil)
+
+	err = jsonhelper.WriteJSON(w, http.StatusOK, jsonhelper.Envelope{"message": "user unlocked"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// adminListUsersHandler lists users for the admin area. q searches names and
+// emails; role, activated and suspended filter the list.
+func (app *application) adminListUsersHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.NewValidator()
+
+	filter := data.UserFilter{
+		Search:    jsonhelper.ReadStringParam(r, "q", ""),
+		Role:      jsonhelper.ReadStringParam(r, "role", ""),
+		Activated: jsonhelper.ReadBoolParam(r, "activated", v),
+		Suspended: jsonhelper.ReadBoolParam(r, "suspended", v),
+	}
+
+	var filters data.Filters
+	filters.Page = jsonhelper.ReadIntParam(r, "page", 1, v)
+	filters.PageSize = jsonhelper.ReadIntParam(r, "page_size", 20, v)
+	filters.Sort = jsonhelper.ReadStringParam(r, "sort", "id")
+	filters.SortSafeList = data.UserSortSafeList
+
+	data.ValidateFilters(v, filters)
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	users, metadata, err := app.models.Users.GetAll(filter, filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = jsonhelper.WriteJSON(w, http.StatusOK, jsonhelper.Envelope{"metadata": metadata, "users": users}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// adminGetUserHandler returns a user with the latest admin changes made to
+// them.
+func (app *application) adminGetUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUserParam(w, r)
+	if !ok {
+		return
+	}
+
+	events, err := app.models.Audit.GetForEntity("user", user.ID, 50)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = jsonhelper.WriteJSON(w, http.StatusOK, jsonhelper.Envelope{"user": user, "audit_events": events}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// adminSuspendUserHandler blocks a user from logging in and revokes their
+// sessions and access tokens until they are unsuspended.
+func (app *application) adminSuspendUserHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Reason string `json:"reason"`
+	}
+
+	err := jsonhelper.ReadJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.NewValidator()
+	v.Check(input.Reason != "", "reason", "must be provided")
+	v.Check(len(input.Reason) <= 500, "reason", "must be at most 500 characters long")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, ok := app.readUserParam(w, r)
+	if !ok {
+		return
+	}
+
+	admin := app.contextGetUser(r)
+	if user.ID == admin.ID {
+		v.AddError("id", "you cannot suspend your own account")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	if !app.checkUserGrantable(w, r, user.ID) {
+		return
+	}
+
+	if user.SuspendedAt == nil {
+		now := time.Now()
+		user.SuspendedAt = &now
+	}
+
+	if !app.saveUser(w, r, user) {
+		return
+	}
+
+	_, err = app.models.Users.RevokeTokens(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.logger.PrintInfo(fmt.Sprintf("user %d suspended by admin %d", user.ID, admin.ID), nil)
+	app.auditUserChange(r, data.AuditUserSuspend, user.ID, map[string]interface{}{"reason": input.Reason})
+
+	err = jsonhelper.WriteJSON(w, http.StatusOK, jsonhelper.Envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) adminUnsuspendUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUserParam(w, r)
+	if !ok {
+		return
+	}
+
+	if !app.checkUserGrantable(w, r, user.ID) {
+		return
+	}
+
+	user.SuspendedAt = nil
+
+	if !app.saveUser(w, r, user) {
+		return
+	}
+
+	admin := app.contextGetUser(r)
+	app.logger.PrintInfo(fmt.Sprintf("user %d unsuspended by admin %d", user.ID, admin.ID), nil)
+	app.auditUserChange(r, data.AuditUserUnsuspend, user.ID, nil)
+
+	err := jsonhelper.WriteJSON(w, http.StatusOK, jsonhelper.Envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// adminForcePasswordResetHandler signs the user out everywhere and emails
+// them a reset link. Logging in is refused until the link is used, e.g.
+// after their password showed up in a breach.
+func (app *application) adminForcePasswordResetHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUserParam(w, r)
+	if !ok {
+		return
+	}
+
+	if !app.checkUserGrantable(w, r, user.ID) {
+		return
+	}
+
+	user.PasswordResetRequired = true
+
+	if !app.saveUser(w, r, user) {
+		return
+	}
+
+	_, err := app.models.Users.RevokeTokens(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.Tokens.DeleteAllForUser(data.TokenScopePasswordReset, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	token, err := app.models.Tokens.New(user.ID, user.Email, data.PasswordResetTokenTTL, data.TokenScopePasswordReset)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	resetLink := fmt.Sprintf("http://%s:%d/users/password/reset/%s", app.config.host, app.config.port, token.Plaintext)
+
+	app.BackgroundEmailTask(func() {
+		err := app.mailer.SendPasswordResetEmail([]string{user.Email}, user.Name, resetLink, data.PasswordResetTokenTTL)
+		if err != nil {
+			app.logger.PrintError(err, map[string]string{
+				"user_email": user.Email,
+				"operation":  "send_password_reset_email",
+			})
+		}
+	})
+
+	admin := app.contextGetUser(r)
+	app.logger.PrintInfo(fmt.Sprintf("password reset of user %d forced by admin %d", user.ID, admin.ID), nil)
+	app.auditUserChange(r, data.AuditUserPasswordReset, user.ID, nil)
+
+	err = jsonhelper.WriteJSON(w, http.StatusAccepted, jsonhelper.Envelope{"message": "a password reset link has been sent to the user"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// adminVerifyUserHandler activates a user whose verification emails do not
+// arrive.
+func (app *application) adminVerifyUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUserParam(w, r)
+	if !ok {
+		return
+	}
+
+	if !app.checkUserGrantable(w, r, user.ID) {
+		return
+	}
+
+	user.Activated = true
+
+	if !app.saveUser(w, r, user) {
+		return
+	}
+
+	err := app.models.Tokens.DeleteAllForUser(data.TokenScopeActivation, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	admin := app.contextGetUser(r)
+	app.logger.PrintInfo(fmt.Sprintf("user %d verified by admin %d", user.ID, admin.ID), nil)
+	app.auditUserChange(r, data.AuditUserVerify, user.ID, nil)
+
+	err = jsonhelper.WriteJSON(w, http.StatusOK, jsonhelper.Envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// readUserParam loads the user named by the id URL parameter. It writes the
+// error response itself and reports whether the handler should continue.
+func (app *application) readUserParam(w http.ResponseWriter, r *http.Request) (*data.User, bool) {
+	id, err := jsonhelper.ReadIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+
+	user, err := app.models.Users.GetUserByID(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+
+	return user, true
+}
+
+// saveUser writes the changed user. It writes the error response itself and
+// reports whether the handler should continue.
+func (app *application) saveUser(w http.ResponseWriter, r *http.Request, user *data.User) bool {
+	_, err := app.models.Users.UpdateUser(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return false
+	}
+
+	return true
+}
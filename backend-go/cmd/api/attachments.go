@@ -0,0 +1,474 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/saiharsha/money-manager/internal/data"
+	"github.com/saiharsha/money-manager/internal/storage"
+	jsonhelper "github.com/saiharsha/money-manager/pkg/json"
+	"github.com/saiharsha/money-manager/pkg/validator"
+)
+
+const thumbnailSize = 256
+
+// allowedAttachmentTypes are the sniffed content types accepted for upload.
+var allowedAttachmentTypes = []string{"image/jpeg", "image/png", "image/gif", "image/webp", "application/pdf", "text/plain"}
+
+var thumbnailTypes = []string{"image/jpeg", "image/png", "image/gif"}
+
+type attachmentResponse struct {
+	*data.Attachment
+	DownloadURL  string    `json:"download_url"`
+	ThumbnailURL string    `json:"thumbnail_url,omitempty"`
+	URLExpiresAt time.Time `json:"url_expires_at"`
+}
+
+func (app *application) listAttachmentsHandler(w http.ResponseWriter, r *http.Request) {
+	record, ok := app.readRecordInLedger(w, r)
+	if !ok {
+		return
+	}
+
+	attachments, err := app.models.Attachments.GetAllForRecord(record.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	responses := make([]attachmentResponse, len(attachments))
+	for i, attachment := range attachments {
+		responses[i] = app.newAttachmentResponse(attachment)
+	}
+
+	err = jsonhelper.WriteJSON(w, http.StatusOK, jsonhelper.Envelope{"attachments": responses}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// uploadAttachmentHandler accepts a multipart/form-data body with the file in
+// the "file" field. The upload is spooled to a temporary file while it is
+// hashed so that large files never sit in memory.
+func (app *application) uploadAttachmentHandler(w http.ResponseWriter, r *http.Request) {
+	record, ok := app.readRecordInLedger(w, r)
+	if !ok {
+		return
+	}
+
+	maxSize := app.config.attachments.maxSize
+
+	// leave room for the multipart boundaries and headers around the file
+	r.Body = http.MaxBytesReader(w, r.Body, maxSize+1_048_576)
+
+	reader, err := r.MultipartReader()
+	if err != nil {
+		app.badRequestResponse(w, r, errors.New("body must be multipart/form-data"))
+		return
+	}
+
+	v := validator.NewValidator()
+
+	var filename string
+	var tmp *os.File
+	var size int64
+	hash := sha256.New()
+
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			app.uploadErrorResponse(w, r, err)
+			return
+		}
+
+		if part.FormName() != "file" {
+			part.Close()
+			continue
+		}
+
+		filename = sanitizeFilename(part.FileName())
+
+		tmp, err = os.CreateTemp("", "attachment-*")
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		defer os.Remove(tmp.Name())
+		defer tmp.Close()
+
+		size, err = io.Copy(io.MultiWriter(tmp, hash), io.LimitReader(part, maxSize+1))
+		part.Close()
+		if err != nil {
+			app.uploadErrorResponse(w, r, err)
+			return
+		}
+		break
+	}
+
+	if tmp == nil {
+		v.AddError("file", "must be provided")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	if size > maxSize {
+		app.payloadTooLargeResponse(w, r, maxSize)
+		return
+	}
+
+	contentType, err := sniffContentType(tmp)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	attachment := &data.Attachment{
+		RecordID:    record.ID,
+		UserID:      app.contextGetUser(r).ID,
+		Filename:    filename,
+		ContentType: contentType,
+		Size:        size,
+		SHA256:      hex.EncodeToString(hash.Sum(nil)),
+	}
+
+	v.Check(size > 0, "file", "must not be empty")
+	v.Check(attachment.Filename != "", "filename", "must be provided")
+	v.Check(validator.In(contentType, allowedAttachmentTypes...), "file", fmt.Sprintf("content type %s is not allowed", contentType))
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// an attachment deleted meanwhile must not take the blob with it
+	unlock, err := app.models.Attachments.LockContent(r.Context(), attachment.SHA256)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	defer unlock()
+
+	err = app.storeAttachment(r, attachment, tmp)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.Attachments.Insert(attachment)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateAttachment):
+			v.AddError("file", "this file is already attached to the record")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = jsonhelper.WriteJSON(w, http.StatusCreated, jsonhelper.Envelope{"attachment": app.newAttachmentResponse(attachment)}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// storeAttachment writes the content to the blob store unless a blob with the
+// same hash is already there, and adds a thumbnail for images. A thumbnail
+// that cannot be produced is logged and skipped.
+func (app *application) storeAttachment(r *http.Request, attachment *data.Attachment, content *os.File) error {
+	ctx := r.Context()
+
+	exists, err := app.blobs.Exists(ctx, attachment.BlobKey())
+	if err != nil {
+		return err
+	}
+
+	if !exists {
+		_, err = content.Seek(0, io.SeekStart)
+		if err != nil {
+			return err
+		}
+
+		err = app.blobs.Put(ctx, attachment.BlobKey(), content, attachment.Size, attachment.ContentType)
+		if err != nil {
+			return err
+		}
+	}
+
+	if !validator.In(attachment.ContentType, thumbnailTypes...) {
+		return nil
+	}
+
+	exists, err = app.blobs.Exists(ctx, attachment.ThumbnailKey())
+	if err != nil {
+		return err
+	}
+	if exists {
+		attachment.HasThumbnail = true
+		return nil
+	}
+
+	_, err = content.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	thumbnail, thumbnailType, err := storage.Thumbnail(content, thumbnailSize)
+	if err != nil {
+		app.logger.PrintError(err, map[string]string{
+			"operation": "create_thumbnail",
+			"sha256":    attachment.SHA256,
+		})
+		return nil
+	}
+
+	err = app.blobs.Put(ctx, attachment.ThumbnailKey(), bytes.NewReader(thumbnail), int64(len(thumbnail)), thumbnailType)
+	if err != nil {
+		return err
+	}
+
+	attachment.HasThumbnail = true
+	return nil
+}
+
+func (app *application) deleteAttachmentHandler(w http.ResponseWriter, r *http.Request) {
+	record, ok := app.readRecordInLedger(w, r)
+	if !ok {
+		return
+	}
+
+	attachmentID, err := jsonhelper.ReadIDURLParam(r, "attachmentID")
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	attachment, err := app.models.Attachments.GetByID(attachmentID)
+	if err != nil || attachment.RecordID != record.ID {
+		switch {
+		case err == nil, errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.models.Attachments.Delete(attachment.ID, record.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.deleteUnusedContent(r.Context(), attachment)
+	if err != nil {
+		app.logError(r, err)
+	}
+
+	err = jsonhelper.WriteJSON(w, http.StatusOK, jsonhelper.Envelope{"message": "attachment successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// deleteUnusedContent removes the blob and thumbnail of the attachment's
+// content unless another attachment still uses it.
+func (app *application) deleteUnusedContent(ctx context.Context, attachment *data.Attachment) error {
+	unlock, err := app.models.Attachments.LockContent(ctx, attachment.SHA256)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	referenced, err := app.models.Attachments.Referenced(attachment.SHA256)
+	if err != nil || referenced {
+		return err
+	}
+
+	for _, key := range []string{attachment.BlobKey(), attachment.ThumbnailKey()} {
+		err = app.blobs.Delete(ctx, key)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// downloadAttachmentHandler serves attachment content to anyone holding a
+// signed URL from newAttachmentResponse, so links work in img tags and
+// browsers without an Authorization header.
+func (app *application) downloadAttachmentHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := jsonhelper.ReadIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	variant := jsonhelper.ReadStringParam(r, "variant", "original")
+	expires, err := strconv.ParseInt(r.URL.Query().Get("expires"), 10, 64)
+	if err != nil || time.Now().Unix() > expires || !validator.In(variant, "original", "thumbnail") {
+		app.invalidDownloadLinkResponse(w, r)
+		return
+	}
+
+	signature, err := hex.DecodeString(r.URL.Query().Get("signature"))
+	if err != nil || !hmac.Equal(signature, app.attachmentSignature(id, variant, expires)) {
+		app.invalidDownloadLinkResponse(w, r)
+		return
+	}
+
+	attachment, err := app.models.Attachments.GetByID(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	key, contentType, disposition := attachment.BlobKey(), attachment.ContentType, "attachment"
+	if variant == "thumbnail" {
+		if !attachment.HasThumbnail {
+			app.notFoundResponse(w, r)
+			return
+		}
+		key, contentType, disposition = attachment.ThumbnailKey(), "image/png", "inline"
+		if attachment.ContentType == "image/jpeg" {
+			contentType = "image/jpeg"
+		}
+	}
+
+	blob, err := app.blobs.Get(r.Context(), key)
+	if err != nil {
+		switch {
+		case errors.Is(err, storage.ErrBlobNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	defer blob.Close()
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": attachment.Filename}))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "private, max-age=300")
+	if variant == "original" {
+		w.Header().Set("Content-Length", strconv.FormatInt(attachment.Size, 10))
+	}
+	w.WriteHeader(http.StatusOK)
+
+	_, err = io.Copy(w, blob)
+	if err != nil {
+		app.logError(r, err)
+	}
+}
+
+func (app *application) newAttachmentResponse(attachment *data.Attachment) attachmentResponse {
+	expires := time.Now().Add(app.config.attachments.urlTTL)
+
+	response := attachmentResponse{
+		Attachment:   attachment,
+		DownloadURL:  app.attachmentURL(attachment.ID, "original", expires.Unix()),
+		URLExpiresAt: expires,
+	}
+
+	if attachment.HasThumbnail {
+		response.ThumbnailURL = app.attachmentURL(attachment.ID, "thumbnail", expires.Unix())
+	}
+
+	return response
+}
+
+func (app *application) attachmentURL(id int64, variant string, expires int64) string {
+	signature := hex.EncodeToString(app.attachmentSignature(id, variant, expires))
+	return fmt.Sprintf("http://%s:%d/attachments/%d/download?variant=%s&expires=%d&signature=%s",
+		app.config.host, app.config.port, id, variant, expires, signature)
+}
+
+func (app *application) attachmentSignature(id int64, variant string, expires int64) []byte {
+	mac := hmac.New(sha256.New, []byte(app.config.attachments.signingKey))
+	fmt.Fprintf(mac, "%d:%s:%d", id, variant, expires)
+	return mac.Sum(nil)
+}
+
+func (app *application) uploadErrorResponse(w http.ResponseWriter, r *http.Request, err error) {
+	var maxBytesError *http.MaxBytesError
+	if errors.As(err, &maxBytesError) {
+		app.payloadTooLargeResponse(w, r, app.config.attachments.maxSize)
+		return
+	}
+	app.badRequestResponse(w, r, err)
+}
+
+// sniffContentType detects the content type from the first 512 bytes of the
+// file rather than trusting the type sent by the client.
+func sniffContentType(f *os.File) (string, error) {
+	_, err := f.Seek(0, io.SeekStart)
+	if err != nil {
+		return "", err
+	}
+
+	head := make([]byte, 512)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+
+	mediaType, _, err := mime.ParseMediaType(http.DetectContentType(head[:n]))
+	if err != nil {
+		return "application/octet-stream", nil
+	}
+
+	return mediaType, nil
+}
+
+func sanitizeFilename(name string) string {
+	name = filepath.Base(strings.ReplaceAll(name, "\\", "/"))
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, name)
+
+	if name == "." || name == "/" {
+		return ""
+	}
+
+	if len(name) > 255 {
+		ext := filepath.Ext(name)
+		if len(ext) > 16 {
+			ext = ""
+		}
+		name = strings.ToValidUTF8(name[:255-len(ext)], "") + ext
+	}
+
+	return name
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/saiharsha/money-manager/internal/data"
+	jsonhelper "github.com/saiharsha/money-manager/pkg/json"
+	"github.com/saiharsha/money-manager/pkg/validator"
+)
+
+// auditSource describes the signed in user making the request, for the
+// audit log. While an admin impersonates a user the admin is the actor.
+func (app *application) auditSource(r *http.Request) data.AuditSource {
+	user := app.contextGetUser(r)
+
+	src := data.AuditSource{
+		ActorID:   &user.ID,
+		IP:        clientIP(r),
+		RequestID: app.contextGetRequestID(r),
+	}
+
+	if admin, ok := app.contextGetImpersonator(r); ok {
+		src.ActorID = &admin.ID
+		src.Impersonating = &user.ID
+	}
+
+	return src
+}
+
+// audit records a change made by the signed in user. The change has already
+// happened, so a failure to record it is logged rather than reported to the
+// client.
+func (app *application) audit(r *http.Request, event *data.AuditEvent) {
+	err := app.models.Audit.Insert(app.auditSource(r), event)
+	if err != nil {
+		app.logError(r, err)
+	}
+}
+
+func (app *application) auditUserChange(r *http.Request, action string, userID int64, details map[string]interface{}) {
+	app.audit(r, &data.AuditEvent{
+		Action:   action,
+		Entity:   "user",
+		EntityID: &userID,
+		Details:  details,
+	})
+}
+
+// listAuditEventsHandler lists the audit log. ledger_id, actor_id, action,
+// entity, entity_id, request_id, since and until filter the events.
+func (app *application) listAuditEventsHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.NewValidator()
+
+	filter := data.AuditFilter{
+		Action:    jsonhelper.ReadStringParam(r, "action", ""),
+		Entity:    jsonhelper.ReadStringParam(r, "entity", ""),
+		RequestID: jsonhelper.ReadStringParam(r, "request_id", ""),
+		Since:     jsonhelper.ReadTimeParam(r, "since", time.Time{}, false, v),
+		Until:     jsonhelper.ReadTimeParam(r, "until", time.Time{}, false, v),
+	}
+
+	if r.URL.Query().Has("ledger_id") {
+		id := int64(jsonhelper.ReadIntParam(r, "ledger_id", 0, v))
+		filter.LedgerID = &id
+	}
+
+	if r.URL.Query().Has("actor_id") {
+		id := int64(jsonhelper.ReadIntParam(r, "actor_id", 0, v))
+		filter.ActorID = &id
+	}
+
+	if r.URL.Query().Has("entity_id") {
+		id := int64(jsonhelper.ReadIntParam(r, "entity_id", 0, v))
+		filter.EntityID = &id
+	}
+
+	var filters data.Filters
+	filters.Page = jsonhelper.ReadIntParam(r, "page", 1, v)
+	filters.PageSize = jsonhelper.ReadIntParam(r, "page_size", 50, v)
+	filters.Sort = jsonhelper.ReadStringParam(r, "sort", "-id")
+	filters.SortSafeList = data.AuditSortSafeList
+
+	data.ValidateFilters(v, filters)
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	events, metadata, err := app.models.Audit.GetAll(filter, filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = jsonhelper.WriteJSON(w, http.StatusOK, jsonhelper.Envelope{"metadata": metadata, "audit_events": events}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// verifyAuditLogHandler checks the hash chains of the audit log. Keep the
+// returned head somewhere else to notice the latest events being removed.
+func (app *application) verifyAuditLogHandler(w http.ResponseWriter, r *http.Request) {
+	result, err := app.models.Audit.Verify()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !result.Valid {
+		app.logger.PrintError(fmt.Errorf("audit log hash chain is broken at event %d", *result.FirstInvalidID), nil)
+	}
+
+	err = jsonhelper.WriteJSON(w, http.StatusOK, jsonhelper.Envelope{"verification": result}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
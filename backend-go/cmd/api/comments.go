@@ -27,7 +27,7 @@ func (app *application) GetCommentsHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	comments, err := app.models.Comments.GetAll(id, filters)
+	comments, err := app.models.Comments.GetAll(id, app.contextGetLedger(r).ID, filters)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
@@ -56,13 +56,17 @@ func (app *application) CreateCommentHandler(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	err = app.models.Comments.Insert(&comment)
+	err = app.models.Comments.Insert(&comment, app.contextGetLedger(r).ID, app.auditSource(r))
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrDuplicateComment):
 			v.AddError("comment", "a comment with this description already exists")
 			app.failedValidationResponse(w, r, v.Errors)
 			return
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("record_id", "record not found")
+			app.failedValidationResponse(w, r, v.Errors)
+			return
 		default:
 			app.serverErrorResponse(w, r, err)
 		}
@@ -100,7 +104,7 @@ func (app *application) UpdateCommentHandler(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	comment, err := app.models.Comments.GetByID(id)
+	comment, err := app.models.Comments.GetByID(id, app.contextGetLedger(r).ID)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -119,7 +123,7 @@ func (app *application) UpdateCommentHandler(w http.ResponseWriter, r *http.Requ
 		comment.RecordID = *input.RecordID
 	}
 
-	err = app.models.Comments.Update(comment)
+	err = app.models.Comments.Update(comment, app.contextGetLedger(r).ID, app.auditSource(r))
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrEditConflict):
@@ -143,7 +147,7 @@ func (app *application) DeleteCommentHandler(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	err = app.models.Comments.Delete(id)
+	err = app.models.Comments.Delete(id, app.contextGetLedger(r).ID, app.auditSource(r))
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -154,7 +158,7 @@ func (app *application) DeleteCommentHandler(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	err = jsonhelper.WriteJSON(w, http.StatusOK, jsonhelper.Envelope{"message": "comment deleted successfully"}, nil)
+	err = jsonhelper.WriteJSON(w, http.StatusOK, jsonhelper.Envelope{"message": "comment moved to trash"}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
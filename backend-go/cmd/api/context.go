@@ -9,7 +9,15 @@ import (
 
 type contextKey string
 
-const userContextKey = contextKey("user")
+const (
+	userContextKey   = contextKey("user")
+	ledgerContextKey = contextKey("ledger")
+	scopesContextKey = contextKey("scopes")
+
+	impersonatorContextKey = contextKey("impersonator")
+	requestIDContextKey    = contextKey("request_id")
+	sessionContextKey      = contextKey("session")
+)
 
 func (app *application) contextSetUser(r *http.Request, user *data.User) *http.Request {
 	ctx := context.WithValue(r.Context(), userContextKey, user)
@@ -23,3 +31,66 @@ func (app *application) contextGetUser(r *http.Request) *data.User {
 	}
 	return user
 }
+
+func (app *application) contextSetLedger(r *http.Request, ledger *data.Ledger) *http.Request {
+	ctx := context.WithValue(r.Context(), ledgerContextKey, ledger)
+	return r.WithContext(ctx)
+}
+
+func (app *application) contextGetLedger(r *http.Request) *data.Ledger {
+	ledger, ok := r.Context().Value(ledgerContextKey).(*data.Ledger)
+	if !ok {
+		panic("missing ledger value in request context")
+	}
+	return ledger
+}
+
+// contextSetScopes records the scopes of the personal access token the
+// request was authenticated with. Requests with a JWT have no scopes set and
+// are not limited by them.
+func (app *application) contextSetScopes(r *http.Request, scopes []string) *http.Request {
+	ctx := context.WithValue(r.Context(), scopesContextKey, scopes)
+	return r.WithContext(ctx)
+}
+
+func (app *application) contextGetScopes(r *http.Request) ([]string, bool) {
+	scopes, ok := r.Context().Value(scopesContextKey).([]string)
+	return scopes, ok
+}
+
+// contextSetImpersonator records the admin acting as the user of the request.
+// Only the id and token epoch of the admin are known.
+func (app *application) contextSetImpersonator(r *http.Request, admin *data.User) *http.Request {
+	ctx := context.WithValue(r.Context(), impersonatorContextKey, admin)
+	return r.WithContext(ctx)
+}
+
+func (app *application) contextGetImpersonator(r *http.Request) (*data.User, bool) {
+	admin, ok := r.Context().Value(impersonatorContextKey).(*data.User)
+	return admin, ok
+}
+
+func (app *application) contextSetRequestID(r *http.Request, id string) *http.Request {
+	ctx := context.WithValue(r.Context(), requestIDContextKey, id)
+	return r.WithContext(ctx)
+}
+
+// contextGetRequestID returns the id RequestID gave the request, or an empty
+// string outside of a request.
+func (app *application) contextGetRequestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDContextKey).(string)
+	return id
+}
+
+func (app *application) contextSetSessionID(r *http.Request, id int64) *http.Request {
+	ctx := context.WithValue(r.Context(), sessionContextKey, id)
+	return r.WithContext(ctx)
+}
+
+// contextGetSessionID returns the session the request was made in, or 0 for
+// personal access tokens, impersonation tokens and tokens issued before
+// sessions were tracked.
+func (app *application) contextGetSessionID(r *http.Request) int64 {
+	id, _ := r.Context().Value(sessionContextKey).(int64)
+	return id
+}
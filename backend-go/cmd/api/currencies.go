@@ -43,7 +43,7 @@ func (app *application) InsertCurrencyHandler(w http.ResponseWriter, r *http.Req
 
 	v := validator.NewValidator()
 
-	err = app.models.Currencies.Insert(&currency)
+	err = app.models.Currencies.Insert(&currency, app.auditSource(r))
 	if err != nil {
 		app.logger.PrintDebug("error while inserting data", nil)
 		if errors.Is(err, data.ErrDuplicateCurrency) {
@@ -72,7 +72,7 @@ func (app *application) DeleteCurrencyHandler(w http.ResponseWriter, r *http.Req
 		return
 	}
 
-	err = app.models.Currencies.Delete(id)
+	err = app.models.Currencies.Delete(id, app.auditSource(r))
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -163,7 +163,7 @@ func (app *application) UpdateCurrencyHandler(w http.ResponseWriter, r *http.Req
 		"currency-version": fmt.Sprintf("%v", currency.Version),
 	})
 
-	err = app.models.Currencies.Update(currency)
+	err = app.models.Currencies.Update(currency, app.auditSource(r))
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrEditConflict):
@@ -3,6 +3,8 @@ package main
 import (
 	"fmt"
 	"net/http"
+	"strconv"
+	"time"
 
 	jsonhelper "github.com/saiharsha/money-manager/pkg/json"
 )
@@ -52,9 +54,11 @@ func (app *application) invalidCredentialsResponse(w http.ResponseWriter, r *htt
 	app.errorResponse(w, r, http.StatusUnauthorized, message)
 }
 
-func (app *application) usernotFound(w http.ResponseWriter, r *http.Request) {
-	message := "no user with this email found"
-	app.errorResponse(w, r, http.StatusUnauthorized, message)
+func (app *application) tooManyAttemptsResponse(w http.ResponseWriter, r *http.Request, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())+1))
+
+	message := "too many attempts, please try again later"
+	app.errorResponse(w, r, http.StatusTooManyRequests, message)
 }
 
 // invalidAuthenticationTokenResponse sends a JSON-formatted error with a 401 Unauthorized status
@@ -80,12 +84,42 @@ func (app *application) inactiveAccountResponse(w http.ResponseWriter, r *http.R
 	app.errorResponse(w, r, http.StatusForbidden, message)
 }
 
+func (app *application) accountSuspendedResponse(w http.ResponseWriter, r *http.Request) {
+	message := "your user account has been suspended, please contact an administrator"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
+func (app *application) passwordResetRequiredResponse(w http.ResponseWriter, r *http.Request) {
+	message := "you must reset your password using the link sent to your email before logging in"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
 func (app *application) notPermittedResponse(w http.ResponseWriter, r *http.Request) {
 	message := "your user account doesn't have the necessary permissions to access this resource"
 	app.errorResponse(w, r, http.StatusForbidden, message)
 }
 
+func (app *application) impersonationNotAllowedResponse(w http.ResponseWriter, r *http.Request) {
+	message := "this action is not allowed while impersonating a user"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
+func (app *application) missingScopeResponse(w http.ResponseWriter, r *http.Request, scope string) {
+	message := fmt.Sprintf("the access token is missing the %s scope", scope)
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
 func (app *application) editConflictResponse(w http.ResponseWriter, r *http.Request) {
 	message := "unable to update the record due to an edit conflict, please try again"
 	app.errorResponse(w, r, http.StatusConflict, message)
 }
+
+func (app *application) payloadTooLargeResponse(w http.ResponseWriter, r *http.Request, maxBytes int64) {
+	message := fmt.Sprintf("the uploaded file must not be larger than %d bytes", maxBytes)
+	app.errorResponse(w, r, http.StatusRequestEntityTooLarge, message)
+}
+
+func (app *application) invalidDownloadLinkResponse(w http.ResponseWriter, r *http.Request) {
+	message := "the download link is invalid or has expired"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
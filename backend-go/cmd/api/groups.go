@@ -0,0 +1,529 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/saiharsha/money-manager/internal/data"
+	jsonhelper "github.com/saiharsha/money-manager/pkg/json"
+	"github.com/saiharsha/money-manager/pkg/validator"
+)
+
+func (app *application) listGroupsHandler(w http.ResponseWriter, r *http.Request) {
+	ledger := app.contextGetLedger(r)
+
+	groups, err := app.models.Groups.GetAllForLedger(ledger.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = jsonhelper.WriteJSON(w, http.StatusOK, jsonhelper.Envelope{"groups": groups}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// createGroupHandler creates an expense group in the active ledger with the
+// current user as its first participant.
+func (app *application) createGroupHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+	ledger := app.contextGetLedger(r)
+
+	var input struct {
+		Name       string `json:"name"`
+		CurrencyID int64  `json:"currency_id"`
+	}
+
+	err := jsonhelper.ReadJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	group := &data.ExpenseGroup{
+		LedgerID:   ledger.ID,
+		Name:       input.Name,
+		CurrencyID: input.CurrencyID,
+		CreatedBy:  user.ID,
+	}
+
+	v := validator.NewValidator()
+	data.ValidateExpenseGroup(v, group)
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	creator, ok := app.readCurrentUser(w, r)
+	if !ok {
+		return
+	}
+
+	err = app.models.Groups.Insert(group)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	participant := &data.ExpenseParticipant{
+		GroupID: group.ID,
+		UserID:  &user.ID,
+		Name:    creator.Name,
+	}
+
+	err = app.models.Groups.AddParticipant(participant)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	envelope := jsonhelper.Envelope{
+		"group":        group,
+		"participants": []*data.ExpenseParticipant{participant},
+	}
+
+	err = jsonhelper.WriteJSON(w, http.StatusCreated, envelope, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) getGroupHandler(w http.ResponseWriter, r *http.Request) {
+	group, ok := app.readGroupInLedger(w, r)
+	if !ok {
+		return
+	}
+
+	participants, err := app.models.Groups.GetParticipants(group.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = jsonhelper.WriteJSON(w, http.StatusOK, jsonhelper.Envelope{"group": group, "participants": participants}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteGroupHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := jsonhelper.ReadIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.models.Groups.Delete(id, app.contextGetLedger(r).ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = jsonhelper.WriteJSON(w, http.StatusOK, jsonhelper.Envelope{"message": "group deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// addParticipantHandler adds a registered user, found by email, or a guest
+// known only by name to the group.
+func (app *application) addParticipantHandler(w http.ResponseWriter, r *http.Request) {
+	group, ok := app.readGroupInLedger(w, r)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		Email string `json:"email"`
+		Name  string `json:"name"`
+	}
+
+	err := jsonhelper.ReadJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	participant := &data.ExpenseParticipant{
+		GroupID: group.ID,
+		Name:    input.Name,
+	}
+
+	v := validator.NewValidator()
+
+	if input.Email != "" {
+		data.ValidateEmail(v, input.Email)
+		if !v.Valid() {
+			app.failedValidationResponse(w, r, v.Errors)
+			return
+		}
+
+		member, err := app.models.Users.GetUserByMail(input.Email)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				v.AddError("email", "no user with this email address, add them as a guest by name instead")
+				app.failedValidationResponse(w, r, v.Errors)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		participant.UserID = &member.ID
+		if participant.Name == "" {
+			participant.Name = member.Name
+		}
+	}
+
+	data.ValidateParticipantName(v, participant.Name)
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Groups.AddParticipant(participant)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateParticipant):
+			v.AddError("email", "this user is already a participant of the group")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = jsonhelper.WriteJSON(w, http.StatusCreated, jsonhelper.Envelope{"participant": participant}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) removeParticipantHandler(w http.ResponseWriter, r *http.Request) {
+	group, ok := app.readGroupInLedger(w, r)
+	if !ok {
+		return
+	}
+
+	participantID, err := jsonhelper.ReadIDURLParam(r, "participantID")
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.models.Groups.RemoveParticipant(participantID, group.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		case errors.Is(err, data.ErrParticipantInUse):
+			v := validator.NewValidator()
+			v.AddError("participant", "the participant has expenses in this group and cannot be removed")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = jsonhelper.WriteJSON(w, http.StatusOK, jsonhelper.Envelope{"message": "participant removed"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) listExpensesHandler(w http.ResponseWriter, r *http.Request) {
+	group, ok := app.readGroupInLedger(w, r)
+	if !ok {
+		return
+	}
+
+	expenses, err := app.models.Expenses.GetAllForGroup(group.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = jsonhelper.WriteJSON(w, http.StatusOK, jsonhelper.Envelope{"expenses": expenses}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// createExpenseHandler records who paid for something and how it is split.
+// An equal split without shares is divided among all participants.
+func (app *application) createExpenseHandler(w http.ResponseWriter, r *http.Request) {
+	group, ok := app.readGroupInLedger(w, r)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		Description string               `json:"description"`
+		Amount      int64                `json:"amount"`
+		PaidBy      int64                `json:"paid_by"`
+		SplitMethod string               `json:"split_method"`
+		OccurredAt  string               `json:"occurred_at"`
+		Shares      []*data.ExpenseShare `json:"shares"`
+	}
+
+	err := jsonhelper.ReadJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	participants, err := app.models.Groups.GetParticipants(group.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	expense := &data.Expense{
+		GroupID:     group.ID,
+		Kind:        data.ExpenseKindExpense,
+		Description: input.Description,
+		Amount:      input.Amount,
+		PaidBy:      input.PaidBy,
+		SplitMethod: input.SplitMethod,
+		OccurredAt:  time.Now(),
+		CreatedBy:   app.contextGetUser(r).ID,
+		Shares:      input.Shares,
+	}
+
+	if expense.SplitMethod == "" {
+		expense.SplitMethod = data.SplitEqual
+	}
+
+	if expense.SplitMethod == data.SplitEqual && len(expense.Shares) == 0 {
+		for _, p := range participants {
+			expense.Shares = append(expense.Shares, &data.ExpenseShare{ParticipantID: p.ID})
+		}
+	}
+
+	v := validator.NewValidator()
+	if input.OccurredAt != "" {
+		expense.OccurredAt, _ = data.ParseOccurredAt(v, input.OccurredAt, "UTC")
+	}
+	data.ValidateExpense(v, expense, participants)
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Expenses.Insert(expense)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = jsonhelper.WriteJSON(w, http.StatusCreated, jsonhelper.Envelope{"expense": expense}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteExpenseHandler(w http.ResponseWriter, r *http.Request) {
+	group, ok := app.readGroupInLedger(w, r)
+	if !ok {
+		return
+	}
+
+	expenseID, err := jsonhelper.ReadIDURLParam(r, "expenseID")
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.models.Expenses.Delete(expenseID, group.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = jsonhelper.WriteJSON(w, http.StatusOK, jsonhelper.Envelope{"message": "expense deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) groupBalancesHandler(w http.ResponseWriter, r *http.Request) {
+	group, ok := app.readGroupInLedger(w, r)
+	if !ok {
+		return
+	}
+
+	balances, err := app.models.Groups.Balances(group.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = jsonhelper.WriteJSON(w, http.StatusOK, jsonhelper.Envelope{"group": group, "balances": balances}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// settleUpHandler suggests the repayments that settle the group. Nothing is
+// recorded until the repayments are posted to createRepaymentHandler.
+func (app *application) settleUpHandler(w http.ResponseWriter, r *http.Request) {
+	group, ok := app.readGroupInLedger(w, r)
+	if !ok {
+		return
+	}
+
+	balances, err := app.models.Groups.Balances(group.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = jsonhelper.WriteJSON(w, http.StatusOK, jsonhelper.Envelope{"balances": balances, "transfers": data.SettleUp(balances)}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// createRepaymentHandler records that one participant paid another back. The
+// repayment is booked as a record in the group's ledger under the given
+// record type, and as a group entry that moves both balances.
+func (app *application) createRepaymentHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	group, ok := app.readGroupInLedger(w, r)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		From       int64  `json:"from_participant_id"`
+		To         int64  `json:"to_participant_id"`
+		Amount     int64  `json:"amount"`
+		TypeID     int64  `json:"type_id"`
+		OccurredAt string `json:"occurred_at"`
+	}
+
+	err := jsonhelper.ReadJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	participants, err := app.models.Groups.GetParticipants(group.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	names := make(map[int64]string, len(participants))
+	for _, p := range participants {
+		names[p.ID] = p.Name
+	}
+
+	v := validator.NewValidator()
+	v.Check(names[input.From] != "", "from_participant_id", "must be a participant of the group")
+	v.Check(names[input.To] != "", "to_participant_id", "must be a participant of the group")
+	v.Check(input.From != input.To, "to_participant_id", "must be different from from_participant_id")
+
+	description := fmt.Sprintf("%s: repayment from %s to %s", group.Name, names[input.From], names[input.To])
+
+	record := &data.Record{
+		Amount:      input.Amount,
+		Description: description,
+		TypeID:      input.TypeID,
+		CurrencyID:  group.CurrencyID,
+		UserID:      user.ID,
+		LedgerID:    group.LedgerID,
+		OccurredAt:  time.Now(),
+		HasTime:     true,
+		Timezone:    "UTC",
+	}
+
+	if input.OccurredAt != "" {
+		record.OccurredAt, record.HasTime = data.ParseOccurredAt(v, input.OccurredAt, record.Timezone)
+	}
+
+	expense := &data.Expense{
+		GroupID:     group.ID,
+		Kind:        data.ExpenseKindRepayment,
+		Description: description,
+		Amount:      input.Amount,
+		PaidBy:      input.From,
+		SplitMethod: data.SplitExact,
+		OccurredAt:  record.OccurredAt,
+		CreatedBy:   user.ID,
+		Shares:      []*data.ExpenseShare{{ParticipantID: input.To, Value: float64(input.Amount)}},
+	}
+
+	data.ValidateRecord(v, record)
+	data.ValidateExpense(v, expense, participants)
+
+	if _, exists := v.Errors["type_id"]; !exists {
+		_, err = app.models.RecordTypes.GetByID(record.TypeID)
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("type_id", "must be an existing record type")
+		case err != nil:
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Expenses.InsertRepayment(expense, record)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = jsonhelper.WriteJSON(w, http.StatusCreated, jsonhelper.Envelope{"repayment": expense, "record": record}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// readGroupInLedger loads the group named by the id URL parameter if it
+// belongs to the active ledger. It writes the error response itself and
+// reports whether the handler should continue.
+func (app *application) readGroupInLedger(w http.ResponseWriter, r *http.Request) (*data.ExpenseGroup, bool) {
+	id, err := jsonhelper.ReadIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+
+	group, err := app.models.Groups.GetForLedger(id, app.contextGetLedger(r).ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+
+	return group, true
+}
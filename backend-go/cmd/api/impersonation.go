@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/saiharsha/money-manager/internal/data"
+	jsonhelper "github.com/saiharsha/money-manager/pkg/json"
+	"github.com/saiharsha/money-manager/pkg/validator"
+)
+
+// impersonateUserHandler lets support see what a user sees. It returns a
+// short-lived access token for the user that also names the admin. No
+// refresh token is issued, the admin starts again once it expires.
+func (app *application) impersonateUserHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Reason string `json:"reason"`
+	}
+
+	err := jsonhelper.ReadJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.NewValidator()
+	v.Check(input.Reason != "", "reason", "must be provided")
+	v.Check(len(input.Reason) <= 500, "reason", "must be at most 500 characters long")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, ok := app.readUserParam(w, r)
+	if !ok {
+		return
+	}
+
+	admin := app.contextGetUser(r)
+	if user.ID == admin.ID {
+		v.AddError("id", "you cannot impersonate yourself")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// acting as a user with more permissions would hand them to the admin
+	permissions, err := app.models.Roles.GetForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !app.checkGrantable(w, r, permissions) {
+		return
+	}
+
+	token, err := app.CreateImpersonationToken(user, admin)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	expiresAt := time.Now().Add(impersonationTokenTTL)
+
+	app.logger.PrintInfo(fmt.Sprintf("admin %d started impersonating user %d", admin.ID, user.ID), nil)
+	app.auditUserChange(r, data.AuditUserImpersonate, user.ID, map[string]interface{}{
+		"reason":     input.Reason,
+		"expires_at": expiresAt,
+	})
+
+	envelope := jsonhelper.Envelope{
+		"accesstoken": token,
+		"user":        user,
+		"expires_at":  expiresAt,
+	}
+
+	err = jsonhelper.WriteJSON(w, http.StatusCreated, envelope, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// serveImpersonated handles a request made with an impersonation token. The
+// admin must still be signed in and allowed to impersonate. The response
+// names the admin in the X-Impersonated-By header and every request is
+// recorded in the audit log.
+func (app *application) serveImpersonated(w http.ResponseWriter, r *http.Request, admin *data.User, next http.Handler) {
+	epoch, err := app.models.Users.GetTokenEpoch(admin.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if admin.TokenEpoch != epoch {
+		app.invalidAuthenticationTokenResponse(w, r)
+		return
+	}
+
+	permissions, err := app.userPermissions(admin.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !permissions[data.PermissionUsersImpersonate] {
+		app.invalidAuthenticationTokenResponse(w, r)
+		return
+	}
+
+	r = app.contextSetImpersonator(r, admin)
+	w.Header().Set("X-Impersonated-By", strconv.FormatInt(admin.ID, 10))
+
+	rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	next.ServeHTTP(rec, r)
+
+	app.auditUserChange(r, data.AuditUserImpersonated, app.contextGetUser(r).ID, map[string]interface{}{
+		"method": r.Method,
+		"path":   r.URL.Path,
+		"status": rec.status,
+	})
+}
+
+// statusRecorder remembers the status code written to the response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *statusRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
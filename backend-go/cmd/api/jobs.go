@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+func (app *application) startBackgroundJobs() {
+	app.runPeriodically("purge_trash", time.Hour, func() error {
+		purged, orphans, err := app.models.Trash.Purge(app.config.trash.retention)
+		if err != nil {
+			return err
+		}
+
+		for _, attachment := range orphans {
+			if err := app.deleteUnusedContent(context.Background(), attachment); err != nil {
+				app.logger.PrintError(err, map[string]string{"job": "purge_trash", "sha256": attachment.SHA256})
+			}
+		}
+
+		if purged > 0 {
+			app.logger.PrintInfo(fmt.Sprintf("purged %d items from the trash", purged), nil)
+		}
+		return nil
+	})
+
+	app.runPeriodically("delete_expired_tokens", time.Hour, func() error {
+		deleted, err := app.models.Tokens.DeleteExpired()
+		if err != nil {
+			return err
+		}
+		if deleted > 0 {
+			app.logger.PrintInfo(fmt.Sprintf("deleted %d expired tokens", deleted), nil)
+		}
+		return nil
+	})
+
+	app.runPeriodically("delete_ended_sessions", time.Hour, func() error {
+		deleted, err := app.models.Sessions.DeleteEnded()
+		if err != nil {
+			return err
+		}
+		if deleted > 0 {
+			app.logger.PrintInfo(fmt.Sprintf("deleted %d ended sessions", deleted), nil)
+		}
+		return nil
+	})
+
+	app.runPeriodically("purge_deleted_accounts", time.Hour, app.purgeDeletedAccounts)
+
+	app.runPeriodically("prune_rate_limiters", 10*time.Minute, func() error {
+		app.logins.prune()
+		app.limits.prune()
+		return nil
+	})
+
+	app.runPeriodically("prune_permission_cache", 10*time.Minute, func() error {
+		app.permissions.prune()
+		return nil
+	})
+}
+
+// runPeriodically runs fn once at startup and then on every interval for as
+// long as the process lives. Errors and panics are logged and the job keeps
+// running.
+func (app *application) runPeriodically(name string, interval time.Duration, fn func() error) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			app.runJob(name, fn)
+			<-ticker.C
+		}
+	}()
+}
+
+func (app *application) runJob(name string, fn func() error) {
+	defer func() {
+		if err := recover(); err != nil {
+			app.logger.PrintError(fmt.Errorf("%v", err), map[string]string{"job": name})
+		}
+	}()
+
+	if err := fn(); err != nil {
+		app.logger.PrintError(err, map[string]string{"job": name})
+	}
+}
@@ -0,0 +1,482 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/saiharsha/money-manager/internal/data"
+	jsonhelper "github.com/saiharsha/money-manager/pkg/json"
+	"github.com/saiharsha/money-manager/pkg/validator"
+)
+
+func (app *application) listLedgersHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	// make sure the personal ledger exists before listing
+	_, err := app.models.Ledgers.GetPersonal(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	ledgers, err := app.models.Ledgers.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = jsonhelper.WriteJSON(w, http.StatusOK, jsonhelper.Envelope{"ledgers": ledgers}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) createLedgerHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	var input struct {
+		Name string `json:"name"`
+	}
+
+	err := jsonhelper.ReadJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	ledger := &data.Ledger{
+		Name:      input.Name,
+		CreatedBy: user.ID,
+	}
+
+	v := validator.NewValidator()
+	data.ValidateLedger(v, ledger)
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Ledgers.Insert(ledger)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = jsonhelper.WriteJSON(w, http.StatusCreated, jsonhelper.Envelope{"ledger": ledger}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) getLedgerHandler(w http.ResponseWriter, r *http.Request) {
+	ledger, ok := app.readLedgerForMember(w, r)
+	if !ok {
+		return
+	}
+
+	members, err := app.models.Ledgers.GetMembers(ledger.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = jsonhelper.WriteJSON(w, http.StatusOK, jsonhelper.Envelope{"ledger": ledger, "members": members}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) updateLedgerHandler(w http.ResponseWriter, r *http.Request) {
+	ledger, ok := app.readLedgerForMember(w, r, data.LedgerOwner)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		Name *string `json:"name"`
+	}
+
+	err := jsonhelper.ReadJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if input.Name != nil {
+		ledger.Name = *input.Name
+	}
+
+	v := validator.NewValidator()
+	data.ValidateLedger(v, ledger)
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Ledgers.Update(ledger)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = jsonhelper.WriteJSON(w, http.StatusOK, jsonhelper.Envelope{"ledger": ledger}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteLedgerHandler(w http.ResponseWriter, r *http.Request) {
+	ledger, ok := app.readLedgerForMember(w, r, data.LedgerOwner)
+	if !ok {
+		return
+	}
+
+	v := validator.NewValidator()
+	v.Check(!ledger.Personal, "ledger", "the personal ledger cannot be deleted")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err := app.models.Ledgers.Delete(ledger.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		case errors.Is(err, data.ErrLedgerNotEmpty):
+			v.AddError("ledger", "move or permanently delete the ledger's records first")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = jsonhelper.WriteJSON(w, http.StatusOK, jsonhelper.Envelope{"message": "ledger deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) updateLedgerMemberHandler(w http.ResponseWriter, r *http.Request) {
+	ledger, ok := app.readLedgerForMember(w, r, data.LedgerOwner)
+	if !ok {
+		return
+	}
+
+	memberID, err := jsonhelper.ReadIDURLParam(r, "userID")
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	var input struct {
+		Role string `json:"role"`
+	}
+
+	err = jsonhelper.ReadJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.NewValidator()
+	data.ValidateLedgerRole(v, input.Role)
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Ledgers.SetMemberRole(ledger.ID, memberID, input.Role)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		case errors.Is(err, data.ErrLastOwner):
+			v.AddError("role", "the ledger must keep at least one owner")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = jsonhelper.WriteJSON(w, http.StatusOK, jsonhelper.Envelope{"message": "member role updated"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// removeLedgerMemberHandler lets an owner remove a member, and any member
+// leave the ledger by removing themselves.
+func (app *application) removeLedgerMemberHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	ledger, ok := app.readLedgerForMember(w, r)
+	if !ok {
+		return
+	}
+
+	memberID, err := jsonhelper.ReadIDURLParam(r, "userID")
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	if memberID != user.ID && ledger.Role != data.LedgerOwner {
+		app.notPermittedResponse(w, r)
+		return
+	}
+
+	v := validator.NewValidator()
+	v.Check(!ledger.Personal, "ledger", "members of the personal ledger cannot be changed")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Ledgers.RemoveMember(ledger.ID, memberID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		case errors.Is(err, data.ErrLastOwner):
+			v.AddError("user_id", "the ledger must keep at least one owner")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = jsonhelper.WriteJSON(w, http.StatusOK, jsonhelper.Envelope{"message": "member removed from ledger"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) listLedgerInvitationsHandler(w http.ResponseWriter, r *http.Request) {
+	ledger, ok := app.readLedgerForMember(w, r, data.LedgerOwner)
+	if !ok {
+		return
+	}
+
+	invitations, err := app.models.Ledgers.GetInvitations(ledger.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = jsonhelper.WriteJSON(w, http.StatusOK, jsonhelper.Envelope{"invitations": invitations}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// createLedgerInvitationHandler emails an invitation to join the ledger. The
+// invitee accepts it while signed in with the invited email address.
+func (app *application) createLedgerInvitationHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	ledger, ok := app.readLedgerForMember(w, r, data.LedgerOwner)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		Email string `json:"email"`
+		Role  string `json:"role"`
+	}
+
+	err := jsonhelper.ReadJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if input.Role == "" {
+		input.Role = data.LedgerEditor
+	}
+
+	v := validator.NewValidator()
+	v.Check(!ledger.Personal, "ledger", "the personal ledger cannot be shared, create a shared ledger instead")
+	data.ValidateEmail(v, input.Email)
+	data.ValidateLedgerRole(v, input.Role)
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	inviter, ok := app.readCurrentUser(w, r)
+	if !ok {
+		return
+	}
+
+	invitation := &data.LedgerInvitation{
+		LedgerID:  ledger.ID,
+		Email:     input.Email,
+		Role:      input.Role,
+		InvitedBy: user.ID,
+	}
+
+	token, err := app.models.Ledgers.CreateInvitation(invitation)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrAlreadyMember):
+			v.AddError("email", "this user is already a member of the ledger")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	acceptLink := fmt.Sprintf("http://%s:%d/ledgers/invitations/%s", app.config.host, app.config.port, token)
+
+	app.BackgroundEmailTask(func() {
+		err := app.mailer.SendLedgerInvitationEmail([]string{invitation.Email}, inviter.Name, ledger.Name, invitation.Role, acceptLink, invitation.Expiry)
+		if err != nil {
+			app.logger.PrintError(err, map[string]string{
+				"user_email": invitation.Email,
+				"operation":  "send_ledger_invitation_email",
+			})
+			return
+		}
+		app.logger.PrintInfo(fmt.Sprintf("ledger invitation sent to %v", invitation.Email), nil)
+	})
+
+	err = jsonhelper.WriteJSON(w, http.StatusAccepted, jsonhelper.Envelope{"invitation": invitation}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteLedgerInvitationHandler(w http.ResponseWriter, r *http.Request) {
+	ledger, ok := app.readLedgerForMember(w, r, data.LedgerOwner)
+	if !ok {
+		return
+	}
+
+	invitationID, err := jsonhelper.ReadIDURLParam(r, "invitationID")
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.models.Ledgers.DeleteInvitation(invitationID, ledger.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = jsonhelper.WriteJSON(w, http.StatusOK, jsonhelper.Envelope{"message": "invitation revoked"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) acceptLedgerInvitationHandler(w http.ResponseWriter, r *http.Request) {
+	token := chi.URLParam(r, "token")
+
+	// the invitation is matched against the current address, not the one
+	// the token was issued with
+	user, ok := app.readCurrentUser(w, r)
+	if !ok {
+		return
+	}
+
+	ledger, err := app.models.Ledgers.AcceptInvitation(token, user.ID, user.Email)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrInvalidInvitation):
+			v := validator.NewValidator()
+			v.AddError("token", "invalid or expired invitation, or it was sent to a different email address")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = jsonhelper.WriteJSON(w, http.StatusOK, jsonhelper.Envelope{"ledger": ledger}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// showLedgerInvitationHandler is opened from the emailed invitation. It only
+// describes the invitation: link scanners and previews follow the link too,
+// so accepting is left to the authenticated POST on the same url.
+func (app *application) showLedgerInvitationHandler(w http.ResponseWriter, r *http.Request) {
+	token := chi.URLParam(r, "token")
+
+	invitation, err := app.models.Ledgers.GetInvitation(token)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrInvalidInvitation):
+			v := validator.NewValidator()
+			v.AddError("token", "invalid or expired invitation")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	message := fmt.Sprintf("log in as %s and send a POST request to this url to accept the invitation", invitation.Email)
+
+	err = jsonhelper.WriteJSON(w, http.StatusOK, jsonhelper.Envelope{"message": message, "invitation": invitation}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// readLedgerForMember loads the ledger named by the id URL parameter if the
+// current user is a member of it and, when roles are given, has one of them.
+// It writes the error response itself and reports whether the handler should
+// continue.
+func (app *application) readLedgerForMember(w http.ResponseWriter, r *http.Request, roles ...string) (*data.Ledger, bool) {
+	user := app.contextGetUser(r)
+
+	id, err := jsonhelper.ReadIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+
+	ledger, err := app.models.Ledgers.GetForMember(id, user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+
+	if len(roles) > 0 && !validator.In(ledger.Role, roles...) {
+		app.notPermittedResponse(w, r)
+		return nil, false
+	}
+
+	return ledger, true
+}
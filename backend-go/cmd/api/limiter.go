@@ -0,0 +1,170 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Per-IP login throttling. An address is blocked from the
+// ipLockoutThreshold-th failed attempt on, for ipLockoutBase doubling with
+// every further failure up to ipLockoutMax. Addresses are forgotten after
+// ipForgetAfter without failures.
+const (
+	ipLockoutThreshold = 20
+	ipLockoutBase      = time.Minute
+	ipLockoutMax       = time.Hour
+	ipForgetAfter      = 24 * time.Hour
+)
+
+// loginLimiter tracks failed logins and second factor checks per client IP
+// in memory. It complements the lockout stored on the user, which an
+// attacker trying one password against many accounts never triggers.
+type loginLimiter struct {
+	mu      sync.Mutex
+	clients map[string]*loginClient
+}
+
+type loginClient struct {
+	failures     int
+	lastFailure  time.Time
+	blockedUntil time.Time
+}
+
+func newLoginLimiter() *loginLimiter {
+	return &loginLimiter{clients: make(map[string]*loginClient)}
+}
+
+// blocked reports whether ip is blocked and for how much longer.
+func (l *loginLimiter) blocked(ip string) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	client, ok := l.clients[ip]
+	if !ok {
+		return 0, false
+	}
+
+	remaining := time.Until(client.blockedUntil)
+	return remaining, remaining > 0
+}
+
+func (l *loginLimiter) fail(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	client, ok := l.clients[ip]
+	if !ok {
+		client = &loginClient{}
+		l.clients[ip] = client
+	}
+
+	now := time.Now()
+	client.failures++
+	client.lastFailure = now
+
+	if client.failures >= ipLockoutThreshold {
+		backoff := ipLockoutMax
+		if shift := client.failures - ipLockoutThreshold; shift < 10 {
+			backoff = min(ipLockoutBase<<shift, ipLockoutMax)
+		}
+		client.blockedUntil = now.Add(backoff)
+	}
+}
+
+// prune forgets addresses that have not failed for a while.
+func (l *loginLimiter) prune() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for ip, client := range l.clients {
+		if time.Since(client.lastFailure) > ipForgetAfter && time.Now().After(client.blockedUntil) {
+			delete(l.clients, ip)
+		}
+	}
+}
+
+// clientIP returns the address the request came from, without the port.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// rateLimiter allows a number of events per key in a fixed time window. It
+// limits actions that send emails, where failures are not the concern.
+type rateLimiter struct {
+	mu      sync.Mutex
+	limit   int
+	window  time.Duration
+	windows map[string]*rateWindow
+}
+
+type rateWindow struct {
+	start time.Time
+	count int
+}
+
+func newRateLimiter(limit int, window time.Duration) *rateLimiter {
+	return &rateLimiter{limit: limit, window: window, windows: make(map[string]*rateWindow)}
+}
+
+// allow counts an event for key. If the limit is reached it reports false
+// and how long until the window resets.
+func (l *rateLimiter) allow(key string) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+
+	w, ok := l.windows[key]
+	if !ok || now.Sub(w.start) >= l.window {
+		w = &rateWindow{start: now}
+		l.windows[key] = w
+	}
+
+	if w.count >= l.limit {
+		return w.start.Add(l.window).Sub(now), false
+	}
+
+	w.count++
+	return 0, true
+}
+
+func (l *rateLimiter) prune() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for key, w := range l.windows {
+		if time.Since(w.start) >= l.window {
+			delete(l.windows, key)
+		}
+	}
+}
+
+// rateLimits holds the limiters of the endpoints that send emails.
+type rateLimits struct {
+	verifyResendByIP    *rateLimiter
+	verifyResendByEmail *rateLimiter
+	loginLinkByIP       *rateLimiter
+	loginLinkByEmail    *rateLimiter
+}
+
+func newRateLimits() *rateLimits {
+	return &rateLimits{
+		verifyResendByIP:    newRateLimiter(10, time.Hour),
+		verifyResendByEmail: newRateLimiter(3, time.Hour),
+		loginLinkByIP:       newRateLimiter(10, time.Hour),
+		loginLinkByEmail:    newRateLimiter(5, time.Hour),
+	}
+}
+
+func (l *rateLimits) prune() {
+	l.verifyResendByIP.prune()
+	l.verifyResendByEmail.prune()
+	l.loginLinkByIP.prune()
+	l.loginLinkByEmail.prune()
+}
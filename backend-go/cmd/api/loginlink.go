@@ -0,0 +1,139 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/saiharsha/money-manager/internal/data"
+	jsonhelper "github.com/saiharsha/money-manager/pkg/json"
+	"github.com/saiharsha/money-manager/pkg/validator"
+)
+
+// requestLoginLinkHandler emails a one-time link that logs the user in
+// without a password. The response is the same whether or not the email
+// belongs to an account.
+func (app *application) requestLoginLinkHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email string `json:"email"`
+	}
+
+	err := jsonhelper.ReadJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.NewValidator()
+	data.ValidateEmail(v, input.Email)
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	if retryAfter, ok := app.limits.loginLinkByIP.allow(clientIP(r)); !ok {
+		app.tooManyAttemptsResponse(w, r, retryAfter)
+		return
+	}
+
+	if retryAfter, ok := app.limits.loginLinkByEmail.allow(strings.ToLower(input.Email)); !ok {
+		app.tooManyAttemptsResponse(w, r, retryAfter)
+		return
+	}
+
+	user, err := app.models.Users.GetUserByMail(input.Email)
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if user != nil {
+		// only the newest link works
+		err = app.models.Tokens.DeleteAllForUser(data.TokenScopeLoginLink, user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		token, err := app.models.Tokens.New(user.ID, user.Email, data.LoginLinkTokenTTL, data.TokenScopeLoginLink)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		loginLink := fmt.Sprintf("http://%s:%d/users/login/link/%s", app.config.host, app.config.port, token.Plaintext)
+
+		app.BackgroundEmailTask(func() {
+			err := app.mailer.SendLoginLinkEmail([]string{user.Email}, user.Name, loginLink, data.LoginLinkTokenTTL)
+			if err != nil {
+				app.logger.PrintError(err, map[string]string{
+					"user_email": user.Email,
+					"operation":  "send_login_link_email",
+				})
+			}
+		})
+	}
+
+	envelope := jsonhelper.Envelope{
+		"message": "if an account uses this email, a login link has been sent",
+	}
+
+	err = jsonhelper.WriteJSON(w, http.StatusAccepted, envelope, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// loginWithLinkHandler is opened from the emailed link. It logs the user in
+// like UserLogin does, including the second factor if they have one.
+func (app *application) loginWithLinkHandler(w http.ResponseWriter, r *http.Request) {
+	ip := clientIP(r)
+	if retryAfter, blocked := app.logins.blocked(ip); blocked {
+		app.tooManyAttemptsResponse(w, r, retryAfter)
+		return
+	}
+
+	v := validator.NewValidator()
+
+	t, err := app.models.Tokens.Use(data.TokenScopeLoginLink, chi.URLParam(r, "token"))
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrExpiredToken):
+			v.AddError("token", "the login link has expired, please request a new one")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.logins.fail(ip)
+			v.AddError("token", "invalid or already used login link")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	user, err := app.models.Users.GetUserByID(t.UserID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or already used login link")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// the link logs in whoever owns the address it was sent to, not a later one
+	if t.Email != user.Email {
+		v.AddError("token", "invalid or already used login link")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	app.logger.PrintInfo(fmt.Sprintf("user %d used a login link", user.ID), map[string]string{"ip": ip})
+
+	app.completeLogin(w, r, user)
+}
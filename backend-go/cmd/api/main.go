@@ -3,14 +3,19 @@ package main
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"flag"
 	"fmt"
 	"os"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/saiharsha/money-manager/internal/data"
+	"github.com/saiharsha/money-manager/internal/jwtkeys"
 	"github.com/saiharsha/money-manager/internal/mail"
+	"github.com/saiharsha/money-manager/internal/oidc"
+	"github.com/saiharsha/money-manager/internal/storage"
 	"github.com/saiharsha/money-manager/pkg/logger"
 
 	_ "github.com/lib/pq"
@@ -29,6 +34,46 @@ type config struct {
 		maxIdleConns int
 		maxIdleTime  string
 	}
+	trash struct {
+		retention time.Duration
+	}
+	accounts struct {
+		deletionGrace time.Duration
+	}
+	attachments struct {
+		store      string
+		dir        string
+		maxSize    int64
+		urlTTL     time.Duration
+		signingKey string
+	}
+	jwt struct {
+		privateKeys string
+		publicKeys  string
+		signingKey  string
+		issuer      string
+		audience    string
+		acceptHS256 bool
+	}
+	oidc struct {
+		issuer        string
+		clientID      string
+		clientSecret  string
+		redirectURL   string
+		defaultRole   string
+		autoProvision bool
+		stateKey      string
+	}
+	mfa struct {
+		encryptionKey string
+	}
+	s3 struct {
+		endpoint  string
+		region    string
+		bucket    string
+		accessKey string
+		secretKey string
+	}
 	smtp struct {
 		host     string
 		sslport  int
@@ -40,11 +85,17 @@ type config struct {
 }
 
 type application struct {
-	config config
-	logger *logger.Logger
-	models data.Models
-	mailer *mail.Mailer
-	wg     sync.WaitGroup
+	config      config
+	logger      *logger.Logger
+	models      data.Models
+	mailer      *mail.Mailer
+	blobs       storage.BlobStore
+	keys        *jwtkeys.KeySet
+	oidc        *oidc.Client
+	logins      *loginLimiter
+	limits      *rateLimits
+	wg          sync.WaitGroup
+	permissions *permissionCache
 }
 
 func main() {
@@ -57,12 +108,42 @@ func main() {
 	flag.StringVar(&config.debugLevel, "debuglevel", "INFO", "Options can be DEBUG, INFO, ERROR, FATAL, OFF level from lowest to highest")
 	secretKey := os.Getenv("SECRET_KEY")
 	flag.StringVar(&config.secretKey, "SecretKey", secretKey, "Secret Key for generating json tokens")
+	flag.StringVar(&config.jwt.privateKeys, "jwt-private-keys", os.Getenv("JWT_PRIVATE_KEYS"), "comma separated PEM files with RSA or Ed25519 private keys for signing tokens, HS256 with the secret key is used if empty")
+	flag.StringVar(&config.jwt.publicKeys, "jwt-public-keys", os.Getenv("JWT_PUBLIC_KEYS"), "comma separated PEM files with public keys of rotated out keys whose tokens are still accepted")
+	flag.StringVar(&config.jwt.signingKey, "jwt-signing-kid", "", "kid of the private key new tokens are signed with, defaults to the first private key")
+	flag.StringVar(&config.jwt.issuer, "jwt-issuer", "money-manager", "iss claim of issued tokens")
+	flag.StringVar(&config.jwt.audience, "jwt-audience", "money-manager", "aud claim of issued tokens")
+	flag.BoolVar(&config.jwt.acceptHS256, "jwt-accept-hs256", false, "keep accepting HS256 tokens while moving to private keys")
 	pw := os.Getenv("DATABASE_PASSWORD")
 	flag.StringVar(&config.db.dsn, "db-dsn", fmt.Sprintf("postgres://moneymanager:%s@localhost:5432/moneymanager?sslmode=disable", pw), "PostgreSQL DSN")
 	flag.IntVar(&config.db.maxOpenConns, "db-max-open-conns", 25, "PostgreSQL max open connections")
 	flag.IntVar(&config.db.maxIdleConns, "db-max-idle-conns", 25, "PostgreSQL max open idle connections")
 	flag.StringVar(&config.db.maxIdleTime, "db-max-idle-time", "15m", "PostgreSQL max connection idle time")
 
+	flag.DurationVar(&config.trash.retention, "trash-retention", 30*24*time.Hour, "how long trashed records and comments are kept before they are purged")
+	flag.DurationVar(&config.accounts.deletionGrace, "account-deletion-grace", 14*24*time.Hour, "how long a confirmed account deletion can be cancelled before the account is purged")
+
+	flag.StringVar(&config.attachments.store, "attachments-store", "local", "where attachments are stored local | s3")
+	flag.StringVar(&config.attachments.dir, "attachments-dir", "uploads", "directory for attachments when using the local store")
+	flag.Int64Var(&config.attachments.maxSize, "attachments-max-size", 10*1024*1024, "maximum attachment size in bytes")
+	flag.DurationVar(&config.attachments.urlTTL, "attachments-url-ttl", 15*time.Minute, "how long signed attachment download urls stay valid")
+	flag.StringVar(&config.attachments.signingKey, "attachments-signing-key", os.Getenv("ATTACHMENTS_SIGNING_KEY"), "key for signing attachment download urls, defaults to the token secret key")
+	flag.StringVar(&config.s3.endpoint, "s3-endpoint", "https://s3.amazonaws.com", "S3 compatible endpoint for the s3 attachment store")
+	flag.StringVar(&config.s3.region, "s3-region", "us-east-1", "S3 region")
+	flag.StringVar(&config.s3.bucket, "s3-bucket", "", "S3 bucket for attachments")
+	flag.StringVar(&config.s3.accessKey, "s3-access-key", os.Getenv("S3_ACCESS_KEY"), "S3 access key")
+	flag.StringVar(&config.s3.secretKey, "s3-secret-key", os.Getenv("S3_SECRET_KEY"), "S3 secret key")
+
+	flag.StringVar(&config.mfa.encryptionKey, "mfa-encryption-key", os.Getenv("MFA_ENCRYPTION_KEY"), "key for encrypting TOTP secrets at rest, defaults to the token secret key")
+
+	flag.StringVar(&config.oidc.issuer, "oidc-issuer", "", "issuer URL of the OpenID Connect provider, OIDC login is off if empty")
+	flag.StringVar(&config.oidc.clientID, "oidc-client-id", "", "OIDC client id")
+	flag.StringVar(&config.oidc.clientSecret, "oidc-client-secret", os.Getenv("OIDC_CLIENT_SECRET"), "OIDC client secret")
+	flag.StringVar(&config.oidc.redirectURL, "oidc-redirect-url", "", "OIDC redirect URL, defaults to /users/oidc/callback on this host")
+	flag.StringVar(&config.oidc.defaultRole, "oidc-default-role", data.RoleUser, "role of users created on their first OIDC login")
+	flag.BoolVar(&config.oidc.autoProvision, "oidc-auto-provision", true, "create users on their first OIDC login instead of only linking existing ones")
+	flag.StringVar(&config.oidc.stateKey, "oidc-state-key", os.Getenv("OIDC_STATE_KEY"), "key for signing the OIDC state cookie, defaults to the token secret key")
+
 	flag.StringVar(&config.smtp.host, "smtp-host", "smtp.gmail.com", "SMTP host")
 	flag.IntVar(&config.smtp.sslport, "smtp-ssl-port", 465, "SMTP SSL port")
 	flag.IntVar(&config.smtp.tlsport, "smtp-tls-port", 587, "SMTP TLS port")
@@ -82,6 +163,62 @@ func main() {
 
 	logger.PrintInfo("connected to psql database", nil)
 
+	blobs, err := openBlobStore(config)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+
+	keys, err := jwtkeys.Load(splitList(config.jwt.privateKeys), splitList(config.jwt.publicKeys), config.jwt.signingKey)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+
+	// HS256 tokens signed with an empty secret key could be forged by anyone
+	if (keys.Empty() || config.jwt.acceptHS256) && config.secretKey == "" {
+		logger.PrintFatal(errors.New("SECRET_KEY must be set unless JWT keys are configured and jwt-accept-hs256 is off"), nil)
+	}
+
+	if config.attachments.signingKey == "" {
+		config.attachments.signingKey = config.secretKey
+	}
+
+	// download urls signed with an empty key could be forged by anyone
+	if config.attachments.signingKey == "" {
+		logger.PrintFatal(errors.New("attachments-signing-key or SECRET_KEY must be set"), nil)
+	}
+
+	if config.mfa.encryptionKey == "" {
+		config.mfa.encryptionKey = config.secretKey
+	}
+
+	// TOTP secrets sealed with an empty key are as good as plain text
+	if config.mfa.encryptionKey == "" {
+		logger.PrintFatal(errors.New("mfa-encryption-key or SECRET_KEY must be set"), nil)
+	}
+
+	if config.oidc.stateKey == "" {
+		config.oidc.stateKey = config.secretKey
+	}
+
+	if config.oidc.redirectURL == "" {
+		config.oidc.redirectURL = fmt.Sprintf("http://%s:%d/users/oidc/callback", config.host, config.port)
+	}
+
+	var oidcClient *oidc.Client
+	if config.oidc.issuer != "" {
+		// a state cookie signed with an empty key could be forged by anyone
+		if config.oidc.stateKey == "" {
+			logger.PrintFatal(errors.New("oidc-state-key or SECRET_KEY must be set for OIDC login"), nil)
+		}
+
+		oidcClient = oidc.NewClient(oidc.Config{
+			Issuer:       config.oidc.issuer,
+			ClientID:     config.oidc.clientID,
+			ClientSecret: config.oidc.clientSecret,
+			RedirectURL:  config.oidc.redirectURL,
+		}, nil)
+	}
+
 	mailer := mail.NewMailer(
 		config.smtp.host,
 		config.smtp.sslport,
@@ -104,13 +241,26 @@ func main() {
 	}
 
 	app := &application{
-		config: config,
-		logger: logger,
-		models: data.NewModels(db),
-		mailer: mailer,
-		wg:     sync.WaitGroup{},
+		config:      config,
+		logger:      logger,
+		models:      data.NewModels(db),
+		mailer:      mailer,
+		blobs:       blobs,
+		keys:        keys,
+		oidc:        oidcClient,
+		logins:      newLoginLimiter(),
+		limits:      newRateLimits(),
+		wg:          sync.WaitGroup{},
+		permissions: newPermissionCache(),
+	}
+
+	_, err = app.models.Roles.Get(config.oidc.defaultRole)
+	if err != nil {
+		logger.PrintFatal(fmt.Errorf("invalid oidc default role %q: %w", config.oidc.defaultRole, err), nil)
 	}
 
+	app.startBackgroundJobs()
+
 	message := fmt.Sprintf("starting server at port %d and host %s", config.port, config.host)
 	logger.PrintInfo(message, nil)
 	err = app.serve()
@@ -156,3 +306,26 @@ func openDB(cfg config) (*sql.DB, error) {
 	// Return the sql.DB connection pool.
 	return db, nil
 }
+
+func openBlobStore(cfg config) (storage.BlobStore, error) {
+	switch cfg.attachments.store {
+	case "local":
+		return storage.NewLocalStore(cfg.attachments.dir)
+	case "s3":
+		return storage.NewS3Store(cfg.s3.endpoint, cfg.s3.region, cfg.s3.bucket, cfg.s3.accessKey, cfg.s3.secretKey)
+	default:
+		return nil, fmt.Errorf("unknown attachments store %q", cfg.attachments.store)
+	}
+}
+
+// splitList splits a comma separated flag value, dropping empty entries.
+func splitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
@@ -0,0 +1,476 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/saiharsha/money-manager/internal/data"
+	jsonhelper "github.com/saiharsha/money-manager/pkg/json"
+	"github.com/saiharsha/money-manager/pkg/totp"
+	"github.com/saiharsha/money-manager/pkg/validator"
+)
+
+// totpIssuer is the account issuer shown in authenticator apps.
+const totpIssuer = "Money Manager"
+
+// secondFactor is the part of a request body that proves the second factor,
+// either a code from the authenticator app or one of the recovery codes.
+type secondFactor struct {
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+func (app *application) mfaStatusHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	enabled := false
+	t, err := app.models.MFA.Get(user.ID)
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if t != nil {
+		enabled = t.Enabled
+	}
+
+	remaining, err := app.models.MFA.RemainingRecoveryCodes(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	envelope := jsonhelper.Envelope{
+		"totp_enabled":             enabled,
+		"recovery_codes_remaining": remaining,
+	}
+
+	err = jsonhelper.WriteJSON(w, http.StatusOK, envelope, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// enrolTOTPHandler starts TOTP enrolment. The secret is returned once, as is
+// and as an otpauth:// URI for QR codes, and only takes effect after the user
+// confirmed a code with confirmTOTPHandler.
+func (app *application) enrolTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	sealed, err := app.sealSecret(secret)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.MFA.SetPendingSecret(user.ID, sealed)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrMFAAlreadyEnabled):
+			v := validator.NewValidator()
+			v.AddError("totp", "two-factor authentication is already enabled")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	envelope := jsonhelper.Envelope{
+		"secret": secret,
+		"uri":    totp.URI(totpIssuer, user.Email, secret),
+	}
+
+	err = jsonhelper.WriteJSON(w, http.StatusCreated, envelope, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) confirmTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	var input struct {
+		Code string `json:"code"`
+	}
+
+	err := jsonhelper.ReadJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.NewValidator()
+	v.Check(input.Code != "", "code", "must be provided")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	t, err := app.models.MFA.Get(user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("totp", "enrolment has not been started")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if t.Enabled {
+		v.AddError("totp", "two-factor authentication is already enabled")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	secret, err := app.openSecret(t.Secret)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	step, ok := totp.Validate(secret, input.Code, time.Now())
+	if !ok {
+		v.AddError("code", "is invalid or has expired")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	codes, err := app.models.MFA.Enable(user.ID, step)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrMFAAlreadyEnabled):
+			v.AddError("totp", "two-factor authentication is already enabled")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.logger.PrintInfo(fmt.Sprintf("user %d enabled two-factor authentication", user.ID), nil)
+
+	err = jsonhelper.WriteJSON(w, http.StatusOK, jsonhelper.Envelope{"recovery_codes": codes}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) disableTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	var input secondFactor
+
+	err := jsonhelper.ReadJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if !app.requireSecondFactor(w, r, user.ID, input) {
+		return
+	}
+
+	err = app.models.MFA.Disable(user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = jsonhelper.WriteJSON(w, http.StatusOK, jsonhelper.Envelope{"message": "two-factor authentication disabled"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) regenerateRecoveryCodesHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	var input secondFactor
+
+	err := jsonhelper.ReadJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if !app.requireSecondFactor(w, r, user.ID, input) {
+		return
+	}
+
+	codes, err := app.models.MFA.RegenerateRecoveryCodes(user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound), errors.Is(err, data.ErrMFANotEnabled):
+			v := validator.NewValidator()
+			v.AddError("totp", "two-factor authentication is not enabled")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = jsonhelper.WriteJSON(w, http.StatusOK, jsonhelper.Envelope{"recovery_codes": codes}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// UserLoginMFA is the second step of a login for users with two-factor
+// authentication. It takes the challenge token from UserLogin and a TOTP or
+// recovery code.
+func (app *application) UserLoginMFA(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		MFAToken string `json:"mfa_token"`
+		secondFactor
+	}
+
+	err := jsonhelper.ReadJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.NewValidator()
+	v.Check(input.MFAToken != "", "mfa_token", "must be provided")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	userID, err := app.VerifyMFAToken(input.MFAToken)
+	if err != nil {
+		app.invalidAuthenticationTokenResponse(w, r)
+		return
+	}
+
+	if !app.requireSecondFactor(w, r, userID, input.secondFactor) {
+		return
+	}
+
+	user, err := app.models.Users.GetUserByID(userID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidCredentialsResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// the account may have been suspended since the password was checked
+	if !app.loginAllowed(w, r, user) {
+		return
+	}
+
+	app.issueSession(w, r, user)
+}
+
+// adminResetMFAHandler turns off two-factor authentication for a user who
+// lost both their device and their recovery codes.
+func (app *application) adminResetMFAHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := jsonhelper.ReadIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	if !app.checkUserGrantable(w, r, id) {
+		return
+	}
+
+	err = app.models.MFA.Disable(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	admin := app.contextGetUser(r)
+	app.logger.PrintInfo(fmt.Sprintf("two-factor authentication of user %d reset by admin %d", id, admin.ID), nil)
+	app.auditUserChange(r, data.AuditUserMFAReset, id, nil)
+
+	err = jsonhelper.WriteJSON(w, http.StatusOK, jsonhelper.Envelope{"message": "two-factor authentication reset"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// requireSecondFactor checks the TOTP or recovery code in input for the
+// user. It writes the error response itself and reports whether the handler
+// should continue.
+func (app *application) requireSecondFactor(w http.ResponseWriter, r *http.Request, userID int64, input secondFactor) bool {
+	v := validator.NewValidator()
+	v.Check(input.Code != "" || input.RecoveryCode != "", "code", "a code or recovery_code must be provided")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return false
+	}
+
+	// six digit codes are as easy to guess as a weak password
+	ip := clientIP(r)
+	if retryAfter, blocked := app.logins.blocked(ip); blocked {
+		app.tooManyAttemptsResponse(w, r, retryAfter)
+		return false
+	}
+
+	// wrong codes count towards the account lockout like wrong passwords,
+	// so asking for new challenge tokens does not buy more guesses
+	user, err := app.models.Users.GetUserByID(userID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidCredentialsResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return false
+	}
+
+	if user.IsLocked() {
+		app.logins.fail(ip)
+		app.invalidCredentialsResponse(w, r)
+		return false
+	}
+
+	var ok bool
+
+	if input.Code != "" {
+		ok, err = app.checkTOTP(userID, input.Code)
+	} else {
+		ok, err = app.models.MFA.UseRecoveryCode(userID, input.RecoveryCode)
+	}
+
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return false
+	}
+
+	if !ok {
+		app.logins.fail(ip)
+
+		err = app.recordFailedLogin(user, ip)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return false
+		}
+
+		app.invalidCredentialsResponse(w, r)
+		return false
+	}
+
+	if user.FailedLogins > 0 {
+		err = app.models.Users.Unlock(user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return false
+		}
+	}
+
+	return true
+}
+
+// checkTOTP reports whether code is a valid, unused code for a user with
+// TOTP enabled.
+func (app *application) checkTOTP(userID int64, code string) (bool, error) {
+	t, err := app.models.MFA.Get(userID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return false, nil
+		default:
+			return false, err
+		}
+	}
+
+	if !t.Enabled {
+		return false, nil
+	}
+
+	secret, err := app.openSecret(t.Secret)
+	if err != nil {
+		return false, err
+	}
+
+	step, ok := totp.Validate(secret, code, time.Now())
+	if !ok {
+		return false, nil
+	}
+
+	return app.models.MFA.UseStep(userID, step)
+}
+
+// sealSecret encrypts a TOTP secret with AES-GCM for storage. The nonce is
+// prepended to the ciphertext.
+func (app *application) sealSecret(secret string) ([]byte, error) {
+	gcm, err := app.secretCipher()
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	return gcm.Seal(nonce, nonce, []byte(secret), nil), nil
+}
+
+func (app *application) openSecret(sealed []byte) (string, error) {
+	gcm, err := app.secretCipher()
+	if err != nil {
+		return "", err
+	}
+
+	if len(sealed) < gcm.NonceSize() {
+		return "", errors.New("sealed secret is too short")
+	}
+
+	nonce, ciphertext := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+
+	secret, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return "", err
+	}
+
+	return string(secret), nil
+}
+
+func (app *application) secretCipher() (cipher.AEAD, error) {
+	key := sha256.Sum256([]byte(app.config.mfa.encryptionKey))
+
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
@@ -1,39 +1,93 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"net/http"
+	"regexp"
+	"strconv"
 	"strings"
 	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/saiharsha/money-manager/internal/data"
+	"github.com/saiharsha/money-manager/pkg/validator"
 )
 
+// requestIDRX limits the request ids accepted from clients and proxies.
+var requestIDRX = regexp.MustCompile("^[A-Za-z0-9._-]{1,64}$")
+
+// RequestID gives every request an id, taken from the X-Request-ID header if
+// a proxy in front already set one. The id is echoed in the response and
+// stored with the audit events of the request.
+func (app *application) RequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !requestIDRX.MatchString(id) {
+			b := make([]byte, 16)
+			if _, err := rand.Read(b); err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+			id = hex.EncodeToString(b)
+		}
+
+		w.Header().Set("X-Request-ID", id)
+		next.ServeHTTP(w, app.contextSetRequestID(r, id))
+	})
+}
+
+// RequestLogger logs every request with its route pattern instead of the URL,
+// so tokens in paths like /users/password/reset/{token} and codes in query
+// strings do not end up in the logs.
 func (app *application) RequestLogger(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
-		message := fmt.Sprintf("recieved %v request from %v at %v", r.Method, r.RemoteAddr, r.URL.String())
+		route := routePattern(r)
+		message := fmt.Sprintf("recieved %v request from %v at %v", r.Method, r.RemoteAddr, route)
 		app.logger.PrintInfo(message, map[string]string{
-			"method": r.Method,
-			"url":    r.URL.String(),
-			"ip":     r.RemoteAddr,
+			"method":     r.Method,
+			"route":      route,
+			"ip":         r.RemoteAddr,
+			"request_id": app.contextGetRequestID(r),
 		})
 		next.ServeHTTP(w, r)
 		duration := time.Since(start)
-		message = fmt.Sprintf("processed %v request from %v at %v", r.Method, r.RemoteAddr, r.URL.String())
+		message = fmt.Sprintf("processed %v request from %v at %v", r.Method, r.RemoteAddr, route)
 		app.logger.PrintInfo(message, map[string]string{
-			"method":   r.Method,
-			"url":      r.URL.String(),
-			"ip":       r.RemoteAddr,
-			"duration": duration.String(),
+			"method":     r.Method,
+			"route":      route,
+			"ip":         r.RemoteAddr,
+			"request_id": app.contextGetRequestID(r),
+			"duration":   duration.String(),
 		})
 	})
 }
 
+// routePattern returns the pattern of the route the request will be served
+// by. Middleware runs before routing, so the route is looked up on a scratch
+// context. Requests without a route are logged as "unmatched".
+func routePattern(r *http.Request) string {
+	rctx := chi.RouteContext(r.Context())
+	if rctx == nil || rctx.Routes == nil {
+		return "unmatched"
+	}
+
+	tctx := chi.NewRouteContext()
+	if !rctx.Routes.Match(tctx, r.Method, r.URL.Path) {
+		return "unmatched"
+	}
+
+	return tctx.RoutePattern()
+}
+
 func (app *application) VerifyUser(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		const prefix = "Bearer "
 
 		authHeader := strings.TrimSpace(r.Header.Get("Authorization"))
-		app.logger.PrintDebug("auth header", map[string]string{"raw": authHeader})
 
 		if authHeader == "" || !strings.HasPrefix(authHeader, prefix) {
 			app.invalidAuthenticationTokenResponse(w, r)
@@ -46,23 +100,81 @@ func (app *application) VerifyUser(next http.Handler) http.Handler {
 			return
 		}
 
-		user, err := app.VerifyToken(token)
+		if strings.HasPrefix(token, data.AccessTokenPrefix) {
+			accessToken, user, err := app.models.AccessTokens.GetForToken(token)
+			if err != nil {
+				switch {
+				case errors.Is(err, data.ErrRecordNotFound):
+					app.invalidAuthenticationTokenResponse(w, r)
+				default:
+					app.serverErrorResponse(w, r, err)
+				}
+				return
+			}
+
+			r = app.contextSetUser(r, user)
+			r = app.contextSetScopes(r, accessToken.Scopes)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		claims, err := app.verifyAccessToken(token)
+		if err != nil {
+			app.invalidAuthenticationTokenResponse(w, r)
+			return
+		}
+		user := claims.user
+
+		epoch, err := app.models.Users.GetTokenEpoch(user.ID)
 		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				app.invalidAuthenticationTokenResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		// the token was revoked, e.g. by a password change
+		if user.TokenEpoch != epoch {
 			app.invalidAuthenticationTokenResponse(w, r)
 			return
 		}
 
+		// the session was signed out, possibly from another device
+		if claims.sessionID != 0 {
+			_, err := app.models.Sessions.Seen(claims.sessionID, user.ID, clientIP(r))
+			if err != nil {
+				switch {
+				case errors.Is(err, data.ErrRecordNotFound):
+					app.invalidAuthenticationTokenResponse(w, r)
+				default:
+					app.serverErrorResponse(w, r, err)
+				}
+				return
+			}
+			r = app.contextSetSessionID(r, claims.sessionID)
+		}
+
 		// app.logger.PrintDebug(fmt.Sprintf("user from jwt decode : %v", user), nil)
 		r = app.contextSetUser(r, user)
 
 		// app.logger.PrintDebug(fmt.Sprintf("context set in request: %v", app.contextGetUser(r)), nil)
 		// app.logger.PrintDebug(fmt.Sprintf("request after adding context: %v", *r), nil)
 
+		if claims.admin != nil {
+			app.serveImpersonated(w, r, claims.admin, next)
+			return
+		}
+
 		next.ServeHTTP(w, r)
 	})
 }
 
-func (app *application) RequireRole(roles ...string) func(http.Handler) http.Handler {
+// RequirePermission allows the request only if the role of the user grants
+// permission.
+func (app *application) RequirePermission(permission string) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			user := app.contextGetUser(r)
@@ -71,14 +183,148 @@ func (app *application) RequireRole(roles ...string) func(http.Handler) http.Han
 				return
 			}
 
-			for _, role := range roles {
-				if user.Role == role {
-					next.ServeHTTP(w, r)
-					return
-				}
+			permissions, err := app.userPermissions(user.ID)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+
+			if !permissions[permission] {
+				app.notPermittedResponse(w, r)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// RequireActivatedUser allows the request only if the user verified their
+// email. The user is read from the database, since tokens issued before the
+// verification would still say otherwise.
+func (app *application) RequireActivatedUser(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, err := app.models.Users.GetUserByID(app.contextGetUser(r).ID)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				app.invalidAuthenticationTokenResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		if !user.Activated {
+			app.inactiveAccountResponse(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RequireScope allows requests made with a personal access token only if the
+// token has the scope. Requests with a JWT always pass.
+func (app *application) RequireScope(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			scopes, ok := app.contextGetScopes(r)
+			if ok && !data.HasScope(scopes, scope) {
+				app.missingScopeResponse(w, r, scope)
+				return
 			}
 
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// RejectAccessTokens keeps personal access tokens away from account and
+// admin routes, which need an interactive login.
+func (app *application) RejectAccessTokens(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := app.contextGetScopes(r); ok {
 			app.notPermittedResponse(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RejectImpersonation keeps admins acting as a user away from the routes that
+// change how the user signs in, like their password, email and second
+// factor.
+func (app *application) RejectImpersonation(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := app.contextGetImpersonator(r); ok {
+			app.impersonationNotAllowedResponse(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ActiveLedger puts the ledger the request works on into the context. Clients
+// switch ledgers with the X-Ledger-ID header or the ledger_id query parameter;
+// without either the user's personal ledger is used. It must run after
+// VerifyUser.
+func (app *application) ActiveLedger(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := app.contextGetUser(r)
+
+		raw := r.Header.Get("X-Ledger-ID")
+		if raw == "" {
+			raw = r.URL.Query().Get("ledger_id")
+		}
+
+		var ledger *data.Ledger
+		var err error
+
+		if raw == "" {
+			ledger, err = app.models.Ledgers.GetPersonal(user.ID)
+		} else {
+			id, convErr := strconv.ParseInt(raw, 10, 64)
+			if convErr != nil || id < 1 {
+				v := validator.NewValidator()
+				v.AddError("ledger_id", "must be a positive integer")
+				app.failedValidationResponse(w, r, v.Errors)
+				return
+			}
+			ledger, err = app.models.Ledgers.GetForMember(id, user.ID)
+		}
+
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				v := validator.NewValidator()
+				v.AddError("ledger_id", "ledger not found")
+				app.failedValidationResponse(w, r, v.Errors)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		next.ServeHTTP(w, app.contextSetLedger(r, ledger))
+	})
+}
+
+// RequireLedgerRole allows the request only if the user has one of the roles
+// in the active ledger. It must run after ActiveLedger.
+func (app *application) RequireLedgerRole(roles ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ledger := app.contextGetLedger(r)
+
+			if !validator.In(ledger.Role, roles...) {
+				app.notPermittedResponse(w, r)
+				return
+			}
+
+			next.ServeHTTP(w, r)
 		})
 	}
 }
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/saiharsha/money-manager/internal/data"
+	"github.com/saiharsha/money-manager/internal/oidc"
+)
+
+// oidcStateCookie holds the state, nonce and PKCE verifier between the
+// redirect to the provider and the callback.
+const oidcStateCookie = "oidcstate"
+
+const oidcStateTTL = 10 * time.Minute
+
+type oidcState struct {
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+	Expires  int64  `json:"expires"`
+}
+
+// oidcLoginHandler sends the user to the identity provider.
+func (app *application) oidcLoginHandler(w http.ResponseWriter, r *http.Request) {
+	if app.oidc == nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	var st oidcState
+	var challenge string
+	var err error
+
+	st.State, err = oidc.RandomString()
+	if err == nil {
+		st.Nonce, err = oidc.RandomString()
+	}
+	if err == nil {
+		st.Verifier, challenge, err = oidc.PKCE()
+	}
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	st.Expires = time.Now().Add(oidcStateTTL).Unix()
+
+	redirectURL, err := app.oidc.AuthCodeURL(r.Context(), st.State, st.Nonce, challenge)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	value, err := app.signOIDCState(st)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	http.SetCookie(w, app.newOIDCStateCookie(value, int(oidcStateTTL.Seconds())))
+
+	http.Redirect(w, r, redirectURL, http.StatusFound)
+}
+
+// oidcCallbackHandler finishes the login when the provider redirects back.
+// Users are found by their provider account, then by verified email, and
+// are created if auto-provisioning is on.
+func (app *application) oidcCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	if app.oidc == nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	http.SetCookie(w, app.newOIDCStateCookie("", -1))
+
+	query := r.URL.Query()
+
+	if providerErr := query.Get("error"); providerErr != "" {
+		app.logger.PrintInfo(fmt.Sprintf("identity provider returned %s: %s", providerErr, query.Get("error_description")), nil)
+		app.invalidCredentialsResponse(w, r)
+		return
+	}
+
+	cookie, err := r.Cookie(oidcStateCookie)
+	if err != nil {
+		app.invalidCredentialsResponse(w, r)
+		return
+	}
+
+	st, ok := app.readOIDCState(cookie.Value)
+	if !ok || subtle.ConstantTimeCompare([]byte(st.State), []byte(query.Get("state"))) != 1 {
+		app.invalidCredentialsResponse(w, r)
+		return
+	}
+
+	claims, err := app.oidc.Exchange(r.Context(), query.Get("code"), st.Verifier, st.Nonce)
+	if err != nil {
+		switch {
+		case errors.Is(err, oidc.ErrInvalidIDToken):
+			app.logger.PrintInfo(err.Error(), nil)
+			app.invalidCredentialsResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	user, err := app.userForIdentity(claims)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidCredentialsResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.completeLogin(w, r, user)
+}
+
+// userForIdentity returns the user for the provider account, linking or
+// creating one when needed. It returns ErrRecordNotFound if the account
+// cannot be matched and auto-provisioning is off, or if the matching local
+// user never verified their email; they have to activate it and log in with
+// their password first.
+func (app *application) userForIdentity(claims *oidc.Claims) (*data.User, error) {
+	issuer := app.config.oidc.issuer
+
+	user, err := app.models.Identities.GetUser(issuer, claims.Subject)
+	if err == nil || !errors.Is(err, data.ErrRecordNotFound) {
+		return user, err
+	}
+
+	// without a verified email the account could belong to anyone
+	if claims.Email == "" || !claims.EmailVerified {
+		return nil, data.ErrRecordNotFound
+	}
+
+	user, err = app.models.Users.GetUserByMail(claims.Email)
+	switch {
+	case err == nil:
+		err = app.models.Identities.Link(user, issuer, claims.Subject)
+		if err != nil {
+			if errors.Is(err, data.ErrRecordNotFound) {
+				app.logger.PrintInfo(fmt.Sprintf("identity provider account %s not linked to unactivated user %d", claims.Subject, user.ID), nil)
+			}
+			return nil, err
+		}
+		app.logger.PrintInfo(fmt.Sprintf("user %d linked to identity provider account %s", user.ID, claims.Subject), nil)
+		return user, nil
+	case !errors.Is(err, data.ErrRecordNotFound):
+		return nil, err
+	}
+
+	if !app.config.oidc.autoProvision {
+		return nil, data.ErrRecordNotFound
+	}
+
+	name := strings.TrimSpace(claims.Name)
+	if name == "" {
+		name, _, _ = strings.Cut(claims.Email, "@")
+	}
+
+	user = &data.User{
+		Name:      name,
+		Email:     claims.Email,
+		Role:      app.config.oidc.defaultRole,
+		Activated: true,
+	}
+
+	// the user signs in through the provider and never learns this password
+	password, err := oidc.RandomString()
+	if err != nil {
+		return nil, err
+	}
+	err = user.Password.SetPasswordHash(password)
+	if err != nil {
+		return nil, err
+	}
+
+	err = app.models.Identities.Provision(user, issuer, claims.Subject)
+	if err != nil {
+		return nil, err
+	}
+
+	app.logger.PrintInfo(fmt.Sprintf("user %d provisioned from identity provider account %s", user.ID, claims.Subject), nil)
+
+	return user, nil
+}
+
+// newOIDCStateCookie returns the state cookie. It must come back on the
+// redirect URL, so it is only marked Secure when that URL is https; browsers
+// drop Secure cookies set over plain http.
+func (app *application) newOIDCStateCookie(value string, maxAge int) *http.Cookie {
+	return &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    value,
+		Path:     "/users/oidc",
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(app.config.oidc.redirectURL, "https://"),
+		// Lax so the cookie comes along on the redirect back from the provider
+		SameSite: http.SameSiteLaxMode,
+		MaxAge:   maxAge,
+	}
+}
+
+func (app *application) signOIDCState(st oidcState) (string, error) {
+	payload, err := json.Marshal(st)
+	if err != nil {
+		return "", err
+	}
+
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(app.oidcStateSignature(encoded)), nil
+}
+
+func (app *application) readOIDCState(value string) (*oidcState, bool) {
+	encoded, signature, ok := strings.Cut(value, ".")
+	if !ok {
+		return nil, false
+	}
+
+	mac, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil || !hmac.Equal(mac, app.oidcStateSignature(encoded)) {
+		return nil, false
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, false
+	}
+
+	var st oidcState
+	if json.Unmarshal(payload, &st) != nil || time.Now().Unix() > st.Expires {
+		return nil, false
+	}
+
+	return &st, true
+}
+
+func (app *application) oidcStateSignature(encoded string) []byte {
+	mac := hmac.New(sha256.New, []byte(app.config.oidc.stateKey))
+	mac.Write([]byte(encoded))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// permissionCacheTTL bounds how long a permission change made on another
+// instance can go unnoticed.
+const permissionCacheTTL = time.Minute
+
+// permissionCache keeps the permissions of recently seen users, so that
+// RequirePermission does not query the database on every request.
+type permissionCache struct {
+	mu      sync.Mutex
+	entries map[int64]*permissionEntry
+}
+
+type permissionEntry struct {
+	permissions map[string]bool
+	expires     time.Time
+}
+
+func newPermissionCache() *permissionCache {
+	return &permissionCache{entries: make(map[int64]*permissionEntry)}
+}
+
+func (c *permissionCache) get(userID int64) (map[string]bool, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[userID]
+	if !ok || time.Now().After(entry.expires) {
+		return nil, false
+	}
+	return entry.permissions, true
+}
+
+func (c *permissionCache) set(userID int64, permissions []string) map[string]bool {
+	set := make(map[string]bool, len(permissions))
+	for _, permission := range permissions {
+		set[permission] = true
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries[userID] = &permissionEntry{permissions: set, expires: time.Now().Add(permissionCacheTTL)}
+	return set
+}
+
+// forget drops a user, e.g. after their role changed.
+func (c *permissionCache) forget(userID int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.entries, userID)
+}
+
+// clear drops every user, e.g. after the permissions of a role changed.
+func (c *permissionCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries = make(map[int64]*permissionEntry)
+}
+
+func (c *permissionCache) prune() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	for userID, entry := range c.entries {
+		if now.After(entry.expires) {
+			delete(c.entries, userID)
+		}
+	}
+}
+
+// userPermissions returns the permissions the user has through their role.
+func (app *application) userPermissions(userID int64) (map[string]bool, error) {
+	if permissions, ok := app.permissions.get(userID); ok {
+		return permissions, nil
+	}
+
+	permissions, err := app.models.Roles.GetForUser(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	return app.permissions.set(userID, permissions), nil
+}
+
+// canGrant reports whether the user holds every one of permissions. Nobody
+// may hand out more than they have themselves.
+func (app *application) canGrant(userID int64, permissions []string) (bool, error) {
+	held, err := app.userPermissions(userID)
+	if err != nil {
+		return false, err
+	}
+
+	for _, permission := range permissions {
+		if !held[permission] {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
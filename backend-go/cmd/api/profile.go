@@ -0,0 +1,518 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/saiharsha/money-manager/internal/data"
+	jsonhelper "github.com/saiharsha/money-manager/pkg/json"
+	"github.com/saiharsha/money-manager/pkg/validator"
+)
+
+func (app *application) getProfileHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readCurrentUser(w, r)
+	if !ok {
+		return
+	}
+
+	err := jsonhelper.WriteJSON(w, http.StatusOK, jsonhelper.Envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// updateProfileHandler changes the username and preferences. A currency_id
+// of 0 clears the preferred currency.
+func (app *application) updateProfileHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readCurrentUser(w, r)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		Username   *string `json:"username"`
+		Timezone   *string `json:"timezone"`
+		CurrencyID *int64  `json:"currency_id"`
+	}
+
+	err := jsonhelper.ReadJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.NewValidator()
+
+	if input.Username != nil {
+		user.Name = strings.TrimSpace(*input.Username)
+		data.ValidateUsername(v, user.Name)
+	}
+
+	if input.Timezone != nil {
+		user.Timezone = *input.Timezone
+		data.ValidateTimezone(v, user.Timezone)
+	}
+
+	if input.CurrencyID != nil {
+		switch {
+		case *input.CurrencyID == 0:
+			user.CurrencyID = nil
+		case *input.CurrencyID < 0:
+			v.AddError("currency_id", "must be a positive integer")
+		default:
+			_, err := app.models.Currencies.GetByID(*input.CurrencyID)
+			if err != nil {
+				switch {
+				case errors.Is(err, data.ErrRecordNotFound):
+					v.AddError("currency_id", "currency not found")
+				default:
+					app.serverErrorResponse(w, r, err)
+					return
+				}
+			}
+			user.CurrencyID = input.CurrencyID
+		}
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	_, err = app.models.Users.UpdateUser(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = jsonhelper.WriteJSON(w, http.StatusOK, jsonhelper.Envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// changePasswordHandler sets a new password after checking the current one.
+// All other sessions are signed out and the response carries new tokens for
+// this one.
+func (app *application) changePasswordHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		CurrentPassword string `json:"current_password"`
+		NewPassword     string `json:"new_password"`
+	}
+
+	err := jsonhelper.ReadJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.NewValidator()
+	v.Check(input.CurrentPassword != "", "current_password", "must be provided")
+	data.CheckPassword(v, input.NewPassword)
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, ok := app.readCurrentUser(w, r)
+	if !ok {
+		return
+	}
+
+	if !app.checkCurrentPassword(w, r, user, input.CurrentPassword) {
+		return
+	}
+
+	err = user.Password.SetPasswordHash(input.NewPassword)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	_, err = app.models.Users.UpdateUser(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	user.TokenEpoch, err = app.models.Users.RevokeTokens(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// a reset link sent before the change must not undo it
+	err = app.models.Tokens.DeleteAllForUser(data.TokenScopePasswordReset, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.logger.PrintInfo(fmt.Sprintf("user %d changed their password", user.ID), nil)
+
+	app.issueSession(w, r, user)
+}
+
+// checkPasswordResetHandler answers the link in a password reset email. A
+// link cannot carry the new password, so it only checks the token, without
+// using it, and says how to send the password.
+func (app *application) checkPasswordResetHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.NewValidator()
+
+	t, err := app.models.Tokens.Check(data.TokenScopePasswordReset, chi.URLParam(r, "token"))
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrExpiredToken):
+			v.AddError("token", "the reset link has expired, please ask for a new one")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or already used reset link")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	envelope := jsonhelper.Envelope{
+		"message":    `the reset link is valid, POST {"password": "..."} to this url to set a new password`,
+		"expires_at": t.Expiry,
+	}
+
+	err = jsonhelper.WriteJSON(w, http.StatusOK, envelope, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// resetPasswordHandler sets a new password with the link from a password
+// reset email. It signs the user out everywhere but does not log them in,
+// as the link alone is no second factor.
+func (app *application) resetPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Password string `json:"password"`
+	}
+
+	err := jsonhelper.ReadJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.NewValidator()
+	data.CheckPassword(v, input.Password)
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	t, err := app.models.Tokens.Use(data.TokenScopePasswordReset, chi.URLParam(r, "token"))
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrExpiredToken):
+			v.AddError("token", "the reset link has expired, please ask for a new one")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or already used reset link")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	user, err := app.models.Users.GetUserByID(t.UserID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or already used reset link")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// the link went to an address the user no longer has
+	if t.Email != user.Email {
+		v.AddError("token", "invalid or already used reset link")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = user.Password.SetPasswordHash(input.Password)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	user.PasswordResetRequired = false
+
+	_, err = app.models.Users.UpdateUser(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	_, err = app.models.Users.RevokeTokens(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.Tokens.DeleteAllForUser(data.TokenScopePasswordReset, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if user.FailedLogins > 0 {
+		err = app.models.Users.Unlock(user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	app.logger.PrintInfo(fmt.Sprintf("user %d reset their password", user.ID), nil)
+
+	err = jsonhelper.WriteJSON(w, http.StatusOK, jsonhelper.Envelope{"message": "password reset, please log in with the new password"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// requestEmailChangeHandler sends a confirmation link to the new address
+// and a notice to the current one. The email only changes once the link is
+// opened.
+func (app *application) requestEmailChangeHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email    string `json:"email"`
+		Password string `json:"password"`
+	}
+
+	err := jsonhelper.ReadJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.NewValidator()
+	data.ValidateEmail(v, input.Email)
+	v.Check(input.Password != "", "password", "must be provided")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, ok := app.readCurrentUser(w, r)
+	if !ok {
+		return
+	}
+
+	if !app.checkCurrentPassword(w, r, user, input.Password) {
+		return
+	}
+
+	if strings.EqualFold(input.Email, user.Email) {
+		v.AddError("email", "must be different from the current email")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	_, err = app.models.Users.GetUserByMail(input.Email)
+	switch {
+	case err == nil:
+		v.AddError("email", "a user with this email address already exists")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	case !errors.Is(err, data.ErrRecordNotFound):
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// only the newest request can be confirmed
+	err = app.models.Tokens.DeleteAllForUser(data.TokenScopeEmailChange, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	token, err := app.models.Tokens.New(user.ID, input.Email, data.EmailChangeTokenTTL, data.TokenScopeEmailChange)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	confirmLink := fmt.Sprintf("http://%s:%d/users/email/confirm/%s", app.config.host, app.config.port, token.Plaintext)
+
+	app.BackgroundEmailTask(func() {
+		err := app.mailer.SendEmailChangeConfirmEmail([]string{input.Email}, user.Name, input.Email, confirmLink, token.Expiry)
+		if err != nil {
+			app.logger.PrintError(err, map[string]string{
+				"user_email": input.Email,
+				"operation":  "send_email_change_confirm_email",
+			})
+		}
+
+		err = app.mailer.SendEmailChangeNoticeEmail([]string{user.Email}, user.Name, input.Email)
+		if err != nil {
+			app.logger.PrintError(err, map[string]string{
+				"user_email": user.Email,
+				"operation":  "send_email_change_notice_email",
+			})
+		}
+	})
+
+	envelope := jsonhelper.Envelope{
+		"message": fmt.Sprintf("a confirmation link has been sent to %s", input.Email),
+	}
+
+	err = jsonhelper.WriteJSON(w, http.StatusAccepted, envelope, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// confirmEmailChangeHandler is opened from the link sent to the new
+// address. The token proves access to that address, so no login is needed.
+func (app *application) confirmEmailChangeHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.NewValidator()
+
+	t, err := app.models.Tokens.Use(data.TokenScopeEmailChange, chi.URLParam(r, "token"))
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrExpiredToken):
+			v.AddError("token", "the confirmation link has expired, please request the change again")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or already used confirmation link")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	user, err := app.models.Users.GetUserByID(t.UserID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or already used confirmation link")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	user.Email = t.Email
+	user.Activated = true
+
+	_, err = app.models.Users.UpdateUser(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateEmail):
+			v.AddError("email", "a user with this email address already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// tokens issued before carry the old address, and whoever controls it
+	// must not stay signed in
+	user.TokenEpoch, err = app.models.Users.RevokeTokens(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// nor take the account back with a reset link sent to the old address
+	err = app.models.Tokens.DeleteAllForUser(data.TokenScopePasswordReset, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.logger.PrintInfo(fmt.Sprintf("user %d changed their email", user.ID), nil)
+
+	envelope := jsonhelper.Envelope{
+		"message": "email changed, please log in again",
+		"user":    user,
+	}
+
+	err = jsonhelper.WriteJSON(w, http.StatusOK, envelope, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// readCurrentUser loads the signed in user from the database; the context
+// only holds what the token says. It writes the error response itself and
+// reports whether the handler should continue.
+func (app *application) readCurrentUser(w http.ResponseWriter, r *http.Request) (*data.User, bool) {
+	user, err := app.models.Users.GetUserByID(app.contextGetUser(r).ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+
+	return user, true
+}
+
+// checkCurrentPassword guards sensitive changes with the current password.
+// Wrong guesses count towards the per-IP login limit. It writes the error
+// response itself and reports whether the handler should continue.
+func (app *application) checkCurrentPassword(w http.ResponseWriter, r *http.Request, user *data.User, password string) bool {
+	ip := clientIP(r)
+	if retryAfter, blocked := app.logins.blocked(ip); blocked {
+		app.tooManyAttemptsResponse(w, r, retryAfter)
+		return false
+	}
+
+	matches, err := user.Password.Matches(password)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return false
+	}
+
+	if !matches {
+		app.logins.fail(ip)
+		v := validator.NewValidator()
+		v.AddError("password", "is incorrect")
+		app.failedValidationResponse(w, r, v.Errors)
+		return false
+	}
+
+	return true
+}
@@ -11,28 +11,28 @@ import (
 )
 
 func (app *application) listRecordsHandler(w http.ResponseWriter, r *http.Request) {
-	userID, err := jsonhelper.ReadIDParam(r)
-	if err != nil {
-		app.notFoundResponse(w, r)
-		return
-	}
+	ledger := app.contextGetLedger(r)
 
 	var v = validator.NewValidator()
 	var filters data.Filters
 	filters.Page = jsonhelper.ReadIntParam(r, "page", 1, v)
 	filters.PageSize = jsonhelper.ReadIntParam(r, "page_size", 20, v)
 	filters.Sort = jsonhelper.ReadStringParam(r, "sort", "id")
+	filters.SortSafeList = data.RecordSortSafeList
 
 	// no default value for start date
 	filters.StartDate = jsonhelper.ReadTimeParam(r, "start_date", time.Time{}, false, v)
 	filters.EndDate = jsonhelper.ReadTimeParam(r, "end_date", time.Now(), true, v)
+	filters.Expr = validator.ParseFilter(v, "filter", jsonhelper.ReadStringParam(r, "filter", ""), data.RecordFilterFields)
+
+	data.ValidateFilters(v, filters)
 
 	if !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
 
-	records, err := app.models.Records.GetRecordsForUser(userID, filters)
+	records, err := app.models.Records.GetAllForLedger(ledger.ID, filters)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
@@ -45,24 +45,72 @@ func (app *application) listRecordsHandler(w http.ResponseWriter, r *http.Reques
 	}
 }
 
+// listUserRecordsHandler keeps GET /records/list/{id} from before ledgers
+// working. id must be the signed in user, and the records of the active
+// ledger are listed, which is their personal ledger unless chosen otherwise.
+func (app *application) listUserRecordsHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := jsonhelper.ReadIDParam(r)
+	if err != nil || id != app.contextGetUser(r).ID {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	w.Header().Set("Deprecation", "true")
+	w.Header().Set("Link", `</records>; rel="successor-version"`)
+
+	app.listRecordsHandler(w, r)
+}
+
 func (app *application) createRecordHandler(w http.ResponseWriter, r *http.Request) {
-	var record data.Record
+	user := app.contextGetUser(r)
+	ledger := app.contextGetLedger(r)
+
+	var input struct {
+		Amount      int64               `json:"amount"`
+		Description string              `json:"description"`
+		TypeID      int64               `json:"type_id"`
+		CurrencyID  int64               `json:"currency_id"`
+		OccurredAt  string              `json:"occurred_at"`
+		Timezone    string              `json:"timezone"`
+		Splits      []*data.RecordSplit `json:"splits"`
+	}
 
-	err := jsonhelper.ReadJSON(w, r, &record)
+	err := jsonhelper.ReadJSON(w, r, &input)
 	if err != nil {
 		app.badRequestResponse(w, r, err)
 		return
 	}
 
+	record := data.Record{
+		Amount:      input.Amount,
+		Description: input.Description,
+		TypeID:      input.TypeID,
+		CurrencyID:  input.CurrencyID,
+		UserID:      user.ID,
+		LedgerID:    ledger.ID,
+		OccurredAt:  time.Now(),
+		HasTime:     true,
+		Timezone:    "UTC",
+		Splits:      input.Splits,
+	}
+
+	if input.Timezone != "" {
+		record.Timezone = input.Timezone
+	}
+
 	v := validator.NewValidator()
+	if input.OccurredAt != "" {
+		record.OccurredAt, record.HasTime = data.ParseOccurredAt(v, input.OccurredAt, record.Timezone)
+	}
 	data.ValidateRecord(v, &record)
+	data.ValidateRecordSplits(v, &record)
 
 	if !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
 
-	err = app.models.Records.Insert(&record)
+	err = app.models.Records.Insert(&record, app.auditSource(r))
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrDuplicateRecord):
@@ -82,50 +130,34 @@ func (app *application) createRecordHandler(w http.ResponseWriter, r *http.Reque
 }
 
 func (app *application) getRecordHandler(w http.ResponseWriter, r *http.Request) {
-	id, err := jsonhelper.ReadIDParam(r)
-	if err != nil {
-		app.notFoundResponse(w, r)
+	record, ok := app.readRecordInLedger(w, r)
+	if !ok {
 		return
 	}
 
-	record, err := app.models.Records.GetByID(id)
-	if err != nil {
-		switch {
-		case errors.Is(err, data.ErrRecordNotFound):
-			app.notFoundResponse(w, r)
-		default:
-			app.serverErrorResponse(w, r, err)
-		}
-		return
-	}
-
-	err = jsonhelper.WriteJSON(w, http.StatusOK, jsonhelper.Envelope{"record": record}, nil)
+	err := jsonhelper.WriteJSON(w, http.StatusOK, jsonhelper.Envelope{"record": record}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
 }
 
 func (app *application) updateRecordHandler(w http.ResponseWriter, r *http.Request) {
-	id, err := jsonhelper.ReadIDParam(r)
-	if err != nil {
-		app.notFoundResponse(w, r)
-		return
-	}
-
-	record, err := app.models.Records.GetByID(id)
-	if err != nil {
-		app.serverErrorResponse(w, r, err)
+	record, ok := app.readRecordInLedger(w, r)
+	if !ok {
 		return
 	}
 
 	var input struct {
-		Amount      *int64  `json:"amount"`
-		Description *string `json:"description"`
-		TypeID      *int64  `json:"type_id"`
-		CurrencyID  *int64  `json:"currency_id"`
+		Amount      *int64               `json:"amount"`
+		Description *string              `json:"description"`
+		TypeID      *int64               `json:"type_id"`
+		CurrencyID  *int64               `json:"currency_id"`
+		OccurredAt  *string              `json:"occurred_at"`
+		Timezone    *string              `json:"timezone"`
+		Splits      *[]*data.RecordSplit `json:"splits"`
 	}
 
-	err = jsonhelper.ReadJSON(w, r, &input)
+	err := jsonhelper.ReadJSON(w, r, &input)
 	if err != nil {
 		app.badRequestResponse(w, r, err)
 		return
@@ -134,6 +166,15 @@ func (app *application) updateRecordHandler(w http.ResponseWriter, r *http.Reque
 	v := validator.NewValidator()
 	data.ValidateRecordUpdate(v, input.Amount, input.TypeID, input.CurrencyID)
 
+	if input.Timezone != nil {
+		record.Timezone = *input.Timezone
+		data.ValidateTimezone(v, record.Timezone)
+	}
+	if input.OccurredAt != nil {
+		record.OccurredAt, record.HasTime = data.ParseOccurredAt(v, *input.OccurredAt, record.Timezone)
+		data.ValidateOccurredAt(v, record.OccurredAt)
+	}
+
 	if !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
@@ -151,8 +192,19 @@ func (app *application) updateRecordHandler(w http.ResponseWriter, r *http.Reque
 	if input.CurrencyID != nil {
 		record.CurrencyID = *input.CurrencyID
 	}
+	if input.Splits != nil {
+		record.Splits = *input.Splits
+	}
+
+	// existing split lines must still add up when only the amount changes
+	data.ValidateRecordSplits(v, record)
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
 
-	err = app.models.Records.Update(record)
+	err = app.models.Records.Update(record, app.contextGetUser(r).ID, app.auditSource(r))
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrEditConflict):
@@ -176,7 +228,7 @@ func (app *application) deleteRecordHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	err = app.models.Records.Delete(id)
+	err = app.models.Records.Delete(id, app.contextGetLedger(r).ID, app.auditSource(r))
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -187,9 +239,103 @@ func (app *application) deleteRecordHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	err = jsonhelper.WriteJSON(w, http.StatusOK, jsonhelper.Envelope{"message": "record successfully deleted"}, nil)
+	err = jsonhelper.WriteJSON(w, http.StatusOK, jsonhelper.Envelope{"message": "record moved to trash"}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 }
+
+func (app *application) recordHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	record, ok := app.readRecordInLedger(w, r)
+	if !ok {
+		return
+	}
+
+	revisions, err := app.models.Revisions.GetAllForRecord(record.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = jsonhelper.WriteJSON(w, http.StatusOK, jsonhelper.Envelope{"record": record, "history": revisions}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) restoreRecordHandler(w http.ResponseWriter, r *http.Request) {
+	record, ok := app.readRecordInLedger(w, r)
+	if !ok {
+		return
+	}
+
+	v := validator.NewValidator()
+	version := jsonhelper.ReadIntParam(r, "version", 0, v)
+	v.Check(version > 0, "version", "must be provided")
+	v.Check(int64(version) < record.Version, "version", "must be an earlier version of the record")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	revision, err := app.models.Revisions.GetVersion(record.ID, int64(version))
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("version", "version not found for this record")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.models.Records.Restore(record, revision, app.contextGetUser(r).ID, app.auditSource(r))
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = jsonhelper.WriteJSON(w, http.StatusOK, jsonhelper.Envelope{"record": record}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// readRecordInLedger loads the record named by the id URL parameter if it
+// belongs to the active ledger. It writes the error response itself and
+// reports whether the handler should continue.
+func (app *application) readRecordInLedger(w http.ResponseWriter, r *http.Request) (*data.Record, bool) {
+	ledger := app.contextGetLedger(r)
+
+	id, err := jsonhelper.ReadIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+
+	record, err := app.models.Records.GetByID(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+
+	if record.LedgerID != ledger.ID {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+
+	return record, true
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/saiharsha/money-manager/internal/data"
+	jsonhelper "github.com/saiharsha/money-manager/pkg/json"
+	"github.com/saiharsha/money-manager/pkg/validator"
+)
+
+func (app *application) typeTotalsReportHandler(w http.ResponseWriter, r *http.Request) {
+	ledger := app.contextGetLedger(r)
+
+	var v = validator.NewValidator()
+	var filters data.Filters
+	filters.StartDate = jsonhelper.ReadTimeParam(r, "start_date", time.Time{}, false, v)
+	filters.EndDate = jsonhelper.ReadTimeParam(r, "end_date", time.Now(), true, v)
+	filters.Expr = validator.ParseFilter(v, "filter", jsonhelper.ReadStringParam(r, "filter", ""), data.RecordFilterFields)
+
+	if !filters.StartDate.IsZero() {
+		v.Check(!filters.StartDate.After(filters.EndDate), "start_date", "must not be after end_date")
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	totals, err := app.models.Reports.TotalsByType(ledger.ID, filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = jsonhelper.WriteJSON(w, http.StatusOK, jsonhelper.Envelope{"totals": totals}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
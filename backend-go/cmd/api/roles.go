@@ -0,0 +1,318 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/saiharsha/money-manager/internal/data"
+	jsonhelper "github.com/saiharsha/money-manager/pkg/json"
+	"github.com/saiharsha/money-manager/pkg/validator"
+)
+
+func (app *application) listRolesHandler(w http.ResponseWriter, r *http.Request) {
+	roles, err := app.models.Roles.GetAll()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = jsonhelper.WriteJSON(w, http.StatusOK, jsonhelper.Envelope{"roles": roles}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) listPermissionsHandler(w http.ResponseWriter, r *http.Request) {
+	permissions, err := app.models.Roles.GetPermissions()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = jsonhelper.WriteJSON(w, http.StatusOK, jsonhelper.Envelope{"permissions": permissions}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) getRoleHandler(w http.ResponseWriter, r *http.Request) {
+	role, ok := app.readRoleParam(w, r)
+	if !ok {
+		return
+	}
+
+	err := jsonhelper.WriteJSON(w, http.StatusOK, jsonhelper.Envelope{"role": role}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) createRoleHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Name        string   `json:"name"`
+		Description string   `json:"description"`
+		Permissions []string `json:"permissions"`
+	}
+
+	err := jsonhelper.ReadJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	role := &data.Role{
+		Name:        input.Name,
+		Description: input.Description,
+		Permissions: input.Permissions,
+	}
+	if role.Permissions == nil {
+		role.Permissions = []string{}
+	}
+
+	v := validator.NewValidator()
+	data.ValidateRole(v, role)
+
+	if !app.validatePermissions(w, r, v, role.Permissions) {
+		return
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	if !app.checkGrantable(w, r, role.Permissions) {
+		return
+	}
+
+	err = app.models.Roles.Insert(role)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateRole):
+			v.AddError("name", "a role with this name already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrUnknownPermission):
+			v.AddError("permissions", "must only contain known permissions")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.audit(r, &data.AuditEvent{
+		Action:  data.AuditRoleCreate,
+		Entity:  "role",
+		After:   role,
+		Details: map[string]interface{}{"name": role.Name},
+	})
+
+	err = jsonhelper.WriteJSON(w, http.StatusCreated, jsonhelper.Envelope{"role": role}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// updateRoleHandler changes the description or replaces the permissions of
+// a role. The superuser role always keeps every permission.
+func (app *application) updateRoleHandler(w http.ResponseWriter, r *http.Request) {
+	role, ok := app.readRoleParam(w, r)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		Description *string  `json:"description"`
+		Permissions []string `json:"permissions"`
+		Version     *int64   `json:"version"`
+	}
+
+	err := jsonhelper.ReadJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.NewValidator()
+
+	if role.Name == data.RoleSuperUser {
+		v.AddError("name", "the superuser role always has every permission and cannot be changed")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	if input.Version != nil && *input.Version != role.Version {
+		app.editConflictResponse(w, r)
+		return
+	}
+
+	before := *role
+	previous := role.Permissions
+
+	if input.Description != nil {
+		role.Description = *input.Description
+	}
+
+	if input.Permissions != nil {
+		role.Permissions = input.Permissions
+	}
+
+	data.ValidateRole(v, role)
+
+	if !app.validatePermissions(w, r, v, role.Permissions) {
+		return
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// both granting and taking away permissions need them
+	if !app.checkGrantable(w, r, append(append([]string{}, previous...), role.Permissions...)) {
+		return
+	}
+
+	err = app.models.Roles.Update(role)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		case errors.Is(err, data.ErrUnknownPermission):
+			v.AddError("permissions", "must only contain known permissions")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.permissions.clear()
+	app.audit(r, &data.AuditEvent{
+		Action:  data.AuditRoleUpdate,
+		Entity:  "role",
+		Before:  before,
+		After:   role,
+		Details: map[string]interface{}{"name": role.Name},
+	})
+
+	err = jsonhelper.WriteJSON(w, http.StatusOK, jsonhelper.Envelope{"role": role}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteRoleHandler(w http.ResponseWriter, r *http.Request) {
+	role, ok := app.readRoleParam(w, r)
+	if !ok {
+		return
+	}
+
+	v := validator.NewValidator()
+
+	if role.Builtin {
+		v.AddError("name", "built in roles cannot be deleted")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err := app.models.Roles.Delete(role.Name)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRoleInUse):
+			v.AddError("name", "the role is still assigned to users")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.audit(r, &data.AuditEvent{
+		Action:  data.AuditRoleDelete,
+		Entity:  "role",
+		Before:  role,
+		Details: map[string]interface{}{"name": role.Name},
+	})
+
+	err = jsonhelper.WriteJSON(w, http.StatusOK, jsonhelper.Envelope{"message": "role successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// readRoleParam loads the role named by the name URL parameter. It writes
+// the error response itself and reports whether the handler should continue.
+func (app *application) readRoleParam(w http.ResponseWriter, r *http.Request) (*data.Role, bool) {
+	role, err := app.models.Roles.Get(chi.URLParam(r, "name"))
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+
+	return role, true
+}
+
+// validatePermissions adds an error to v for every unknown permission. It
+// only writes a response itself if the permissions cannot be loaded.
+func (app *application) validatePermissions(w http.ResponseWriter, r *http.Request, v *validator.Validator, permissions []string) bool {
+	known, err := app.models.Roles.GetPermissions()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return false
+	}
+
+	codes := make([]string, len(known))
+	for i, permission := range known {
+		codes[i] = permission.Code
+	}
+
+	for _, permission := range permissions {
+		if !validator.In(permission, codes...) {
+			v.AddError("permissions", fmt.Sprintf("unknown permission %q", permission))
+		}
+	}
+
+	return true
+}
+
+// checkUserGrantable refuses actions against a user who has permissions the
+// signed in user does not, so admins cannot lock out those above them. It
+// writes the error response itself and reports whether the handler should
+// continue.
+func (app *application) checkUserGrantable(w http.ResponseWriter, r *http.Request, userID int64) bool {
+	permissions, err := app.models.Roles.GetForUser(userID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return false
+	}
+
+	return app.checkGrantable(w, r, permissions)
+}
+
+// checkGrantable refuses to hand out permissions the signed in user does not
+// have. It writes the error response itself and reports whether the handler
+// should continue.
+func (app *application) checkGrantable(w http.ResponseWriter, r *http.Request, permissions []string) bool {
+	allowed, err := app.canGrant(app.contextGetUser(r).ID, permissions)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return false
+	}
+
+	if !allowed {
+		app.notPermittedResponse(w, r)
+		return false
+	}
+
+	return true
+}
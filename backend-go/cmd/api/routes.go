@@ -1,60 +1,272 @@
 package main
 
 import (
+	"net/http"
+
 	"github.com/go-chi/chi/v5"
+	"github.com/saiharsha/money-manager/internal/data"
 )
 
 func (app *application) router() *chi.Mux {
 	r := chi.NewRouter()
+	r.Use(app.RequestID)
 	r.Use(app.RequestLogger)
 	r.Use(app.panicRecover)
 	r.MethodNotAllowed(app.methodNotAllowedResponse)
 
 	r.Get("/", app.healthcheck)
+	r.Get("/.well-known/jwks.json", app.jwksHandler)
 
 	// account
 	r.Route("/users", func(r chi.Router) {
 		r.Post("/signup", app.UserSignUp)
 		r.Post("/login", app.UserLogin)
+		r.Post("/login/mfa", app.UserLoginMFA)
+		r.Post("/login/link", app.requestLoginLinkHandler)
+		r.Get("/login/link/{token}", app.loginWithLinkHandler)
+		r.Get("/oidc/login", app.oidcLoginHandler)
+		r.Get("/oidc/callback", app.oidcCallbackHandler)
 		r.Post("/signout", app.UserSignOut)
 		r.Post("/refresh", app.UserRefresh)
 		r.Get("/verify/{token}", app.UserVerify)
+		r.Post("/verify/resend", app.UserVerifyResend)
+		r.Get("/email/confirm/{token}", app.confirmEmailChangeHandler)
+		r.Get("/delete/confirm/{token}", app.checkAccountDeletionHandler)
+		r.Post("/delete/confirm/{token}", app.confirmAccountDeletionHandler)
+		r.Get("/password/reset/{token}", app.checkPasswordResetHandler)
+		r.Post("/password/reset/{token}", app.resetPasswordHandler)
+
+		// account settings need an interactive login, not an access token
+		r.Group(func(r chi.Router) {
+			r.Use(app.VerifyUser)
+			r.Use(app.RejectAccessTokens)
+
+			// profile
+			r.Get("/me", app.getProfileHandler)
+			r.Patch("/me", app.updateProfileHandler)
+			r.With(app.RejectImpersonation).Post("/me/password", app.changePasswordHandler)
+			r.With(app.RejectImpersonation).Post("/me/email", app.requestEmailChangeHandler)
+
+			// personal data
+			r.With(app.RejectImpersonation).Get("/me/export", app.exportAccountHandler)
+			r.With(app.RejectImpersonation).Delete("/me", app.deleteAccountHandler)
+			r.Post("/me/delete/cancel", app.cancelAccountDeletionHandler)
+
+			// two-factor authentication
+			r.Get("/me/mfa", app.mfaStatusHandler)
+			r.With(app.RejectImpersonation).Post("/me/mfa/totp", app.enrolTOTPHandler)
+			r.With(app.RejectImpersonation).Post("/me/mfa/totp/confirm", app.confirmTOTPHandler)
+			r.With(app.RejectImpersonation).Delete("/me/mfa/totp", app.disableTOTPHandler)
+			r.With(app.RejectImpersonation).Post("/me/mfa/recovery-codes", app.regenerateRecoveryCodesHandler)
+
+			// sessions
+			r.Get("/me/sessions", app.listSessionsHandler)
+			r.With(app.RejectImpersonation).Delete("/me/sessions/others", app.revokeOtherSessionsHandler)
+			r.With(app.RejectImpersonation).Delete("/me/sessions/{id}", app.revokeSessionHandler)
+
+			// personal access tokens
+			r.Get("/me/tokens", app.listAccessTokensHandler)
+			r.With(app.RejectImpersonation).Post("/me/tokens", app.createAccessTokenHandler)
+			r.With(app.RejectImpersonation).Delete("/me/tokens/{id}", app.deleteAccessTokenHandler)
+		})
 	})
 
-	// records
-	r.Route("/records", func(r chi.Router) {
+	// ledgers
+	r.Route("/ledgers", func(r chi.Router) {
+		// the link in the invitation email only shows the invitation, it is
+		// accepted with the POST below once the invited user logged in
+		r.Get("/invitations/{token}", app.showLedgerInvitationHandler)
+
+		r.Group(func(r chi.Router) {
+			r.Use(app.VerifyUser)
+			r.Use(app.RequireScope(data.ScopeLedgersRead))
+
+			write := app.RequireScope(data.ScopeLedgersWrite)
+
+			r.Get("/", app.listLedgersHandler)
+			r.With(write).Post("/", app.createLedgerHandler)
+			r.Get("/{id}", app.getLedgerHandler)
+			r.With(write).Patch("/{id}", app.updateLedgerHandler)
+			r.With(write).Delete("/{id}", app.deleteLedgerHandler)
+			r.With(write).Patch("/{id}/members/{userID}", app.updateLedgerMemberHandler)
+			r.With(write).Delete("/{id}/members/{userID}", app.removeLedgerMemberHandler)
+			r.Get("/{id}/invitations", app.listLedgerInvitationsHandler)
+			r.With(write).Post("/{id}/invitations", app.createLedgerInvitationHandler)
+			r.With(write).Delete("/{id}/invitations/{invitationID}", app.deleteLedgerInvitationHandler)
+			r.With(app.RequireActivatedUser, write).Post("/invitations/{token}", app.acceptLedgerInvitationHandler)
+		})
+	})
+
+	// records, comments, search, reports, expense groups and trash work on the
+	// active ledger, chosen with the X-Ledger-ID header or ledger_id query
+	// parameter, and are only open to users who verified their email. Reads
+	// need the read scope of the resource, writes the write scope and a ledger
+	// role that may edit.
+	r.Group(func(r chi.Router) {
 		r.Use(app.VerifyUser)
-		r.Get("/list/{id}", app.listRecordsHandler)
-		r.Post("/", app.createRecordHandler)
-		r.Get("/{id}", app.getRecordHandler)
-		r.Patch("/{id}", app.updateRecordHandler)
-		r.Delete("/{id}", app.deleteRecordHandler)
+		r.Use(app.ActiveLedger)
+		r.Use(app.RequireActivatedUser)
+
+		editor := app.RequireLedgerRole(data.LedgerOwner, data.LedgerEditor)
+		writes := func(scope string) func(http.Handler) http.Handler {
+			return func(next http.Handler) http.Handler {
+				return chi.Chain(app.RequireScope(scope), editor).Handler(next)
+			}
+		}
+
+		// records
+		r.Route("/records", func(r chi.Router) {
+			r.Use(app.RequireScope(data.ScopeRecordsRead))
+			write := writes(data.ScopeRecordsWrite)
+
+			r.Get("/", app.listRecordsHandler)
+			r.Get("/list/{id}", app.listUserRecordsHandler) // deprecated, use GET /records
+			r.With(write).Post("/", app.createRecordHandler)
+			r.Get("/{id}", app.getRecordHandler)
+			r.With(write).Patch("/{id}", app.updateRecordHandler)
+			r.With(write).Delete("/{id}", app.deleteRecordHandler)
+			r.Get("/{id}/history", app.recordHistoryHandler)
+			r.With(write).Post("/{id}/restore", app.restoreRecordHandler)
+			r.Get("/{id}/attachments", app.listAttachmentsHandler)
+			r.With(write).Post("/{id}/attachments", app.uploadAttachmentHandler)
+			r.With(write).Delete("/{id}/attachments/{attachmentID}", app.deleteAttachmentHandler)
+		})
+
+		// comments
+		r.Route("/comments", func(r chi.Router) {
+			r.Use(app.RequireScope(data.ScopeRecordsRead))
+			write := writes(data.ScopeRecordsWrite)
+
+			r.With(write).Post("/", app.CreateCommentHandler)
+			r.Get("/{id}", app.GetCommentsHandler)                  // id is the record id
+			r.With(write).Patch("/{id}", app.UpdateCommentHandler)  // id is the comment id
+			r.With(write).Delete("/{id}", app.DeleteCommentHandler) // id is comment id
+		})
+
+		// search
+		r.Route("/search", func(r chi.Router) {
+			r.Use(app.RequireScope(data.ScopeRecordsRead))
+			r.Get("/", app.searchHandler)
+		})
+
+		// reports
+		r.Route("/reports", func(r chi.Router) {
+			r.Use(app.RequireScope(data.ScopeReportsRead))
+			r.Get("/types", app.typeTotalsReportHandler)
+		})
+
+		// expense groups
+		r.Route("/groups", func(r chi.Router) {
+			r.Use(app.RequireScope(data.ScopeGroupsRead))
+			write := writes(data.ScopeGroupsWrite)
+
+			r.Get("/", app.listGroupsHandler)
+			r.With(write).Post("/", app.createGroupHandler)
+			r.Get("/{id}", app.getGroupHandler)
+			r.With(write).Delete("/{id}", app.deleteGroupHandler)
+			r.With(write).Post("/{id}/participants", app.addParticipantHandler)
+			r.With(write).Delete("/{id}/participants/{participantID}", app.removeParticipantHandler)
+			r.Get("/{id}/expenses", app.listExpensesHandler)
+			r.With(write).Post("/{id}/expenses", app.createExpenseHandler)
+			r.With(write).Delete("/{id}/expenses/{expenseID}", app.deleteExpenseHandler)
+			r.Get("/{id}/balances", app.groupBalancesHandler)
+			r.Get("/{id}/settle-up", app.settleUpHandler)
+			r.With(write).Post("/{id}/repayments", app.createRepaymentHandler)
+		})
+
+		// trash
+		r.Route("/trash", func(r chi.Router) {
+			r.Use(app.RequireScope(data.ScopeRecordsRead))
+			write := writes(data.ScopeRecordsWrite)
+
+			r.Get("/", app.listTrashHandler)
+			r.With(write).Post("/{id}/restore", app.restoreTrashHandler) // ?kind=record|comment
+		})
 	})
 
-	// comments
-	r.Route("/comments", func(r chi.Router) {
+	// attachment downloads are authorised by the signed url, not a bearer token
+	r.Get("/attachments/{id}/download", app.downloadAttachmentHandler)
+
+	// saved views
+	r.Route("/views", func(r chi.Router) {
 		r.Use(app.VerifyUser)
-		r.Post("/", app.CreateCommentHandler)
-		r.Get("/{id}", app.GetCommentsHandler)      // id is the record id
-		r.Patch("/{id}", app.UpdateCommentHandler)  // id is the record id
-		r.Delete("/{id}", app.DeleteCommentHandler) // id is comment id
+		r.Use(app.RequireScope(data.ScopeViewsRead))
+
+		write := app.RequireScope(data.ScopeViewsWrite)
+
+		r.Get("/", app.listViewsHandler)
+		r.With(write).Post("/", app.createViewHandler)
+		r.Get("/{id}", app.getViewHandler)
+		r.With(write).Patch("/{id}", app.updateViewHandler)
+		r.With(write).Delete("/{id}", app.deleteViewHandler)
+		r.With(app.RequireScope(data.ScopeRecordsRead), app.ActiveLedger, app.RequireActivatedUser).Get("/{id}/records", app.viewRecordsHandler)
+		r.With(write).Put("/{id}/pin", app.pinViewHandler)
+		r.With(write).Delete("/{id}/pin", app.unpinViewHandler)
+		r.Get("/{id}/shares", app.listViewSharesHandler)
+		r.With(write).Post("/{id}/shares", app.shareViewHandler)
+		r.With(write).Delete("/{id}/shares/{userID}", app.unshareViewHandler)
 	})
 
+	// impersonated users never get admin access, even if they are admins
 	r.Group(func(r chi.Router) {
 		r.Use(app.VerifyUser)
+		r.Use(app.RejectAccessTokens)
+		r.Use(app.RejectImpersonation)
 		r.Route("/admin", func(r chi.Router) {
-			r.Use(app.RequireRole("admin"))
-			r.Patch("/role", app.UpdateUserRoleHandler)
-			r.Get("/currencies", app.GetCurrenciesHandler)
-			r.Post("/currencies", app.InsertCurrencyHandler)
-			r.Get("/currencies/{id}", app.GetCurrencyHandler)
-			r.Patch("/currencies/{id}", app.UpdateCurrencyHandler)
-			r.Delete("/currencies/{id}", app.DeleteCurrencyHandler)
-
-			r.Get("/recordtypes", app.GetRecordTypesHandler)
-			r.Post("/recordtypes", app.InsertRecordTypeHandler)
-			r.Get("/recordtypes/{id}", app.GetRecordTypeHandler)
-			r.Delete("/recordtypes/{id}", app.DeleteRecordTypeHandler)
+			r.Group(func(r chi.Router) {
+				r.Use(app.RequirePermission(data.PermissionUsersRead))
+				r.Get("/users", app.adminListUsersHandler)
+				r.Get("/users/{id}", app.adminGetUserHandler)
+			})
+
+			r.Group(func(r chi.Router) {
+				r.Use(app.RequirePermission(data.PermissionUsersManage))
+				r.Patch("/role", app.UpdateUserRoleHandler)
+				r.Post("/users/{id}/suspend", app.adminSuspendUserHandler)
+				r.Post("/users/{id}/unsuspend", app.adminUnsuspendUserHandler)
+				r.Post("/users/{id}/password-reset", app.adminForcePasswordResetHandler)
+				r.Post("/users/{id}/verify", app.adminVerifyUserHandler)
+				r.Delete("/users/{id}/mfa", app.adminResetMFAHandler)
+				r.Post("/users/{id}/unlock", app.adminUnlockUserHandler)
+			})
+
+			r.Group(func(r chi.Router) {
+				r.Use(app.RequirePermission(data.PermissionAuditRead))
+				r.Get("/audit", app.listAuditEventsHandler)
+				r.Get("/audit/verify", app.verifyAuditLogHandler)
+			})
+
+			r.Group(func(r chi.Router) {
+				r.Use(app.RequirePermission(data.PermissionUsersImpersonate))
+				r.Post("/impersonate/{id}", app.impersonateUserHandler)
+			})
+
+			r.Group(func(r chi.Router) {
+				r.Use(app.RequirePermission(data.PermissionRolesManage))
+				r.Get("/roles", app.listRolesHandler)
+				r.Post("/roles", app.createRoleHandler)
+				r.Get("/roles/{name}", app.getRoleHandler)
+				r.Patch("/roles/{name}", app.updateRoleHandler)
+				r.Delete("/roles/{name}", app.deleteRoleHandler)
+				r.Get("/permissions", app.listPermissionsHandler)
+			})
+
+			r.Group(func(r chi.Router) {
+				r.Use(app.RequirePermission(data.PermissionCurrenciesWrite))
+				r.Get("/currencies", app.GetCurrenciesHandler)
+				r.Post("/currencies", app.InsertCurrencyHandler)
+				r.Get("/currencies/{id}", app.GetCurrencyHandler)
+				r.Patch("/currencies/{id}", app.UpdateCurrencyHandler)
+				r.Delete("/currencies/{id}", app.DeleteCurrencyHandler)
+			})
+
+			r.Group(func(r chi.Router) {
+				r.Use(app.RequirePermission(data.PermissionRecordTypesWrite))
+				r.Get("/recordtypes", app.GetRecordTypesHandler)
+				r.Post("/recordtypes", app.InsertRecordTypeHandler)
+				r.Get("/recordtypes/{id}", app.GetRecordTypeHandler)
+				r.Delete("/recordtypes/{id}", app.DeleteRecordTypeHandler)
+			})
 		})
 	})
 
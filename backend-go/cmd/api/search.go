@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/saiharsha/money-manager/internal/data"
+	jsonhelper "github.com/saiharsha/money-manager/pkg/json"
+	"github.com/saiharsha/money-manager/pkg/validator"
+)
+
+func (app *application) searchHandler(w http.ResponseWriter, r *http.Request) {
+	ledger := app.contextGetLedger(r)
+
+	var v = validator.NewValidator()
+	search := jsonhelper.ReadStringParam(r, "q", "")
+
+	var filters data.Filters
+	filters.Page = jsonhelper.ReadIntParam(r, "page", 1, v)
+	filters.PageSize = jsonhelper.ReadIntParam(r, "page_size", 20, v)
+	filters.StartDate = jsonhelper.ReadTimeParam(r, "start_date", time.Time{}, false, v)
+	filters.EndDate = jsonhelper.ReadTimeParam(r, "end_date", time.Now(), true, v)
+
+	data.ValidateSearch(v, search, filters)
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	results, err := app.models.Search.Search(ledger.ID, search, filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = jsonhelper.WriteJSON(w, http.StatusOK, jsonhelper.Envelope{"metadata": filters.CalculateMetadata(len(results)), "results": results}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/saiharsha/money-manager/internal/data"
+	jsonhelper "github.com/saiharsha/money-manager/pkg/json"
+)
+
+// maxUserAgentLength caps the User-Agent stored with a session.
+const maxUserAgentLength = 512
+
+// startSession records a login of the user from the device of the request.
+// The user is emailed when they log in from a device they never used before.
+func (app *application) startSession(r *http.Request, user *data.User) (*data.Session, error) {
+	userAgent := r.UserAgent()
+	if len(userAgent) > maxUserAgentLength {
+		userAgent = userAgent[:maxUserAgentLength]
+	}
+
+	session := &data.Session{
+		UserID:    user.ID,
+		Device:    deviceName(userAgent),
+		UserAgent: userAgent,
+		IP:        clientIP(r),
+		ExpiresAt: time.Now().Add(data.SessionTTL),
+	}
+
+	isNew, err := app.models.Sessions.IsNewDevice(user.ID, session.Device)
+	if err != nil {
+		return nil, err
+	}
+
+	err = app.models.Sessions.Insert(session)
+	if err != nil {
+		return nil, err
+	}
+
+	if isNew {
+		app.logger.PrintInfo(fmt.Sprintf("user %d logged in from a new device", user.ID), map[string]string{"device": session.Device, "ip": session.IP})
+		app.BackgroundEmailTask(func() {
+			err := app.mailer.SendNewDeviceLoginEmail([]string{user.Email}, user.Name, session.Device, session.IP, session.CreatedAt)
+			if err != nil {
+				app.logger.PrintError(err, map[string]string{
+					"user_email": user.Email,
+					"operation":  "send_new_device_login_email",
+				})
+			}
+		})
+	}
+
+	return session, nil
+}
+
+func (app *application) listSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	sessions, err := app.models.Sessions.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	current := app.contextGetSessionID(r)
+	for _, session := range sessions {
+		session.Current = session.ID == current
+	}
+
+	err = jsonhelper.WriteJSON(w, http.StatusOK, jsonhelper.Envelope{"sessions": sessions}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// revokeSessionHandler signs out one session. Its refresh and access tokens
+// stop working right away.
+func (app *application) revokeSessionHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	id, err := jsonhelper.ReadIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.models.Sessions.Revoke(id, user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.logger.PrintInfo(fmt.Sprintf("user %d signed out session %d", user.ID, id), nil)
+
+	err = jsonhelper.WriteJSON(w, http.StatusOK, jsonhelper.Envelope{"message": "session signed out"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// revokeOtherSessionsHandler signs out every session but the one making the
+// request.
+func (app *application) revokeOtherSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	revoked, err := app.models.Sessions.RevokeAllExcept(user.ID, app.contextGetSessionID(r))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.logger.PrintInfo(fmt.Sprintf("user %d signed out %d other sessions", user.ID, revoked), nil)
+
+	envelope := jsonhelper.Envelope{
+		"message": fmt.Sprintf("%d other sessions signed out", revoked),
+	}
+
+	err = jsonhelper.WriteJSON(w, http.StatusOK, envelope, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// User-Agent tokens of browsers and operating systems, most specific first:
+// Edge and Opera also claim to be Chrome, and Chrome claims to be Safari.
+var (
+	deviceBrowsers = []struct{ token, name string }{
+		{"Edg/", "Edge"},
+		{"OPR/", "Opera"},
+		{"SamsungBrowser/", "Samsung Internet"},
+		{"Firefox/", "Firefox"},
+		{"FxiOS/", "Firefox"},
+		{"CriOS/", "Chrome"},
+		{"Chrome/", "Chrome"},
+		{"Safari/", "Safari"},
+	}
+	deviceSystems = []struct{ token, name string }{
+		{"Windows", "Windows"},
+		{"iPhone", "iOS"},
+		{"iPad", "iPadOS"},
+		{"Android", "Android"},
+		{"CrOS", "ChromeOS"},
+		{"Mac OS X", "macOS"},
+		{"Linux", "Linux"},
+	}
+)
+
+// deviceName describes the browser and operating system of a User-Agent,
+// like "Firefox on Windows". Other clients are named by their first product
+// token, like "curl".
+func deviceName(userAgent string) string {
+	var browser, system string
+
+	for _, b := range deviceBrowsers {
+		if strings.Contains(userAgent, b.token) {
+			browser = b.name
+			break
+		}
+	}
+
+	for _, s := range deviceSystems {
+		if strings.Contains(userAgent, s.token) {
+			system = s.name
+			break
+		}
+	}
+
+	switch {
+	case browser != "" && system != "":
+		return browser + " on " + system
+	case browser != "":
+		return browser
+	}
+
+	product, _, _ := strings.Cut(userAgent, "/")
+	product = strings.TrimSpace(product)
+
+	switch {
+	case product != "" && product != "Mozilla":
+		return product
+	case system != "":
+		return "Browser on " + system
+	default:
+		return "Unknown device"
+	}
+}
@@ -1,43 +1,228 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/base64"
 	"errors"
 	"fmt"
+	"net/http"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/saiharsha/money-manager/internal/data"
+	jsonhelper "github.com/saiharsha/money-manager/pkg/json"
 )
 
 var (
 	ErrInvalidAuthenticationToken = errors.New("invalid or missing authentication token")
 )
 
-func (app *application) CreateToken(u *data.User, ttl time.Duration) (string, error) {
-	expiresAt := time.Now().Add(ttl).Unix()
-	claims := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+// mfaTokenTTL is how long a user has to enter their second factor after the
+// password check.
+const mfaTokenTTL = 5 * time.Minute
+
+// impersonationTokenTTL is how long support can act as a user before they
+// have to start the impersonation again.
+const impersonationTokenTTL = 15 * time.Minute
+
+// CreateToken returns an access token for u that belongs to the session
+// with the id.
+func (app *application) CreateToken(u *data.User, sessionID int64, ttl time.Duration) (string, error) {
+	return app.signToken(sessionClaims(u, sessionID), ttl)
+}
+
+// CreateRefreshToken returns the refresh token of the session with the id.
+// Its typ claim keeps it from being accepted as an access token.
+func (app *application) CreateRefreshToken(u *data.User, sessionID int64) (string, error) {
+	claims := sessionClaims(u, sessionID)
+	claims["typ"] = "refresh"
+	return app.signToken(claims, data.SessionTTL)
+}
+
+func sessionClaims(u *data.User, sessionID int64) jwt.MapClaims {
+	return jwt.MapClaims{
 		"sub":   u.ID,
 		"role":  u.Role,
 		"email": u.Email,
-		"exp":   expiresAt,
-		"iat":   time.Now().Add(ttl).Unix(),
-	})
+		"epoch": u.TokenEpoch,
+		"sid":   sessionID,
+	}
+}
 
-	token, err := claims.SignedString([]byte(app.config.secretKey))
+// CreateImpersonationToken returns an access token for u that also carries
+// the admin acting as them in the act claim. It is never handed out as a
+// refresh token.
+func (app *application) CreateImpersonationToken(u, admin *data.User) (string, error) {
+	return app.signToken(jwt.MapClaims{
+		"sub":   u.ID,
+		"role":  u.Role,
+		"email": u.Email,
+		"epoch": u.TokenEpoch,
+		"act": map[string]interface{}{
+			"sub":   admin.ID,
+			"epoch": admin.TokenEpoch,
+		},
+	}, impersonationTokenTTL)
+}
+
+// CreateMFAToken returns the challenge token handed out when the password
+// was right but the second factor is still missing. It only works on the
+// MFA login endpoint.
+func (app *application) CreateMFAToken(u *data.User) (string, error) {
+	return app.signToken(jwt.MapClaims{
+		"sub": u.ID,
+		"typ": "mfa",
+	}, mfaTokenTTL)
+}
+
+// signToken adds the registered claims and signs the token with the current
+// signing key, or with the HS256 secret key if no keys are configured.
+func (app *application) signToken(claims jwt.MapClaims, ttl time.Duration) (string, error) {
+	jti := make([]byte, 16)
+	_, err := rand.Read(jti)
 	if err != nil {
 		return "", err
 	}
 
-	return token, nil
+	now := time.Now()
+	claims["iss"] = app.config.jwt.issuer
+	claims["aud"] = app.config.jwt.audience
+	claims["iat"] = now.Unix()
+	claims["exp"] = now.Add(ttl).Unix()
+	claims["jti"] = base64.RawURLEncoding.EncodeToString(jti)
+
+	key := app.keys.Signing()
+	if key == nil {
+		return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(app.config.secretKey))
+	}
+
+	token := jwt.NewWithClaims(key.Method, claims)
+	token.Header["kid"] = key.ID
+
+	return token.SignedString(key.Private)
 }
 
-func (app *application) VerifyToken(tokenString string) (*data.User, error) {
-	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+// tokenClaims is what an access or refresh token says about its holder.
+type tokenClaims struct {
+	user *data.User
+	// sessionID is 0 for impersonation tokens and for tokens issued before
+	// sessions were tracked.
+	sessionID int64
+	// admin is the admin acting as user, for impersonation tokens only.
+	admin *data.User
+}
+
+// VerifyRefreshToken checks a token from CreateRefreshToken. Access and
+// impersonation tokens are refused, so they cannot be exchanged for a
+// regular session.
+func (app *application) VerifyRefreshToken(tokenString string) (*tokenClaims, error) {
+	claims, err := app.parseToken(tokenString)
+	if err != nil {
+		return nil, err
+	}
+
+	if claims["typ"] != "refresh" {
+		return nil, ErrInvalidAuthenticationToken
+	}
+
+	if _, ok := claims["act"]; ok {
+		return nil, ErrInvalidAuthenticationToken
+	}
+
+	return userClaims(claims)
+}
+
+// verifyAccessToken checks a token from CreateToken or
+// CreateImpersonationToken.
+func (app *application) verifyAccessToken(tokenString string) (*tokenClaims, error) {
+	claims, err := app.parseToken(tokenString)
+	if err != nil {
+		return nil, err
+	}
+
+	// refresh and challenge tokens must not be accepted in place of an
+	// access token
+	if _, ok := claims["typ"]; ok {
+		return nil, ErrInvalidAuthenticationToken
+	}
+
+	result, err := userClaims(claims)
+	if err != nil {
+		return nil, err
+	}
+
+	if act, ok := claims["act"]; ok {
+		act, ok := act.(map[string]interface{})
+		if !ok {
+			return nil, ErrInvalidAuthenticationToken
 		}
-		return []byte(app.config.secretKey), nil
-	})
+
+		sub, ok := act["sub"].(float64)
+		if !ok {
+			return nil, ErrInvalidAuthenticationToken
+		}
+
+		epoch, _ := act["epoch"].(float64)
+
+		result.admin = &data.User{
+			ID:         int64(sub),
+			TokenEpoch: int(epoch),
+		}
+	}
+
+	return result, nil
+}
+
+// userClaims reads the holder and session of an access or refresh token.
+func userClaims(claims jwt.MapClaims) (*tokenClaims, error) {
+	sub, ok := claims["sub"].(float64)
+	if !ok {
+		return nil, ErrInvalidAuthenticationToken
+	}
+
+	// tokens from before epochs were introduced have none and count as 0
+	epoch, _ := claims["epoch"].(float64)
+	sid, _ := claims["sid"].(float64)
+
+	return &tokenClaims{
+		user: &data.User{
+			ID:         int64(sub),
+			Email:      fmt.Sprint(claims["email"]),
+			Role:       fmt.Sprint(claims["role"]),
+			TokenEpoch: int(epoch),
+		},
+		sessionID: int64(sid),
+	}, nil
+}
+
+// VerifyMFAToken checks a challenge token from CreateMFAToken and returns
+// the id of the user it was issued to.
+func (app *application) VerifyMFAToken(tokenString string) (int64, error) {
+	claims, err := app.parseToken(tokenString)
+	if err != nil {
+		return 0, err
+	}
+
+	if claims["typ"] != "mfa" {
+		return 0, ErrInvalidAuthenticationToken
+	}
+
+	sub, ok := claims["sub"].(float64)
+	if !ok {
+		return 0, ErrInvalidAuthenticationToken
+	}
+
+	return int64(sub), nil
+}
+
+func (app *application) parseToken(tokenString string) (jwt.MapClaims, error) {
+	token, err := jwt.Parse(tokenString, app.verificationKey,
+		jwt.WithValidMethods([]string{"RS256", "EdDSA", "HS256"}),
+		jwt.WithIssuer(app.config.jwt.issuer),
+		jwt.WithAudience(app.config.jwt.audience),
+		jwt.WithIssuedAt(),
+		jwt.WithExpirationRequired(),
+	)
 
 	if err != nil {
 		return nil, err
@@ -52,11 +237,41 @@ func (app *application) VerifyToken(tokenString string) (*data.User, error) {
 		return nil, fmt.Errorf("invalid token claims")
 	}
 
-	user := &data.User{
-		ID:    int64(claims["sub"].(float64)),
-		Email: fmt.Sprint(claims["email"]),
-		Role:  fmt.Sprint(claims["role"]),
+	return claims, nil
+}
+
+// verificationKey picks the key for a token by its kid header. HS256 tokens
+// are only accepted while no keys are configured, or during the migration
+// to keys when jwt-accept-hs256 is set.
+func (app *application) verificationKey(token *jwt.Token) (interface{}, error) {
+	if _, ok := token.Method.(*jwt.SigningMethodHMAC); ok {
+		if !app.keys.Empty() && !app.config.jwt.acceptHS256 {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return []byte(app.config.secretKey), nil
+	}
+
+	kid, _ := token.Header["kid"].(string)
+
+	key, err := app.keys.Lookup(kid)
+	if err != nil {
+		return nil, err
+	}
+
+	if key.Method.Alg() != token.Method.Alg() {
+		return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
 	}
 
-	return user, nil
+	return key.Public, nil
+}
+
+// jwksHandler publishes the public keys so other services can verify our
+// tokens. It is empty while tokens are signed with the HS256 secret key.
+func (app *application) jwksHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+
+	err := jsonhelper.WriteJSON(w, http.StatusOK, jsonhelper.Envelope{"keys": app.keys.JWKS()}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
 }
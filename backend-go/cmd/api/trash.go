@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/saiharsha/money-manager/internal/data"
+	jsonhelper "github.com/saiharsha/money-manager/pkg/json"
+	"github.com/saiharsha/money-manager/pkg/validator"
+)
+
+func (app *application) listTrashHandler(w http.ResponseWriter, r *http.Request) {
+	ledger := app.contextGetLedger(r)
+
+	records, comments, err := app.models.Trash.GetAllForLedger(ledger.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	envelope := jsonhelper.Envelope{
+		"records":        records,
+		"comments":       comments,
+		"retention_days": int(app.config.trash.retention.Hours() / 24),
+	}
+
+	err = jsonhelper.WriteJSON(w, http.StatusOK, envelope, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) restoreTrashHandler(w http.ResponseWriter, r *http.Request) {
+	ledger := app.contextGetLedger(r)
+
+	id, err := jsonhelper.ReadIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	v := validator.NewValidator()
+	kind := jsonhelper.ReadStringParam(r, "kind", "record")
+	v.Check(validator.In(kind, "record", "comment"), "kind", "must be record or comment")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	switch kind {
+	case "comment":
+		err = app.models.Trash.RestoreComment(id, ledger.ID, app.auditSource(r))
+	default:
+		err = app.models.Trash.RestoreRecord(id, ledger.ID, app.auditSource(r))
+	}
+
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		case errors.Is(err, data.ErrTrashedParent):
+			v.AddError("record_id", "the comment's record is in the trash, restore the record first")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = jsonhelper.WriteJSON(w, http.StatusOK, jsonhelper.Envelope{"message": kind + " restored from trash"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
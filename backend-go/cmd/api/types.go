@@ -37,7 +37,7 @@ func (app *application) InsertRecordTypeHandler(w http.ResponseWriter, r *http.R
 
 	v := validator.NewValidator()
 
-	err = app.models.RecordTypes.Insert(&recordtype)
+	err = app.models.RecordTypes.Insert(&recordtype, app.auditSource(r))
 	if err != nil {
 		app.logger.PrintDebug("error while inserting data", nil)
 		if errors.Is(err, data.ErrDuplicateCurrency) {
@@ -66,7 +66,7 @@ func (app *application) DeleteRecordTypeHandler(w http.ResponseWriter, r *http.R
 		return
 	}
 
-	err = app.models.RecordTypes.Delete(id)
+	err = app.models.RecordTypes.Delete(id, app.auditSource(r))
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/go-chi/chi/v5"
@@ -60,13 +61,13 @@ func (app *application) UserSignUp(w http.ResponseWriter, r *http.Request) {
 	}
 	app.logger.PrintInfo(fmt.Sprintf("user %v has been created in database", user.Name), nil)
 
-	token, err := app.CreateToken(user, 3*24*time.Hour)
+	token, err := app.models.Tokens.New(user.ID, user.Email, data.ActivationTokenTTL, data.TokenScopeActivation)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	verifyLink := fmt.Sprintf("http://%s:%d/users/verify/%s", app.config.host, app.config.port, token)
+	verifyLink := fmt.Sprintf("http://%s:%d/users/verify/%s", app.config.host, app.config.port, token.Plaintext)
 
 	app.BackgroundEmailTask(func() {
 		err := app.mailer.SendWelcomeEmail([]string{user.Email}, user.Name, verifyLink)
@@ -107,11 +108,21 @@ func (app *application) UserLogin(w http.ResponseWriter, r *http.Request) {
 
 	app.logger.PrintInfo(fmt.Sprintf("email %v has passed intial validation", userdetails.Email), nil)
 
+	ip := clientIP(r)
+	if retryAfter, blocked := app.logins.blocked(ip); blocked {
+		app.tooManyAttemptsResponse(w, r, retryAfter)
+		return
+	}
+
+	// Unknown emails, locked accounts and wrong passwords all get the same
+	// response, so the endpoint cannot be used to find out who has an account.
 	user, err := app.models.Users.GetUserByMail(userdetails.Email)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
-			app.usernotFound(w, r)
+			data.SimulatePasswordCheck(userdetails.Password)
+			app.logins.fail(ip)
+			app.invalidCredentialsResponse(w, r)
 		default:
 			app.serverErrorResponse(w, r, err)
 		}
@@ -125,12 +136,127 @@ func (app *application) UserLogin(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if !matches {
+		app.logins.fail(ip)
+
+		err = app.recordFailedLogin(user, ip)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
 		app.invalidCredentialsResponse(w, r)
 		return
 	}
 
+	// checked before the failures are cleared, so the right password does not
+	// lift a lock
+	if !app.loginAllowed(w, r, user) {
+		return
+	}
+
+	// with two-factor authentication the failures are only cleared once the
+	// second factor is checked too, or the password alone would reset the
+	// count of wrong codes
+	if user.FailedLogins > 0 && !user.MFAEnabled {
+		err = app.models.Users.Unlock(user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
 	app.logger.PrintDebug(fmt.Sprintf("user %v has passed password validation", user.Name), nil)
-	accesstoken, err := app.CreateToken(user, 1*time.Hour)
+
+	app.completeLogin(w, r, user)
+}
+
+// recordFailedLogin counts a wrong password or second factor against the
+// user and emails them when it locks the account.
+func (app *application) recordFailedLogin(user *data.User, ip string) error {
+	failures, lockedUntil, err := app.models.Users.RecordFailedLogin(user.ID)
+	if err != nil {
+		return err
+	}
+
+	// only the failure that first locks the account sends an email
+	if failures == data.LockoutThreshold && lockedUntil != nil {
+		app.logger.PrintInfo(fmt.Sprintf("user %v locked after %d failed logins", user.ID, failures), map[string]string{"ip": ip})
+		app.BackgroundEmailTask(func() {
+			err := app.mailer.SendAccountLockedEmail([]string{user.Email}, user.Name, *lockedUntil)
+			if err != nil {
+				app.logger.PrintError(err, map[string]string{
+					"user_email": user.Email,
+					"operation":  "send_account_locked_email",
+				})
+			}
+		})
+	}
+
+	return nil
+}
+
+// completeLogin is called once the user proved who they are, with a
+// password or through an identity provider. Users with two-factor
+// authentication get a challenge token, everyone else a session.
+func (app *application) completeLogin(w http.ResponseWriter, r *http.Request, user *data.User) {
+	if !app.loginAllowed(w, r, user) {
+		return
+	}
+
+	if user.MFAEnabled {
+		mfatoken, err := app.CreateMFAToken(user)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		envelope := jsonhelper.Envelope{
+			"mfa_required": true,
+			"mfa_token":    mfatoken,
+		}
+
+		err = jsonhelper.WriteJSON(w, http.StatusAccepted, envelope, nil)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.issueSession(w, r, user)
+}
+
+// loginAllowed refuses logins to locked and suspended accounts and to
+// accounts that must reset their password first. Every way of logging in
+// goes through it. It writes the error response itself and
+// reports whether the login may go on.
+func (app *application) loginAllowed(w http.ResponseWriter, r *http.Request, user *data.User) bool {
+	switch {
+	case user.IsLocked():
+		// the same answer as a wrong password, so guessing does not reveal
+		// the lock
+		app.invalidCredentialsResponse(w, r)
+		return false
+	case user.SuspendedAt != nil:
+		app.accountSuspendedResponse(w, r)
+		return false
+	case user.PasswordResetRequired:
+		app.passwordResetRequiredResponse(w, r)
+		return false
+	}
+
+	return true
+}
+
+// issueSession completes a login: it sets the refresh token cookie and
+// responds with an access token for the user.
+func (app *application) issueSession(w http.ResponseWriter, r *http.Request, user *data.User) {
+	session, err := app.startSession(r, user)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	accesstoken, err := app.CreateToken(user, session.ID, 1*time.Hour)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
@@ -138,7 +264,7 @@ func (app *application) UserLogin(w http.ResponseWriter, r *http.Request) {
 
 	app.logger.PrintDebug(fmt.Sprintf("user %v got the access token", user.Name), nil)
 
-	refreshtoken, err := app.CreateToken(user, 10*24*time.Hour)
+	refreshtoken, err := app.CreateRefreshToken(user, session.ID)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
@@ -150,7 +276,7 @@ func (app *application) UserLogin(w http.ResponseWriter, r *http.Request) {
 		Path:     "/",
 		HttpOnly: true,
 		Secure:   true,
-		MaxAge:   int((10 * 24 * time.Hour).Seconds()),
+		MaxAge:   int(data.SessionTTL.Seconds()),
 	}
 	http.SetCookie(w, &cookie)
 
@@ -167,6 +293,18 @@ func (app *application) UserLogin(w http.ResponseWriter, r *http.Request) {
 }
 
 func (app *application) UserSignOut(w http.ResponseWriter, r *http.Request) {
+	// end the session of the refresh token, if it is still valid
+	if cookie, err := r.Cookie("refreshtoken"); err == nil {
+		claims, err := app.VerifyRefreshToken(cookie.Value)
+		if err == nil && claims.sessionID != 0 {
+			err = app.models.Sessions.Revoke(claims.sessionID, claims.user.ID)
+			if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+		}
+	}
+
 	http.SetCookie(w, &http.Cookie{
 		Name:     "refreshtoken",
 		Value:    "",
@@ -199,7 +337,7 @@ func (app *application) UserRefresh(w http.ResponseWriter, r *http.Request) {
 
 	tokenString := cookie.Value
 
-	user, err := app.VerifyToken(tokenString)
+	claims, err := app.VerifyRefreshToken(tokenString)
 	if err != nil {
 		switch {
 		case errors.Is(err, ErrInvalidAuthenticationToken):
@@ -210,7 +348,37 @@ func (app *application) UserRefresh(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	accesstoken, err := app.CreateToken(user, 1*time.Hour)
+	// load the user to pick up changes to the role or email since login
+	user, err := app.models.Users.GetUserByID(claims.user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if claims.user.TokenEpoch != user.TokenEpoch {
+		app.invalidAuthenticationTokenResponse(w, r)
+		return
+	}
+
+	if claims.sessionID != 0 {
+		_, err = app.models.Sessions.Seen(claims.sessionID, user.ID, clientIP(r))
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				app.invalidAuthenticationTokenResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+	}
+
+	accesstoken, err := app.CreateToken(user, claims.sessionID, 1*time.Hour)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
@@ -226,29 +394,63 @@ func (app *application) UserRefresh(w http.ResponseWriter, r *http.Request) {
 func (app *application) UserVerify(w http.ResponseWriter, r *http.Request) {
 	token := chi.URLParam(r, "token")
 
-	app.logger.PrintInfo(fmt.Sprintf("token %v has been received", token), nil)
+	v := validator.NewValidator()
 
-	userdetails, err := app.VerifyToken(token)
+	t, err := app.models.Tokens.Use(data.TokenScopeActivation, token)
 	if err != nil {
-		app.serverErrorResponse(w, r, err)
+		switch {
+		case errors.Is(err, data.ErrExpiredToken):
+			v.AddError("token", "the verification link has expired, please request a new one")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or already used verification link")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
 		return
 	}
 
-	app.logger.PrintInfo(fmt.Sprintf("user %v has been verified", userdetails.Email), nil)
-
-	user, err := app.models.Users.GetUserByMail(userdetails.Email)
+	user, err := app.models.Users.GetUserByID(t.UserID)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
-			app.usernotFound(w, r)
+			v.AddError("token", "invalid or already used verification link")
+			app.failedValidationResponse(w, r, v.Errors)
 		default:
 			app.serverErrorResponse(w, r, err)
 		}
 		return
 	}
 
+	// the link verifies the address it was sent to, not a later one
+	if t.Email != user.Email {
+		v.AddError("token", "invalid or already used verification link")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	if user.Activated {
+		v.AddError("token", "this account has already been verified")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	app.logger.PrintInfo(fmt.Sprintf("user %v has been verified", user.Email), nil)
+
 	user.Activated = true
 	_, err = app.models.Users.UpdateUser(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.models.Tokens.DeleteAllForUser(data.TokenScopeActivation, user.ID)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
@@ -277,3 +479,77 @@ func (app *application) UserVerify(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 }
+
+// UserVerifyResend sends a new verification link. It answers the same way
+// whether or not the email belongs to an unverified account.
+func (app *application) UserVerifyResend(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email string `json:"email"`
+	}
+
+	err := jsonhelper.ReadJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.NewValidator()
+	data.ValidateEmail(v, input.Email)
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	if retryAfter, ok := app.limits.verifyResendByIP.allow(clientIP(r)); !ok {
+		app.tooManyAttemptsResponse(w, r, retryAfter)
+		return
+	}
+
+	if retryAfter, ok := app.limits.verifyResendByEmail.allow(strings.ToLower(input.Email)); !ok {
+		app.tooManyAttemptsResponse(w, r, retryAfter)
+		return
+	}
+
+	user, err := app.models.Users.GetUserByMail(input.Email)
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if user != nil && !user.Activated {
+		// only the newest link works
+		err = app.models.Tokens.DeleteAllForUser(data.TokenScopeActivation, user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		token, err := app.models.Tokens.New(user.ID, user.Email, data.ActivationTokenTTL, data.TokenScopeActivation)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		verifyLink := fmt.Sprintf("http://%s:%d/users/verify/%s", app.config.host, app.config.port, token.Plaintext)
+
+		app.BackgroundEmailTask(func() {
+			err := app.mailer.SendVerifyLinkEmail([]string{user.Email}, user.Name, verifyLink)
+			if err != nil {
+				app.logger.PrintError(err, map[string]string{
+					"user_email": user.Email,
+					"operation":  "send_verify_link_email",
+				})
+			}
+		})
+	}
+
+	envelope := jsonhelper.Envelope{
+		"message": "if an unverified account uses this email, a new verification link has been sent",
+	}
+
+	err = jsonhelper.WriteJSON(w, http.StatusAccepted, envelope, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
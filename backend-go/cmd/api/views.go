@@ -0,0 +1,393 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/saiharsha/money-manager/internal/data"
+	jsonhelper "github.com/saiharsha/money-manager/pkg/json"
+	"github.com/saiharsha/money-manager/pkg/validator"
+)
+
+func (app *application) listViewsHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	views, err := app.models.Views.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = jsonhelper.WriteJSON(w, http.StatusOK, jsonhelper.Envelope{"views": views}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) createViewHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	var input struct {
+		Name   string         `json:"name"`
+		Query  data.ViewQuery `json:"query"`
+		Pinned bool           `json:"pinned"`
+	}
+
+	err := jsonhelper.ReadJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	view := &data.SavedView{
+		UserID: user.ID,
+		Name:   input.Name,
+		Query:  input.Query,
+		Pinned: input.Pinned,
+	}
+
+	v := validator.NewValidator()
+	data.ValidateSavedView(v, view)
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Views.Insert(view)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateView):
+			v.AddError("name", "a view with this name already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = jsonhelper.WriteJSON(w, http.StatusCreated, jsonhelper.Envelope{"view": view}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) getViewHandler(w http.ResponseWriter, r *http.Request) {
+	view, ok := app.readViewForUser(w, r)
+	if !ok {
+		return
+	}
+
+	err := jsonhelper.WriteJSON(w, http.StatusOK, jsonhelper.Envelope{"view": view}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) updateViewHandler(w http.ResponseWriter, r *http.Request) {
+	view, ok := app.readViewForUser(w, r)
+	if !ok {
+		return
+	}
+
+	if view.Shared {
+		app.notPermittedResponse(w, r)
+		return
+	}
+
+	var input struct {
+		Name  *string         `json:"name"`
+		Query *data.ViewQuery `json:"query"`
+	}
+
+	err := jsonhelper.ReadJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if input.Name != nil {
+		view.Name = *input.Name
+	}
+	if input.Query != nil {
+		view.Query = *input.Query
+	}
+
+	v := validator.NewValidator()
+	data.ValidateSavedView(v, view)
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Views.Update(view)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateView):
+			v.AddError("name", "a view with this name already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = jsonhelper.WriteJSON(w, http.StatusOK, jsonhelper.Envelope{"view": view}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteViewHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	id, err := jsonhelper.ReadIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.models.Views.Delete(id, user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = jsonhelper.WriteJSON(w, http.StatusOK, jsonhelper.Envelope{"message": "view successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// viewRecordsHandler executes a saved view. The owner runs it against the
+// active ledger; a user it was shared with runs it against the owner's
+// personal ledger, so they see the same records the owner sees there.
+func (app *application) viewRecordsHandler(w http.ResponseWriter, r *http.Request) {
+	view, ok := app.readViewForUser(w, r)
+	if !ok {
+		return
+	}
+
+	ledger := app.contextGetLedger(r)
+	if view.UserID != app.contextGetUser(r).ID {
+		var err error
+		ledger, err = app.models.Ledgers.GetPersonal(view.UserID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	var v = validator.NewValidator()
+	var filters data.Filters
+	filters.Page = jsonhelper.ReadIntParam(r, "page", 1, v)
+	filters.PageSize = jsonhelper.ReadIntParam(r, "page_size", 20, v)
+	view.Query.Apply(v, &filters, time.Now())
+
+	data.ValidateFilters(v, filters)
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	records, err := app.models.Records.GetAllForLedger(ledger.ID, filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = jsonhelper.WriteJSON(w, http.StatusOK, jsonhelper.Envelope{"view": view, "metadata": filters.CalculateMetadata(len(records)), "records": records}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) pinViewHandler(w http.ResponseWriter, r *http.Request) {
+	app.setViewPinned(w, r, true)
+}
+
+func (app *application) unpinViewHandler(w http.ResponseWriter, r *http.Request) {
+	app.setViewPinned(w, r, false)
+}
+
+func (app *application) setViewPinned(w http.ResponseWriter, r *http.Request, pinned bool) {
+	user := app.contextGetUser(r)
+
+	id, err := jsonhelper.ReadIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.models.Views.SetPinned(id, user.ID, pinned)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	view, err := app.models.Views.GetForUser(id, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = jsonhelper.WriteJSON(w, http.StatusOK, jsonhelper.Envelope{"view": view}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) shareViewHandler(w http.ResponseWriter, r *http.Request) {
+	view, ok := app.readViewForUser(w, r)
+	if !ok {
+		return
+	}
+
+	if view.Shared {
+		app.notPermittedResponse(w, r)
+		return
+	}
+
+	var input struct {
+		Email string `json:"email"`
+	}
+
+	err := jsonhelper.ReadJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.NewValidator()
+	data.ValidateEmail(v, input.Email)
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// the answer is the same whether or not someone uses the address, so
+	// sharing cannot be used to find out who has an account
+	recipient, err := app.models.Users.GetUserByMail(input.Email)
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if recipient != nil && recipient.ID == view.UserID {
+		v.AddError("email", "a view cannot be shared with its owner")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	if recipient != nil {
+		err = app.models.Views.Share(view.ID, view.UserID, recipient.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	err = jsonhelper.WriteJSON(w, http.StatusOK, jsonhelper.Envelope{"message": "the view is shared if a user with this email address exists"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// listViewSharesHandler lists who the owner shared the view with, e.g. to
+// find the user id for unsharing it.
+func (app *application) listViewSharesHandler(w http.ResponseWriter, r *http.Request) {
+	view, ok := app.readViewForUser(w, r)
+	if !ok {
+		return
+	}
+
+	if view.Shared {
+		app.notPermittedResponse(w, r)
+		return
+	}
+
+	shares, err := app.models.Views.GetShares(view.ID, view.UserID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = jsonhelper.WriteJSON(w, http.StatusOK, jsonhelper.Envelope{"shares": shares}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) unshareViewHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	id, err := jsonhelper.ReadIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	recipientID, err := jsonhelper.ReadIDURLParam(r, "userID")
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.models.Views.Unshare(id, user.ID, recipientID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = jsonhelper.WriteJSON(w, http.StatusOK, jsonhelper.Envelope{"message": "view no longer shared"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// readViewForUser loads the view named by the id URL parameter if the current
+// user owns it or it has been shared with them. It writes the error response
+// itself and reports whether the handler should continue.
+func (app *application) readViewForUser(w http.ResponseWriter, r *http.Request) (*data.SavedView, bool) {
+	user := app.contextGetUser(r)
+
+	id, err := jsonhelper.ReadIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+
+	view, err := app.models.Views.GetForUser(id, user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+
+	return view, true
+}
@@ -0,0 +1,246 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/saiharsha/money-manager/pkg/validator"
+)
+
+// AccessTokenPrefix starts every personal access token, so they are easy to
+// tell apart from JWTs and to find when leaked.
+const AccessTokenPrefix = "mm_pat_"
+
+// Scopes limit what a personal access token can do. A write scope includes
+// the read scope of the same resource.
+const (
+	ScopeRecordsRead  = "records:read"
+	ScopeRecordsWrite = "records:write"
+	ScopeReportsRead  = "reports:read"
+	ScopeGroupsRead   = "groups:read"
+	ScopeGroupsWrite  = "groups:write"
+	ScopeLedgersRead  = "ledgers:read"
+	ScopeLedgersWrite = "ledgers:write"
+	ScopeViewsRead    = "views:read"
+	ScopeViewsWrite   = "views:write"
+)
+
+var Scopes = []string{
+	ScopeRecordsRead,
+	ScopeRecordsWrite,
+	ScopeReportsRead,
+	ScopeGroupsRead,
+	ScopeGroupsWrite,
+	ScopeLedgersRead,
+	ScopeLedgersWrite,
+	ScopeViewsRead,
+	ScopeViewsWrite,
+}
+
+var (
+	ErrDuplicateTokenName = errors.New("duplicate token name")
+)
+
+type AccessTokenModel struct {
+	DB       *sql.DB
+	InfoLog  *log.Logger
+	ErrorLog *log.Logger
+}
+
+// AccessToken is a named, long lived token for scripts. Only its hash is
+// stored; Token holds the plaintext right after creation and is empty
+// otherwise.
+type AccessToken struct {
+	ID         int64      `json:"id"`
+	UserID     int64      `json:"user_id"`
+	Name       string     `json:"name"`
+	Token      string     `json:"token,omitempty"`
+	Scopes     []string   `json:"scopes"`
+	Expiry     *time.Time `json:"expiry,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+func (m *AccessTokenModel) Insert(token *AccessToken) error {
+	b := make([]byte, 20)
+	_, err := rand.Read(b)
+	if err != nil {
+		return err
+	}
+
+	plaintext := AccessTokenPrefix + strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b))
+	hash := sha256.Sum256([]byte(plaintext))
+
+	query := `
+		INSERT INTO access_tokens (user_id, name, token_hash, scopes, expiry)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, created_at
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	args := []interface{}{token.UserID, token.Name, hash[:], pq.Array(token.Scopes), token.Expiry}
+
+	err = m.DB.QueryRowContext(ctx, query, args...).Scan(&token.ID, &token.CreatedAt)
+	if err != nil {
+		switch {
+		case err.Error() == `pq: duplicate key value violates unique constraint "access_tokens_user_id_name_key"`:
+			return ErrDuplicateTokenName
+		default:
+			m.ErrorLog.Print(err)
+			return err
+		}
+	}
+
+	token.Token = plaintext
+
+	return nil
+}
+
+func (m *AccessTokenModel) GetAllForUser(userID int64) ([]*AccessToken, error) {
+	query := `
+		SELECT id, user_id, name, scopes, expiry, last_used_at, created_at
+		FROM access_tokens
+		WHERE user_id = $1
+		ORDER BY created_at DESC, id DESC
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		m.ErrorLog.Print(err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := make([]*AccessToken, 0)
+	for rows.Next() {
+		var token AccessToken
+		err := rows.Scan(&token.ID, &token.UserID, &token.Name, pq.Array(&token.Scopes), &token.Expiry, &token.LastUsedAt, &token.CreatedAt)
+		if err != nil {
+			m.ErrorLog.Print(err)
+			return nil, err
+		}
+		tokens = append(tokens, &token)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return tokens, nil
+}
+
+func (m *AccessTokenModel) Delete(id int64, userID int64) error {
+	query := `
+		DELETE FROM access_tokens
+		WHERE id = $1 AND user_id = $2
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id, userID)
+	if err != nil {
+		m.ErrorLog.Print(err)
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// GetForToken looks up an unexpired token by its plaintext and returns it
+// with its user. It records the use, at most once a minute per token.
+func (m *AccessTokenModel) GetForToken(plaintext string) (*AccessToken, *User, error) {
+	hash := sha256.Sum256([]byte(plaintext))
+
+	query := `
+		SELECT t.id, t.user_id, t.name, t.scopes, t.expiry, t.last_used_at, t.created_at,
+			u.id, u.email, u.role
+		FROM access_tokens t
+		INNER JOIN users u ON u.id = t.user_id
+		WHERE t.token_hash = $1 AND (t.expiry IS NULL OR t.expiry > NOW()) AND u.suspended_at IS NULL
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var token AccessToken
+	var user User
+
+	err := m.DB.QueryRowContext(ctx, query, hash[:]).Scan(
+		&token.ID,
+		&token.UserID,
+		&token.Name,
+		pq.Array(&token.Scopes),
+		&token.Expiry,
+		&token.LastUsedAt,
+		&token.CreatedAt,
+		&user.ID,
+		&user.Email,
+		&user.Role,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, nil, ErrRecordNotFound
+		default:
+			m.ErrorLog.Print(err)
+			return nil, nil, err
+		}
+	}
+
+	if token.LastUsedAt == nil || time.Since(*token.LastUsedAt) > time.Minute {
+		_, err = m.DB.ExecContext(ctx, `UPDATE access_tokens SET last_used_at = NOW() WHERE id = $1`, token.ID)
+		if err != nil {
+			m.ErrorLog.Print(err)
+			return nil, nil, err
+		}
+	}
+
+	return &token, &user, nil
+}
+
+// HasScope reports whether scopes grant scope, counting a write scope as
+// granting the read scope of the same resource.
+func HasScope(scopes []string, scope string) bool {
+	if validator.In(scope, scopes...) {
+		return true
+	}
+
+	resource, action, ok := strings.Cut(scope, ":")
+	return ok && action == "read" && validator.In(resource+":write", scopes...)
+}
+
+func ValidateAccessToken(v *validator.Validator, token *AccessToken) {
+	v.Check(strings.TrimSpace(token.Name) != "", "name", "must be provided")
+	v.Check(len(token.Name) <= 100, "name", "must be at most 100 characters long")
+	v.Check(len(token.Scopes) > 0, "scopes", "must contain at least one scope")
+	v.Check(validator.Unique(token.Scopes), "scopes", "must not contain duplicate values")
+	for _, scope := range token.Scopes {
+		v.Check(validator.In(scope, Scopes...), "scopes", "must only contain "+strings.Join(Scopes, ", "))
+	}
+	if token.Expiry != nil {
+		v.Check(token.Expiry.After(time.Now()), "expiry", "must be in the future")
+	}
+}
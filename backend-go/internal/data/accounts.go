@@ -0,0 +1,432 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"time"
+)
+
+type AccountModel struct {
+	DB       *sql.DB
+	InfoLog  *log.Logger
+	ErrorLog *log.Logger
+}
+
+// AccountExport is the personal data of a user that is not already covered
+// by the other models: the records they added, comments on those records and
+// linked OpenID Connect identities.
+type AccountExport struct {
+	Records    []*ExportedRecord   `json:"records"`
+	Comments   []*ExportedComment  `json:"comments"`
+	Identities []*ExportedIdentity `json:"identities"`
+}
+
+type ExportedRecord struct {
+	ID          int64      `json:"id"`
+	LedgerID    int64      `json:"ledger_id"`
+	Ledger      string     `json:"ledger"`
+	Amount      int64      `json:"amount"`
+	Currency    string     `json:"currency"`
+	Type        string     `json:"type"`
+	Description string     `json:"description"`
+	OccurredAt  time.Time  `json:"occurred_at"`
+	HasTime     bool       `json:"has_time"`
+	Timezone    string     `json:"timezone"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+	DeletedAt   *time.Time `json:"deleted_at,omitempty"`
+}
+
+type ExportedComment struct {
+	ID          int64      `json:"id"`
+	RecordID    int64      `json:"record_id"`
+	Description string     `json:"description"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+	DeletedAt   *time.Time `json:"deleted_at,omitempty"`
+}
+
+type ExportedIdentity struct {
+	Issuer    string    `json:"issuer"`
+	Subject   string    `json:"subject"`
+	Email     string    `json:"email"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Export reads the user's records, comments and identities from one snapshot
+// of the database. Trashed records and comments are included as they are
+// still stored.
+func (m *AccountModel) Export(userID int64) (*AccountExport, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	export := &AccountExport{
+		Records:    make([]*ExportedRecord, 0),
+		Comments:   make([]*ExportedComment, 0),
+		Identities: make([]*ExportedIdentity, 0),
+	}
+
+	query := `
+		SELECT r.id, r.ledger_id, l.name, r.amount, c.name, t.name, coalesce(r.description, ''),
+			r.occurred_at, r.has_time, r.timezone, r.created_at, r.updated_at, r.deleted_at
+		FROM records r
+		INNER JOIN ledgers l ON l.id = r.ledger_id
+		INNER JOIN currencies c ON c.id = r.currency_id
+		INNER JOIN types t ON t.id = r.type_id
+		WHERE r.user_id = $1
+		ORDER BY r.occurred_at ASC, r.id ASC
+	`
+
+	rows, err := tx.QueryContext(ctx, query, userID)
+	if err != nil {
+		m.ErrorLog.Print(err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var record ExportedRecord
+		err := rows.Scan(&record.ID, &record.LedgerID, &record.Ledger, &record.Amount, &record.Currency, &record.Type, &record.Description,
+			&record.OccurredAt, &record.HasTime, &record.Timezone, &record.CreatedAt, &record.UpdatedAt, &record.DeletedAt)
+		if err != nil {
+			m.ErrorLog.Print(err)
+			return nil, err
+		}
+		export.Records = append(export.Records, &record)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	query = `
+		SELECT c.id, c.record_id, c.description, c.created_at, c.updated_at, c.deleted_at
+		FROM comments c
+		INNER JOIN records r ON r.id = c.record_id
+		WHERE r.user_id = $1
+		ORDER BY c.record_id ASC, c.id ASC
+	`
+
+	rows, err = tx.QueryContext(ctx, query, userID)
+	if err != nil {
+		m.ErrorLog.Print(err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var comment ExportedComment
+		err := rows.Scan(&comment.ID, &comment.RecordID, &comment.Description, &comment.CreatedAt, &comment.UpdatedAt, &comment.DeletedAt)
+		if err != nil {
+			m.ErrorLog.Print(err)
+			return nil, err
+		}
+		export.Comments = append(export.Comments, &comment)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	query = `
+		SELECT issuer, subject, email, created_at
+		FROM user_identities
+		WHERE user_id = $1
+		ORDER BY id ASC
+	`
+
+	rows, err = tx.QueryContext(ctx, query, userID)
+	if err != nil {
+		m.ErrorLog.Print(err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var identity ExportedIdentity
+		err := rows.Scan(&identity.Issuer, &identity.Subject, &identity.Email, &identity.CreatedAt)
+		if err != nil {
+			m.ErrorLog.Print(err)
+			return nil, err
+		}
+		export.Identities = append(export.Identities, &identity)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return export, nil
+}
+
+// ScheduleDeletion marks the account for deletion at the given time. An
+// earlier schedule is kept.
+func (m *AccountModel) ScheduleDeletion(userID int64, at time.Time) (time.Time, error) {
+	query := `
+		UPDATE users
+		SET delete_after = coalesce(delete_after, $2)
+		WHERE id = $1
+		RETURNING delete_after
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var deleteAfter time.Time
+
+	err := m.DB.QueryRowContext(ctx, query, userID, at).Scan(&deleteAfter)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return time.Time{}, ErrRecordNotFound
+		default:
+			m.ErrorLog.Print(err)
+			return time.Time{}, err
+		}
+	}
+
+	return deleteAfter, nil
+}
+
+// CancelDeletion keeps the account. It does nothing if no deletion is
+// scheduled.
+func (m *AccountModel) CancelDeletion(userID int64) error {
+	query := `
+		UPDATE users
+		SET delete_after = NULL
+		WHERE id = $1
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID)
+	if err != nil {
+		m.ErrorLog.Print(err)
+		return err
+	}
+
+	return nil
+}
+
+// DueForDeletion returns the users whose grace period has passed.
+func (m *AccountModel) DueForDeletion() ([]int64, error) {
+	query := `
+		SELECT id
+		FROM users
+		WHERE delete_after <= NOW()
+		ORDER BY delete_after ASC
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		m.ErrorLog.Print(err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := make([]int64, 0)
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return ids, nil
+}
+
+// Purge deletes an account whose grace period has passed, in one
+// transaction:
+//
+//   - shared ledgers the user owns are handed to the longest standing
+//     remaining member, who becomes an owner if the user was the last one
+//   - the personal ledger and shared ledgers without other members are
+//     deleted with their records and comments
+//   - records the user added to ledgers of others stay with the ledger, as
+//     the other members' balances and reports depend on them, but lose their
+//     author and descriptions; so do the revisions and attachments the user
+//     left there
+//   - the user row goes last, together with everything referencing it
+//
+// The audit log is append-only and is not touched. It refers to the user by
+// id only and keeps digests instead of descriptions, see auditPseudonymised,
+// so with the user row gone its events no longer identify them.
+//
+// It returns the attachments whose content is no longer referenced, so their
+// blobs can be removed. ErrRecordNotFound means the deletion was cancelled in
+// the meantime.
+func (m *AccountModel) Purge(userID int64) ([]*Attachment, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var email string
+
+	query := `
+		SELECT email
+		FROM users
+		WHERE id = $1 AND delete_after <= NOW()
+		FOR UPDATE
+	`
+
+	err = tx.QueryRowContext(ctx, query, userID).Scan(&email)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			m.ErrorLog.Print(err)
+			return nil, err
+		}
+	}
+
+	query = `
+		UPDATE ledger_members
+		SET role = 'owner'
+		WHERE (ledger_id, user_id) IN (
+			SELECT DISTINCT ON (o.ledger_id) o.ledger_id, o.user_id
+			FROM ledger_members o
+			INNER JOIN ledger_members me ON me.ledger_id = o.ledger_id AND me.user_id = $1 AND me.role = 'owner'
+			WHERE o.user_id <> $1
+			AND NOT EXISTS (
+				SELECT 1 FROM ledger_members x
+				WHERE x.ledger_id = o.ledger_id AND x.role = 'owner' AND x.user_id <> $1
+			)
+			ORDER BY o.ledger_id, o.created_at ASC, o.user_id ASC
+		)
+	`
+
+	_, err = tx.ExecContext(ctx, query, userID)
+	if err != nil {
+		m.ErrorLog.Print(err)
+		return nil, err
+	}
+
+	query = `
+		UPDATE ledgers l
+		SET created_by = (
+			SELECT m.user_id FROM ledger_members m
+			WHERE m.ledger_id = l.id AND m.role = 'owner' AND m.user_id <> $1
+			ORDER BY m.created_at ASC, m.user_id ASC
+			LIMIT 1
+		), version = version + 1
+		WHERE l.created_by = $1 AND NOT l.personal
+		AND EXISTS (
+			SELECT 1 FROM ledger_members m
+			WHERE m.ledger_id = l.id AND m.role = 'owner' AND m.user_id <> $1
+		)
+	`
+
+	_, err = tx.ExecContext(ctx, query, userID)
+	if err != nil {
+		m.ErrorLog.Print(err)
+		return nil, err
+	}
+
+	// remember the content of the attachments that go with the records, to
+	// find out afterwards which of it is no longer used
+	query = `
+		SELECT DISTINCT a.sha256
+		FROM attachments a
+		INNER JOIN records r ON r.id = a.record_id
+		INNER JOIN ledgers l ON l.id = r.ledger_id
+		WHERE l.created_by = $1
+	`
+
+	rows, err := tx.QueryContext(ctx, query, userID)
+	if err != nil {
+		m.ErrorLog.Print(err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	hashes := make([]string, 0)
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			return nil, err
+		}
+		hashes = append(hashes, hash)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	queries := []string{
+		`DELETE FROM comments
+		WHERE record_id IN (
+			SELECT r.id FROM records r
+			INNER JOIN ledgers l ON l.id = r.ledger_id
+			WHERE l.created_by = $1
+		)`,
+		`DELETE FROM records
+		WHERE ledger_id IN (SELECT id FROM ledgers WHERE created_by = $1)`,
+		// what is left is in ledgers of others, 0 stands for a deleted account
+		`UPDATE record_splits
+		SET description = ''
+		WHERE record_id IN (SELECT id FROM records WHERE user_id = $1)`,
+		`UPDATE records
+		SET user_id = 0, description = '', version = version + 1
+		WHERE user_id = $1`,
+		`UPDATE record_revisions
+		SET changed_by = 0, description = '',
+			splits = (SELECT coalesce(jsonb_agg(s || '{"description": ""}'), '[]') FROM jsonb_array_elements(splits) s)
+		WHERE changed_by = $1`,
+		`UPDATE attachments
+		SET user_id = 0
+		WHERE user_id = $1`,
+		`DELETE FROM users
+		WHERE id = $1`,
+	}
+
+	for _, query := range queries {
+		_, err = tx.ExecContext(ctx, query, userID)
+		if err != nil {
+			m.ErrorLog.Print(err)
+			return nil, err
+		}
+	}
+
+	// invitations are addressed by email and do not reference the user
+	query = `
+		DELETE FROM ledger_invitations
+		WHERE lower(email) = lower($1)
+	`
+
+	_, err = tx.ExecContext(ctx, query, email)
+	if err != nil {
+		m.ErrorLog.Print(err)
+		return nil, err
+	}
+
+	orphans, err := unusedContent(ctx, tx, hashes)
+	if err != nil {
+		m.ErrorLog.Print(err)
+		return nil, err
+	}
+
+	return orphans, tx.Commit()
+}
@@ -0,0 +1,236 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+type AttachmentModel struct {
+	DB       *sql.DB
+	InfoLog  *log.Logger
+	ErrorLog *log.Logger
+}
+
+// Attachment is a file kept with a record. The content lives in the blob store
+// under a key derived from SHA256, so identical files are stored once.
+type Attachment struct {
+	ID           int64     `json:"id"`
+	RecordID     int64     `json:"record_id"`
+	UserID       int64     `json:"user_id"`
+	Filename     string    `json:"filename"`
+	ContentType  string    `json:"content_type"`
+	Size         int64     `json:"size"`
+	SHA256       string    `json:"sha256"`
+	HasThumbnail bool      `json:"has_thumbnail"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+var (
+	ErrDuplicateAttachment = errors.New("duplicate attachment")
+)
+
+// BlobKey is the blob store key of the attachment's content.
+func (a *Attachment) BlobKey() string {
+	return "blobs/" + a.SHA256[:2] + "/" + a.SHA256
+}
+
+// ThumbnailKey is the blob store key of the attachment's thumbnail.
+func (a *Attachment) ThumbnailKey() string {
+	return "thumbnails/" + a.SHA256[:2] + "/" + a.SHA256
+}
+
+func (m *AttachmentModel) Insert(attachment *Attachment) error {
+	query := `
+		INSERT INTO attachments (record_id, user_id, filename, content_type, size, sha256, has_thumbnail)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id, created_at
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	args := []interface{}{attachment.RecordID, attachment.UserID, attachment.Filename, attachment.ContentType, attachment.Size, attachment.SHA256, attachment.HasThumbnail}
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&attachment.ID, &attachment.CreatedAt)
+	if err != nil {
+		m.ErrorLog.Print(err)
+		switch {
+		case err.Error() == `pq: duplicate key value violates unique constraint "attachments_record_id_sha256_key"`:
+			return ErrDuplicateAttachment
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+// GetByID returns an attachment whose record has not been trashed.
+func (m *AttachmentModel) GetByID(id int64) (*Attachment, error) {
+	query := `
+		SELECT a.id, a.record_id, a.user_id, a.filename, a.content_type, a.size, a.sha256, a.has_thumbnail, a.created_at
+		FROM attachments a
+		INNER JOIN records r ON r.id = a.record_id
+		WHERE a.id = $1 AND r.deleted_at IS NULL
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var a Attachment
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(&a.ID, &a.RecordID, &a.UserID, &a.Filename, &a.ContentType, &a.Size, &a.SHA256, &a.HasThumbnail, &a.CreatedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			m.ErrorLog.Print(err)
+			return nil, err
+		}
+	}
+
+	return &a, nil
+}
+
+func (m *AttachmentModel) GetAllForRecord(recordID int64) ([]*Attachment, error) {
+	query := `
+		SELECT id, record_id, user_id, filename, content_type, size, sha256, has_thumbnail, created_at
+		FROM attachments
+		WHERE record_id = $1
+		ORDER BY created_at ASC, id ASC
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, recordID)
+	if err != nil {
+		m.ErrorLog.Print(err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	attachments := make([]*Attachment, 0)
+	for rows.Next() {
+		var a Attachment
+		err := rows.Scan(&a.ID, &a.RecordID, &a.UserID, &a.Filename, &a.ContentType, &a.Size, &a.SHA256, &a.HasThumbnail, &a.CreatedAt)
+		if err != nil {
+			m.ErrorLog.Print(err)
+			return nil, err
+		}
+		attachments = append(attachments, &a)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return attachments, nil
+}
+
+// Delete removes the attachment from its record. Its content may still be
+// used by other attachments, see Referenced.
+func (m *AttachmentModel) Delete(id int64, recordID int64) error {
+	query := `
+		DELETE FROM attachments
+		WHERE id = $1 AND record_id = $2
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id, recordID)
+	if err != nil {
+		m.ErrorLog.Print(err)
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// Referenced reports whether any attachment uses the content with the hash.
+func (m *AttachmentModel) Referenced(sha256 string) (bool, error) {
+	query := `
+		SELECT EXISTS (SELECT 1 FROM attachments WHERE sha256 = $1)
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var referenced bool
+	err := m.DB.QueryRowContext(ctx, query, sha256).Scan(&referenced)
+	if err != nil {
+		m.ErrorLog.Print(err)
+		return false, err
+	}
+
+	return referenced, nil
+}
+
+// LockContent waits until no one else holds the lock for the content with the
+// hash and takes it. Uploads hold it from checking for the blob until the
+// attachment is inserted, and deletions from checking for references until
+// the blob is gone, so a blob is never deleted under a new attachment. The
+// lock is released by calling unlock or when ctx ends.
+func (m *AttachmentModel) LockContent(ctx context.Context, sha256 string) (unlock func(), err error) {
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock(hashtext('attachments'), hashtext($1))`, sha256)
+	if err != nil {
+		tx.Rollback()
+		m.ErrorLog.Print(err)
+		return nil, err
+	}
+
+	return func() { tx.Rollback() }, nil
+}
+
+// unusedContent returns the content among hashes that no attachment refers
+// to anymore, as attachments with only SHA256 set, so their blobs can be
+// removed once tx commits.
+func unusedContent(ctx context.Context, tx *sql.Tx, hashes []string) ([]*Attachment, error) {
+	query := `
+		SELECT h.sha256
+		FROM unnest($1::text[]) AS h(sha256)
+		WHERE NOT EXISTS (SELECT 1 FROM attachments a WHERE a.sha256 = h.sha256)
+	`
+
+	rows, err := tx.QueryContext(ctx, query, pq.Array(hashes))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	unused := make([]*Attachment, 0)
+	for rows.Next() {
+		var attachment Attachment
+		if err := rows.Scan(&attachment.SHA256); err != nil {
+			return nil, err
+		}
+		unused = append(unused, &attachment)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return unused, nil
+}
@@ -0,0 +1,435 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+type AuditModel struct {
+	DB       *sql.DB
+	InfoLog  *log.Logger
+	ErrorLog *log.Logger
+}
+
+// AuditEvent records who did what to which entity. ActorID is nil for
+// changes made by the system itself. Before and After hold the entity as
+// JSON around the change, where that is known. Every event is chained to the
+// one written before it in the same ledger through PrevHash and Hash, which
+// the database sets. Events without a LedgerID share one chain.
+type AuditEvent struct {
+	ID        int64                  `json:"id"`
+	LedgerID  *int64                 `json:"ledger_id,omitempty"`
+	ActorID   *int64                 `json:"actor_id,omitempty"`
+	Action    string                 `json:"action"`
+	Entity    string                 `json:"entity"`
+	EntityID  *int64                 `json:"entity_id,omitempty"`
+	Before    interface{}            `json:"before,omitempty"`
+	After     interface{}            `json:"after,omitempty"`
+	Details   map[string]interface{} `json:"details,omitempty"`
+	IP        string                 `json:"ip,omitempty"`
+	RequestID string                 `json:"request_id,omitempty"`
+	PrevHash  string                 `json:"prev_hash"`
+	Hash      string                 `json:"hash"`
+	CreatedAt time.Time              `json:"created_at"`
+}
+
+// AuditSource says who makes a change and from where. Models that audit
+// their own changes take one and write the event in the transaction of the
+// change.
+type AuditSource struct {
+	ActorID *int64
+	// Impersonating is the user the actor acted as, if any.
+	Impersonating *int64
+	IP            string
+	RequestID     string
+}
+
+// AuditFilter narrows the audit log. Empty fields match every event.
+type AuditFilter struct {
+	LedgerID  *int64
+	ActorID   *int64
+	Action    string
+	Entity    string
+	EntityID  *int64
+	RequestID string
+	Since     time.Time
+	Until     time.Time
+}
+
+// AuditVerification is the result of checking the hash chains of the log.
+// Head is a hash over the latest event of every chain.
+type AuditVerification struct {
+	Valid          bool   `json:"valid"`
+	Checked        int    `json:"checked"`
+	Chains         int    `json:"chains"`
+	FirstInvalidID *int64 `json:"first_invalid_id,omitempty"`
+	Head           string `json:"head,omitempty"`
+}
+
+// AuditSortSafeList lists the values accepted by the sort parameter of the
+// audit log endpoint.
+var AuditSortSafeList = []string{"id", "-id"}
+
+// Audited actions on users.
+const (
+	AuditUserRoleChange    = "user.role_change"
+	AuditUserSuspend       = "user.suspend"
+	AuditUserUnsuspend     = "user.unsuspend"
+	AuditUserPasswordReset = "user.force_password_reset"
+	AuditUserVerify        = "user.force_verify"
+	AuditUserUnlock        = "user.unlock"
+	AuditUserMFAReset      = "user.mfa_reset"
+	AuditUserImpersonate   = "user.impersonate"
+	AuditUserImpersonated  = "user.impersonated_request"
+)
+
+// Audited actions on roles. Roles have no numeric id, the name is in the
+// details.
+const (
+	AuditRoleCreate = "role.create"
+	AuditRoleUpdate = "role.update"
+	AuditRoleDelete = "role.delete"
+)
+
+// Audited data changes, written by the models.
+const (
+	AuditCurrencyCreate   = "currency.create"
+	AuditCurrencyUpdate   = "currency.update"
+	AuditCurrencyDelete   = "currency.delete"
+	AuditRecordTypeCreate = "recordtype.create"
+	AuditRecordTypeDelete = "recordtype.delete"
+	AuditRecordCreate     = "record.create"
+	AuditRecordUpdate     = "record.update"
+	AuditRecordRestore    = "record.restore"
+	AuditRecordDelete     = "record.delete"
+	AuditRecordUndelete   = "record.undelete"
+	AuditCommentCreate    = "comment.create"
+	AuditCommentUpdate    = "comment.update"
+	AuditCommentDelete    = "comment.delete"
+	AuditCommentUndelete  = "comment.undelete"
+)
+
+const auditColumns = `id, ledger_id, actor_id, action, entity, entity_id, before, after, details, ip, request_id, prev_hash, hash, created_at`
+
+// Insert writes an event made by src.
+func (m *AuditModel) Insert(src AuditSource, event *AuditEvent) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = insertAuditEvent(ctx, tx, src, event)
+	if err != nil {
+		m.ErrorLog.Print(err)
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// insertAuditEvent writes an event inside tx, so models can record a change
+// atomically with it. Inserts into the same chain wait for each other until
+// the transaction ends, keep audited transactions short.
+func insertAuditEvent(ctx context.Context, tx *sql.Tx, src AuditSource, event *AuditEvent) error {
+	event.ActorID = src.ActorID
+	event.IP = src.IP
+	event.RequestID = src.RequestID
+
+	if src.Impersonating != nil {
+		details := map[string]interface{}{"impersonating": *src.Impersonating}
+		for k, v := range event.Details {
+			details[k] = v
+		}
+		event.Details = details
+	}
+
+	details := []byte("{}")
+	if event.Details != nil {
+		var err error
+		details, err = json.Marshal(event.Details)
+		if err != nil {
+			return err
+		}
+	}
+
+	before, err := auditJSON(event.Before)
+	if err != nil {
+		return err
+	}
+
+	after, err := auditJSON(event.After)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		INSERT INTO audit_events (ledger_id, actor_id, action, entity, entity_id, before, after, details, ip, request_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		RETURNING id, prev_hash, hash, created_at
+	`
+
+	args := []interface{}{event.LedgerID, event.ActorID, event.Action, event.Entity, event.EntityID, before, after, details, event.IP, event.RequestID}
+
+	return tx.QueryRowContext(ctx, query, args...).Scan(&event.ID, &event.PrevHash, &event.Hash, &event.CreatedAt)
+}
+
+// auditJSON encodes the before or after state of an event. Missing states
+// are stored as NULL.
+func auditJSON(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case nil:
+		return nil, nil
+	case json.RawMessage:
+		if v == nil {
+			return nil, nil
+		}
+		return []byte(v), nil
+	default:
+		return json.Marshal(v)
+	}
+}
+
+// auditPseudonymised lists the columns of audited tables that hold what
+// users wrote. The audit log is append-only and outlives deleted accounts,
+// so it keeps a digest of them instead: a change still shows, the text does
+// not. Users appear in events only by id, which no longer leads anywhere
+// once the account is purged. Generated search vectors are left out, they
+// repeat the text.
+var auditPseudonymised = map[string][]string{
+	"records":  {"description"},
+	"comments": {"description"},
+}
+
+// auditRow returns the row of table with the id as JSON and locks it until
+// the transaction ends. It is nil if there is no such row.
+func auditRow(ctx context.Context, tx *sql.Tx, table string, id int64) (json.RawMessage, error) {
+	columns := "(to_jsonb(t) - 'search_vector')"
+	for _, column := range auditPseudonymised[table] {
+		columns += fmt.Sprintf(` || jsonb_build_object('%[1]s', encode(sha256(convert_to(coalesce(t.%[1]s, ''), 'UTF8')), 'hex'))`, column)
+	}
+
+	query := fmt.Sprintf(`SELECT %s FROM %s t WHERE t.id = $1 FOR UPDATE`, columns, table)
+
+	var row []byte
+	err := tx.QueryRowContext(ctx, query, id).Scan(&row)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, nil
+		default:
+			return nil, err
+		}
+	}
+
+	return row, nil
+}
+
+// GetAll lists the events matching filter in the order of the chain, or the
+// reverse order when sorted by -id.
+func (m *AuditModel) GetAll(filter AuditFilter, filters Filters) ([]*AuditEvent, Metadata, error) {
+	q := &queryArgs{}
+	conditions := []string{"TRUE"}
+
+	if filter.LedgerID != nil {
+		conditions = append(conditions, "ledger_id = "+q.bind(*filter.LedgerID))
+	}
+
+	if filter.ActorID != nil {
+		conditions = append(conditions, "actor_id = "+q.bind(*filter.ActorID))
+	}
+
+	if filter.Action != "" {
+		conditions = append(conditions, "action = "+q.bind(filter.Action))
+	}
+
+	if filter.Entity != "" {
+		conditions = append(conditions, "entity = "+q.bind(filter.Entity))
+	}
+
+	if filter.EntityID != nil {
+		conditions = append(conditions, "entity_id = "+q.bind(*filter.EntityID))
+	}
+
+	if filter.RequestID != "" {
+		conditions = append(conditions, "request_id = "+q.bind(filter.RequestID))
+	}
+
+	if !filter.Since.IsZero() {
+		conditions = append(conditions, "created_at >= "+q.bind(filter.Since))
+	}
+
+	if !filter.Until.IsZero() {
+		conditions = append(conditions, "created_at < "+q.bind(filter.Until))
+	}
+
+	query := fmt.Sprintf(`
+		SELECT count(*) OVER(), %s
+		FROM audit_events
+		WHERE %s
+		ORDER BY %s %s
+		LIMIT %s OFFSET %s`,
+		auditColumns, strings.Join(conditions, " AND "), filters.sortColumn(), filters.sortDirection(),
+		q.bind(filters.limit()), q.bind(filters.offset()))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, q.args...)
+	if err != nil {
+		m.ErrorLog.Print(err)
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	events := make([]*AuditEvent, 0)
+
+	for rows.Next() {
+		event, err := scanAuditEvent(rows, &totalRecords)
+		if err != nil {
+			m.ErrorLog.Print(err)
+			return nil, Metadata{}, err
+		}
+		events = append(events, event)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	return events, filters.CalculateMetadata(totalRecords), nil
+}
+
+// GetForEntity returns the latest events about one entity, newest first.
+func (m *AuditModel) GetForEntity(entity string, entityID int64, limit int) ([]*AuditEvent, error) {
+	query := `
+		SELECT ` + auditColumns + `
+		FROM audit_events
+		WHERE entity = $1 AND entity_id = $2
+		ORDER BY id DESC
+		LIMIT $3
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, entity, entityID, limit)
+	if err != nil {
+		m.ErrorLog.Print(err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := make([]*AuditEvent, 0)
+	for rows.Next() {
+		event, err := scanAuditEvent(rows)
+		if err != nil {
+			m.ErrorLog.Print(err)
+			return nil, err
+		}
+		events = append(events, event)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return events, nil
+}
+
+// Verify recomputes the hash of every event and checks that it links to the
+// event before it in its chain. The first event that does not match was
+// changed, or an event before it was removed. Removing the latest events of a
+// chain is only noticed by comparing Head with a copy kept elsewhere.
+func (m *AuditModel) Verify() (*AuditVerification, error) {
+	query := `
+		SELECT count(*), count(*) FILTER (WHERE last), min(id) FILTER (WHERE NOT ok),
+			coalesce(encode(sha256(convert_to(string_agg(hash, ',' ORDER BY ledger_id NULLS FIRST) FILTER (WHERE last), 'UTF8')), 'hex'), '')
+		FROM (
+			SELECT id, ledger_id, hash,
+				prev_hash = coalesce(lag(hash) OVER w, '') AND hash = audit_event_hash(e) AS ok,
+				lead(id) OVER w IS NULL AS last
+			FROM audit_events e
+			WINDOW w AS (PARTITION BY ledger_id ORDER BY id)
+		) chain
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	var result AuditVerification
+
+	err := m.DB.QueryRowContext(ctx, query).Scan(&result.Checked, &result.Chains, &result.FirstInvalidID, &result.Head)
+	if err != nil {
+		m.ErrorLog.Print(err)
+		return nil, err
+	}
+
+	result.Valid = result.FirstInvalidID == nil
+
+	return &result, nil
+}
+
+func scanAuditEvent(rows *sql.Rows, extra ...interface{}) (*AuditEvent, error) {
+	var event AuditEvent
+	var before, after, details []byte
+
+	dest := append(extra, &event.ID, &event.LedgerID, &event.ActorID, &event.Action, &event.Entity, &event.EntityID, &before, &after, &details,
+		&event.IP, &event.RequestID, &event.PrevHash, &event.Hash, &event.CreatedAt)
+
+	err := rows.Scan(dest...)
+	if err != nil {
+		return nil, err
+	}
+
+	if before != nil {
+		event.Before = json.RawMessage(before)
+	}
+
+	if after != nil {
+		event.After = json.RawMessage(after)
+	}
+
+	err = json.Unmarshal(details, &event.Details)
+	if err != nil {
+		return nil, err
+	}
+
+	return &event, nil
+}
+
+// auditChange records the change of the row of table with the id, given the
+// row as it was before. The row as it is now is read inside tx, so it is nil
+// after a delete.
+func auditChange(ctx context.Context, tx *sql.Tx, src AuditSource, action, entity, table string, id int64, before json.RawMessage) error {
+	return auditRowChange(ctx, tx, src, &AuditEvent{Action: action, Entity: entity}, table, id, before)
+}
+
+// auditLedgerChange is auditChange for rows that belong to a ledger. The
+// event goes to the ledger's chain.
+func auditLedgerChange(ctx context.Context, tx *sql.Tx, src AuditSource, ledgerID int64, action, entity, table string, id int64, before json.RawMessage) error {
+	return auditRowChange(ctx, tx, src, &AuditEvent{LedgerID: &ledgerID, Action: action, Entity: entity}, table, id, before)
+}
+
+func auditRowChange(ctx context.Context, tx *sql.Tx, src AuditSource, event *AuditEvent, table string, id int64, before json.RawMessage) error {
+	after, err := auditRow(ctx, tx, table, id)
+	if err != nil {
+		return err
+	}
+
+	event.EntityID = &id
+	event.Before = before
+	event.After = after
+
+	return insertAuditEvent(ctx, tx, src, event)
+}
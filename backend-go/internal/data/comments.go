@@ -29,44 +29,74 @@ var (
 	ErrDuplicateComment = errors.New("duplicate comment")
 )
 
-func (c *CommentModel) Insert(comment *Comment) error {
+// Insert adds a comment to a record of the ledger and records the audit
+// event in the same transaction.
+func (c *CommentModel) Insert(comment *Comment, ledgerID int64, src AuditSource) error {
 	query := `
 		INSERT INTO comments (record_id, description)
-		VALUES ($1, $2)
+		SELECT id, $2 FROM records
+		WHERE id = $1 AND ledger_id = $3 AND deleted_at IS NULL
 		RETURNING id, created_at, version
 	`
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	err := c.DB.QueryRowContext(ctx, query, comment.RecordID, comment.Description).Scan(&comment.ID, &comment.CreatedAt, &comment.Version)
+	tx, err := c.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRowContext(ctx, query, comment.RecordID, comment.Description, ledgerID).Scan(&comment.ID, &comment.CreatedAt, &comment.Version)
 	if err != nil {
 		c.ErrorLog.Print(err)
 		switch {
 		case err.Error() == `pq: duplicate key value violates unique constraint "comments_pkey"`:
 			return ErrDuplicateComment
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrRecordNotFound
 		default:
 			return err
 		}
 	}
 
-	return nil
+	err = auditLedgerChange(ctx, tx, src, ledgerID, AuditCommentCreate, "comment", "comments", comment.ID, nil)
+	if err != nil {
+		c.ErrorLog.Print(err)
+		return err
+	}
+
+	return tx.Commit()
 }
 
-func (c *CommentModel) Update(comment *Comment) error {
+func (c *CommentModel) Update(comment *Comment, ledgerID int64, src AuditSource) error {
 	query := `
 		UPDATE comments
 		SET description = $1, version = version + 1
-		WHERE id = $2 AND version = $3
+		WHERE id = $2 AND version = $3 AND deleted_at IS NULL
+		AND record_id IN (SELECT id FROM records WHERE ledger_id = $4)
 		RETURNING version
 	`
 
-	args := []interface{}{comment.Description, comment.ID, comment.Version}
+	args := []interface{}{comment.Description, comment.ID, comment.Version, ledgerID}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	err := c.DB.QueryRowContext(ctx, query, args...).Scan(&comment.Version)
+	tx, err := c.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	before, err := auditRow(ctx, tx, "comments", comment.ID)
+	if err != nil {
+		c.ErrorLog.Print(err)
+		return err
+	}
+
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&comment.Version)
 	if err != nil {
 		c.ErrorLog.Print(err)
 		switch {
@@ -76,27 +106,44 @@ func (c *CommentModel) Update(comment *Comment) error {
 			return err
 		}
 	}
-	return nil
+
+	err = auditLedgerChange(ctx, tx, src, ledgerID, AuditCommentUpdate, "comment", "comments", comment.ID, before)
+	if err != nil {
+		c.ErrorLog.Print(err)
+		return err
+	}
+
+	return tx.Commit()
 }
 
-func (c *CommentModel) Delete(id int64) error {
+// Delete moves a comment on one of the ledger's records to the trash.
+func (c *CommentModel) Delete(id int64, ledgerID int64, src AuditSource) error {
 	query := `
-		DELETE FROM comments
-		WHERE id = $1
+		UPDATE comments
+		SET deleted_at = NOW()
+		WHERE id = $1 AND deleted_at IS NULL
+		AND record_id IN (SELECT id FROM records WHERE ledger_id = $2)
 	`
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	result, err := c.DB.ExecContext(ctx, query, id)
+	tx, err := c.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	before, err := auditRow(ctx, tx, "comments", id)
 	if err != nil {
 		c.ErrorLog.Print(err)
-		switch {
-		case errors.Is(err, sql.ErrNoRows):
-			return ErrEditConflict
-		default:
-			return err
-		}
+		return err
+	}
+
+	result, err := tx.ExecContext(ctx, query, id, ledgerID)
+	if err != nil {
+		c.ErrorLog.Print(err)
+		return err
 	}
 
 	rowsAffected, err := result.RowsAffected()
@@ -109,14 +156,21 @@ func (c *CommentModel) Delete(id int64) error {
 		return ErrRecordNotFound
 	}
 
-	return nil
+	err = auditLedgerChange(ctx, tx, src, ledgerID, AuditCommentDelete, "comment", "comments", id, before)
+	if err != nil {
+		c.ErrorLog.Print(err)
+		return err
+	}
+
+	return tx.Commit()
 }
 
-func (c *CommentModel) GetByID(id int64) (*Comment, error) {
+func (c *CommentModel) GetByID(id int64, ledgerID int64) (*Comment, error) {
 	query := `
-		SELECT id, record_id, description, created_at, version
-		FROM comments
-		WHERE id = $1
+		SELECT c.id, c.record_id, c.description, c.created_at, c.version
+		FROM comments c
+		INNER JOIN records r ON r.id = c.record_id
+		WHERE c.id = $1 AND r.ledger_id = $2 AND c.deleted_at IS NULL AND r.deleted_at IS NULL
 	`
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
@@ -124,7 +178,7 @@ func (c *CommentModel) GetByID(id int64) (*Comment, error) {
 
 	var comment Comment
 
-	err := c.DB.QueryRowContext(ctx, query, id).Scan(&comment.ID, &comment.RecordID, &comment.Description, &comment.CreatedAt, &comment.Version)
+	err := c.DB.QueryRowContext(ctx, query, id, ledgerID).Scan(&comment.ID, &comment.RecordID, &comment.Description, &comment.CreatedAt, &comment.Version)
 	if err != nil {
 		c.ErrorLog.Print(err)
 		switch {
@@ -138,16 +192,17 @@ func (c *CommentModel) GetByID(id int64) (*Comment, error) {
 	return &comment, nil
 }
 
-func (c *CommentModel) GetAll(recordID int64, filters Filters) ([]*Comment, error) {
+func (c *CommentModel) GetAll(recordID int64, ledgerID int64, filters Filters) ([]*Comment, error) {
 	query := fmt.Sprintf(`
 		SELECT id, record_id, description, created_at, version
 		FROM comments
-		WHERE record_id = $1
+		WHERE record_id = $1 AND deleted_at IS NULL
+		AND record_id IN (SELECT id FROM records WHERE ledger_id = $4 AND deleted_at IS NULL)
 		ORDER BY %s %s, id ASC
 		LIMIT $2 OFFSET $3`,
 		filters.sortColumn(), filters.sortDirection())
 
-	args := []interface{}{recordID, filters.limit(), filters.offset()}
+	args := []interface{}{recordID, filters.limit(), filters.offset(), ledgerID}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
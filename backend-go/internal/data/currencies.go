@@ -82,7 +82,8 @@ func (c *CurrencyModel) GetByID(id int64) (*Currency, error) {
 	return &currency, err
 }
 
-func (c *CurrencyModel) Insert(currency *Currency) error {
+// Insert creates the currency and records it in the audit log.
+func (c *CurrencyModel) Insert(currency *Currency, src AuditSource) error {
 	query := `
 		INSERT INTO currencies (name , rate)
 		VALUES ($1 , $2)
@@ -95,7 +96,13 @@ func (c *CurrencyModel) Insert(currency *Currency) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	err := c.DB.QueryRowContext(ctx, query, args...).Scan(&currency.ID, &currency.CreatedAt, &currency.Version)
+	tx, err := c.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&currency.ID, &currency.CreatedAt, &currency.Version)
 
 	if err != nil {
 		c.ErrorLog.Print(err)
@@ -106,10 +113,19 @@ func (c *CurrencyModel) Insert(currency *Currency) error {
 			return err
 		}
 	}
-	return nil
+
+	err = auditChange(ctx, tx, src, AuditCurrencyCreate, "currency", "currencies", currency.ID, nil)
+	if err != nil {
+		c.ErrorLog.Print(err)
+		return err
+	}
+
+	return tx.Commit()
 }
 
-func (c *CurrencyModel) Update(currency *Currency) error {
+// Update saves the currency and records the old and new values in the
+// audit log.
+func (c *CurrencyModel) Update(currency *Currency, src AuditSource) error {
 	query := `
 		UPDATE currencies 
 		SET name=$1, rate=$2, version=version+1
@@ -120,6 +136,18 @@ func (c *CurrencyModel) Update(currency *Currency) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
+	tx, err := c.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	before, err := auditRow(ctx, tx, "currencies", currency.ID)
+	if err != nil {
+		c.ErrorLog.Print(err)
+		return err
+	}
+
 	args := []interface{}{
 		currency.Name,
 		currency.Rate,
@@ -127,7 +155,7 @@ func (c *CurrencyModel) Update(currency *Currency) error {
 		currency.Version,
 	}
 
-	err := c.DB.QueryRowContext(ctx, query, args...).Scan(&currency.Version)
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&currency.Version)
 
 	if err != nil {
 		c.ErrorLog.Print(err.Error())
@@ -138,10 +166,18 @@ func (c *CurrencyModel) Update(currency *Currency) error {
 			return err
 		}
 	}
-	return nil
+
+	err = auditChange(ctx, tx, src, AuditCurrencyUpdate, "currency", "currencies", currency.ID, before)
+	if err != nil {
+		c.ErrorLog.Print(err)
+		return err
+	}
+
+	return tx.Commit()
 }
 
-func (c *CurrencyModel) Delete(id int64) error {
+// Delete removes the currency and keeps its last values in the audit log.
+func (c *CurrencyModel) Delete(id int64, src AuditSource) error {
 	if id < 1 {
 		return ErrRecordNotFound
 	}
@@ -154,7 +190,18 @@ func (c *CurrencyModel) Delete(id int64) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	result, err := c.DB.ExecContext(ctx, query, id)
+	tx, err := c.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	before, err := auditRow(ctx, tx, "currencies", id)
+	if err != nil {
+		return err
+	}
+
+	result, err := tx.ExecContext(ctx, query, id)
 	if err != nil {
 		return err
 	}
@@ -168,5 +215,11 @@ func (c *CurrencyModel) Delete(id int64) error {
 		return ErrRecordNotFound
 	}
 
-	return nil
+	err = auditChange(ctx, tx, src, AuditCurrencyDelete, "currency", "currencies", id, before)
+	if err != nil {
+		c.ErrorLog.Print(err)
+		return err
+	}
+
+	return tx.Commit()
 }
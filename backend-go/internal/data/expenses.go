@@ -0,0 +1,517 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"math"
+	"math/bits"
+	"sort"
+	"time"
+
+	"github.com/saiharsha/money-manager/pkg/validator"
+)
+
+type ExpenseModel struct {
+	DB       *sql.DB
+	InfoLog  *log.Logger
+	ErrorLog *log.Logger
+}
+
+const (
+	SplitEqual   = "equal"
+	SplitExact   = "exact"
+	SplitPercent = "percent"
+	SplitShares  = "shares"
+
+	ExpenseKindExpense   = "expense"
+	ExpenseKindRepayment = "repayment"
+)
+
+// Expense is a cost paid by one participant of a group and divided among some
+// of its participants. A repayment is stored as an expense paid by the debtor
+// and owed entirely by the creditor, which moves both balances towards zero.
+type Expense struct {
+	ID          int64           `json:"id"`
+	GroupID     int64           `json:"group_id"`
+	Kind        string          `json:"kind"`
+	Description string          `json:"description"`
+	Amount      int64           `json:"amount"`
+	PaidBy      int64           `json:"paid_by"`
+	SplitMethod string          `json:"split_method"`
+	RecordID    *int64          `json:"record_id,omitempty"`
+	OccurredAt  time.Time       `json:"occurred_at"`
+	CreatedBy   int64           `json:"created_by"`
+	CreatedAt   time.Time       `json:"created_at"`
+	Shares      []*ExpenseShare `json:"shares"`
+}
+
+// ExpenseShare is one participant's part of an expense. Value is the input to
+// the split method: ignored for equal, an amount for exact, a percentage for
+// percent and a number of shares for shares. Amount is the computed share.
+type ExpenseShare struct {
+	ParticipantID int64   `json:"participant_id"`
+	Value         float64 `json:"value"`
+	Amount        int64   `json:"amount"`
+}
+
+// Transfer is a payment that settles debts between two participants.
+type Transfer struct {
+	From   int64 `json:"from_participant_id"`
+	To     int64 `json:"to_participant_id"`
+	Amount int64 `json:"amount"`
+}
+
+func (m *ExpenseModel) Insert(expense *Expense) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = insertExpense(ctx, tx, expense)
+	if err != nil {
+		m.ErrorLog.Print(err)
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// InsertRepayment stores a repayment together with the record that books it
+// in the ledger, so that the group balances and the ledger agree.
+func (m *ExpenseModel) InsertRepayment(expense *Expense, record *Record) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = insertRecord(ctx, tx, record)
+	if err != nil {
+		m.ErrorLog.Print(err)
+		return err
+	}
+
+	expense.RecordID = &record.ID
+
+	err = insertExpense(ctx, tx, expense)
+	if err != nil {
+		m.ErrorLog.Print(err)
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func insertExpense(ctx context.Context, tx *sql.Tx, expense *Expense) error {
+	query := `
+		INSERT INTO expenses (group_id, kind, description, amount, paid_by, split_method, record_id, occurred_at, created_by)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		RETURNING id, created_at
+	`
+
+	args := []interface{}{expense.GroupID, expense.Kind, expense.Description, expense.Amount, expense.PaidBy, expense.SplitMethod, expense.RecordID, expense.OccurredAt, expense.CreatedBy}
+
+	err := tx.QueryRowContext(ctx, query, args...).Scan(&expense.ID, &expense.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	query = `
+		INSERT INTO expense_shares (expense_id, participant_id, value, amount)
+		VALUES ($1, $2, $3, $4)
+	`
+
+	for _, share := range expense.Shares {
+		_, err = tx.ExecContext(ctx, query, expense.ID, share.ParticipantID, share.Value, share.Amount)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// GetAllForGroup lists the group's expenses and repayments, newest first.
+func (m *ExpenseModel) GetAllForGroup(groupID int64) ([]*Expense, error) {
+	query := `
+		SELECT id, group_id, kind, description, amount, paid_by, split_method, record_id, occurred_at, created_by, created_at
+		FROM expenses
+		WHERE group_id = $1
+		ORDER BY occurred_at DESC, id DESC
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, groupID)
+	if err != nil {
+		m.ErrorLog.Print(err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	expenses := make([]*Expense, 0)
+	byID := make(map[int64]*Expense)
+	for rows.Next() {
+		e := Expense{Shares: []*ExpenseShare{}}
+		err := rows.Scan(&e.ID, &e.GroupID, &e.Kind, &e.Description, &e.Amount, &e.PaidBy, &e.SplitMethod, &e.RecordID, &e.OccurredAt, &e.CreatedBy, &e.CreatedAt)
+		if err != nil {
+			m.ErrorLog.Print(err)
+			return nil, err
+		}
+		expenses = append(expenses, &e)
+		byID[e.ID] = &e
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	query = `
+		SELECT s.expense_id, s.participant_id, s.value, s.amount
+		FROM expense_shares s
+		INNER JOIN expenses e ON e.id = s.expense_id
+		WHERE e.group_id = $1
+		ORDER BY s.expense_id, s.participant_id
+	`
+
+	shareRows, err := m.DB.QueryContext(ctx, query, groupID)
+	if err != nil {
+		m.ErrorLog.Print(err)
+		return nil, err
+	}
+	defer shareRows.Close()
+
+	for shareRows.Next() {
+		var share ExpenseShare
+		var expenseID int64
+		err := shareRows.Scan(&expenseID, &share.ParticipantID, &share.Value, &share.Amount)
+		if err != nil {
+			m.ErrorLog.Print(err)
+			return nil, err
+		}
+		if e, ok := byID[expenseID]; ok {
+			e.Shares = append(e.Shares, &share)
+		}
+	}
+
+	if err = shareRows.Err(); err != nil {
+		return nil, err
+	}
+
+	return expenses, nil
+}
+
+// Delete removes an expense from the group. A record booked for a repayment
+// is kept and has to be deleted separately.
+func (m *ExpenseModel) Delete(id int64, groupID int64) error {
+	query := `
+		DELETE FROM expenses
+		WHERE id = $1 AND group_id = $2
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id, groupID)
+	if err != nil {
+		m.ErrorLog.Print(err)
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// ValidateExpense checks an expense against the group's participants and
+// computes the amount of every share with ComputeShares.
+func ValidateExpense(v *validator.Validator, expense *Expense, participants []*ExpenseParticipant) {
+	v.Check(expense.Amount > 0, "amount", "must be greater than 0")
+	v.Check(expense.Amount <= math.MaxInt32, "amount", "is too large")
+	v.Check(len(expense.Description) <= 500, "description", "must be at most 500 characters long")
+	v.Check(validator.In(expense.SplitMethod, SplitEqual, SplitExact, SplitPercent, SplitShares), "split_method", "must be one of equal, exact, percent or shares")
+
+	inGroup := make(map[int64]bool, len(participants))
+	for _, p := range participants {
+		inGroup[p.ID] = true
+	}
+
+	v.Check(inGroup[expense.PaidBy], "paid_by", "must be a participant of the group")
+
+	v.Check(len(expense.Shares) > 0, "shares", "must contain at least one participant")
+	v.Check(len(expense.Shares) <= 100, "shares", "must contain at most 100 participants")
+
+	seen := make(map[int64]bool, len(expense.Shares))
+	for i, share := range expense.Shares {
+		if share == nil {
+			v.AddError(fmt.Sprintf("shares[%d]", i), "must be provided")
+			continue
+		}
+		key := fmt.Sprintf("shares[%d].participant_id", i)
+		v.Check(inGroup[share.ParticipantID], key, "must be a participant of the group")
+		v.Check(!seen[share.ParticipantID], key, "must not be repeated")
+		seen[share.ParticipantID] = true
+	}
+
+	if !v.Valid() {
+		return
+	}
+
+	ComputeShares(v, expense)
+}
+
+// ComputeShares sets the amount of every share of the expense according to its
+// split method. Amounts are in the currency's smallest unit, so whatever
+// cannot be divided evenly is handed out one unit at a time to the shares
+// with the largest remainders, earlier shares winning ties. The amounts always
+// add up to the expense amount.
+func ComputeShares(v *validator.Validator, expense *Expense) {
+	weights := make([]int64, len(expense.Shares))
+
+	switch expense.SplitMethod {
+	case SplitEqual:
+		for i := range weights {
+			weights[i] = 1
+		}
+
+	case SplitExact:
+		var total int64
+		for i, share := range expense.Shares {
+			key := fmt.Sprintf("shares[%d].value", i)
+			v.Check(share.Value >= 0, key, "must not be negative")
+			v.Check(share.Value == math.Trunc(share.Value), key, "must be a whole amount")
+			v.Check(share.Value <= math.MaxInt32, key, "is too large")
+			weights[i] = int64(share.Value)
+			total += weights[i]
+		}
+		if !v.Valid() {
+			return
+		}
+		v.Check(total == expense.Amount, "shares", fmt.Sprintf("amounts must add up to the expense amount %d, got %d", expense.Amount, total))
+		if !v.Valid() {
+			return
+		}
+		for i, share := range expense.Shares {
+			share.Amount = weights[i]
+		}
+		return
+
+	case SplitPercent:
+		var total int64
+		for i, share := range expense.Shares {
+			key := fmt.Sprintf("shares[%d].value", i)
+			v.Check(share.Value >= 0 && share.Value <= 100, key, "must be between 0 and 100")
+			// percentages are kept to two decimal places
+			weights[i] = int64(math.Round(share.Value * 100))
+			total += weights[i]
+		}
+		if !v.Valid() {
+			return
+		}
+		v.Check(total == 100_00, "shares", "percentages must add up to 100")
+
+	case SplitShares:
+		for i, share := range expense.Shares {
+			key := fmt.Sprintf("shares[%d].value", i)
+			v.Check(share.Value > 0, key, "must be greater than 0")
+			v.Check(share.Value == math.Trunc(share.Value), key, "must be a whole number of shares")
+			v.Check(share.Value <= 1_000_000, key, "must be at most 1000000")
+			weights[i] = int64(share.Value)
+		}
+
+	default:
+		v.AddError("split_method", "must be one of equal, exact, percent or shares")
+	}
+
+	if !v.Valid() {
+		return
+	}
+
+	for i, amount := range distribute(expense.Amount, weights) {
+		expense.Shares[i].Amount = amount
+	}
+}
+
+// distribute divides amount in proportion to weights using the largest
+// remainder method.
+func distribute(amount int64, weights []int64) []int64 {
+	var total int64
+	for _, w := range weights {
+		total += w
+	}
+
+	amounts := make([]int64, len(weights))
+	if total == 0 {
+		return amounts
+	}
+
+	remainders := make([]int64, len(weights))
+	var assigned int64
+	for i, w := range weights {
+		amounts[i] = amount * w / total
+		remainders[i] = amount * w % total
+		assigned += amounts[i]
+	}
+
+	order := make([]int, len(weights))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return remainders[order[a]] > remainders[order[b]]
+	})
+
+	for i := int64(0); i < amount-assigned; i++ {
+		amounts[order[i]]++
+	}
+
+	return amounts
+}
+
+// maxExactSettleUp is the most participants with a non zero balance for which
+// SettleUp searches for the fewest transfers. The search takes 2^n steps.
+const maxExactSettleUp = 16
+
+// settleParty is a participant with money to pay or receive. amount is
+// positive for creditors and negative for debtors.
+type settleParty struct {
+	id     int64
+	amount int64
+}
+
+// SettleUp returns the fewest transfers that bring every balance to zero.
+// Participants are split into the most groups whose balances cancel out,
+// each settled on its own with one transfer fewer than it has members.
+// Beyond maxExactSettleUp participants with a non zero balance everyone is
+// settled as one group, which still needs at most one transfer fewer than
+// there are such participants. Ties are broken by participant id so the plan
+// is stable.
+func SettleUp(balances []*Balance) []*Transfer {
+	parties := make([]*settleParty, 0, len(balances))
+	for _, b := range balances {
+		if b.Balance != 0 {
+			parties = append(parties, &settleParty{b.ParticipantID, b.Balance})
+		}
+	}
+	sort.Slice(parties, func(i, j int) bool { return parties[i].id < parties[j].id })
+
+	if len(parties) > maxExactSettleUp {
+		return settleGroup(parties)
+	}
+
+	transfers := make([]*Transfer, 0)
+	for _, group := range zeroSumGroups(parties) {
+		transfers = append(transfers, settleGroup(group)...)
+	}
+	return transfers
+}
+
+// zeroSumGroups partitions parties into as many groups with a zero total as
+// possible. best[mask] is the most such groups the parties in mask can be
+// split into, found by removing one party at a time. Following the removals
+// back from all parties, every mask with a zero total closes a group.
+func zeroSumGroups(parties []*settleParty) [][]*settleParty {
+	n := len(parties)
+	full := 1<<n - 1
+
+	sums := make([]int64, full+1)
+	best := make([]int, full+1)
+	removed := make([]int, full+1)
+
+	for mask := 1; mask <= full; mask++ {
+		sums[mask] = sums[mask&(mask-1)] + parties[bits.TrailingZeros(uint(mask))].amount
+
+		best[mask] = -1
+		for i := 0; i < n; i++ {
+			bit := 1 << i
+			if mask&bit == 0 {
+				continue
+			}
+			if best[mask^bit] > best[mask] {
+				best[mask] = best[mask^bit]
+				removed[mask] = i
+			}
+		}
+		if sums[mask] == 0 {
+			best[mask]++
+		}
+	}
+
+	groups := make([][]*settleParty, 0)
+	start := full
+	for mask := full; mask != 0; {
+		mask ^= 1 << removed[mask]
+		if sums[mask] != 0 {
+			continue
+		}
+
+		var group []*settleParty
+		for i := 0; i < n; i++ {
+			if (start^mask)&(1<<i) != 0 {
+				group = append(group, parties[i])
+			}
+		}
+		groups = append(groups, group)
+		start = mask
+	}
+
+	return groups
+}
+
+// settleGroup repeatedly lets the largest debtor of the group pay its largest
+// creditor. Every transfer clears at least one of them, and the last one
+// clears both when the balances add up to zero.
+func settleGroup(parties []*settleParty) []*Transfer {
+	var creditors, debtors []*settleParty
+	for _, p := range parties {
+		switch {
+		case p.amount > 0:
+			creditors = append(creditors, &settleParty{p.id, p.amount})
+		case p.amount < 0:
+			debtors = append(debtors, &settleParty{p.id, -p.amount})
+		}
+	}
+
+	largest := func(parties []*settleParty) *settleParty {
+		var best *settleParty
+		for _, p := range parties {
+			if p.amount == 0 {
+				continue
+			}
+			if best == nil || p.amount > best.amount || (p.amount == best.amount && p.id < best.id) {
+				best = p
+			}
+		}
+		return best
+	}
+
+	transfers := make([]*Transfer, 0)
+	for {
+		creditor, debtor := largest(creditors), largest(debtors)
+		if creditor == nil || debtor == nil {
+			return transfers
+		}
+
+		amount := min(creditor.amount, debtor.amount)
+		transfers = append(transfers, &Transfer{From: debtor.id, To: creditor.id, Amount: amount})
+		creditor.amount -= amount
+		debtor.amount -= amount
+	}
+}
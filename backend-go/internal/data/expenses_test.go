@@ -0,0 +1,225 @@
+package data
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/saiharsha/money-manager/pkg/validator"
+)
+
+func TestComputeShares(t *testing.T) {
+	tests := []struct {
+		name   string
+		amount int64
+		method string
+		values []float64
+		want   []int64
+	}{
+		{"equal even", 900, SplitEqual, []float64{0, 0, 0}, []int64{300, 300, 300}},
+		{"equal remainder goes to earlier shares", 1000, SplitEqual, []float64{0, 0, 0}, []int64{334, 333, 333}},
+		{"equal single share", 7, SplitEqual, []float64{0}, []int64{7}},
+		{"exact", 1000, SplitExact, []float64{250, 0, 750}, []int64{250, 0, 750}},
+		{"percent", 1000, SplitPercent, []float64{50, 30, 20}, []int64{500, 300, 200}},
+		{"percent with decimals", 1000, SplitPercent, []float64{33.33, 33.33, 33.34}, []int64{333, 333, 334}},
+		{"percent largest remainder", 999, SplitPercent, []float64{12.5, 87.5}, []int64{125, 874}},
+		{"shares", 1000, SplitShares, []float64{1, 2, 2}, []int64{200, 400, 400}},
+		{"shares remainder", 100, SplitShares, []float64{1, 1, 1}, []int64{34, 33, 33}},
+		{"shares largest remainder wins", 10, SplitShares, []float64{1, 2}, []int64{3, 7}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			expense := &Expense{Amount: tt.amount, SplitMethod: tt.method}
+			for i, value := range tt.values {
+				expense.Shares = append(expense.Shares, &ExpenseShare{ParticipantID: int64(i + 1), Value: value})
+			}
+
+			v := validator.NewValidator()
+			ComputeShares(v, expense)
+			if !v.Valid() {
+				t.Fatalf("unexpected errors: %v", v.Errors)
+			}
+
+			got := make([]int64, len(expense.Shares))
+			var total int64
+			for i, share := range expense.Shares {
+				got[i] = share.Amount
+				total += share.Amount
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+			if total != tt.amount {
+				t.Errorf("shares add up to %d, want %d", total, tt.amount)
+			}
+		})
+	}
+}
+
+func TestComputeSharesErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		amount  int64
+		method  string
+		values  []float64
+		wantKey string
+	}{
+		{"exact not adding up", 1000, SplitExact, []float64{400, 500}, "shares"},
+		{"exact negative", 1000, SplitExact, []float64{1100, -100}, "shares[1].value"},
+		{"exact fractional", 1000, SplitExact, []float64{499.5, 500.5}, "shares[0].value"},
+		{"percent not adding up", 1000, SplitPercent, []float64{50, 40}, "shares"},
+		{"percent out of range", 1000, SplitPercent, []float64{120, -20}, "shares[0].value"},
+		{"shares zero", 1000, SplitShares, []float64{0, 1}, "shares[0].value"},
+		{"shares fractional", 1000, SplitShares, []float64{1.5, 1}, "shares[0].value"},
+		{"unknown method", 1000, "thirds", []float64{1}, "split_method"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			expense := &Expense{Amount: tt.amount, SplitMethod: tt.method}
+			for i, value := range tt.values {
+				expense.Shares = append(expense.Shares, &ExpenseShare{ParticipantID: int64(i + 1), Value: value})
+			}
+
+			v := validator.NewValidator()
+			ComputeShares(v, expense)
+
+			if _, ok := v.Errors[tt.wantKey]; !ok {
+				t.Errorf("got errors %v, want one for %s", v.Errors, tt.wantKey)
+			}
+		})
+	}
+}
+
+func TestDistribute(t *testing.T) {
+	tests := []struct {
+		name    string
+		amount  int64
+		weights []int64
+		want    []int64
+	}{
+		{"no weights", 100, []int64{0, 0}, []int64{0, 0}},
+		{"exact", 100, []int64{1, 3}, []int64{25, 75}},
+		{"ties go to earlier weights", 2, []int64{1, 1, 1}, []int64{1, 1, 0}},
+		{"largest remainder first", 10, []int64{3, 3, 1}, []int64{4, 4, 2}},
+		{"zero weight gets nothing", 5, []int64{0, 1, 1}, []int64{0, 3, 2}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := distribute(tt.amount, tt.weights)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSettleUp(t *testing.T) {
+	tests := []struct {
+		name     string
+		balances []int64
+		want     []*Transfer
+	}{
+		{
+			name:     "settled",
+			balances: []int64{0, 0},
+			want:     []*Transfer{},
+		},
+		{
+			name:     "one debt",
+			balances: []int64{-500, 500, 0},
+			want:     []*Transfer{{From: 1, To: 2, Amount: 500}},
+		},
+		{
+			name:     "one creditor",
+			balances: []int64{900, -300, -600},
+			want:     []*Transfer{{From: 3, To: 1, Amount: 600}, {From: 2, To: 1, Amount: 300}},
+		},
+		{
+			// largest debtor to largest creditor would need four transfers
+			name:     "pairs that cancel are settled on their own",
+			balances: []int64{-5, -6, -2, 7, 6},
+			want: []*Transfer{
+				{From: 1, To: 4, Amount: 5},
+				{From: 3, To: 4, Amount: 2},
+				{From: 2, To: 5, Amount: 6},
+			},
+		},
+		{
+			name:     "ties are broken by participant id",
+			balances: []int64{-100, -100, 100, 100},
+			want:     []*Transfer{{From: 1, To: 3, Amount: 100}, {From: 2, To: 4, Amount: 100}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := SettleUp(testBalances(tt.balances))
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", formatTransfers(got), formatTransfers(tt.want))
+			}
+			checkSettled(t, tt.balances, got)
+		})
+	}
+}
+
+func TestSettleUpLargeGroup(t *testing.T) {
+	// more participants than the exact search handles fall back to one group
+	balances := make([]int64, maxExactSettleUp+4)
+	for i := range balances {
+		balances[i] = int64(i + 1)
+		if i%2 == 1 {
+			balances[i] = -int64(i)
+		}
+	}
+
+	got := SettleUp(testBalances(balances))
+
+	if len(got) >= len(balances) {
+		t.Errorf("got %d transfers for %d participants", len(got), len(balances))
+	}
+	checkSettled(t, balances, got)
+}
+
+func testBalances(amounts []int64) []*Balance {
+	balances := make([]*Balance, len(amounts))
+	for i, amount := range amounts {
+		balances[i] = &Balance{ParticipantID: int64(i + 1), Balance: amount}
+	}
+	return balances
+}
+
+// checkSettled applies the transfers and fails unless every balance is zero.
+func checkSettled(t *testing.T, amounts []int64, transfers []*Transfer) {
+	t.Helper()
+
+	left := make(map[int64]int64)
+	for i, amount := range amounts {
+		left[int64(i+1)] = amount
+	}
+
+	for _, transfer := range transfers {
+		if transfer.Amount <= 0 {
+			t.Errorf("transfer of %d from %d to %d", transfer.Amount, transfer.From, transfer.To)
+		}
+		left[transfer.From] += transfer.Amount
+		left[transfer.To] -= transfer.Amount
+	}
+
+	for id, amount := range left {
+		if amount != 0 {
+			t.Errorf("participant %d is left with %d", id, amount)
+		}
+	}
+}
+
+func formatTransfers(transfers []*Transfer) []Transfer {
+	list := make([]Transfer, len(transfers))
+	for i, transfer := range transfers {
+		list[i] = *transfer
+	}
+	return list
+}
@@ -1,6 +1,8 @@
 package data
 
 import (
+	"errors"
+	"fmt"
 	"math"
 	"strings"
 	"time"
@@ -15,6 +17,7 @@ type Filters struct {
 	SortSafeList []string
 	StartDate    time.Time
 	EndDate      time.Time
+	Expr         validator.FilterExpr
 }
 
 type Metadata struct {
@@ -74,3 +77,78 @@ func (f Filters) limit() int {
 func (f Filters) offset() int {
 	return (f.Page - 1) * f.PageSize
 }
+
+// queryArgs collects positional arguments while a query is being built so
+// that user input is always bound as a parameter and never concatenated.
+type queryArgs struct {
+	args []interface{}
+}
+
+// bind appends value to the argument list and returns its placeholder.
+func (q *queryArgs) bind(value interface{}) string {
+	q.args = append(q.args, value)
+	return fmt.Sprintf("$%d", len(q.args))
+}
+
+// compileFilter turns a parsed filter expression into a parameterised SQL
+// condition. columns maps each filter field to the SQL expression it reads.
+func compileFilter(expr validator.FilterExpr, columns map[string]string, q *queryArgs) (string, error) {
+	switch e := expr.(type) {
+	case validator.FilterAnd:
+		return compileFilterTerms(e.Terms, " AND ", columns, q)
+	case validator.FilterOr:
+		return compileFilterTerms(e.Terms, " OR ", columns, q)
+	case validator.FilterNot:
+		clause, err := compileFilter(e.Expr, columns, q)
+		if err != nil {
+			return "", err
+		}
+		return "NOT " + clause, nil
+	case validator.FilterCondition:
+		column, ok := columns[e.Field]
+		if !ok {
+			return "", fmt.Errorf("unsupported filter field %q", e.Field)
+		}
+
+		switch e.Operator {
+		case "=", "!=", "<", "<=", ">", ">=":
+			op := e.Operator
+			if op == "!=" {
+				op = "<>"
+			}
+			return fmt.Sprintf("(%s %s %s)", column, op, q.bind(e.Values[0])), nil
+		case "~":
+			value, ok := e.Values[0].(string)
+			if !ok {
+				return "", errors.New("contains filter requires a string value")
+			}
+			pattern := "%" + escapeLike(value) + "%"
+			return fmt.Sprintf(`(%s ILIKE %s ESCAPE '\')`, column, q.bind(pattern)), nil
+		case "in":
+			placeholders := make([]string, len(e.Values))
+			for i, value := range e.Values {
+				placeholders[i] = q.bind(value)
+			}
+			return fmt.Sprintf("(%s IN (%s))", column, strings.Join(placeholders, ", ")), nil
+		}
+		return "", fmt.Errorf("unsupported filter operator %q", e.Operator)
+	}
+
+	return "", errors.New("unsupported filter expression")
+}
+
+func compileFilterTerms(terms []validator.FilterExpr, sep string, columns map[string]string, q *queryArgs) (string, error) {
+	clauses := make([]string, len(terms))
+	for i, term := range terms {
+		clause, err := compileFilter(term, columns, q)
+		if err != nil {
+			return "", err
+		}
+		clauses[i] = clause
+	}
+	return "(" + strings.Join(clauses, sep) + ")", nil
+}
+
+func escapeLike(value string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(value)
+}
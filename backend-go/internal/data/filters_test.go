@@ -0,0 +1,80 @@
+package data
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/saiharsha/money-manager/pkg/validator"
+)
+
+func TestCompileFilter(t *testing.T) {
+	tests := []struct {
+		name     string
+		filter   string
+		want     string
+		wantArgs []interface{}
+	}{
+		{
+			name:     "comparison",
+			filter:   "amount>=100",
+			want:     "(records.amount >= $1)",
+			wantArgs: []interface{}{int64(100)},
+		},
+		{
+			name:     "not equal",
+			filter:   "currency_id!=3",
+			want:     "(records.currency_id <> $1)",
+			wantArgs: []interface{}{int64(3)},
+		},
+		{
+			name:     "contains escapes like patterns",
+			filter:   `description~"50%_off\\"`,
+			want:     `(records.description ILIKE $1 ESCAPE '\')`,
+			wantArgs: []interface{}{`%50\%\_off\\%`},
+		},
+		{
+			name:     "in list",
+			filter:   "type_id in (1,2)",
+			want:     "(records.type_id IN ($1, $2))",
+			wantArgs: []interface{}{int64(1), int64(2)},
+		},
+		{
+			name:     "nested",
+			filter:   "amount>1 and (type_id=2 or not has_comments)",
+			want:     "((records.amount > $1) AND ((records.type_id = $2) OR NOT (" + recordFilterColumns["has_comments"] + " = $3)))",
+			wantArgs: []interface{}{int64(1), int64(2), true},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := validator.NewValidator()
+			expr := validator.ParseFilter(v, "filter", tt.filter, RecordFilterFields)
+			if !v.Valid() {
+				t.Fatalf("unexpected errors: %v", v.Errors)
+			}
+
+			q := &queryArgs{}
+			got, err := compileFilter(expr, recordFilterColumns, q)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+			if !reflect.DeepEqual(q.args, tt.wantArgs) {
+				t.Errorf("got args %#v, want %#v", q.args, tt.wantArgs)
+			}
+		})
+	}
+}
+
+func TestCompileFilterUnknownField(t *testing.T) {
+	expr := validator.FilterCondition{Field: "user_id", Operator: "=", Values: []interface{}{int64(1)}}
+
+	_, err := compileFilter(expr, recordFilterColumns, &queryArgs{})
+	if err == nil {
+		t.Fatal("expected an error for a field without a column")
+	}
+}
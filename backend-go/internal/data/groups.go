@@ -0,0 +1,314 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/saiharsha/money-manager/pkg/validator"
+)
+
+type ExpenseGroupModel struct {
+	DB       *sql.DB
+	InfoLog  *log.Logger
+	ErrorLog *log.Logger
+}
+
+// ExpenseGroup is a set of people sharing costs, e.g. the people on a trip.
+// Groups live in a ledger and are visible to its members.
+type ExpenseGroup struct {
+	ID         int64     `json:"id"`
+	LedgerID   int64     `json:"ledger_id"`
+	Name       string    `json:"name"`
+	CurrencyID int64     `json:"currency_id"`
+	CreatedBy  int64     `json:"created_by"`
+	CreatedAt  time.Time `json:"created_at"`
+	Version    int64     `json:"version"`
+}
+
+// ExpenseParticipant is a member of a group. UserID is nil for guests, who
+// are only known by name.
+type ExpenseParticipant struct {
+	ID        int64     `json:"id"`
+	GroupID   int64     `json:"group_id"`
+	UserID    *int64    `json:"user_id,omitempty"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Balance is what a participant has paid and owes in a group. A positive
+// balance means the others owe the participant money.
+type Balance struct {
+	ParticipantID int64  `json:"participant_id"`
+	Name          string `json:"name"`
+	Paid          int64  `json:"paid"`
+	Owed          int64  `json:"owed"`
+	Balance       int64  `json:"balance"`
+}
+
+var (
+	ErrDuplicateParticipant = errors.New("duplicate participant")
+	ErrParticipantInUse     = errors.New("participant has expenses")
+)
+
+func (m *ExpenseGroupModel) Insert(group *ExpenseGroup) error {
+	query := `
+		INSERT INTO expense_groups (ledger_id, name, currency_id, created_by)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, created_at, version
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	args := []interface{}{group.LedgerID, group.Name, group.CurrencyID, group.CreatedBy}
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&group.ID, &group.CreatedAt, &group.Version)
+	if err != nil {
+		m.ErrorLog.Print(err)
+		return err
+	}
+
+	return nil
+}
+
+func (m *ExpenseGroupModel) GetForLedger(id int64, ledgerID int64) (*ExpenseGroup, error) {
+	query := `
+		SELECT id, ledger_id, name, currency_id, created_by, created_at, version
+		FROM expense_groups
+		WHERE id = $1 AND ledger_id = $2
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var group ExpenseGroup
+
+	err := m.DB.QueryRowContext(ctx, query, id, ledgerID).Scan(&group.ID, &group.LedgerID, &group.Name, &group.CurrencyID, &group.CreatedBy, &group.CreatedAt, &group.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			m.ErrorLog.Print(err)
+			return nil, err
+		}
+	}
+
+	return &group, nil
+}
+
+func (m *ExpenseGroupModel) GetAllForLedger(ledgerID int64) ([]*ExpenseGroup, error) {
+	query := `
+		SELECT id, ledger_id, name, currency_id, created_by, created_at, version
+		FROM expense_groups
+		WHERE ledger_id = $1
+		ORDER BY created_at DESC, id DESC
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, ledgerID)
+	if err != nil {
+		m.ErrorLog.Print(err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	groups := make([]*ExpenseGroup, 0)
+	for rows.Next() {
+		var group ExpenseGroup
+		err := rows.Scan(&group.ID, &group.LedgerID, &group.Name, &group.CurrencyID, &group.CreatedBy, &group.CreatedAt, &group.Version)
+		if err != nil {
+			m.ErrorLog.Print(err)
+			return nil, err
+		}
+		groups = append(groups, &group)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return groups, nil
+}
+
+// Delete removes the group with its participants and expenses. Records created
+// for repayments stay in the ledger.
+func (m *ExpenseGroupModel) Delete(id int64, ledgerID int64) error {
+	query := `
+		DELETE FROM expense_groups
+		WHERE id = $1 AND ledger_id = $2
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id, ledgerID)
+	if err != nil {
+		m.ErrorLog.Print(err)
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+func (m *ExpenseGroupModel) AddParticipant(participant *ExpenseParticipant) error {
+	query := `
+		INSERT INTO expense_participants (group_id, user_id, name)
+		VALUES ($1, $2, $3)
+		RETURNING id, created_at
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, participant.GroupID, participant.UserID, participant.Name).Scan(&participant.ID, &participant.CreatedAt)
+	if err != nil {
+		switch {
+		case err.Error() == `pq: duplicate key value violates unique constraint "expense_participants_group_id_user_id_key"`:
+			return ErrDuplicateParticipant
+		default:
+			m.ErrorLog.Print(err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (m *ExpenseGroupModel) GetParticipants(groupID int64) ([]*ExpenseParticipant, error) {
+	query := `
+		SELECT id, group_id, user_id, name, created_at
+		FROM expense_participants
+		WHERE group_id = $1
+		ORDER BY id ASC
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, groupID)
+	if err != nil {
+		m.ErrorLog.Print(err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	participants := make([]*ExpenseParticipant, 0)
+	for rows.Next() {
+		var p ExpenseParticipant
+		err := rows.Scan(&p.ID, &p.GroupID, &p.UserID, &p.Name, &p.CreatedAt)
+		if err != nil {
+			m.ErrorLog.Print(err)
+			return nil, err
+		}
+		participants = append(participants, &p)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return participants, nil
+}
+
+// RemoveParticipant takes a participant out of the group. Participants that
+// paid for or share in an expense cannot be removed.
+func (m *ExpenseGroupModel) RemoveParticipant(id int64, groupID int64) error {
+	query := `
+		DELETE FROM expense_participants
+		WHERE id = $1 AND group_id = $2
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id, groupID)
+	if err != nil {
+		switch {
+		case err.Error() == `pq: update or delete on table "expense_participants" violates foreign key constraint "expenses_paid_by_fkey" on table "expenses"`,
+			err.Error() == `pq: update or delete on table "expense_participants" violates foreign key constraint "expense_shares_participant_id_fkey" on table "expense_shares"`:
+			return ErrParticipantInUse
+		default:
+			m.ErrorLog.Print(err)
+			return err
+		}
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// Balances returns what every participant of the group has paid and owes,
+// repayments included.
+func (m *ExpenseGroupModel) Balances(groupID int64) ([]*Balance, error) {
+	query := `
+		SELECT p.id, p.name,
+			COALESCE((SELECT SUM(e.amount) FROM expenses e WHERE e.paid_by = p.id), 0),
+			COALESCE((SELECT SUM(s.amount) FROM expense_shares s WHERE s.participant_id = p.id), 0)
+		FROM expense_participants p
+		WHERE p.group_id = $1
+		ORDER BY p.id ASC
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, groupID)
+	if err != nil {
+		m.ErrorLog.Print(err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	balances := make([]*Balance, 0)
+	for rows.Next() {
+		var b Balance
+		err := rows.Scan(&b.ParticipantID, &b.Name, &b.Paid, &b.Owed)
+		if err != nil {
+			m.ErrorLog.Print(err)
+			return nil, err
+		}
+		b.Balance = b.Paid - b.Owed
+		balances = append(balances, &b)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return balances, nil
+}
+
+func ValidateExpenseGroup(v *validator.Validator, group *ExpenseGroup) {
+	v.Check(strings.TrimSpace(group.Name) != "", "name", "must be provided")
+	v.Check(len(group.Name) <= 100, "name", "must be at most 100 characters long")
+	v.Check(group.CurrencyID > 0, "currency_id", "must be provided")
+}
+
+func ValidateParticipantName(v *validator.Validator, name string) {
+	v.Check(strings.TrimSpace(name) != "", "name", "must be provided")
+	v.Check(len(name) <= 100, "name", "must be at most 100 characters long")
+}
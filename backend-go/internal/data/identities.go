@@ -0,0 +1,131 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"time"
+)
+
+var (
+	ErrDuplicateIdentity = errors.New("duplicate identity")
+)
+
+type IdentityModel struct {
+	DB       *sql.DB
+	InfoLog  *log.Logger
+	ErrorLog *log.Logger
+}
+
+// GetUser returns the user linked to the account subject at the provider
+// issuer.
+func (m *IdentityModel) GetUser(issuer, subject string) (*User, error) {
+	query := `
+		SELECT ` + userColumns + `
+		FROM users
+		WHERE id = (SELECT user_id FROM user_identities WHERE issuer = $1 AND subject = $2)
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var user User
+
+	err := m.DB.QueryRowContext(ctx, query, issuer, subject).Scan(userFields(&user)...)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			m.ErrorLog.Print(err)
+			return nil, err
+		}
+	}
+
+	return &user, nil
+}
+
+// Link connects an existing, activated user to an account at a provider.
+// Unactivated users are not linked: anyone can sign up with an address they
+// do not own, and linking would hand that account to the address's owner
+// with the squatter's password still working.
+func (m *IdentityModel) Link(user *User, issuer, subject string) error {
+	if !user.Activated {
+		return ErrRecordNotFound
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = insertIdentity(ctx, tx, user.ID, issuer, subject, user.Email)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Provision creates a user for a first login through a provider and links
+// it to the provider account.
+func (m *IdentityModel) Provision(user *User, issuer, subject string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `
+		INSERT INTO users (name, email, password_hash, activated, role)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, created_at, version
+	`
+
+	args := []interface{}{user.Name, user.Email, user.Password.hashed, user.Activated, user.Role}
+
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&user.ID, &user.CreatedAt, &user.Version)
+	if err != nil {
+		switch {
+		case err.Error() == `pq: duplicate key value violates unique constraint "users_email_key"`:
+			return ErrDuplicateEmail
+		default:
+			m.ErrorLog.Print(err)
+			return err
+		}
+	}
+
+	err = insertIdentity(ctx, tx, user.ID, issuer, subject, user.Email)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func insertIdentity(ctx context.Context, tx *sql.Tx, userID int64, issuer, subject, email string) error {
+	query := `
+		INSERT INTO user_identities (user_id, issuer, subject, email)
+		VALUES ($1, $2, $3, $4)
+	`
+
+	_, err := tx.ExecContext(ctx, query, userID, issuer, subject, email)
+	if err != nil {
+		switch {
+		case err.Error() == `pq: duplicate key value violates unique constraint "user_identities_issuer_subject_key"`:
+			return ErrDuplicateIdentity
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,680 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/saiharsha/money-manager/pkg/validator"
+)
+
+type LedgerModel struct {
+	DB       *sql.DB
+	InfoLog  *log.Logger
+	ErrorLog *log.Logger
+}
+
+// Ledger groups records. Every user has a personal ledger that only they can
+// see; shared ledgers are created explicitly and have members with a role.
+type Ledger struct {
+	ID        int64     `json:"id"`
+	Name      string    `json:"name"`
+	Personal  bool      `json:"personal"`
+	CreatedBy int64     `json:"created_by"`
+	Role      string    `json:"role,omitempty"` // role of the requesting user
+	CreatedAt time.Time `json:"created_at"`
+	Version   int64     `json:"version"`
+}
+
+type LedgerMember struct {
+	LedgerID  int64     `json:"ledger_id"`
+	UserID    int64     `json:"user_id"`
+	Name      string    `json:"name"`
+	Email     string    `json:"email"`
+	Role      string    `json:"role"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type LedgerInvitation struct {
+	ID        int64     `json:"id"`
+	LedgerID  int64     `json:"ledger_id"`
+	Email     string    `json:"email"`
+	Role      string    `json:"role"`
+	InvitedBy int64     `json:"invited_by"`
+	Expiry    time.Time `json:"expiry"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// LedgerInvitationDetails is what the invitation link shows before the
+// invited user logs in to accept it.
+type LedgerInvitationDetails struct {
+	LedgerInvitation
+	LedgerName  string `json:"ledger_name"`
+	InviterName string `json:"inviter_name"`
+}
+
+const (
+	LedgerOwner  = "owner"
+	LedgerEditor = "editor"
+	LedgerViewer = "viewer"
+
+	// InvitationTTL is how long a ledger invitation can be accepted.
+	InvitationTTL = 7 * 24 * time.Hour
+)
+
+var (
+	ErrLedgerNotEmpty    = errors.New("ledger still has records")
+	ErrLastOwner         = errors.New("ledger must keep at least one owner")
+	ErrAlreadyMember     = errors.New("user is already a member of the ledger")
+	ErrInvalidInvitation = errors.New("invitation is invalid or has expired")
+)
+
+// GetPersonal returns the user's personal ledger, creating it on first use.
+func (m *LedgerModel) GetPersonal(userID int64) (*Ledger, error) {
+	query := `
+		WITH created AS (
+			INSERT INTO ledgers (name, personal, created_by)
+			VALUES ('Personal', TRUE, $1)
+			ON CONFLICT (created_by) WHERE personal DO NOTHING
+			RETURNING id, name, personal, created_by, created_at, version
+		), member AS (
+			INSERT INTO ledger_members (ledger_id, user_id, role)
+			SELECT id, $1, 'owner' FROM created
+		)
+		SELECT id, name, personal, created_by, created_at, version FROM created
+		UNION ALL
+		SELECT id, name, personal, created_by, created_at, version FROM ledgers
+		WHERE created_by = $1 AND personal
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	ledger := Ledger{Role: LedgerOwner}
+
+	err := m.DB.QueryRowContext(ctx, query, userID).Scan(&ledger.ID, &ledger.Name, &ledger.Personal, &ledger.CreatedBy, &ledger.CreatedAt, &ledger.Version)
+	if errors.Is(err, sql.ErrNoRows) {
+		// a concurrent request created the ledger after this statement's
+		// snapshot was taken, it is visible to the next one
+		err = m.DB.QueryRowContext(ctx, query, userID).Scan(&ledger.ID, &ledger.Name, &ledger.Personal, &ledger.CreatedBy, &ledger.CreatedAt, &ledger.Version)
+	}
+	if err != nil {
+		m.ErrorLog.Print(err)
+		return nil, err
+	}
+
+	return &ledger, nil
+}
+
+// GetForMember returns the ledger with the role the user has in it. Ledgers
+// the user is not a member of are reported as not found.
+func (m *LedgerModel) GetForMember(id int64, userID int64) (*Ledger, error) {
+	query := `
+		SELECT l.id, l.name, l.personal, l.created_by, lm.role, l.created_at, l.version
+		FROM ledgers l
+		INNER JOIN ledger_members lm ON lm.ledger_id = l.id
+		WHERE l.id = $1 AND lm.user_id = $2
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var ledger Ledger
+
+	err := m.DB.QueryRowContext(ctx, query, id, userID).Scan(&ledger.ID, &ledger.Name, &ledger.Personal, &ledger.CreatedBy, &ledger.Role, &ledger.CreatedAt, &ledger.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			m.ErrorLog.Print(err)
+			return nil, err
+		}
+	}
+
+	return &ledger, nil
+}
+
+// GetAllForUser lists the ledgers the user can switch to, personal first.
+func (m *LedgerModel) GetAllForUser(userID int64) ([]*Ledger, error) {
+	query := `
+		SELECT l.id, l.name, l.personal, l.created_by, lm.role, l.created_at, l.version
+		FROM ledgers l
+		INNER JOIN ledger_members lm ON lm.ledger_id = l.id
+		WHERE lm.user_id = $1
+		ORDER BY l.personal DESC, l.name ASC, l.id ASC
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		m.ErrorLog.Print(err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	ledgers := make([]*Ledger, 0)
+	for rows.Next() {
+		var ledger Ledger
+		err := rows.Scan(&ledger.ID, &ledger.Name, &ledger.Personal, &ledger.CreatedBy, &ledger.Role, &ledger.CreatedAt, &ledger.Version)
+		if err != nil {
+			m.ErrorLog.Print(err)
+			return nil, err
+		}
+		ledgers = append(ledgers, &ledger)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return ledgers, nil
+}
+
+// Insert creates a shared ledger with its creator as the owner.
+func (m *LedgerModel) Insert(ledger *Ledger) error {
+	query := `
+		INSERT INTO ledgers (name, created_by)
+		VALUES ($1, $2)
+		RETURNING id, created_at, version
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRowContext(ctx, query, ledger.Name, ledger.CreatedBy).Scan(&ledger.ID, &ledger.CreatedAt, &ledger.Version)
+	if err != nil {
+		m.ErrorLog.Print(err)
+		return err
+	}
+
+	query = `
+		INSERT INTO ledger_members (ledger_id, user_id, role)
+		VALUES ($1, $2, 'owner')
+	`
+
+	_, err = tx.ExecContext(ctx, query, ledger.ID, ledger.CreatedBy)
+	if err != nil {
+		m.ErrorLog.Print(err)
+		return err
+	}
+
+	ledger.Role = LedgerOwner
+
+	return tx.Commit()
+}
+
+func (m *LedgerModel) Update(ledger *Ledger) error {
+	query := `
+		UPDATE ledgers
+		SET name = $1, version = version + 1
+		WHERE id = $2 AND version = $3
+		RETURNING version
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, ledger.Name, ledger.ID, ledger.Version).Scan(&ledger.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			m.ErrorLog.Print(err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Delete removes a shared ledger. Ledgers that still hold records, including
+// records in the trash, cannot be deleted.
+func (m *LedgerModel) Delete(id int64) error {
+	query := `
+		DELETE FROM ledgers
+		WHERE id = $1 AND NOT personal
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id)
+	if err != nil {
+		switch {
+		case err.Error() == `pq: update or delete on table "ledgers" violates foreign key constraint "records_ledger_id_fkey" on table "records"`:
+			return ErrLedgerNotEmpty
+		default:
+			m.ErrorLog.Print(err)
+			return err
+		}
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+func (m *LedgerModel) GetMembers(ledgerID int64) ([]*LedgerMember, error) {
+	query := `
+		SELECT lm.ledger_id, lm.user_id, u.name, u.email, lm.role, lm.created_at
+		FROM ledger_members lm
+		INNER JOIN users u ON u.id = lm.user_id
+		WHERE lm.ledger_id = $1
+		ORDER BY lm.created_at ASC, lm.user_id ASC
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, ledgerID)
+	if err != nil {
+		m.ErrorLog.Print(err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := make([]*LedgerMember, 0)
+	for rows.Next() {
+		var member LedgerMember
+		err := rows.Scan(&member.LedgerID, &member.UserID, &member.Name, &member.Email, &member.Role, &member.CreatedAt)
+		if err != nil {
+			m.ErrorLog.Print(err)
+			return nil, err
+		}
+		members = append(members, &member)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return members, nil
+}
+
+// SetMemberRole changes the role of a member. The last owner of a ledger
+// cannot be demoted.
+func (m *LedgerModel) SetMemberRole(ledgerID int64, userID int64, role string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	current, owners, err := lockMembers(ctx, tx, ledgerID, userID)
+	if err != nil {
+		return err
+	}
+
+	if current == LedgerOwner && role != LedgerOwner && owners == 1 {
+		return ErrLastOwner
+	}
+
+	query := `
+		UPDATE ledger_members
+		SET role = $3
+		WHERE ledger_id = $1 AND user_id = $2
+	`
+
+	_, err = tx.ExecContext(ctx, query, ledgerID, userID, role)
+	if err != nil {
+		m.ErrorLog.Print(err)
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// RemoveMember takes a user out of a ledger. The last owner of a ledger
+// cannot be removed.
+func (m *LedgerModel) RemoveMember(ledgerID int64, userID int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	current, owners, err := lockMembers(ctx, tx, ledgerID, userID)
+	if err != nil {
+		return err
+	}
+
+	if current == LedgerOwner && owners == 1 {
+		return ErrLastOwner
+	}
+
+	query := `
+		DELETE FROM ledger_members
+		WHERE ledger_id = $1 AND user_id = $2
+	`
+
+	_, err = tx.ExecContext(ctx, query, ledgerID, userID)
+	if err != nil {
+		m.ErrorLog.Print(err)
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// lockMembers locks the memberships of a ledger for the rest of the
+// transaction and returns the role of userID and the number of owners.
+func lockMembers(ctx context.Context, tx *sql.Tx, ledgerID int64, userID int64) (string, int, error) {
+	query := `
+		SELECT user_id, role
+		FROM ledger_members
+		WHERE ledger_id = $1
+		FOR UPDATE
+	`
+
+	rows, err := tx.QueryContext(ctx, query, ledgerID)
+	if err != nil {
+		return "", 0, err
+	}
+	defer rows.Close()
+
+	var current string
+	var owners int
+	for rows.Next() {
+		var memberID int64
+		var role string
+		err := rows.Scan(&memberID, &role)
+		if err != nil {
+			return "", 0, err
+		}
+		if memberID == userID {
+			current = role
+		}
+		if role == LedgerOwner {
+			owners++
+		}
+	}
+
+	if err = rows.Err(); err != nil {
+		return "", 0, err
+	}
+
+	if current == "" {
+		return "", 0, ErrRecordNotFound
+	}
+
+	return current, owners, nil
+}
+
+// CreateInvitation stores an invitation to join a ledger and returns the
+// plaintext token to send to the invitee. Only a hash of the token is kept.
+// A pending invitation for the same email is replaced.
+func (m *LedgerModel) CreateInvitation(invitation *LedgerInvitation) (string, error) {
+	token, hash, err := generateToken()
+	if err != nil {
+		return "", err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	query := `
+		SELECT EXISTS (
+			SELECT 1 FROM ledger_members lm
+			INNER JOIN users u ON u.id = lm.user_id
+			WHERE lm.ledger_id = $1 AND lower(u.email) = lower($2)
+		)
+	`
+
+	var member bool
+	err = tx.QueryRowContext(ctx, query, invitation.LedgerID, invitation.Email).Scan(&member)
+	if err != nil {
+		m.ErrorLog.Print(err)
+		return "", err
+	}
+
+	if member {
+		return "", ErrAlreadyMember
+	}
+
+	query = `
+		DELETE FROM ledger_invitations
+		WHERE ledger_id = $1 AND lower(email) = lower($2) AND accepted_at IS NULL
+	`
+
+	_, err = tx.ExecContext(ctx, query, invitation.LedgerID, invitation.Email)
+	if err != nil {
+		m.ErrorLog.Print(err)
+		return "", err
+	}
+
+	query = `
+		INSERT INTO ledger_invitations (ledger_id, email, role, token_hash, invited_by, expiry)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id, created_at
+	`
+
+	invitation.Expiry = time.Now().Add(InvitationTTL)
+	args := []interface{}{invitation.LedgerID, invitation.Email, invitation.Role, hash, invitation.InvitedBy, invitation.Expiry}
+
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&invitation.ID, &invitation.CreatedAt)
+	if err != nil {
+		m.ErrorLog.Print(err)
+		return "", err
+	}
+
+	return token, tx.Commit()
+}
+
+// GetInvitations lists the pending invitations of a ledger.
+func (m *LedgerModel) GetInvitations(ledgerID int64) ([]*LedgerInvitation, error) {
+	query := `
+		SELECT id, ledger_id, email, role, invited_by, expiry, created_at
+		FROM ledger_invitations
+		WHERE ledger_id = $1 AND accepted_at IS NULL AND expiry > NOW()
+		ORDER BY created_at ASC, id ASC
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, ledgerID)
+	if err != nil {
+		m.ErrorLog.Print(err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	invitations := make([]*LedgerInvitation, 0)
+	for rows.Next() {
+		var inv LedgerInvitation
+		err := rows.Scan(&inv.ID, &inv.LedgerID, &inv.Email, &inv.Role, &inv.InvitedBy, &inv.Expiry, &inv.CreatedAt)
+		if err != nil {
+			m.ErrorLog.Print(err)
+			return nil, err
+		}
+		invitations = append(invitations, &inv)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return invitations, nil
+}
+
+func (m *LedgerModel) DeleteInvitation(id int64, ledgerID int64) error {
+	query := `
+		DELETE FROM ledger_invitations
+		WHERE id = $1 AND ledger_id = $2 AND accepted_at IS NULL
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id, ledgerID)
+	if err != nil {
+		m.ErrorLog.Print(err)
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// GetInvitation returns a pending, unexpired invitation by its token, along
+// with the names of the ledger and of the member who sent it.
+func (m *LedgerModel) GetInvitation(token string) (*LedgerInvitationDetails, error) {
+	hash := sha256.Sum256([]byte(token))
+
+	query := `
+		SELECT i.id, i.ledger_id, i.email, i.role, i.invited_by, i.expiry, i.created_at, l.name, u.name
+		FROM ledger_invitations i
+		INNER JOIN ledgers l ON l.id = i.ledger_id
+		INNER JOIN users u ON u.id = i.invited_by
+		WHERE i.token_hash = $1 AND i.accepted_at IS NULL AND i.expiry > NOW()
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var invitation LedgerInvitationDetails
+	err := m.DB.QueryRowContext(ctx, query, hash[:]).Scan(
+		&invitation.ID,
+		&invitation.LedgerID,
+		&invitation.Email,
+		&invitation.Role,
+		&invitation.InvitedBy,
+		&invitation.Expiry,
+		&invitation.CreatedAt,
+		&invitation.LedgerName,
+		&invitation.InviterName,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrInvalidInvitation
+		default:
+			m.ErrorLog.Print(err)
+			return nil, err
+		}
+	}
+
+	return &invitation, nil
+}
+
+// AcceptInvitation adds the user to the ledger the token invites them to. The
+// invitation must be pending, unexpired and addressed to the user's email.
+// A user who is already a member keeps their current role.
+func (m *LedgerModel) AcceptInvitation(token string, userID int64, email string) (*Ledger, error) {
+	hash := sha256.Sum256([]byte(token))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	query := `
+		UPDATE ledger_invitations
+		SET accepted_at = NOW()
+		WHERE token_hash = $1 AND lower(email) = lower($2) AND accepted_at IS NULL AND expiry > NOW()
+		RETURNING ledger_id, role
+	`
+
+	var ledgerID int64
+	var role string
+	err = tx.QueryRowContext(ctx, query, hash[:], email).Scan(&ledgerID, &role)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrInvalidInvitation
+		default:
+			m.ErrorLog.Print(err)
+			return nil, err
+		}
+	}
+
+	query = `
+		INSERT INTO ledger_members (ledger_id, user_id, role)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (ledger_id, user_id) DO NOTHING
+	`
+
+	_, err = tx.ExecContext(ctx, query, ledgerID, userID, role)
+	if err != nil {
+		m.ErrorLog.Print(err)
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	return m.GetForMember(ledgerID, userID)
+}
+
+// generateToken returns a random token for use in links together with the
+// SHA-256 hash under which it is stored.
+func generateToken() (string, []byte, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", nil, err
+	}
+
+	token := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b)
+	hash := sha256.Sum256([]byte(token))
+
+	return token, hash[:], nil
+}
+
+func ValidateLedger(v *validator.Validator, ledger *Ledger) {
+	v.Check(strings.TrimSpace(ledger.Name) != "", "name", "must be provided")
+	v.Check(len(ledger.Name) <= 100, "name", "must be at most 100 characters long")
+}
+
+func ValidateLedgerRole(v *validator.Validator, role string) {
+	v.Check(validator.In(role, LedgerOwner, LedgerEditor, LedgerViewer), "role", "must be one of owner, editor or viewer")
+}
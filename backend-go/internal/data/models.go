@@ -15,11 +15,28 @@ var (
 
 // Models struct is a single convenient container to hold and represent all our database models.
 type Models struct {
-	Users       UserModel
-	Currencies  CurrencyModel
-	RecordTypes RecordTypeModel
-	Records     RecordModel
-	Comments    CommentModel
+	Users        UserModel
+	Currencies   CurrencyModel
+	RecordTypes  RecordTypeModel
+	Records      RecordModel
+	Revisions    RecordRevisionModel
+	Comments     CommentModel
+	Search       SearchModel
+	Views        SavedViewModel
+	Trash        TrashModel
+	Attachments  AttachmentModel
+	Reports      ReportModel
+	Ledgers      LedgerModel
+	Groups       ExpenseGroupModel
+	Expenses     ExpenseModel
+	MFA          MFAModel
+	AccessTokens AccessTokenModel
+	Identities   IdentityModel
+	Tokens       TokenModel
+	Accounts     AccountModel
+	Audit        AuditModel
+	Roles        RoleModel
+	Sessions     SessionModel
 }
 
 func NewModels(db *sql.DB) Models {
@@ -46,10 +63,95 @@ func NewModels(db *sql.DB) Models {
 			InfoLog:  infoLog,
 			ErrorLog: errorLog,
 		},
+		Revisions: RecordRevisionModel{
+			DB:       db,
+			InfoLog:  infoLog,
+			ErrorLog: errorLog,
+		},
 		Comments: CommentModel{
 			DB:       db,
 			InfoLog:  infoLog,
 			ErrorLog: errorLog,
 		},
+		Search: SearchModel{
+			DB:       db,
+			InfoLog:  infoLog,
+			ErrorLog: errorLog,
+		},
+		Views: SavedViewModel{
+			DB:       db,
+			InfoLog:  infoLog,
+			ErrorLog: errorLog,
+		},
+		Trash: TrashModel{
+			DB:       db,
+			InfoLog:  infoLog,
+			ErrorLog: errorLog,
+		},
+		Attachments: AttachmentModel{
+			DB:       db,
+			InfoLog:  infoLog,
+			ErrorLog: errorLog,
+		},
+		Reports: ReportModel{
+			DB:       db,
+			InfoLog:  infoLog,
+			ErrorLog: errorLog,
+		},
+		Ledgers: LedgerModel{
+			DB:       db,
+			InfoLog:  infoLog,
+			ErrorLog: errorLog,
+		},
+		Groups: ExpenseGroupModel{
+			DB:       db,
+			InfoLog:  infoLog,
+			ErrorLog: errorLog,
+		},
+		Expenses: ExpenseModel{
+			DB:       db,
+			InfoLog:  infoLog,
+			ErrorLog: errorLog,
+		},
+		MFA: MFAModel{
+			DB:       db,
+			InfoLog:  infoLog,
+			ErrorLog: errorLog,
+		},
+		AccessTokens: AccessTokenModel{
+			DB:       db,
+			InfoLog:  infoLog,
+			ErrorLog: errorLog,
+		},
+		Identities: IdentityModel{
+			DB:       db,
+			InfoLog:  infoLog,
+			ErrorLog: errorLog,
+		},
+		Tokens: TokenModel{
+			DB:       db,
+			InfoLog:  infoLog,
+			ErrorLog: errorLog,
+		},
+		Accounts: AccountModel{
+			DB:       db,
+			InfoLog:  infoLog,
+			ErrorLog: errorLog,
+		},
+		Audit: AuditModel{
+			DB:       db,
+			InfoLog:  infoLog,
+			ErrorLog: errorLog,
+		},
+		Roles: RoleModel{
+			DB:       db,
+			InfoLog:  infoLog,
+			ErrorLog: errorLog,
+		},
+		Sessions: SessionModel{
+			DB:       db,
+			InfoLog:  infoLog,
+			ErrorLog: errorLog,
+		},
 	}
 }
@@ -6,6 +6,7 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"strings"
 	"time"
 
 	"github.com/saiharsha/money-manager/pkg/validator"
@@ -18,35 +19,88 @@ type RecordModel struct {
 }
 
 type Record struct {
-	ID          int64     `json:"id"`
-	Amount      int64     `json:"amount"`
-	Description string    `json:"description"`
-	TypeID      int64     `json:"type_id"`
-	CurrencyID  int64     `json:"currency_id"`
-	UserID      int64     `json:"user_id"`
-	CreatedAt   time.Time `json:"created_at"`
-	Version     int64     `json:"version"`
+	ID          int64        `json:"id"`
+	Amount      int64        `json:"amount"`
+	Description string       `json:"description"`
+	TypeID      int64        `json:"type_id"`
+	CurrencyID  int64        `json:"currency_id"`
+	UserID      int64        `json:"user_id"`
+	LedgerID    int64        `json:"ledger_id"`
+	OccurredAt  time.Time    `json:"occurred_at"`
+	HasTime     bool         `json:"has_time"`
+	Timezone    string       `json:"timezone"`
+	CreatedAt   time.Time    `json:"created_at"`
+	UpdatedAt   time.Time    `json:"updated_at"`
+	Version     int64        `json:"version"`
+	Splits      RecordSplits `json:"splits,omitempty"`
 }
 
 var (
 	ErrDuplicateRecord = errors.New("duplicate record")
 )
 
-func (r *RecordModel) Insert(record *Record) error {
-	query := `
-		INSERT INTO records (amount, description, type_id, currency_id, user_id)
-		VALUES ($1, $2, $3, $4, $5)
-		RETURNING id, created_at, version
-	`
+// RecordSortSafeList lists the values accepted by the sort parameter of the
+// records list endpoint.
+var RecordSortSafeList = []string{"id", "amount", "occurred_at", "created_at", "-id", "-amount", "-occurred_at", "-created_at"}
+
+// RecordFilterFields lists the fields that can be used in the filter
+// expression of the records list endpoint.
+var RecordFilterFields = map[string]validator.FilterField{
+	"amount":       {Kind: validator.FilterNumber, Operators: []string{"=", "!=", "<", "<=", ">", ">=", "in"}, Bits: 32},
+	"type_id":      {Kind: validator.FilterNumber, Operators: []string{"=", "!=", "in"}, Bits: 32},
+	"currency_id":  {Kind: validator.FilterNumber, Operators: []string{"=", "!=", "in"}, Bits: 32},
+	"description":  {Kind: validator.FilterString, Operators: []string{"=", "!=", "~"}},
+	"has_comments": {Kind: validator.FilterBool, Operators: []string{"=", "!="}},
+}
+
+var recordFilterColumns = map[string]string{
+	"amount":       "records.amount",
+	"type_id":      "records.type_id",
+	"currency_id":  "records.currency_id",
+	"description":  "records.description",
+	"has_comments": "EXISTS (SELECT 1 FROM comments WHERE comments.record_id = records.id AND comments.deleted_at IS NULL)",
+}
 
+// Insert creates the record, its split lines, its first revision and the
+// audit event in one transaction.
+func (r *RecordModel) Insert(record *Record, src AuditSource) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	args := []interface{}{record.Amount, record.Description, record.TypeID, record.CurrencyID, record.UserID}
+	tx, err := r.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
 
-	err := r.DB.QueryRowContext(ctx, query, args...).Scan(&record.ID, &record.CreatedAt, &record.Version)
+	err = insertRecord(ctx, tx, record)
 	if err != nil {
 		r.ErrorLog.Print(err.Error())
+		return err
+	}
+
+	err = auditLedgerChange(ctx, tx, src, record.LedgerID, AuditRecordCreate, "record", "records", record.ID, nil)
+	if err != nil {
+		r.ErrorLog.Print(err.Error())
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// insertRecord writes a new record with its split lines and first revision
+// inside tx, so other models can create records atomically with their rows.
+func insertRecord(ctx context.Context, tx *sql.Tx, record *Record) error {
+	query := `
+		INSERT INTO records (amount, description, type_id, currency_id, user_id, ledger_id, occurred_at, has_time, timezone)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		RETURNING id, created_at, updated_at, version
+	`
+
+	args := []interface{}{record.Amount, record.Description, record.TypeID, record.CurrencyID, record.UserID, record.LedgerID, record.OccurredAt, record.HasTime, record.Timezone}
+
+	err := tx.QueryRowContext(ctx, query, args...).Scan(&record.ID, &record.CreatedAt, &record.UpdatedAt, &record.Version)
+	if err != nil {
 		switch {
 		case err.Error() == `pq: duplicate key value violates unique constraint "records_pkey"`:
 			return ErrDuplicateRecord
@@ -55,14 +109,19 @@ func (r *RecordModel) Insert(record *Record) error {
 		}
 	}
 
-	return nil
+	err = replaceSplits(ctx, tx, record)
+	if err != nil {
+		return err
+	}
+
+	return insertRevision(ctx, tx, record, record.UserID, nil)
 }
 
 func (r *RecordModel) GetByID(id int64) (*Record, error) {
 	query := `
-		SELECT id, amount, description, type_id, currency_id, created_at, version, user_id
+		SELECT id, amount, description, type_id, currency_id, occurred_at, has_time, timezone, created_at, updated_at, version, user_id, ledger_id
 		FROM records
-		WHERE id = $1
+		WHERE id = $1 AND deleted_at IS NULL
 	`
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
@@ -70,7 +129,7 @@ func (r *RecordModel) GetByID(id int64) (*Record, error) {
 
 	var record Record
 
-	err := r.DB.QueryRowContext(ctx, query, id).Scan(&record.ID, &record.Amount, &record.Description, &record.TypeID, &record.CurrencyID, &record.CreatedAt, &record.Version, &record.UserID)
+	err := r.DB.QueryRowContext(ctx, query, id).Scan(&record.ID, &record.Amount, &record.Description, &record.TypeID, &record.CurrencyID, &record.OccurredAt, &record.HasTime, &record.Timezone, &record.CreatedAt, &record.UpdatedAt, &record.Version, &record.UserID, &record.LedgerID)
 	if err != nil {
 		r.ErrorLog.Print(err.Error())
 		switch {
@@ -81,53 +140,126 @@ func (r *RecordModel) GetByID(id int64) (*Record, error) {
 		}
 	}
 
+	err = loadSplits(r.DB, &record)
+	if err != nil {
+		r.ErrorLog.Print(err.Error())
+		return nil, err
+	}
+
 	return &record, nil
 }
 
-func (r *RecordModel) Delete(id int64) error {
+// Delete moves a record of the ledger to the trash together with its comments.
+// The comments share the record's deleted_at so that restoring the record
+// brings back exactly the comments that were trashed with it.
+func (r *RecordModel) Delete(id int64, ledgerID int64, src AuditSource) error {
 	if id < 1 {
 		return ErrRecordNotFound
 	}
 
 	query := `
-		DELETE FROM records
-		WHERE id = $1
+		UPDATE records
+		SET deleted_at = NOW()
+		WHERE id = $1 AND ledger_id = $2 AND deleted_at IS NULL
+		RETURNING deleted_at
 	`
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	result, err := r.DB.ExecContext(ctx, query, id)
+	tx, err := r.DB.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
+	defer tx.Rollback()
 
-	rowsAffected, err := result.RowsAffected()
+	before, err := auditRow(ctx, tx, "records", id)
 	if err != nil {
+		r.ErrorLog.Print(err.Error())
 		return err
 	}
 
-	if rowsAffected == 0 {
-		return ErrRecordNotFound
+	var deletedAt time.Time
+	err = tx.QueryRowContext(ctx, query, id, ledgerID).Scan(&deletedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrRecordNotFound
+		default:
+			r.ErrorLog.Print(err.Error())
+			return err
+		}
+	}
+
+	query = `
+		UPDATE comments
+		SET deleted_at = $1
+		WHERE record_id = $2 AND deleted_at IS NULL
+	`
+
+	_, err = tx.ExecContext(ctx, query, deletedAt, id)
+	if err != nil {
+		r.ErrorLog.Print(err.Error())
+		return err
+	}
+
+	err = auditLedgerChange(ctx, tx, src, ledgerID, AuditRecordDelete, "record", "records", id, before)
+	if err != nil {
+		r.ErrorLog.Print(err.Error())
+		return err
 	}
 
-	return nil
+	return tx.Commit()
 }
 
-func (r *RecordModel) Update(record *Record) error {
+// Update saves the record as a new version and stores that version in its
+// history, attributed to changedBy.
+func (r *RecordModel) Update(record *Record, changedBy int64, src AuditSource) error {
+	return r.update(record, changedBy, nil, AuditRecordUpdate, src)
+}
+
+// Restore writes the fields of an earlier revision back to the record. The
+// result is saved as a new version so the history in between is kept.
+func (r *RecordModel) Restore(record *Record, revision *RecordRevision, changedBy int64, src AuditSource) error {
+	record.Amount = revision.Amount
+	record.Description = revision.Description
+	record.TypeID = revision.TypeID
+	record.CurrencyID = revision.CurrencyID
+	record.OccurredAt = revision.OccurredAt
+	record.HasTime = revision.HasTime
+	record.Timezone = revision.Timezone
+	record.Splits = revision.Splits
+
+	return r.update(record, changedBy, &revision.Version, AuditRecordRestore, src)
+}
+
+func (r *RecordModel) update(record *Record, changedBy int64, restoredFrom *int64, action string, src AuditSource) error {
 	query := `
 		UPDATE records
-		SET amount = $1, description = $2, type_id = $3, currency_id = $4, version = version + 1
-		WHERE id = $5 AND version = $6 AND user_id = $7
-		RETURNING version
+		SET amount = $1, description = $2, type_id = $3, currency_id = $4, occurred_at = $5, has_time = $6, timezone = $7,
+			updated_at = NOW(), version = version + 1
+		WHERE id = $8 AND version = $9 AND ledger_id = $10 AND deleted_at IS NULL
+		RETURNING updated_at, version
 	`
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	args := []interface{}{&record.Amount, &record.Description, &record.TypeID, &record.CurrencyID, &record.ID, &record.Version, &record.UserID}
+	tx, err := r.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	before, err := auditRow(ctx, tx, "records", record.ID)
+	if err != nil {
+		r.ErrorLog.Print(err.Error())
+		return err
+	}
+
+	args := []interface{}{&record.Amount, &record.Description, &record.TypeID, &record.CurrencyID, &record.OccurredAt, &record.HasTime, &record.Timezone, &record.ID, &record.Version, &record.LedgerID}
 
-	err := r.DB.QueryRowContext(ctx, query, args...).Scan(&record.Version)
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&record.UpdatedAt, &record.Version)
 	if err != nil {
 		r.ErrorLog.Print(err.Error())
 		switch {
@@ -138,50 +270,69 @@ func (r *RecordModel) Update(record *Record) error {
 		}
 	}
 
-	return nil
+	err = replaceSplits(ctx, tx, record)
+	if err != nil {
+		r.ErrorLog.Print(err.Error())
+		return err
+	}
+
+	err = insertRevision(ctx, tx, record, changedBy, restoredFrom)
+	if err != nil {
+		r.ErrorLog.Print(err.Error())
+		return err
+	}
+
+	err = auditLedgerChange(ctx, tx, src, record.LedgerID, action, "record", "records", record.ID, before)
+	if err != nil {
+		r.ErrorLog.Print(err.Error())
+		return err
+	}
+
+	return tx.Commit()
 }
 
 // Query Parameters:
-// userID: int64
+// ledgerID: int64
 // filters: Filters
-// filters.StartDate: time.Time example: 2025-01-01 00:00:00 , can be empty
-// filters.EndDate: time.Time example: 2025-01-01 00:00:00
+// filters.StartDate: time.Time example: 2025-01-01 00:00:00 , can be empty, compared with occurred_at
+// filters.EndDate: time.Time example: 2025-01-01 00:00:00, compared with occurred_at
+// filters.Expr: validator.FilterExpr parsed from RecordFilterFields, can be nil
 // with pagination
 // return: []*Record, error
-func (r *RecordModel) GetRecordsForUser(userID int64, filters Filters) ([]*Record, error) {
-
-	var query string
-	var args []interface{}
-
-	switch {
-	case filters.StartDate.IsZero():
-		query = fmt.Sprintf(`
-			SELECT id, amount, description, type_id, currency_id, created_at, version
-			FROM records
-			WHERE user_id = $1
-			AND created_at <= $2
-			ORDER BY %s %s, id ASC
-			LIMIT $3 OFFSET $4`,
-			filters.sortColumn(), filters.sortDirection())
-
-		args = []interface{}{userID, filters.EndDate, filters.limit(), filters.offset()}
-	default:
-		query = fmt.Sprintf(`
-			SELECT id, amount, description, type_id, currency_id, created_at, version
-			FROM records
-			WHERE user_id = $1
-			AND created_at >= $2
-			AND created_at <= $3
-			ORDER BY %s %s, id ASC
-			LIMIT $4 OFFSET $5`,
-			filters.sortColumn(), filters.sortDirection())
-		args = []interface{}{userID, filters.StartDate, filters.EndDate, filters.limit(), filters.offset()}
+func (r *RecordModel) GetAllForLedger(ledgerID int64, filters Filters) ([]*Record, error) {
+	q := &queryArgs{}
+
+	conditions := []string{
+		"ledger_id = " + q.bind(ledgerID),
+		"deleted_at IS NULL",
+		"occurred_at <= " + q.bind(filters.EndDate),
+	}
+
+	if !filters.StartDate.IsZero() {
+		conditions = append(conditions, "occurred_at >= "+q.bind(filters.StartDate))
 	}
 
+	if filters.Expr != nil {
+		clause, err := compileFilter(filters.Expr, recordFilterColumns, q)
+		if err != nil {
+			return nil, err
+		}
+		conditions = append(conditions, clause)
+	}
+
+	query := fmt.Sprintf(`
+		SELECT id, amount, description, type_id, currency_id, user_id, ledger_id, occurred_at, has_time, timezone, created_at, updated_at, version
+		FROM records
+		WHERE %s
+		ORDER BY %s %s, id ASC
+		LIMIT %s OFFSET %s`,
+		strings.Join(conditions, " AND "), filters.sortColumn(), filters.sortDirection(),
+		q.bind(filters.limit()), q.bind(filters.offset()))
+
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	rows, err := r.DB.QueryContext(ctx, query, args...)
+	rows, err := r.DB.QueryContext(ctx, query, q.args...)
 	if err != nil {
 		r.ErrorLog.Print(err.Error())
 		switch {
@@ -196,7 +347,7 @@ func (r *RecordModel) GetRecordsForUser(userID int64, filters Filters) ([]*Recor
 	records := make([]*Record, 0)
 	for rows.Next() {
 		var record Record
-		err := rows.Scan(&record.ID, &record.Amount, &record.Description, &record.TypeID, &record.CurrencyID, &record.CreatedAt, &record.Version)
+		err := rows.Scan(&record.ID, &record.Amount, &record.Description, &record.TypeID, &record.CurrencyID, &record.UserID, &record.LedgerID, &record.OccurredAt, &record.HasTime, &record.Timezone, &record.CreatedAt, &record.UpdatedAt, &record.Version)
 		if err != nil {
 			r.ErrorLog.Print(err.Error())
 			return nil, err
@@ -208,13 +359,67 @@ func (r *RecordModel) GetRecordsForUser(userID int64, filters Filters) ([]*Recor
 		return nil, err
 	}
 
+	err = loadSplits(r.DB, records...)
+	if err != nil {
+		r.ErrorLog.Print(err.Error())
+		return nil, err
+	}
+
 	return records, nil
 }
 
+// ParseOccurredAt reads the date a record occurred on. value is either a date
+// (2006-01-02), a local date and time (2006-01-02T15:04[:05]) or an RFC 3339
+// timestamp. Dates and local times are interpreted in the named IANA timezone.
+// The returned bool reports whether value carried a time of day.
+func ParseOccurredAt(v *validator.Validator, value string, timezone string) (time.Time, bool) {
+	loc := ValidateTimezone(v, timezone)
+	if loc == nil {
+		return time.Time{}, false
+	}
+
+	if t, err := time.ParseInLocation("2006-01-02", value, loc); err == nil {
+		return t, false
+	}
+
+	for _, layout := range []string{"2006-01-02T15:04", "2006-01-02T15:04:05"} {
+		if t, err := time.ParseInLocation(layout, value, loc); err == nil {
+			return t, true
+		}
+	}
+
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, true
+	}
+
+	v.AddError("occurred_at", "must be a date (2006-01-02) or a date and time (2006-01-02T15:04:05)")
+	return time.Time{}, false
+}
+
+// ValidateTimezone checks that timezone names an IANA timezone and returns its
+// location, or nil if it does not.
+func ValidateTimezone(v *validator.Validator, timezone string) *time.Location {
+	loc, err := time.LoadLocation(timezone)
+	if err != nil || timezone == "" || timezone == "Local" {
+		v.AddError("timezone", "must be a valid IANA timezone")
+		return nil
+	}
+	return loc
+}
+
 func ValidateRecord(v *validator.Validator, record *Record) {
 	v.Check(record.Amount > 0, "amount", "must be greater than 0")
 	v.Check(record.TypeID > 0, "type_id", "must be provided")
 	v.Check(record.CurrencyID > 0, "currency_id", "must be provided")
+	v.Check(!record.OccurredAt.IsZero(), "occurred_at", "must be provided")
+	ValidateOccurredAt(v, record.OccurredAt)
+	ValidateTimezone(v, record.Timezone)
+}
+
+// ValidateOccurredAt rejects records in the future. List filters and reports
+// end at the current time by default and would not show them.
+func ValidateOccurredAt(v *validator.Validator, occurredAt time.Time) {
+	v.Check(!occurredAt.After(time.Now()), "occurred_at", "must not be in the future")
 }
 
 func ValidateRecordUpdate(v *validator.Validator, amount *int64, typeID *int64, currencyID *int64) {
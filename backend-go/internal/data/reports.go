@@ -0,0 +1,95 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+type ReportModel struct {
+	DB       *sql.DB
+	InfoLog  *log.Logger
+	ErrorLog *log.Logger
+}
+
+// TypeTotal is the sum of the amounts booked against one record type in one
+// currency.
+type TypeTotal struct {
+	TypeID     int64  `json:"type_id"`
+	TypeName   string `json:"type_name"`
+	CurrencyID int64  `json:"currency_id"`
+	Total      int64  `json:"total"`
+	Lines      int64  `json:"lines"`
+}
+
+// TotalsByType aggregates the ledger's records per record type and currency.
+// A split record contributes each of its lines to the line's own type; a
+// record without split lines contributes its whole amount to its type.
+// filters.StartDate, filters.EndDate and filters.Expr select the records,
+// pagination and sorting are not used.
+func (m *ReportModel) TotalsByType(ledgerID int64, filters Filters) ([]*TypeTotal, error) {
+	q := &queryArgs{}
+
+	conditions := []string{
+		"records.ledger_id = " + q.bind(ledgerID),
+		"records.deleted_at IS NULL",
+		"records.occurred_at <= " + q.bind(filters.EndDate),
+	}
+
+	if !filters.StartDate.IsZero() {
+		conditions = append(conditions, "records.occurred_at >= "+q.bind(filters.StartDate))
+	}
+
+	if filters.Expr != nil {
+		clause, err := compileFilter(filters.Expr, recordFilterColumns, q)
+		if err != nil {
+			return nil, err
+		}
+		conditions = append(conditions, clause)
+	}
+
+	query := fmt.Sprintf(`
+		SELECT lines.type_id, types.name, lines.currency_id, SUM(lines.amount), COUNT(*)
+		FROM (
+			SELECT COALESCE(record_splits.type_id, records.type_id) AS type_id,
+				records.currency_id,
+				COALESCE(record_splits.amount, records.amount) AS amount
+			FROM records
+			LEFT JOIN record_splits ON record_splits.record_id = records.id
+			WHERE %s
+		) lines
+		INNER JOIN types ON types.id = lines.type_id
+		GROUP BY lines.type_id, types.name, lines.currency_id
+		ORDER BY lines.currency_id ASC, SUM(lines.amount) DESC, lines.type_id ASC`,
+		strings.Join(conditions, " AND "))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, q.args...)
+	if err != nil {
+		m.ErrorLog.Print(err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	totals := make([]*TypeTotal, 0)
+	for rows.Next() {
+		var t TypeTotal
+		err := rows.Scan(&t.TypeID, &t.TypeName, &t.CurrencyID, &t.Total, &t.Lines)
+		if err != nil {
+			m.ErrorLog.Print(err)
+			return nil, err
+		}
+		totals = append(totals, &t)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return totals, nil
+}
@@ -0,0 +1,170 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"time"
+)
+
+type RecordRevisionModel struct {
+	DB       *sql.DB
+	InfoLog  *log.Logger
+	ErrorLog *log.Logger
+}
+
+// RecordRevision is a snapshot of a record as it was saved at one version.
+type RecordRevision struct {
+	RecordID      int64         `json:"record_id"`
+	Version       int64         `json:"version"`
+	Amount        int64         `json:"amount"`
+	Description   string        `json:"description"`
+	TypeID        int64         `json:"type_id"`
+	CurrencyID    int64         `json:"currency_id"`
+	OccurredAt    time.Time     `json:"occurred_at"`
+	HasTime       bool          `json:"has_time"`
+	Timezone      string        `json:"timezone"`
+	Splits        RecordSplits  `json:"splits"`
+	RestoredFrom  *int64        `json:"restored_from,omitempty"`
+	ChangedBy     int64         `json:"changed_by"`
+	ChangedByName string        `json:"changed_by_name"`
+	ChangedAt     time.Time     `json:"changed_at"`
+	Changes       []FieldChange `json:"changes"`
+}
+
+// FieldChange describes one field that differs from the previous revision.
+// From is nil for the first revision of a record.
+type FieldChange struct {
+	Field string      `json:"field"`
+	From  interface{} `json:"from"`
+	To    interface{} `json:"to"`
+}
+
+// insertRevision stores the current state of record as a revision. It must run
+// in the same transaction as the write that produced that state.
+func insertRevision(ctx context.Context, tx *sql.Tx, record *Record, changedBy int64, restoredFrom *int64) error {
+	query := `
+		INSERT INTO record_revisions (record_id, version, amount, description, type_id, currency_id, occurred_at, has_time, timezone, splits, restored_from, changed_by)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+	`
+
+	args := []interface{}{record.ID, record.Version, record.Amount, record.Description, record.TypeID, record.CurrencyID, record.OccurredAt, record.HasTime, record.Timezone, record.Splits, restoredFrom, changedBy}
+
+	_, err := tx.ExecContext(ctx, query, args...)
+	return err
+}
+
+// GetAllForRecord returns every revision of the record, oldest first, each
+// with the field level changes against the revision before it.
+func (m *RecordRevisionModel) GetAllForRecord(recordID int64) ([]*RecordRevision, error) {
+	query := `
+		SELECT rr.record_id, rr.version, rr.amount, coalesce(rr.description, ''), rr.type_id, rr.currency_id, rr.occurred_at,
+			rr.has_time, rr.timezone, rr.splits, rr.restored_from, rr.changed_by, coalesce(u.name, ''), rr.changed_at
+		FROM record_revisions rr
+		LEFT JOIN users u ON u.id = rr.changed_by
+		WHERE rr.record_id = $1
+		ORDER BY rr.version ASC
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, recordID)
+	if err != nil {
+		m.ErrorLog.Print(err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	revisions := make([]*RecordRevision, 0)
+	var previous *RecordRevision
+
+	for rows.Next() {
+		var rev RecordRevision
+		err := rows.Scan(&rev.RecordID, &rev.Version, &rev.Amount, &rev.Description, &rev.TypeID, &rev.CurrencyID, &rev.OccurredAt,
+			&rev.HasTime, &rev.Timezone, &rev.Splits, &rev.RestoredFrom, &rev.ChangedBy, &rev.ChangedByName, &rev.ChangedAt)
+		if err != nil {
+			m.ErrorLog.Print(err)
+			return nil, err
+		}
+
+		rev.Changes = diffRevisions(previous, &rev)
+		revisions = append(revisions, &rev)
+		previous = &rev
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return revisions, nil
+}
+
+func (m *RecordRevisionModel) GetVersion(recordID int64, version int64) (*RecordRevision, error) {
+	query := `
+		SELECT record_id, version, amount, coalesce(description, ''), type_id, currency_id, occurred_at,
+			has_time, timezone, splits, restored_from, changed_by, changed_at
+		FROM record_revisions
+		WHERE record_id = $1 AND version = $2
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var rev RecordRevision
+
+	err := m.DB.QueryRowContext(ctx, query, recordID, version).Scan(&rev.RecordID, &rev.Version, &rev.Amount, &rev.Description, &rev.TypeID, &rev.CurrencyID, &rev.OccurredAt,
+		&rev.HasTime, &rev.Timezone, &rev.Splits, &rev.RestoredFrom, &rev.ChangedBy, &rev.ChangedAt)
+	if err != nil {
+		m.ErrorLog.Print(err)
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &rev, nil
+}
+
+func diffRevisions(before, after *RecordRevision) []FieldChange {
+	first := before == nil
+	if first {
+		before = &RecordRevision{}
+	}
+
+	changes := make([]FieldChange, 0)
+	add := func(field string, from, to interface{}, changed bool) {
+		switch {
+		case first:
+			changes = append(changes, FieldChange{Field: field, To: to})
+		case changed:
+			changes = append(changes, FieldChange{Field: field, From: from, To: to})
+		}
+	}
+
+	add("amount", before.Amount, after.Amount, before.Amount != after.Amount)
+	add("description", before.Description, after.Description, before.Description != after.Description)
+	add("type_id", before.TypeID, after.TypeID, before.TypeID != after.TypeID)
+	add("currency_id", before.CurrencyID, after.CurrencyID, before.CurrencyID != after.CurrencyID)
+	add("occurred_at", before.OccurredAt, after.OccurredAt, !before.OccurredAt.Equal(after.OccurredAt))
+	add("has_time", before.HasTime, after.HasTime, before.HasTime != after.HasTime)
+	add("timezone", before.Timezone, after.Timezone, before.Timezone != after.Timezone)
+	add("splits", before.Splits, after.Splits, !equalSplits(before.Splits, after.Splits))
+
+	return changes
+}
+
+func equalSplits(a, b RecordSplits) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Amount != b[i].Amount || a[i].TypeID != b[i].TypeID || a[i].Description != b[i].Description {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,339 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"regexp"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/saiharsha/money-manager/pkg/validator"
+)
+
+type RoleModel struct {
+	DB       *sql.DB
+	InfoLog  *log.Logger
+	ErrorLog *log.Logger
+}
+
+// Role is a named set of permissions. Every user has exactly one role.
+type Role struct {
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	Builtin     bool      `json:"builtin"`
+	Permissions []string  `json:"permissions"`
+	CreatedAt   time.Time `json:"created_at"`
+	Version     int64     `json:"version"`
+}
+
+type Permission struct {
+	Code        string `json:"code"`
+	Description string `json:"description"`
+}
+
+// Permissions checked by the API. New ones are added by a migration, which
+// also grants them to the superuser role.
+const (
+	PermissionCurrenciesWrite  = "currencies:write"
+	PermissionRecordTypesWrite = "recordtypes:write"
+	PermissionUsersRead        = "users:read"
+	PermissionUsersManage      = "users:manage"
+	PermissionRolesManage      = "roles:manage"
+	PermissionUsersImpersonate = "users:impersonate"
+	PermissionAuditRead        = "audit:read"
+)
+
+// Built in roles. RoleUser is given to new users, RoleSuperUser always has
+// every permission.
+const (
+	RoleUser      = "user"
+	RoleAdmin     = "admin"
+	RoleSuperUser = "superuser"
+)
+
+var (
+	ErrDuplicateRole     = errors.New("duplicate role")
+	ErrRoleInUse         = errors.New("role is assigned to users")
+	ErrUnknownPermission = errors.New("unknown permission")
+)
+
+var roleNameRX = regexp.MustCompile("^[a-z0-9_-]+$")
+
+const roleQuery = `
+	SELECT r.name, r.description, r.builtin, r.created_at, r.version,
+		coalesce(array_agg(rp.permission ORDER BY rp.permission) FILTER (WHERE rp.permission IS NOT NULL), '{}')
+	FROM roles r
+	LEFT JOIN role_permissions rp ON rp.role = r.name
+`
+
+func (m *RoleModel) GetAll() ([]*Role, error) {
+	query := roleQuery + `
+		GROUP BY r.name
+		ORDER BY r.builtin DESC, r.name ASC
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		m.ErrorLog.Print(err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	roles := make([]*Role, 0)
+	for rows.Next() {
+		var role Role
+		err := rows.Scan(&role.Name, &role.Description, &role.Builtin, &role.CreatedAt, &role.Version, pq.Array(&role.Permissions))
+		if err != nil {
+			m.ErrorLog.Print(err)
+			return nil, err
+		}
+		roles = append(roles, &role)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return roles, nil
+}
+
+func (m *RoleModel) Get(name string) (*Role, error) {
+	query := roleQuery + `
+		WHERE r.name = $1
+		GROUP BY r.name
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var role Role
+
+	err := m.DB.QueryRowContext(ctx, query, name).Scan(&role.Name, &role.Description, &role.Builtin, &role.CreatedAt, &role.Version, pq.Array(&role.Permissions))
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			m.ErrorLog.Print(err)
+			return nil, err
+		}
+	}
+
+	return &role, nil
+}
+
+// Insert creates the role with its permissions.
+func (m *RoleModel) Insert(role *Role) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `
+		INSERT INTO roles (name, description)
+		VALUES ($1, $2)
+		RETURNING builtin, created_at, version
+	`
+
+	err = tx.QueryRowContext(ctx, query, role.Name, role.Description).Scan(&role.Builtin, &role.CreatedAt, &role.Version)
+	if err != nil {
+		switch {
+		case err.Error() == `pq: duplicate key value violates unique constraint "roles_pkey"`:
+			return ErrDuplicateRole
+		default:
+			m.ErrorLog.Print(err)
+			return err
+		}
+	}
+
+	err = setRolePermissions(ctx, tx, role.Name, role.Permissions)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Update changes the description and replaces the permissions of the role.
+func (m *RoleModel) Update(role *Role) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `
+		UPDATE roles
+		SET description = $1, version = version + 1
+		WHERE name = $2 AND version = $3
+		RETURNING version
+	`
+
+	err = tx.QueryRowContext(ctx, query, role.Description, role.Name, role.Version).Scan(&role.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			m.ErrorLog.Print(err)
+			return err
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM role_permissions WHERE role = $1`, role.Name)
+	if err != nil {
+		m.ErrorLog.Print(err)
+		return err
+	}
+
+	err = setRolePermissions(ctx, tx, role.Name, role.Permissions)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Delete removes a role that is neither built in nor assigned to anyone.
+func (m *RoleModel) Delete(name string) error {
+	query := `
+		DELETE FROM roles
+		WHERE name = $1 AND NOT builtin
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, name)
+	if err != nil {
+		switch {
+		case err.Error() == `pq: update or delete on table "roles" violates foreign key constraint "users_role_fkey" on table "users"`:
+			return ErrRoleInUse
+		default:
+			m.ErrorLog.Print(err)
+			return err
+		}
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// GetPermissions lists every permission a role can be given.
+func (m *RoleModel) GetPermissions() ([]*Permission, error) {
+	query := `
+		SELECT code, description
+		FROM permissions
+		ORDER BY code ASC
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		m.ErrorLog.Print(err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	permissions := make([]*Permission, 0)
+	for rows.Next() {
+		var permission Permission
+		err := rows.Scan(&permission.Code, &permission.Description)
+		if err != nil {
+			m.ErrorLog.Print(err)
+			return nil, err
+		}
+		permissions = append(permissions, &permission)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return permissions, nil
+}
+
+// GetForUser returns the permissions the user has through their current
+// role.
+func (m *RoleModel) GetForUser(userID int64) ([]string, error) {
+	query := `
+		SELECT rp.permission
+		FROM users u
+		INNER JOIN role_permissions rp ON rp.role = u.role
+		WHERE u.id = $1
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		m.ErrorLog.Print(err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	permissions := make([]string, 0)
+	for rows.Next() {
+		var permission string
+		if err := rows.Scan(&permission); err != nil {
+			return nil, err
+		}
+		permissions = append(permissions, permission)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return permissions, nil
+}
+
+func setRolePermissions(ctx context.Context, tx *sql.Tx, role string, permissions []string) error {
+	query := `
+		INSERT INTO role_permissions (role, permission)
+		SELECT $1, unnest($2::text[])
+	`
+
+	_, err := tx.ExecContext(ctx, query, role, pq.Array(permissions))
+	if err != nil {
+		switch {
+		case err.Error() == `pq: insert or update on table "role_permissions" violates foreign key constraint "role_permissions_permission_fkey"`:
+			return ErrUnknownPermission
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+func ValidateRole(v *validator.Validator, role *Role) {
+	v.Check(role.Name != "", "name", "must be provided")
+	v.Check(len(role.Name) <= 50, "name", "must be at most 50 characters long")
+	v.Check(validator.Matches(role.Name, roleNameRX), "name", "must only contain lowercase letters, digits, - and _")
+	v.Check(len(role.Description) <= 200, "description", "must be at most 200 characters long")
+	v.Check(validator.Unique(role.Permissions), "permissions", "must not contain duplicate values")
+}
@@ -0,0 +1,186 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"html"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/saiharsha/money-manager/pkg/validator"
+)
+
+// Snippets are returned as HTML with matched terms in <mark> tags. The text
+// comes from users, so ts_headline marks matches with control characters
+// that are first removed from the text, and highlightSnippet escapes the
+// rest before turning them into tags.
+const (
+	headlineStart = "\x02"
+	headlineStop  = "\x03"
+
+	headlineOptions = "StartSel=" + headlineStart + ", StopSel=" + headlineStop + ", MaxFragments=2, MaxWords=20, MinWords=5"
+)
+
+var snippetReplacer = strings.NewReplacer(headlineStart, "<mark>", headlineStop, "</mark>")
+
+// highlightSnippet turns a ts_headline result into safe HTML.
+func highlightSnippet(headline string) string {
+	return snippetReplacer.Replace(html.EscapeString(headline))
+}
+
+type SearchModel struct {
+	DB       *sql.DB
+	InfoLog  *log.Logger
+	ErrorLog *log.Logger
+}
+
+type SearchResult struct {
+	Record   *Record          `json:"record"`
+	Rank     float64          `json:"rank"`
+	Snippet  string           `json:"snippet"`
+	Comments []*CommentSearch `json:"comments"`
+}
+
+type CommentSearch struct {
+	ID       int64   `json:"id"`
+	RecordID int64   `json:"record_id"`
+	Rank     float64 `json:"rank"`
+	Snippet  string  `json:"snippet"`
+}
+
+// Search returns the ledger's records whose description or comments match the
+// web search style query, ordered by relevance. The date range in filters is
+// applied to the date the records occurred on.
+func (s *SearchModel) Search(ledgerID int64, search string, filters Filters) ([]*SearchResult, error) {
+	q := &queryArgs{}
+	tsquery := fmt.Sprintf("websearch_to_tsquery('english', %s)", q.bind(search))
+	headline := fmt.Sprintf("ts_headline('english', translate(coalesce(r.description, ''), %s, ''), q.query, %s)",
+		q.bind(headlineStart+headlineStop), q.bind(headlineOptions))
+
+	conditions := []string{
+		"r.ledger_id = " + q.bind(ledgerID),
+		"r.deleted_at IS NULL",
+		"r.occurred_at <= " + q.bind(filters.EndDate),
+		`(r.search_vector @@ q.query OR EXISTS (
+			SELECT 1 FROM comments c WHERE c.record_id = r.id AND c.deleted_at IS NULL AND c.search_vector @@ q.query))`,
+	}
+
+	if !filters.StartDate.IsZero() {
+		conditions = append(conditions, "r.occurred_at >= "+q.bind(filters.StartDate))
+	}
+
+	query := fmt.Sprintf(`
+		SELECT r.id, r.amount, r.description, r.type_id, r.currency_id, r.user_id, r.ledger_id, r.occurred_at, r.has_time, r.timezone,
+			r.created_at, r.updated_at, r.version,
+			ts_rank(r.search_vector, q.query) + COALESCE((
+				SELECT max(ts_rank(c.search_vector, q.query))
+				FROM comments c
+				WHERE c.record_id = r.id AND c.deleted_at IS NULL AND c.search_vector @@ q.query), 0) AS rank,
+			%s
+		FROM records r, %s AS q(query)
+		WHERE %s
+		ORDER BY rank DESC, r.id ASC
+		LIMIT %s OFFSET %s`,
+		headline, tsquery, strings.Join(conditions, " AND "),
+		q.bind(filters.limit()), q.bind(filters.offset()))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := s.DB.QueryContext(ctx, query, q.args...)
+	if err != nil {
+		s.ErrorLog.Print(err.Error())
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := make([]*SearchResult, 0)
+	byRecord := make(map[int64]*SearchResult)
+	recordIDs := make([]int64, 0)
+
+	for rows.Next() {
+		var record Record
+		result := SearchResult{Record: &record, Comments: []*CommentSearch{}}
+		var description sql.NullString
+
+		err := rows.Scan(&record.ID, &record.Amount, &description, &record.TypeID, &record.CurrencyID, &record.UserID, &record.LedgerID, &record.OccurredAt, &record.HasTime, &record.Timezone, &record.CreatedAt, &record.UpdatedAt, &record.Version, &result.Rank, &result.Snippet)
+		if err != nil {
+			s.ErrorLog.Print(err.Error())
+			return nil, err
+		}
+		record.Description = description.String
+		result.Snippet = highlightSnippet(result.Snippet)
+
+		results = append(results, &result)
+		byRecord[record.ID] = &result
+		recordIDs = append(recordIDs, record.ID)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(recordIDs) == 0 {
+		return results, nil
+	}
+
+	comments, err := s.matchingComments(ctx, search, recordIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, comment := range comments {
+		if result, ok := byRecord[comment.RecordID]; ok {
+			result.Comments = append(result.Comments, comment)
+		}
+	}
+
+	return results, nil
+}
+
+func (s *SearchModel) matchingComments(ctx context.Context, search string, recordIDs []int64) ([]*CommentSearch, error) {
+	query := `
+		SELECT c.id, c.record_id, ts_rank(c.search_vector, q.query) AS rank,
+			ts_headline('english', translate(c.description, $3, ''), q.query, $4)
+		FROM comments c, websearch_to_tsquery('english', $1) AS q(query)
+		WHERE c.record_id = ANY($2) AND c.deleted_at IS NULL AND c.search_vector @@ q.query
+		ORDER BY rank DESC, c.id ASC`
+
+	args := []interface{}{search, pq.Array(recordIDs), headlineStart + headlineStop, headlineOptions}
+
+	rows, err := s.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		s.ErrorLog.Print(err.Error())
+		return nil, err
+	}
+	defer rows.Close()
+
+	comments := make([]*CommentSearch, 0)
+	for rows.Next() {
+		var comment CommentSearch
+		err := rows.Scan(&comment.ID, &comment.RecordID, &comment.Rank, &comment.Snippet)
+		if err != nil {
+			s.ErrorLog.Print(err.Error())
+			return nil, err
+		}
+		comment.Snippet = highlightSnippet(comment.Snippet)
+		comments = append(comments, &comment)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return comments, nil
+}
+
+func ValidateSearch(v *validator.Validator, search string, filters Filters) {
+	v.Check(strings.TrimSpace(search) != "", "q", "must be provided")
+	v.Check(len(search) <= 200, "q", "must be at most 200 characters long")
+	v.Check(filters.Page > 0, "page", "must be greater than 0")
+	v.Check(filters.PageSize > 0, "page_size", "must be greater than 0")
+	v.Check(filters.PageSize <= 100, "page_size", "must be a maximum of 100")
+}
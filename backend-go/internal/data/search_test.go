@@ -0,0 +1,37 @@
+package data
+
+import "testing"
+
+func TestHighlightSnippet(t *testing.T) {
+	tests := []struct {
+		name     string
+		headline string
+		want     string
+	}{
+		{"plain", "monthly \x02rent\x03 for march", "monthly <mark>rent</mark> for march"},
+		{"no match marked", "monthly rent", "monthly rent"},
+		{
+			name:     "script in the description",
+			headline: "<script>alert('x')</script> \x02rent\x03",
+			want:     "&lt;script&gt;alert(&#39;x&#39;)&lt;/script&gt; <mark>rent</mark>",
+		},
+		{
+			name:     "markup around a match",
+			headline: "<img src=x onerror=\"alert(1)\">\x02rent\x03</b>",
+			want:     "&lt;img src=x onerror=&#34;alert(1)&#34;&gt;<mark>rent</mark>&lt;/b&gt;",
+		},
+		{
+			name:     "mark tags typed by the user stay text",
+			headline: "<mark>\x02rent\x03</mark>",
+			want:     "&lt;mark&gt;<mark>rent</mark>&lt;/mark&gt;",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := highlightSnippet(tt.headline); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,235 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"time"
+)
+
+// SessionTTL is how long a login lasts without signing in again. It is also
+// the lifetime of the refresh token of the session.
+const SessionTTL = 10 * 24 * time.Hour
+
+// SessionRetention is how long ended sessions are kept, so that logins from
+// devices used before are not reported as new.
+const SessionRetention = 90 * 24 * time.Hour
+
+type SessionModel struct {
+	DB       *sql.DB
+	InfoLog  *log.Logger
+	ErrorLog *log.Logger
+}
+
+// Session is one login of a user, from creation until it expires or is
+// revoked. Its id is carried by the refresh and access tokens of the login.
+type Session struct {
+	ID         int64      `json:"id"`
+	UserID     int64      `json:"-"`
+	Device     string     `json:"device"`
+	UserAgent  string     `json:"user_agent"`
+	IP         string     `json:"ip"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastSeenAt time.Time  `json:"last_seen_at"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	RevokedAt  *time.Time `json:"-"`
+	Current    bool       `json:"current"`
+}
+
+func (m *SessionModel) Insert(session *Session) error {
+	query := `
+		INSERT INTO sessions (user_id, device, user_agent, ip, expires_at)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, created_at, last_seen_at
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	args := []interface{}{session.UserID, session.Device, session.UserAgent, session.IP, session.ExpiresAt}
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&session.ID, &session.CreatedAt, &session.LastSeenAt)
+	if err != nil {
+		m.ErrorLog.Print(err)
+		return err
+	}
+
+	return nil
+}
+
+// IsNewDevice reports whether the user has logged in before, but never from
+// device. The very first login is not from a new device.
+func (m *SessionModel) IsNewDevice(userID int64, device string) (bool, error) {
+	query := `
+		SELECT count(*) > 0 AND count(*) FILTER (WHERE device = $2) = 0
+		FROM sessions
+		WHERE user_id = $1
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var isNew bool
+
+	err := m.DB.QueryRowContext(ctx, query, userID, device).Scan(&isNew)
+	if err != nil {
+		m.ErrorLog.Print(err)
+		return false, err
+	}
+
+	return isNew, nil
+}
+
+// GetAllForUser lists the sessions of the user that are still active, the
+// most recently used first.
+func (m *SessionModel) GetAllForUser(userID int64) ([]*Session, error) {
+	query := `
+		SELECT id, user_id, device, user_agent, ip, created_at, last_seen_at, expires_at, revoked_at
+		FROM sessions
+		WHERE user_id = $1 AND revoked_at IS NULL AND expires_at > NOW()
+		ORDER BY last_seen_at DESC, id DESC
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		m.ErrorLog.Print(err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := make([]*Session, 0)
+	for rows.Next() {
+		var session Session
+		err := rows.Scan(&session.ID, &session.UserID, &session.Device, &session.UserAgent, &session.IP,
+			&session.CreatedAt, &session.LastSeenAt, &session.ExpiresAt, &session.RevokedAt)
+		if err != nil {
+			m.ErrorLog.Print(err)
+			return nil, err
+		}
+		sessions = append(sessions, &session)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return sessions, nil
+}
+
+// Seen looks up an active session of the user and records that it was used
+// from ip, at most once a minute per session.
+func (m *SessionModel) Seen(id int64, userID int64, ip string) (*Session, error) {
+	query := `
+		SELECT id, user_id, device, user_agent, ip, created_at, last_seen_at, expires_at, revoked_at
+		FROM sessions
+		WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL AND expires_at > NOW()
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var session Session
+
+	err := m.DB.QueryRowContext(ctx, query, id, userID).Scan(&session.ID, &session.UserID, &session.Device, &session.UserAgent,
+		&session.IP, &session.CreatedAt, &session.LastSeenAt, &session.ExpiresAt, &session.RevokedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			m.ErrorLog.Print(err)
+			return nil, err
+		}
+	}
+
+	if time.Since(session.LastSeenAt) > time.Minute || session.IP != ip {
+		query = `
+			UPDATE sessions
+			SET last_seen_at = NOW(), ip = $2
+			WHERE id = $1
+			RETURNING last_seen_at
+		`
+
+		err = m.DB.QueryRowContext(ctx, query, session.ID, ip).Scan(&session.LastSeenAt)
+		if err != nil {
+			m.ErrorLog.Print(err)
+			return nil, err
+		}
+		session.IP = ip
+	}
+
+	return &session, nil
+}
+
+// Revoke ends one active session of the user.
+func (m *SessionModel) Revoke(id int64, userID int64) error {
+	query := `
+		UPDATE sessions
+		SET revoked_at = NOW()
+		WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL AND expires_at > NOW()
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id, userID)
+	if err != nil {
+		m.ErrorLog.Print(err)
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// RevokeAllExcept ends every active session of the user but keep, and
+// returns how many were ended. A keep of 0 ends them all.
+func (m *SessionModel) RevokeAllExcept(userID int64, keep int64) (int64, error) {
+	query := `
+		UPDATE sessions
+		SET revoked_at = NOW()
+		WHERE user_id = $1 AND id <> $2 AND revoked_at IS NULL AND expires_at > NOW()
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userID, keep)
+	if err != nil {
+		m.ErrorLog.Print(err)
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+// DeleteEnded removes sessions that ended longer than SessionRetention ago.
+func (m *SessionModel) DeleteEnded() (int64, error) {
+	query := `
+		DELETE FROM sessions
+		WHERE least(expires_at, coalesce(revoked_at, expires_at)) < $1
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, time.Now().Add(-SessionRetention))
+	if err != nil {
+		m.ErrorLog.Print(err)
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
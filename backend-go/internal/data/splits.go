@@ -0,0 +1,136 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/saiharsha/money-manager/pkg/validator"
+)
+
+// RecordSplit is one line of a record whose amount is divided across several
+// record types, e.g. the groceries and household parts of one receipt.
+type RecordSplit struct {
+	ID          int64  `json:"id,omitempty"`
+	Amount      int64  `json:"amount"`
+	TypeID      int64  `json:"type_id"`
+	Description string `json:"description"`
+}
+
+// RecordSplits is stored as JSON in record revisions.
+type RecordSplits []*RecordSplit
+
+func (s RecordSplits) Value() (driver.Value, error) {
+	if s == nil {
+		return []byte("[]"), nil
+	}
+	return json.Marshal(s)
+}
+
+func (s *RecordSplits) Scan(src interface{}) error {
+	b, ok := src.([]byte)
+	if !ok {
+		return errors.New("record splits must be a jsonb value")
+	}
+	return json.Unmarshal(b, s)
+}
+
+// replaceSplits makes the stored split lines of the record match
+// record.Splits. It must run in the same transaction as the record write.
+func replaceSplits(ctx context.Context, tx *sql.Tx, record *Record) error {
+	_, err := tx.ExecContext(ctx, `DELETE FROM record_splits WHERE record_id = $1`, record.ID)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		INSERT INTO record_splits (record_id, position, amount, type_id, description)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id
+	`
+
+	for i, split := range record.Splits {
+		err = tx.QueryRowContext(ctx, query, record.ID, i, split.Amount, split.TypeID, split.Description).Scan(&split.ID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// loadSplits fills in the split lines of the given records.
+func loadSplits(db *sql.DB, records ...*Record) error {
+	if len(records) == 0 {
+		return nil
+	}
+
+	byID := make(map[int64]*Record, len(records))
+	ids := make([]int64, len(records))
+	for i, record := range records {
+		record.Splits = RecordSplits{}
+		byID[record.ID] = record
+		ids[i] = record.ID
+	}
+
+	query := `
+		SELECT id, record_id, amount, type_id, description
+		FROM record_splits
+		WHERE record_id = ANY($1)
+		ORDER BY record_id, position
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := db.QueryContext(ctx, query, pq.Array(ids))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var split RecordSplit
+		var recordID int64
+		err := rows.Scan(&split.ID, &recordID, &split.Amount, &split.TypeID, &split.Description)
+		if err != nil {
+			return err
+		}
+		if record, ok := byID[recordID]; ok {
+			record.Splits = append(record.Splits, &split)
+		}
+	}
+
+	return rows.Err()
+}
+
+// ValidateRecordSplits checks the split lines of a record. A record without
+// split lines is valid; otherwise there must be at least two lines whose
+// amounts add up to the record's amount.
+func ValidateRecordSplits(v *validator.Validator, record *Record) {
+	if len(record.Splits) == 0 {
+		return
+	}
+
+	v.Check(len(record.Splits) >= 2, "splits", "must contain at least two lines")
+	v.Check(len(record.Splits) <= 50, "splits", "must contain at most 50 lines")
+
+	var total int64
+	for i, split := range record.Splits {
+		if split == nil {
+			v.AddError(fmt.Sprintf("splits[%d]", i), "must be provided")
+			continue
+		}
+		v.Check(split.Amount > 0, fmt.Sprintf("splits[%d].amount", i), "must be greater than 0")
+		v.Check(split.TypeID > 0, fmt.Sprintf("splits[%d].type_id", i), "must be provided")
+		v.Check(len(split.Description) <= 500, fmt.Sprintf("splits[%d].description", i), "must be at most 500 characters long")
+		total += split.Amount
+	}
+
+	v.Check(total == record.Amount, "splits", fmt.Sprintf("amounts must add up to the record amount %d, got %d", record.Amount, total))
+}
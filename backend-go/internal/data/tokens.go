@@ -0,0 +1,203 @@
+package data
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"log"
+	"time"
+)
+
+// Scopes of emailed tokens. A token only works for the action it was issued
+// for.
+const (
+	TokenScopeActivation      = "activation"
+	TokenScopePasswordReset   = "password-reset"
+	TokenScopeEmailChange     = "email-change"
+	TokenScopeAccountDeletion = "account-deletion"
+	TokenScopeLoginLink       = "login-link"
+)
+
+// How long the links in emails work.
+const (
+	ActivationTokenTTL      = 3 * 24 * time.Hour
+	EmailChangeTokenTTL     = 24 * time.Hour
+	AccountDeletionTokenTTL = 24 * time.Hour
+	PasswordResetTokenTTL   = 24 * time.Hour
+	LoginLinkTokenTTL       = 15 * time.Minute
+)
+
+var (
+	ErrExpiredToken = errors.New("token has expired")
+)
+
+type TokenModel struct {
+	DB       *sql.DB
+	InfoLog  *log.Logger
+	ErrorLog *log.Logger
+}
+
+// Token is a single-use token for a link in an email. Email is the address
+// the token was sent to, which for email changes is the new address.
+// Plaintext is only known right after the token was created.
+type Token struct {
+	Plaintext string    `json:"token"`
+	Hash      []byte    `json:"-"`
+	UserID    int64     `json:"-"`
+	Scope     string    `json:"-"`
+	Email     string    `json:"-"`
+	Expiry    time.Time `json:"expiry"`
+}
+
+// New creates and stores a token for the user.
+func (m *TokenModel) New(userID int64, email string, ttl time.Duration, scope string) (*Token, error) {
+	plaintext, hash, err := generateToken()
+	if err != nil {
+		return nil, err
+	}
+
+	token := &Token{
+		Plaintext: plaintext,
+		Hash:      hash,
+		UserID:    userID,
+		Scope:     scope,
+		Email:     email,
+		Expiry:    time.Now().Add(ttl),
+	}
+
+	err = m.Insert(token)
+	if err != nil {
+		return nil, err
+	}
+
+	return token, nil
+}
+
+func (m *TokenModel) Insert(token *Token) error {
+	query := `
+		INSERT INTO tokens (hash, user_id, scope, email, expiry)
+		VALUES ($1, $2, $3, $4, $5)
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	args := []interface{}{token.Hash, token.UserID, token.Scope, token.Email, token.Expiry}
+
+	_, err := m.DB.ExecContext(ctx, query, args...)
+	if err != nil {
+		m.ErrorLog.Print(err)
+		return err
+	}
+
+	return nil
+}
+
+// Use redeems a token. The token is deleted in the same statement, so it
+// works exactly once. It returns ErrRecordNotFound for unknown or already
+// used tokens and ErrExpiredToken for expired ones.
+func (m *TokenModel) Use(scope, plaintext string) (*Token, error) {
+	hash := sha256.Sum256([]byte(plaintext))
+
+	query := `
+		DELETE FROM tokens
+		WHERE hash = $1 AND scope = $2
+		RETURNING user_id, email, expiry
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	token := Token{Hash: hash[:], Scope: scope}
+
+	err := m.DB.QueryRowContext(ctx, query, hash[:], scope).Scan(&token.UserID, &token.Email, &token.Expiry)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			m.ErrorLog.Print(err)
+			return nil, err
+		}
+	}
+
+	if time.Now().After(token.Expiry) {
+		return nil, ErrExpiredToken
+	}
+
+	return &token, nil
+}
+
+// Check looks a token up without redeeming it, so a link can be opened
+// before the action it is for is sent. It returns the same errors as Use.
+func (m *TokenModel) Check(scope, plaintext string) (*Token, error) {
+	hash := sha256.Sum256([]byte(plaintext))
+
+	query := `
+		SELECT user_id, email, expiry
+		FROM tokens
+		WHERE hash = $1 AND scope = $2
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	token := Token{Hash: hash[:], Scope: scope}
+
+	err := m.DB.QueryRowContext(ctx, query, hash[:], scope).Scan(&token.UserID, &token.Email, &token.Expiry)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			m.ErrorLog.Print(err)
+			return nil, err
+		}
+	}
+
+	if time.Now().After(token.Expiry) {
+		return nil, ErrExpiredToken
+	}
+
+	return &token, nil
+}
+
+// DeleteAllForUser revokes the user's tokens of one scope, e.g. older
+// verification links when a new one is sent.
+func (m *TokenModel) DeleteAllForUser(scope string, userID int64) error {
+	query := `
+		DELETE FROM tokens
+		WHERE scope = $1 AND user_id = $2
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, scope, userID)
+	if err != nil {
+		m.ErrorLog.Print(err)
+		return err
+	}
+
+	return nil
+}
+
+// DeleteExpired removes expired tokens and returns how many there were.
+func (m *TokenModel) DeleteExpired() (int64, error) {
+	query := `
+		DELETE FROM tokens
+		WHERE expiry < NOW()
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query)
+	if err != nil {
+		m.ErrorLog.Print(err)
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
@@ -0,0 +1,297 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"time"
+)
+
+type TrashModel struct {
+	DB       *sql.DB
+	InfoLog  *log.Logger
+	ErrorLog *log.Logger
+}
+
+type TrashedRecord struct {
+	ID          int64     `json:"id"`
+	Amount      int64     `json:"amount"`
+	Description string    `json:"description"`
+	TypeID      int64     `json:"type_id"`
+	CurrencyID  int64     `json:"currency_id"`
+	OccurredAt  time.Time `json:"occurred_at"`
+	DeletedAt   time.Time `json:"deleted_at"`
+}
+
+type TrashedComment struct {
+	ID          int64     `json:"id"`
+	RecordID    int64     `json:"record_id"`
+	Description string    `json:"description"`
+	DeletedAt   time.Time `json:"deleted_at"`
+}
+
+var (
+	ErrTrashedParent = errors.New("parent record is in the trash")
+)
+
+// GetAllForLedger returns the ledger's trashed records and the comments that
+// were trashed on their own. Comments trashed together with their record come back
+// when the record is restored and are not listed separately.
+func (m *TrashModel) GetAllForLedger(ledgerID int64) ([]*TrashedRecord, []*TrashedComment, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `
+		SELECT id, amount, coalesce(description, ''), type_id, currency_id, occurred_at, deleted_at
+		FROM records
+		WHERE ledger_id = $1 AND deleted_at IS NOT NULL
+		ORDER BY deleted_at DESC, id ASC
+	`
+
+	rows, err := m.DB.QueryContext(ctx, query, ledgerID)
+	if err != nil {
+		m.ErrorLog.Print(err)
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	records := make([]*TrashedRecord, 0)
+	for rows.Next() {
+		var record TrashedRecord
+		err := rows.Scan(&record.ID, &record.Amount, &record.Description, &record.TypeID, &record.CurrencyID, &record.OccurredAt, &record.DeletedAt)
+		if err != nil {
+			m.ErrorLog.Print(err)
+			return nil, nil, err
+		}
+		records = append(records, &record)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	query = `
+		SELECT c.id, c.record_id, c.description, c.deleted_at
+		FROM comments c
+		INNER JOIN records r ON r.id = c.record_id
+		WHERE r.ledger_id = $1 AND c.deleted_at IS NOT NULL AND r.deleted_at IS NULL
+		ORDER BY c.deleted_at DESC, c.id ASC
+	`
+
+	rows, err = m.DB.QueryContext(ctx, query, ledgerID)
+	if err != nil {
+		m.ErrorLog.Print(err)
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	comments := make([]*TrashedComment, 0)
+	for rows.Next() {
+		var comment TrashedComment
+		err := rows.Scan(&comment.ID, &comment.RecordID, &comment.Description, &comment.DeletedAt)
+		if err != nil {
+			m.ErrorLog.Print(err)
+			return nil, nil, err
+		}
+		comments = append(comments, &comment)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	return records, comments, nil
+}
+
+// RestoreRecord takes a record out of the trash along with the comments that
+// were trashed in the same delete, and records the audit event.
+func (m *TrashModel) RestoreRecord(id int64, ledgerID int64, src AuditSource) error {
+	query := `
+		UPDATE records r
+		SET deleted_at = NULL
+		FROM (SELECT id, deleted_at FROM records WHERE id = $1 AND ledger_id = $2 AND deleted_at IS NOT NULL FOR UPDATE) old
+		WHERE r.id = old.id
+		RETURNING old.deleted_at
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	before, err := auditRow(ctx, tx, "records", id)
+	if err != nil {
+		m.ErrorLog.Print(err)
+		return err
+	}
+
+	var deletedAt time.Time
+	err = tx.QueryRowContext(ctx, query, id, ledgerID).Scan(&deletedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrRecordNotFound
+		default:
+			m.ErrorLog.Print(err)
+			return err
+		}
+	}
+
+	query = `
+		UPDATE comments
+		SET deleted_at = NULL
+		WHERE record_id = $1 AND deleted_at = $2
+	`
+
+	_, err = tx.ExecContext(ctx, query, id, deletedAt)
+	if err != nil {
+		m.ErrorLog.Print(err)
+		return err
+	}
+
+	err = auditLedgerChange(ctx, tx, src, ledgerID, AuditRecordUndelete, "record", "records", id, before)
+	if err != nil {
+		m.ErrorLog.Print(err)
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// RestoreComment takes a comment out of the trash and records the audit
+// event. The comment's record must not be in the trash itself.
+func (m *TrashModel) RestoreComment(id int64, ledgerID int64, src AuditSource) error {
+	query := `
+		UPDATE comments c
+		SET deleted_at = NULL
+		FROM records r
+		WHERE c.id = $1 AND c.deleted_at IS NOT NULL
+		AND r.id = c.record_id AND r.ledger_id = $2
+		RETURNING r.deleted_at IS NOT NULL
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	before, err := auditRow(ctx, tx, "comments", id)
+	if err != nil {
+		m.ErrorLog.Print(err)
+		return err
+	}
+
+	var parentTrashed bool
+	err = tx.QueryRowContext(ctx, query, id, ledgerID).Scan(&parentTrashed)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrRecordNotFound
+		default:
+			m.ErrorLog.Print(err)
+			return err
+		}
+	}
+
+	if parentTrashed {
+		return ErrTrashedParent
+	}
+
+	err = auditLedgerChange(ctx, tx, src, ledgerID, AuditCommentUndelete, "comment", "comments", id, before)
+	if err != nil {
+		m.ErrorLog.Print(err)
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Purge permanently deletes records and comments that have been in the trash
+// for longer than retention and returns how many rows were removed. The
+// attachments of the records go with them. It also returns the attachments
+// whose content is no longer referenced, so their blobs can be removed.
+func (m *TrashModel) Purge(retention time.Duration) (int64, []*Attachment, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer tx.Rollback()
+
+	cutoff := time.Now().Add(-retention)
+
+	query := `
+		SELECT DISTINCT a.sha256
+		FROM attachments a
+		INNER JOIN records r ON r.id = a.record_id
+		WHERE r.deleted_at < $1
+	`
+
+	rows, err := tx.QueryContext(ctx, query, cutoff)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer rows.Close()
+
+	hashes := make([]string, 0)
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			return 0, nil, err
+		}
+		hashes = append(hashes, hash)
+	}
+
+	if err = rows.Err(); err != nil {
+		return 0, nil, err
+	}
+
+	query = `
+		DELETE FROM comments
+		WHERE deleted_at < $1
+		OR record_id IN (SELECT id FROM records WHERE deleted_at < $1)
+	`
+
+	result, err := tx.ExecContext(ctx, query, cutoff)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	comments, err := result.RowsAffected()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	query = `
+		DELETE FROM records
+		WHERE deleted_at < $1
+	`
+
+	result, err = tx.ExecContext(ctx, query, cutoff)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	records, err := result.RowsAffected()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	orphans, err := unusedContent(ctx, tx, hashes)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return comments + records, orphans, tx.Commit()
+}
@@ -25,7 +25,8 @@ var (
 	ErrDuplicateRecordType = errors.New("duplicate currency")
 )
 
-func (r *RecordTypeModel) Insert(recordtype *RecordType) error {
+// Insert creates the record type and records it in the audit log.
+func (r *RecordTypeModel) Insert(recordtype *RecordType, src AuditSource) error {
 	query := `
 		INSERT INTO types (name)
 		VALUES ($1)
@@ -35,7 +36,13 @@ func (r *RecordTypeModel) Insert(recordtype *RecordType) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	err := r.DB.QueryRowContext(ctx, query, recordtype.Name).Scan(&recordtype.ID, &recordtype.Version, &recordtype.CreatedAt)
+	tx, err := r.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRowContext(ctx, query, recordtype.Name).Scan(&recordtype.ID, &recordtype.Version, &recordtype.CreatedAt)
 	if err != nil {
 		r.ErrorLog.Print(err)
 		switch {
@@ -45,7 +52,14 @@ func (r *RecordTypeModel) Insert(recordtype *RecordType) error {
 			return err
 		}
 	}
-	return nil
+
+	err = auditChange(ctx, tx, src, AuditRecordTypeCreate, "recordtype", "types", recordtype.ID, nil)
+	if err != nil {
+		r.ErrorLog.Print(err)
+		return err
+	}
+
+	return tx.Commit()
 }
 
 func (r *RecordTypeModel) GetAll() ([]*RecordType, error) {
@@ -103,7 +117,9 @@ func (r *RecordTypeModel) GetByID(id int64) (*RecordType, error) {
 	return &recordtype, err
 }
 
-func (r *RecordTypeModel) Delete(id int64) error {
+// Delete removes the record type and keeps its last values in the audit
+// log.
+func (r *RecordTypeModel) Delete(id int64, src AuditSource) error {
 	if id < 1 {
 		return ErrRecordNotFound
 	}
@@ -116,7 +132,18 @@ func (r *RecordTypeModel) Delete(id int64) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	result, err := r.DB.ExecContext(ctx, query, id)
+	tx, err := r.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	before, err := auditRow(ctx, tx, "types", id)
+	if err != nil {
+		return err
+	}
+
+	result, err := tx.ExecContext(ctx, query, id)
 	if err != nil {
 		return err
 	}
@@ -130,5 +157,11 @@ func (r *RecordTypeModel) Delete(id int64) error {
 		return ErrRecordNotFound
 	}
 
-	return nil
+	err = auditChange(ctx, tx, src, AuditRecordTypeDelete, "recordtype", "types", id, before)
+	if err != nil {
+		r.ErrorLog.Print(err)
+		return err
+	}
+
+	return tx.Commit()
 }
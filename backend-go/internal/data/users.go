@@ -4,7 +4,10 @@ import (
 	"context"
 	"database/sql"
 	"errors"
+	"fmt"
 	"log"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/saiharsha/money-manager/pkg/validator"
@@ -15,15 +18,65 @@ var (
 	ErrDuplicateEmail = errors.New("duplicate email")
 )
 
+// Account lockout policy, see RecordFailedLogin.
+const (
+	LockoutThreshold = 5
+	LockoutBase      = time.Minute
+	LockoutMax       = time.Hour
+)
+
 type User struct {
-	ID        int64     `json:"id"`
-	Name      string    `json:"username"`
-	Password  password  `json:"_"`
-	Email     string    `json:"email"`
-	Role      string    `json:"role"`
-	CreatedAt time.Time `json:"created_at"`
-	Activated bool      `json:"activated"`
-	Version   int       `json:"version"`
+	ID         int64     `json:"id"`
+	Name       string    `json:"username"`
+	Password   password  `json:"_"`
+	Email      string    `json:"email"`
+	Role       string    `json:"role"`
+	CreatedAt  time.Time `json:"created_at"`
+	Activated  bool      `json:"activated"`
+	MFAEnabled bool      `json:"mfa_enabled"`
+	// FailedLogins counts wrong passwords since the last successful login.
+	FailedLogins int        `json:"-"`
+	LockedUntil  *time.Time `json:"locked_until,omitempty"`
+	Timezone     string     `json:"timezone"`
+	CurrencyID   *int64     `json:"currency_id,omitempty"`
+	// TokenEpoch is part of every token issued to the user; bumping it
+	// revokes them all.
+	TokenEpoch int `json:"-"`
+	// DeleteAfter is set while the account is scheduled for deletion.
+	DeleteAfter *time.Time `json:"delete_after,omitempty"`
+	SuspendedAt *time.Time `json:"suspended_at,omitempty"`
+	// PasswordResetRequired blocks logins until the user set a new password
+	// through the emailed reset link.
+	PasswordResetRequired bool `json:"password_reset_required"`
+	Version               int  `json:"version"`
+}
+
+// userColumns and userFields list the columns of a whole user and where
+// they are scanned to, for the queries that load one.
+const userColumns = `id, created_at, name, email, password_hash, activated, version, role, totp_enabled,
+		failed_logins, locked_until, timezone, currency_id, token_epoch, delete_after,
+		suspended_at, password_reset_required`
+
+func userFields(user *User) []interface{} {
+	return []interface{}{
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hashed,
+		&user.Activated,
+		&user.Version,
+		&user.Role,
+		&user.MFAEnabled,
+		&user.FailedLogins,
+		&user.LockedUntil,
+		&user.Timezone,
+		&user.CurrencyID,
+		&user.TokenEpoch,
+		&user.DeleteAfter,
+		&user.SuspendedAt,
+		&user.PasswordResetRequired,
+	}
 }
 
 type UserModel struct {
@@ -59,7 +112,7 @@ func (m UserModel) CreateUser(user *User) error {
 
 func (m UserModel) GetUserByMail(email string) (*User, error) {
 	query := `
-		SELECT id, created_at, name, email, password_hash, activated, version, role
+		SELECT ` + userColumns + `
 		FROM users
 		WHERE email = $1
 		`
@@ -69,16 +122,33 @@ func (m UserModel) GetUserByMail(email string) (*User, error) {
 
 	var user User
 
-	err := m.DB.QueryRowContext(ctx, query, email).Scan(
-		&user.ID,
-		&user.CreatedAt,
-		&user.Name,
-		&user.Email,
-		&user.Password.hashed,
-		&user.Activated,
-		&user.Version,
-		&user.Role,
-	)
+	err := m.DB.QueryRowContext(ctx, query, email).Scan(userFields(&user)...)
+
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &user, nil
+}
+
+func (m UserModel) GetUserByID(id int64) (*User, error) {
+	query := `
+		SELECT ` + userColumns + `
+		FROM users
+		WHERE id = $1
+		`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var user User
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(userFields(&user)...)
 
 	if err != nil {
 		switch {
@@ -95,8 +165,9 @@ func (m UserModel) GetUserByMail(email string) (*User, error) {
 func (m *UserModel) UpdateUser(user *User) (*User, error) {
 	query := `
 	UPDATE users 
-	SET name = $1, email = $2, role = $3, activated = $4, password_hash = $5, version = version + 1
-	WHERE id = $6 AND version = $7
+	SET name = $1, email = $2, role = $3, activated = $4, password_hash = $5, timezone = $6, currency_id = $7,
+		suspended_at = $8, password_reset_required = $9, version = version + 1
+	WHERE id = $10 AND version = $11
 	RETURNING version
 	`
 
@@ -106,6 +177,10 @@ func (m *UserModel) UpdateUser(user *User) (*User, error) {
 		user.Role,
 		user.Activated,
 		user.Password.hashed,
+		user.Timezone,
+		user.CurrencyID,
+		user.SuspendedAt,
+		user.PasswordResetRequired,
 		user.ID,
 		user.Version,
 	}
@@ -129,6 +204,223 @@ func (m *UserModel) UpdateUser(user *User) (*User, error) {
 	return user, nil
 }
 
+// UserSortSafeList lists the values accepted by the sort parameter of the
+// admin users list.
+var UserSortSafeList = []string{"id", "name", "email", "created_at", "-id", "-name", "-email", "-created_at"}
+
+// UserFilter narrows the admin users list. Search matches the name or email;
+// nil fields do not filter.
+type UserFilter struct {
+	Search    string
+	Role      string
+	Activated *bool
+	Suspended *bool
+}
+
+// GetAll returns a page of users matching the filter, with the metadata for
+// all matches.
+func (m *UserModel) GetAll(filter UserFilter, filters Filters) ([]*User, Metadata, error) {
+	q := &queryArgs{}
+	conditions := []string{"TRUE"}
+
+	if filter.Search != "" {
+		pattern := q.bind("%" + escapeLike(filter.Search) + "%")
+		conditions = append(conditions, fmt.Sprintf(`(name ILIKE %s ESCAPE '\' OR email ILIKE %s ESCAPE '\')`, pattern, pattern))
+	}
+
+	if filter.Role != "" {
+		conditions = append(conditions, "role = "+q.bind(filter.Role))
+	}
+
+	if filter.Activated != nil {
+		conditions = append(conditions, "activated = "+q.bind(*filter.Activated))
+	}
+
+	if filter.Suspended != nil {
+		if *filter.Suspended {
+			conditions = append(conditions, "suspended_at IS NOT NULL")
+		} else {
+			conditions = append(conditions, "suspended_at IS NULL")
+		}
+	}
+
+	query := fmt.Sprintf(`
+		SELECT count(*) OVER(), %s
+		FROM users
+		WHERE %s
+		ORDER BY %s %s, id ASC
+		LIMIT %s OFFSET %s`,
+		userColumns, strings.Join(conditions, " AND "), filters.sortColumn(), filters.sortDirection(),
+		q.bind(filters.limit()), q.bind(filters.offset()))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, q.args...)
+	if err != nil {
+		m.ErrorLog.Print(err)
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	users := make([]*User, 0)
+
+	for rows.Next() {
+		var user User
+		err := rows.Scan(append([]interface{}{&totalRecords}, userFields(&user)...)...)
+		if err != nil {
+			m.ErrorLog.Print(err)
+			return nil, Metadata{}, err
+		}
+		users = append(users, &user)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	return users, filters.CalculateMetadata(totalRecords), nil
+}
+
+// IsLocked reports whether too many failed logins locked the account.
+func (u *User) IsLocked() bool {
+	return u.LockedUntil != nil && u.LockedUntil.After(time.Now())
+}
+
+// RecordFailedLogin counts a wrong password for the user. From the
+// LockoutThreshold-th failure on, the account is locked for LockoutBase,
+// doubling with every further failure up to LockoutMax. It returns the new
+// number of failures and the lock, if any.
+func (m *UserModel) RecordFailedLogin(id int64) (int, *time.Time, error) {
+	query := `
+		UPDATE users
+		SET failed_logins = failed_logins + 1,
+			locked_until = CASE
+				WHEN failed_logins + 1 >= $2 THEN NOW() + LEAST(
+					make_interval(secs => $3 * power(2, failed_logins + 1 - $2)),
+					make_interval(secs => $4)
+				)
+				ELSE locked_until
+			END
+		WHERE id = $1
+		RETURNING failed_logins, locked_until
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	args := []interface{}{id, LockoutThreshold, LockoutBase.Seconds(), LockoutMax.Seconds()}
+
+	var failures int
+	var lockedUntil *time.Time
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&failures, &lockedUntil)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return 0, nil, ErrRecordNotFound
+		default:
+			m.ErrorLog.Print(err)
+			return 0, nil, err
+		}
+	}
+
+	return failures, lockedUntil, nil
+}
+
+// Unlock clears the failed logins and any lock of the user. It runs after
+// every successful login and when an admin unlocks an account.
+func (m *UserModel) Unlock(id int64) error {
+	query := `
+		UPDATE users
+		SET failed_logins = 0, locked_until = NULL
+		WHERE id = $1
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id)
+	if err != nil {
+		m.ErrorLog.Print(err)
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// RevokeTokens invalidates every token issued to the user so far, ends
+// their sessions and returns the new epoch for the tokens issued from now on.
+func (m *UserModel) RevokeTokens(id int64) (int, error) {
+	query := `
+		WITH ended AS (
+			UPDATE sessions
+			SET revoked_at = NOW()
+			WHERE user_id = $1 AND revoked_at IS NULL
+		)
+		UPDATE users
+		SET token_epoch = token_epoch + 1
+		WHERE id = $1
+		RETURNING token_epoch
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var epoch int
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(&epoch)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return 0, ErrRecordNotFound
+		default:
+			m.ErrorLog.Print(err)
+			return 0, err
+		}
+	}
+
+	return epoch, nil
+}
+
+// GetTokenEpoch returns the epoch tokens of the user must carry to be
+// valid.
+func (m *UserModel) GetTokenEpoch(id int64) (int, error) {
+	query := `
+		SELECT token_epoch
+		FROM users
+		WHERE id = $1
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var epoch int
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(&epoch)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return 0, ErrRecordNotFound
+		default:
+			m.ErrorLog.Print(err)
+			return 0, err
+		}
+	}
+
+	return epoch, nil
+}
+
 type password struct {
 	plaintext *string
 	hashed    []byte
@@ -157,6 +449,20 @@ func (p *password) Matches(plaintextPassword string) (bool, error) {
 	return true, nil
 }
 
+var (
+	dummyHash     []byte
+	dummyHashOnce sync.Once
+)
+
+// SimulatePasswordCheck costs as much as checking a real password. Logins for
+// unknown emails call it so they cannot be told apart by their timing.
+func SimulatePasswordCheck(plaintextPassword string) {
+	dummyHashOnce.Do(func() {
+		dummyHash, _ = bcrypt.GenerateFromPassword([]byte("not a real password"), 12)
+	})
+	_ = bcrypt.CompareHashAndPassword(dummyHash, []byte(plaintextPassword))
+}
+
 func CheckPassword(v *validator.Validator, password string) {
 	v.Check(password != "", "password", "should be not empty")
 	v.Check(len(password) > 8, "password", "should be atleast 8 chars length")
@@ -168,9 +474,13 @@ func ValidateEmail(v *validator.Validator, email string) {
 	v.Check(validator.Matches(email, validator.EmailRX), "email", "must be valid email address")
 }
 
+func ValidateUsername(v *validator.Validator, name string) {
+	v.Check(name != "", "username", "should be not empty")
+	v.Check(len(name) < 100, "username", "length of user name should be less than 100")
+}
+
 func ValidateUser(v *validator.Validator, user *User) {
-	v.Check(user.Name != "", "username", "should be not empty")
-	v.Check(len(user.Name) < 100, "username", "length of user name should be less than 100")
+	ValidateUsername(v, user.Name)
 	ValidateEmail(v, user.Email)
 	CheckPassword(v, *user.Password.plaintext)
 }
@@ -0,0 +1,378 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/saiharsha/money-manager/pkg/validator"
+)
+
+type SavedViewModel struct {
+	DB       *sql.DB
+	InfoLog  *log.Logger
+	ErrorLog *log.Logger
+}
+
+// ViewQuery is the serialised filter and sort set of a saved view. LastDays
+// takes precedence over StartDate so that views like "last 30 days" stay
+// relative to the time they are executed.
+type ViewQuery struct {
+	Filter    string     `json:"filter,omitempty"`
+	Sort      string     `json:"sort,omitempty"`
+	LastDays  int        `json:"last_days,omitempty"`
+	StartDate *time.Time `json:"start_date,omitempty"`
+	EndDate   *time.Time `json:"end_date,omitempty"`
+}
+
+type SavedView struct {
+	ID        int64     `json:"id"`
+	UserID    int64     `json:"user_id"`
+	Name      string    `json:"name"`
+	Query     ViewQuery `json:"query"`
+	Pinned    bool      `json:"pinned"`
+	Shared    bool      `json:"shared"`
+	CreatedAt time.Time `json:"created_at"`
+	Version   int64     `json:"version"`
+}
+
+// ViewShare is a user a view has been shared with.
+type ViewShare struct {
+	UserID   int64     `json:"user_id"`
+	Name     string    `json:"name"`
+	Email    string    `json:"email"`
+	SharedAt time.Time `json:"shared_at"`
+}
+
+var (
+	ErrDuplicateView = errors.New("duplicate view")
+)
+
+func (q ViewQuery) Value() (driver.Value, error) {
+	return json.Marshal(q)
+}
+
+func (q *ViewQuery) Scan(src interface{}) error {
+	b, ok := src.([]byte)
+	if !ok {
+		return errors.New("view query must be a jsonb value")
+	}
+	return json.Unmarshal(b, q)
+}
+
+// Apply fills the filter, sort and date range of filters from the view query.
+// Problems with the stored filter are added to the validator.
+func (q ViewQuery) Apply(v *validator.Validator, filters *Filters, now time.Time) {
+	filters.Expr = validator.ParseFilter(v, "filter", q.Filter, RecordFilterFields)
+
+	filters.Sort = "id"
+	if q.Sort != "" {
+		filters.Sort = q.Sort
+	}
+	filters.SortSafeList = RecordSortSafeList
+
+	filters.EndDate = now
+	if q.EndDate != nil {
+		filters.EndDate = *q.EndDate
+	}
+
+	switch {
+	case q.LastDays > 0:
+		filters.StartDate = now.AddDate(0, 0, -q.LastDays)
+	case q.StartDate != nil:
+		filters.StartDate = *q.StartDate
+	}
+}
+
+func (m *SavedViewModel) Insert(view *SavedView) error {
+	query := `
+		INSERT INTO saved_views (user_id, name, query, pinned)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, created_at, version
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	args := []interface{}{view.UserID, view.Name, view.Query, view.Pinned}
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&view.ID, &view.CreatedAt, &view.Version)
+	if err != nil {
+		m.ErrorLog.Print(err)
+		switch {
+		case err.Error() == `pq: duplicate key value violates unique constraint "saved_views_user_id_name_key"`:
+			return ErrDuplicateView
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+// GetForUser returns a view owned by or shared with the user. Pinned reflects
+// the user's own pin and Shared is set when the user is not the owner.
+func (m *SavedViewModel) GetForUser(id int64, userID int64) (*SavedView, error) {
+	query := `
+		SELECT v.id, v.user_id, v.name, v.query, v.created_at, v.version,
+			CASE WHEN v.user_id = $2 THEN v.pinned ELSE s.pinned END,
+			v.user_id <> $2
+		FROM saved_views v
+		LEFT JOIN saved_view_shares s ON s.view_id = v.id AND s.user_id = $2
+		WHERE v.id = $1 AND (v.user_id = $2 OR s.user_id IS NOT NULL)
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var view SavedView
+
+	err := m.DB.QueryRowContext(ctx, query, id, userID).Scan(&view.ID, &view.UserID, &view.Name, &view.Query, &view.CreatedAt, &view.Version, &view.Pinned, &view.Shared)
+	if err != nil {
+		m.ErrorLog.Print(err)
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &view, nil
+}
+
+// GetAllForUser returns the user's own views and the views shared with them,
+// pinned views first.
+func (m *SavedViewModel) GetAllForUser(userID int64) ([]*SavedView, error) {
+	query := `
+		SELECT v.id, v.user_id, v.name, v.query, v.created_at, v.version,
+			CASE WHEN v.user_id = $1 THEN v.pinned ELSE s.pinned END AS pinned,
+			v.user_id <> $1
+		FROM saved_views v
+		LEFT JOIN saved_view_shares s ON s.view_id = v.id AND s.user_id = $1
+		WHERE v.user_id = $1 OR s.user_id IS NOT NULL
+		ORDER BY pinned DESC, v.name ASC, v.id ASC
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		m.ErrorLog.Print(err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	views := make([]*SavedView, 0)
+	for rows.Next() {
+		var view SavedView
+		err := rows.Scan(&view.ID, &view.UserID, &view.Name, &view.Query, &view.CreatedAt, &view.Version, &view.Pinned, &view.Shared)
+		if err != nil {
+			m.ErrorLog.Print(err)
+			return nil, err
+		}
+		views = append(views, &view)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return views, nil
+}
+
+func (m *SavedViewModel) Update(view *SavedView) error {
+	query := `
+		UPDATE saved_views
+		SET name = $1, query = $2, version = version + 1
+		WHERE id = $3 AND user_id = $4 AND version = $5
+		RETURNING version
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	args := []interface{}{view.Name, view.Query, view.ID, view.UserID, view.Version}
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&view.Version)
+	if err != nil {
+		m.ErrorLog.Print(err)
+		switch {
+		case err.Error() == `pq: duplicate key value violates unique constraint "saved_views_user_id_name_key"`:
+			return ErrDuplicateView
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (m *SavedViewModel) Delete(id int64, userID int64) error {
+	query := `
+		DELETE FROM saved_views
+		WHERE id = $1 AND user_id = $2
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id, userID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// SetPinned pins or unpins a view for the user, on the view itself for its
+// owner and on the share for everyone else.
+func (m *SavedViewModel) SetPinned(id int64, userID int64, pinned bool) error {
+	query := `
+		WITH owned AS (
+			UPDATE saved_views SET pinned = $3
+			WHERE id = $1 AND user_id = $2
+			RETURNING id
+		), shared AS (
+			UPDATE saved_view_shares SET pinned = $3
+			WHERE view_id = $1 AND user_id = $2
+			RETURNING view_id
+		)
+		SELECT (SELECT count(*) FROM owned) + (SELECT count(*) FROM shared)
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var rowsAffected int64
+	err := m.DB.QueryRowContext(ctx, query, id, userID, pinned).Scan(&rowsAffected)
+	if err != nil {
+		m.ErrorLog.Print(err)
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// Share gives another user read-only access to the view. Sharing a view with
+// someone who already has access is a no-op.
+func (m *SavedViewModel) Share(id int64, ownerID int64, userID int64) error {
+	query := `
+		INSERT INTO saved_view_shares (view_id, user_id)
+		SELECT id, $3 FROM saved_views
+		WHERE id = $1 AND user_id = $2 AND user_id <> $3
+		ON CONFLICT (view_id, user_id) DO NOTHING
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, id, ownerID, userID)
+	if err != nil {
+		m.ErrorLog.Print(err)
+		return err
+	}
+
+	return nil
+}
+
+// GetShares lists the users the owner shared the view with.
+func (m *SavedViewModel) GetShares(id int64, ownerID int64) ([]*ViewShare, error) {
+	query := `
+		SELECT u.id, u.name, u.email, s.created_at
+		FROM saved_view_shares s
+		INNER JOIN saved_views v ON v.id = s.view_id
+		INNER JOIN users u ON u.id = s.user_id
+		WHERE v.id = $1 AND v.user_id = $2
+		ORDER BY s.created_at, u.id
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, id, ownerID)
+	if err != nil {
+		m.ErrorLog.Print(err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	shares := make([]*ViewShare, 0)
+	for rows.Next() {
+		var share ViewShare
+		err := rows.Scan(&share.UserID, &share.Name, &share.Email, &share.SharedAt)
+		if err != nil {
+			return nil, err
+		}
+		shares = append(shares, &share)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return shares, nil
+}
+
+func (m *SavedViewModel) Unshare(id int64, ownerID int64, userID int64) error {
+	query := `
+		DELETE FROM saved_view_shares
+		USING saved_views
+		WHERE saved_view_shares.view_id = saved_views.id
+		AND saved_views.id = $1 AND saved_views.user_id = $2 AND saved_view_shares.user_id = $3
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id, ownerID, userID)
+	if err != nil {
+		m.ErrorLog.Print(err)
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+func ValidateSavedView(v *validator.Validator, view *SavedView) {
+	v.Check(view.Name != "", "name", "must be provided")
+	v.Check(len(view.Name) <= 100, "name", "must be at most 100 characters long")
+	v.Check(view.Query.LastDays >= 0, "last_days", "must not be negative")
+	v.Check(view.Query.LastDays <= 3650, "last_days", "must be at most 3650")
+	v.Check(view.Query.Sort == "" || validator.In(view.Query.Sort, RecordSortSafeList...), "sort", "invalid sort value")
+
+	if view.Query.StartDate != nil && view.Query.EndDate != nil {
+		v.Check(!view.Query.StartDate.After(*view.Query.EndDate), "start_date", "must be before end_date")
+	}
+
+	validator.ParseFilter(v, "filter", view.Query.Filter, RecordFilterFields)
+}
@@ -0,0 +1,260 @@
+// Package jwtkeys loads the asymmetric keys used to sign and verify access
+// tokens and publishes their public halves as a JSON Web Key Set.
+//
+// Keys are identified by their RFC 7638 thumbprint, which becomes the kid
+// header of every token. To rotate, add the new private key, make it the
+// signing key and keep the old one as a verification key until the longest
+// lived token signed with it has expired.
+package jwtkeys
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var (
+	ErrUnknownKey = errors.New("unknown signing key")
+)
+
+// Key is a single key. Private is nil for keys that are only used to verify
+// tokens signed before a rotation.
+type Key struct {
+	ID      string
+	Method  jwt.SigningMethod
+	Private crypto.Signer
+	Public  crypto.PublicKey
+}
+
+// JWK is the JSON Web Key form of a public key.
+type JWK struct {
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+}
+
+type KeySet struct {
+	signing *Key
+	keys    map[string]*Key
+	order   []string
+}
+
+// Load reads private keys from privateFiles and public keys from
+// publicFiles, all PEM encoded. The key used for signing is the one with
+// the id signingID, or the first private key if signingID is empty. A key
+// set without any keys is valid and Empty reports true for it.
+func Load(privateFiles, publicFiles []string, signingID string) (*KeySet, error) {
+	ks := &KeySet{keys: make(map[string]*Key)}
+
+	for _, file := range privateFiles {
+		key, err := loadFile(file, true)
+		if err != nil {
+			return nil, err
+		}
+		ks.add(key)
+		if ks.signing == nil && (signingID == "" || signingID == key.ID) {
+			ks.signing = key
+		}
+	}
+
+	for _, file := range publicFiles {
+		key, err := loadFile(file, false)
+		if err != nil {
+			return nil, err
+		}
+		ks.add(key)
+	}
+
+	if len(ks.keys) > 0 && ks.signing == nil {
+		if signingID != "" {
+			return nil, fmt.Errorf("no private key with id %q", signingID)
+		}
+		return nil, errors.New("at least one private key is needed to sign tokens")
+	}
+
+	return ks, nil
+}
+
+// add keeps the private half when a key is given both as a private and a
+// public key.
+func (ks *KeySet) add(key *Key) {
+	existing, ok := ks.keys[key.ID]
+	if !ok {
+		ks.keys[key.ID] = key
+		ks.order = append(ks.order, key.ID)
+		return
+	}
+	if existing.Private == nil {
+		ks.keys[key.ID] = key
+	}
+}
+
+func (ks *KeySet) Empty() bool {
+	return len(ks.keys) == 0
+}
+
+// Signing returns the key new tokens are signed with.
+func (ks *KeySet) Signing() *Key {
+	return ks.signing
+}
+
+// Lookup returns the key with the given id.
+func (ks *KeySet) Lookup(id string) (*Key, error) {
+	key, ok := ks.keys[id]
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+	return key, nil
+}
+
+// JWKS returns the public keys in the order they were loaded.
+func (ks *KeySet) JWKS() []JWK {
+	jwks := make([]JWK, 0, len(ks.order))
+	for _, id := range ks.order {
+		jwk, err := toJWK(ks.keys[id])
+		if err != nil {
+			continue
+		}
+		jwks = append(jwks, jwk)
+	}
+	return jwks
+}
+
+func loadFile(file string, private bool) (*Key, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data found", file)
+	}
+
+	var parsed interface{}
+
+	switch {
+	case private && block.Type == "PRIVATE KEY":
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case private && block.Type == "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case !private && block.Type == "PUBLIC KEY":
+		parsed, err = x509.ParsePKIXPublicKey(block.Bytes)
+	case !private && block.Type == "RSA PUBLIC KEY":
+		parsed, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("%s: unexpected PEM block %q", file, block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+
+	key, err := newKey(parsed)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+
+	return key, nil
+}
+
+func newKey(parsed interface{}) (*Key, error) {
+	key := &Key{}
+
+	switch k := parsed.(type) {
+	case *rsa.PrivateKey:
+		key.Method = jwt.SigningMethodRS256
+		key.Private = k
+		key.Public = k.Public()
+	case ed25519.PrivateKey:
+		key.Method = jwt.SigningMethodEdDSA
+		key.Private = k
+		key.Public = k.Public()
+	case *rsa.PublicKey:
+		key.Method = jwt.SigningMethodRS256
+		key.Public = k
+	case ed25519.PublicKey:
+		key.Method = jwt.SigningMethodEdDSA
+		key.Public = k
+	default:
+		return nil, fmt.Errorf("unsupported key type %T, use RSA or Ed25519", parsed)
+	}
+
+	if rsaKey, ok := key.Public.(*rsa.PublicKey); ok && rsaKey.N.BitLen() < 2048 {
+		return nil, errors.New("RSA keys must be at least 2048 bits")
+	}
+
+	jwk, err := toJWK(key)
+	if err != nil {
+		return nil, err
+	}
+	key.ID = thumbprint(jwk)
+
+	return key, nil
+}
+
+func toJWK(key *Key) (JWK, error) {
+	switch k := key.Public.(type) {
+	case *rsa.PublicKey:
+		return JWK{
+			Kty: "RSA",
+			Use: "sig",
+			Alg: key.Method.Alg(),
+			Kid: key.ID,
+			N:   base64.RawURLEncoding.EncodeToString(k.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(k.E)).Bytes()),
+		}, nil
+	case ed25519.PublicKey:
+		return JWK{
+			Kty: "OKP",
+			Use: "sig",
+			Alg: key.Method.Alg(),
+			Kid: key.ID,
+			Crv: "Ed25519",
+			X:   base64.RawURLEncoding.EncodeToString(k),
+		}, nil
+	default:
+		return JWK{}, fmt.Errorf("unsupported key type %T", key.Public)
+	}
+}
+
+// thumbprint computes the RFC 7638 thumbprint: the SHA-256 of the required
+// members of the key in lexicographic order.
+func thumbprint(jwk JWK) string {
+	var members interface{}
+
+	switch jwk.Kty {
+	case "RSA":
+		members = struct {
+			E   string `json:"e"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+		}{jwk.E, jwk.Kty, jwk.N}
+	default:
+		members = struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+		}{jwk.Crv, jwk.Kty, jwk.X}
+	}
+
+	b, _ := json.Marshal(members)
+	sum := sha256.Sum256(b)
+
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
@@ -2,6 +2,7 @@ package mail
 
 import (
 	"bytes"
+	"fmt"
 	"path/filepath"
 	"text/template"
 	"time"
@@ -69,6 +70,16 @@ func (m *Mailer) SendWelcomeEmail(to []string, username, verifyLink string) erro
 	return m.SendEmail(to, "internal/mail/templates/userwelcome.tmpl", data)
 }
 
+// SendVerifyLinkEmail is a convenience method for sending a new verification link
+func (m *Mailer) SendVerifyLinkEmail(to []string, username, verifyLink string) error {
+	data := map[string]interface{}{
+		"Subject":    "Verify Your Email - Money Manager",
+		"Username":   username,
+		"VerifyLink": verifyLink,
+	}
+	return m.SendEmail(to, "internal/mail/templates/verifyemail.tmpl", data)
+}
+
 // SendVerificationEmail is a convenience method for sending verification emails
 func (m *Mailer) SendVerificationEmail(to []string, username string) error {
 	data := map[string]interface{}{
@@ -78,6 +89,107 @@ func (m *Mailer) SendVerificationEmail(to []string, username string) error {
 	return m.SendEmail(to, "internal/mail/templates/userverfied.tmpl", data)
 }
 
+// SendLedgerInvitationEmail is a convenience method for sending ledger invitations
+func (m *Mailer) SendLedgerInvitationEmail(to []string, inviterName, ledgerName, role, acceptLink string, expiry time.Time) error {
+	data := map[string]interface{}{
+		"Subject":     "You have been invited to a ledger - Money Manager",
+		"InviterName": inviterName,
+		"LedgerName":  ledgerName,
+		"Role":        role,
+		"AcceptLink":  acceptLink,
+		"Expiry":      expiry.UTC().Format("02 Jan 2006 15:04 MST"),
+	}
+	return m.SendEmail(to, "internal/mail/templates/ledgerinvitation.tmpl", data)
+}
+
+// SendAccountLockedEmail is a convenience method for sending account lockout notices
+func (m *Mailer) SendAccountLockedEmail(to []string, username string, lockedUntil time.Time) error {
+	data := map[string]interface{}{
+		"Subject":     "Your account has been locked - Money Manager",
+		"Username":    username,
+		"LockedUntil": lockedUntil.UTC().Format("02 Jan 2006 15:04 MST"),
+	}
+	return m.SendEmail(to, "internal/mail/templates/accountlocked.tmpl", data)
+}
+
+// SendEmailChangeConfirmEmail is a convenience method for sending the confirmation link to a new email address
+func (m *Mailer) SendEmailChangeConfirmEmail(to []string, username, newEmail, confirmLink string, expiry time.Time) error {
+	data := map[string]interface{}{
+		"Subject":     "Confirm Your New Email - Money Manager",
+		"Username":    username,
+		"NewEmail":    newEmail,
+		"ConfirmLink": confirmLink,
+		"Expiry":      expiry.UTC().Format("02 Jan 2006 15:04 MST"),
+	}
+	return m.SendEmail(to, "internal/mail/templates/emailchangeconfirm.tmpl", data)
+}
+
+// SendEmailChangeNoticeEmail is a convenience method for warning the old email address about a change
+func (m *Mailer) SendEmailChangeNoticeEmail(to []string, username, newEmail string) error {
+	data := map[string]interface{}{
+		"Subject":  "Your Email Is Being Changed - Money Manager",
+		"Username": username,
+		"NewEmail": newEmail,
+	}
+	return m.SendEmail(to, "internal/mail/templates/emailchangenotice.tmpl", data)
+}
+
+// SendAccountDeletionConfirmEmail is a convenience method for sending the link that confirms an account deletion
+func (m *Mailer) SendAccountDeletionConfirmEmail(to []string, username, confirmLink string, expiry time.Time, grace time.Duration) error {
+	data := map[string]interface{}{
+		"Subject":     "Confirm Deleting Your Account - Money Manager",
+		"Username":    username,
+		"ConfirmLink": confirmLink,
+		"Expiry":      expiry.UTC().Format("02 Jan 2006 15:04 MST"),
+		"GraceDays":   int(grace.Hours() / 24),
+	}
+	return m.SendEmail(to, "internal/mail/templates/accountdeletionconfirm.tmpl", data)
+}
+
+// SendAccountDeletionScheduledEmail is a convenience method for telling users when their account will be deleted
+func (m *Mailer) SendAccountDeletionScheduledEmail(to []string, username string, deleteAfter time.Time) error {
+	data := map[string]interface{}{
+		"Subject":     "Your Account Will Be Deleted - Money Manager",
+		"Username":    username,
+		"DeleteAfter": deleteAfter.UTC().Format("02 Jan 2006 15:04 MST"),
+	}
+	return m.SendEmail(to, "internal/mail/templates/accountdeletionscheduled.tmpl", data)
+}
+
+// SendPasswordResetEmail is a convenience method for sending password reset links
+func (m *Mailer) SendPasswordResetEmail(to []string, username, resetLink string, ttl time.Duration) error {
+	data := map[string]interface{}{
+		"Subject":    "Reset Your Password - Money Manager",
+		"Username":   username,
+		"ResetLink":  resetLink,
+		"ExpiryTime": fmt.Sprintf("%d hours", int(ttl.Hours())),
+	}
+	return m.SendEmail(to, "internal/mail/templates/passwordreset.tmpl", data)
+}
+
+// SendLoginLinkEmail is a convenience method for sending one-time login links
+func (m *Mailer) SendLoginLinkEmail(to []string, username, loginLink string, ttl time.Duration) error {
+	data := map[string]interface{}{
+		"Subject":    "Your Login Link - Money Manager",
+		"Username":   username,
+		"LoginLink":  loginLink,
+		"ExpiryTime": fmt.Sprintf("%d minutes", int(ttl.Minutes())),
+	}
+	return m.SendEmail(to, "internal/mail/templates/loginlink.tmpl", data)
+}
+
+// SendNewDeviceLoginEmail is a convenience method for telling users about a login from a device they have not used before
+func (m *Mailer) SendNewDeviceLoginEmail(to []string, username, device, ip string, at time.Time) error {
+	data := map[string]interface{}{
+		"Subject":  "New Sign-in To Your Account - Money Manager",
+		"Username": username,
+		"Device":   device,
+		"IP":       ip,
+		"Time":     at.UTC().Format("02 Jan 2006 15:04 MST"),
+	}
+	return m.SendEmail(to, "internal/mail/templates/newdevicelogin.tmpl", data)
+}
+
 // TestConnection tests the SMTP connection
 func (m *Mailer) TestConnection() error {
 	s, err := m.dailer.Dial()
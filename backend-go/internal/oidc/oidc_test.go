@@ -0,0 +1,452 @@
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	testClientID     = "money-manager"
+	testClientSecret = "client secret"
+	testRedirectURL  = "https://app.example.com/users/oidc/callback"
+	testCode         = "authorization-code"
+	testNonce        = "nonce"
+)
+
+// fakeProvider is an OpenID Connect provider that answers discovery, serves
+// one RSA key and hands out the idToken set by the test for testCode.
+type fakeProvider struct {
+	srv      *httptest.Server
+	key      *rsa.PrivateKey
+	kid      string
+	verifier string
+	idToken  string
+
+	discoveryRequests int
+	keysRequests      int
+	// issuer overrides the issuer reported by discovery when set.
+	issuer string
+}
+
+func newFakeProvider(t *testing.T) *fakeProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &fakeProvider{key: key, kid: "key-1"}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", p.discovery)
+	mux.HandleFunc("/token", p.token)
+	mux.HandleFunc("/jwks", p.jwks)
+
+	p.srv = httptest.NewServer(mux)
+	t.Cleanup(p.srv.Close)
+
+	return p
+}
+
+func (p *fakeProvider) discovery(w http.ResponseWriter, r *http.Request) {
+	p.discoveryRequests++
+
+	issuer := p.srv.URL
+	if p.issuer != "" {
+		issuer = p.issuer
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{
+		"issuer":                 issuer,
+		"authorization_endpoint": p.srv.URL + "/authorize",
+		"token_endpoint":         p.srv.URL + "/token",
+		"jwks_uri":               p.srv.URL + "/jwks",
+	})
+}
+
+func (p *fakeProvider) token(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+
+	clientID, clientSecret, _ := r.BasicAuth()
+
+	switch {
+	case r.Method != http.MethodPost,
+		clientID != testClientID || clientSecret != url.QueryEscape(testClientSecret),
+		r.PostForm.Get("grant_type") != "authorization_code",
+		r.PostForm.Get("redirect_uri") != testRedirectURL:
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_request"})
+		return
+	case r.PostForm.Get("code") != testCode || r.PostForm.Get("code_verifier") != p.verifier:
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant", "error_description": "bad code"})
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{"access_token": "access", "token_type": "Bearer", "id_token": p.idToken})
+}
+
+func (p *fakeProvider) jwks(w http.ResponseWriter, r *http.Request) {
+	p.keysRequests++
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"use": "sig",
+			"kid": p.kid,
+			"n":   base64.RawURLEncoding.EncodeToString(p.key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(p.key.E)).Bytes()),
+		}},
+	})
+}
+
+// claims returns valid ID token claims for testClientID.
+func (p *fakeProvider) claims() jwt.MapClaims {
+	now := time.Now()
+	return jwt.MapClaims{
+		"iss":            p.srv.URL,
+		"aud":            testClientID,
+		"sub":            "provider-user-1",
+		"email":          "ana@example.com",
+		"email_verified": true,
+		"name":           "Ana",
+		"nonce":          testNonce,
+		"iat":            now.Unix(),
+		"exp":            now.Add(time.Hour).Unix(),
+	}
+}
+
+func (p *fakeProvider) sign(t *testing.T, claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = p.kid
+
+	signed, err := token.SignedString(p.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func (p *fakeProvider) client() *Client {
+	return NewClient(Config{
+		Issuer:       p.srv.URL,
+		ClientID:     testClientID,
+		ClientSecret: testClientSecret,
+		RedirectURL:  testRedirectURL,
+	}, p.srv.Client())
+}
+
+func TestAuthCodeURL(t *testing.T) {
+	p := newFakeProvider(t)
+
+	raw, err := p.client().AuthCodeURL(context.Background(), "state", testNonce, "challenge")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := u.Scheme + "://" + u.Host + u.Path; got != p.srv.URL+"/authorize" {
+		t.Errorf("got endpoint %s, want %s/authorize", got, p.srv.URL)
+	}
+
+	want := map[string]string{
+		"response_type":         "code",
+		"client_id":             testClientID,
+		"redirect_uri":          testRedirectURL,
+		"scope":                 "openid email profile",
+		"state":                 "state",
+		"nonce":                 testNonce,
+		"code_challenge":        "challenge",
+		"code_challenge_method": "S256",
+	}
+	for name, value := range want {
+		if got := u.Query().Get(name); got != value {
+			t.Errorf("%s = %q, want %q", name, got, value)
+		}
+	}
+}
+
+func TestExchange(t *testing.T) {
+	p := newFakeProvider(t)
+
+	verifier, challenge, err := PKCE()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if challenge == verifier || challenge == "" {
+		t.Fatalf("challenge %q is not derived from verifier %q", challenge, verifier)
+	}
+
+	p.verifier = verifier
+	p.idToken = p.sign(t, p.claims())
+
+	c := p.client()
+
+	claims, err := c.Exchange(context.Background(), testCode, verifier, testNonce)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := Claims{Subject: "provider-user-1", Email: "ana@example.com", EmailVerified: true, Name: "Ana"}
+	if *claims != want {
+		t.Errorf("got %+v, want %+v", *claims, want)
+	}
+
+	// discovery and keys are fetched once and then reused
+	_, err = c.Exchange(context.Background(), testCode, verifier, testNonce)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.discoveryRequests != 1 || p.keysRequests != 1 {
+		t.Errorf("got %d discovery and %d key requests, want 1 and 1", p.discoveryRequests, p.keysRequests)
+	}
+}
+
+func TestExchangeErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		code     string
+		verifier string
+		idToken  bool
+		want     string
+	}{
+		{"wrong code", "other-code", "verifier", true, "invalid_grant bad code"},
+		{"wrong verifier", testCode, "other-verifier", true, "invalid_grant bad code"},
+		{"no id token", testCode, "verifier", false, "no id_token"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newFakeProvider(t)
+			p.verifier = "verifier"
+			if tt.idToken {
+				p.idToken = p.sign(t, p.claims())
+			}
+
+			_, err := p.client().Exchange(context.Background(), tt.code, tt.verifier, testNonce)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got %v, want an error containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestVerify(t *testing.T) {
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		token   func(t *testing.T, p *fakeProvider) string
+		wantErr bool
+	}{
+		{
+			name:  "valid",
+			token: func(t *testing.T, p *fakeProvider) string { return p.sign(t, p.claims()) },
+		},
+		{
+			name: "email_verified as a string",
+			token: func(t *testing.T, p *fakeProvider) string {
+				claims := p.claims()
+				claims["email_verified"] = "true"
+				return p.sign(t, claims)
+			},
+		},
+		{
+			name: "issued to us among several audiences",
+			token: func(t *testing.T, p *fakeProvider) string {
+				claims := p.claims()
+				claims["aud"] = []string{"other-client", testClientID}
+				claims["azp"] = testClientID
+				return p.sign(t, claims)
+			},
+		},
+		{
+			name: "wrong nonce",
+			token: func(t *testing.T, p *fakeProvider) string {
+				claims := p.claims()
+				claims["nonce"] = "other"
+				return p.sign(t, claims)
+			},
+			wantErr: true,
+		},
+		{
+			name: "missing nonce",
+			token: func(t *testing.T, p *fakeProvider) string {
+				claims := p.claims()
+				delete(claims, "nonce")
+				return p.sign(t, claims)
+			},
+			wantErr: true,
+		},
+		{
+			name: "wrong audience",
+			token: func(t *testing.T, p *fakeProvider) string {
+				claims := p.claims()
+				claims["aud"] = "other-client"
+				return p.sign(t, claims)
+			},
+			wantErr: true,
+		},
+		{
+			name: "issued to another party",
+			token: func(t *testing.T, p *fakeProvider) string {
+				claims := p.claims()
+				claims["aud"] = []string{"other-client", testClientID}
+				claims["azp"] = "other-client"
+				return p.sign(t, claims)
+			},
+			wantErr: true,
+		},
+		{
+			name: "wrong issuer",
+			token: func(t *testing.T, p *fakeProvider) string {
+				claims := p.claims()
+				claims["iss"] = "https://evil.example.com"
+				return p.sign(t, claims)
+			},
+			wantErr: true,
+		},
+		{
+			name: "expired",
+			token: func(t *testing.T, p *fakeProvider) string {
+				claims := p.claims()
+				claims["exp"] = time.Now().Add(-time.Hour).Unix()
+				return p.sign(t, claims)
+			},
+			wantErr: true,
+		},
+		{
+			name: "missing subject",
+			token: func(t *testing.T, p *fakeProvider) string {
+				claims := p.claims()
+				delete(claims, "sub")
+				return p.sign(t, claims)
+			},
+			wantErr: true,
+		},
+		{
+			name: "signed with another key",
+			token: func(t *testing.T, p *fakeProvider) string {
+				token := jwt.NewWithClaims(jwt.SigningMethodRS256, p.claims())
+				token.Header["kid"] = p.kid
+				signed, err := token.SignedString(otherKey)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return signed
+			},
+			wantErr: true,
+		},
+		{
+			name: "unknown key id",
+			token: func(t *testing.T, p *fakeProvider) string {
+				token := jwt.NewWithClaims(jwt.SigningMethodRS256, p.claims())
+				token.Header["kid"] = "key-2"
+				signed, err := token.SignedString(p.key)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return signed
+			},
+			wantErr: true,
+		},
+		{
+			name: "symmetric algorithm",
+			token: func(t *testing.T, p *fakeProvider) string {
+				signed, err := jwt.NewWithClaims(jwt.SigningMethodHS256, p.claims()).SignedString([]byte(testClientSecret))
+				if err != nil {
+					t.Fatal(err)
+				}
+				return signed
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newFakeProvider(t)
+
+			claims, err := p.client().Verify(context.Background(), tt.token(t, p), testNonce)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("got claims %+v, want an error", claims)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if claims.Subject != "provider-user-1" || !claims.EmailVerified {
+				t.Errorf("got %+v", claims)
+			}
+		})
+	}
+}
+
+func TestVerifyFetchesRotatedKeys(t *testing.T) {
+	p := newFakeProvider(t)
+	c := p.client()
+
+	_, err := c.Verify(context.Background(), p.sign(t, p.claims()), testNonce)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p.kid = "key-2"
+	token := p.sign(t, p.claims())
+
+	// a new key is not fetched again right away
+	_, err = c.Verify(context.Background(), token, testNonce)
+	if !errors.Is(err, ErrInvalidIDToken) {
+		t.Fatalf("got %v, want ErrInvalidIDToken", err)
+	}
+
+	c.keysFetched = time.Now().Add(-keysRefreshInterval)
+
+	_, err = c.Verify(context.Background(), token, testNonce)
+	if err != nil {
+		t.Fatalf("after the refresh interval: %v", err)
+	}
+	if p.keysRequests != 2 {
+		t.Errorf("got %d key requests, want 2", p.keysRequests)
+	}
+}
+
+func TestDiscoveryErrors(t *testing.T) {
+	p := newFakeProvider(t)
+	p.issuer = "https://other.example.com"
+
+	_, err := p.client().AuthCodeURL(context.Background(), "state", testNonce, "challenge")
+	if err == nil || !strings.Contains(err.Error(), "issuer") {
+		t.Errorf("got %v, want an issuer mismatch", err)
+	}
+
+	srv := httptest.NewServer(http.NotFoundHandler())
+	defer srv.Close()
+
+	c := NewClient(Config{Issuer: srv.URL, ClientID: testClientID}, srv.Client())
+	_, err = c.AuthCodeURL(context.Background(), "state", testNonce, "challenge")
+	if err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("got %v, want a discovery failure", err)
+	}
+}
@@ -0,0 +1,75 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLocalStore(t *testing.T) {
+	s, err := NewLocalStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	key := "blobs/ab/abcdef"
+
+	err = s.Put(ctx, key, strings.NewReader("receipt content"), 15, "text/plain")
+	if err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	exists, err := s.Exists(ctx, key)
+	if err != nil || !exists {
+		t.Fatalf("Exists after Put = %v, %v, want true, nil", exists, err)
+	}
+
+	body, err := s.Get(ctx, key)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	got, err := io.ReadAll(body)
+	body.Close()
+	if err != nil || string(got) != "receipt content" {
+		t.Fatalf("Get returned %q, %v", got, err)
+	}
+
+	// no temporary files are left next to the blob
+	entries, err := os.ReadDir(filepath.Join(s.root, "blobs", "ab"))
+	if err != nil || len(entries) != 1 {
+		t.Errorf("blob directory has %d entries, %v, want 1", len(entries), err)
+	}
+
+	err = s.Delete(ctx, key)
+	if err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+
+	_, err = s.Get(ctx, key)
+	if !errors.Is(err, ErrBlobNotFound) {
+		t.Fatalf("Get after Delete returned %v, want ErrBlobNotFound", err)
+	}
+
+	err = s.Delete(ctx, key)
+	if err != nil {
+		t.Fatalf("second Delete: %v", err)
+	}
+}
+
+func TestLocalStoreRejectsKeysOutsideRoot(t *testing.T) {
+	s, err := NewLocalStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"../escape", "blobs/../../escape", "", "."} {
+		_, err := s.Exists(context.Background(), key)
+		if err == nil {
+			t.Errorf("Exists(%q) did not fail", key)
+		}
+	}
+}
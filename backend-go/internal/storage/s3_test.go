@@ -0,0 +1,289 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testAccessKey = "AKIDEXAMPLE"
+	testSecretKey = "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"
+	testRegion    = "eu-west-1"
+)
+
+// fakeS3 is a minimal S3 stand-in that keeps objects in memory and rejects
+// requests without a valid SigV4 signature with 403, like S3 does.
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string]fakeObject
+	fail    bool
+}
+
+type fakeObject struct {
+	body        []byte
+	contentType string
+}
+
+var authorizationRX = regexp.MustCompile(`^AWS4-HMAC-SHA256 Credential=([^/]+)/(\d{8})/([^/]+)/s3/aws4_request, SignedHeaders=([a-z0-9;-]+), Signature=([0-9a-f]{64})$`)
+
+func newFakeS3(t *testing.T) (*fakeS3, *httptest.Server) {
+	f := &fakeS3{objects: make(map[string]fakeObject)}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	return f, srv
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !f.validSignature(r) {
+		http.Error(w, "SignatureDoesNotMatch", http.StatusForbidden)
+		return
+	}
+
+	if f.fail {
+		http.Error(w, "InternalError", http.StatusInternalServerError)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	path := r.URL.EscapedPath()
+
+	switch r.Method {
+	case http.MethodPut:
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if int64(len(body)) != r.ContentLength {
+			http.Error(w, "IncompleteBody", http.StatusBadRequest)
+			return
+		}
+		f.objects[path] = fakeObject{body: body, contentType: r.Header.Get("Content-Type")}
+	case http.MethodGet, http.MethodHead:
+		object, ok := f.objects[path]
+		if !ok {
+			http.Error(w, "NoSuchKey", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", object.contentType)
+		if r.Method == http.MethodGet {
+			w.Write(object.body)
+		}
+	case http.MethodDelete:
+		// S3 answers 204 whether or not the object existed
+		delete(f.objects, path)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "MethodNotAllowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// validSignature recomputes the SigV4 signature from the request as S3 would.
+func (f *fakeS3) validSignature(r *http.Request) bool {
+	m := authorizationRX.FindStringSubmatch(r.Header.Get("Authorization"))
+	if m == nil {
+		return false
+	}
+	accessKey, day, region, signedHeaders, signature := m[1], m[2], m[3], m[4], m[5]
+
+	amzDate := r.Header.Get("X-Amz-Date")
+	if accessKey != testAccessKey || region != testRegion || !strings.HasPrefix(amzDate, day) {
+		return false
+	}
+
+	var canonicalHeaders strings.Builder
+	for _, name := range strings.Split(signedHeaders, ";") {
+		value := r.Header.Get(name)
+		if name == "host" {
+			value = r.Host
+		}
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(value) + "\n")
+	}
+
+	canonicalRequest := r.Method + "\n" +
+		r.URL.EscapedPath() + "\n" +
+		r.URL.RawQuery + "\n" +
+		canonicalHeaders.String() + "\n" +
+		signedHeaders + "\n" +
+		r.Header.Get("X-Amz-Content-Sha256")
+
+	hashed := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + day + "/" + region + "/s3/aws4_request\n" + hex.EncodeToString(hashed[:])
+
+	key := []byte("AWS4" + testSecretKey)
+	for _, part := range []string{day, region, "s3", "aws4_request", stringToSign} {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(part))
+		key = mac.Sum(nil)
+	}
+
+	return hex.EncodeToString(key) == signature
+}
+
+func newTestS3Store(t *testing.T, endpoint string) *S3Store {
+	s, err := NewS3Store(endpoint, testRegion, "attachments", testAccessKey, testSecretKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestS3Store(t *testing.T) {
+	tests := []struct {
+		name     string
+		prefix   string
+		key      string
+		wantPath string
+	}{
+		{"blob key", "", "blobs/ab/abcdef", "/attachments/blobs/ab/abcdef"},
+		{"endpoint with a path", "/minio/", "thumbnails/ab/abcdef", "/minio/attachments/thumbnails/ab/abcdef"},
+		{"key that needs escaping", "", "odd/a b+c", "/attachments/odd/a%20b%2Bc"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake, srv := newFakeS3(t)
+			s := newTestS3Store(t, srv.URL+tt.prefix)
+			ctx := context.Background()
+			content := []byte("receipt content")
+
+			exists, err := s.Exists(ctx, tt.key)
+			if err != nil || exists {
+				t.Fatalf("Exists before Put = %v, %v, want false, nil", exists, err)
+			}
+
+			err = s.Put(ctx, tt.key, bytes.NewReader(content), int64(len(content)), "text/plain")
+			if err != nil {
+				t.Fatalf("Put: %v", err)
+			}
+
+			object, ok := fake.objects[tt.wantPath]
+			if !ok {
+				t.Fatalf("object not stored at %s, have %v", tt.wantPath, fake.objects)
+			}
+			if object.contentType != "text/plain" {
+				t.Errorf("stored content type %q, want text/plain", object.contentType)
+			}
+
+			exists, err = s.Exists(ctx, tt.key)
+			if err != nil || !exists {
+				t.Fatalf("Exists after Put = %v, %v, want true, nil", exists, err)
+			}
+
+			body, err := s.Get(ctx, tt.key)
+			if err != nil {
+				t.Fatalf("Get: %v", err)
+			}
+			got, err := io.ReadAll(body)
+			body.Close()
+			if err != nil || !bytes.Equal(got, content) {
+				t.Fatalf("Get returned %q, %v, want %q", got, err, content)
+			}
+
+			err = s.Delete(ctx, tt.key)
+			if err != nil {
+				t.Fatalf("Delete: %v", err)
+			}
+
+			_, err = s.Get(ctx, tt.key)
+			if !errors.Is(err, ErrBlobNotFound) {
+				t.Fatalf("Get after Delete returned %v, want ErrBlobNotFound", err)
+			}
+
+			// deleting twice is not an error
+			err = s.Delete(ctx, tt.key)
+			if err != nil {
+				t.Fatalf("second Delete: %v", err)
+			}
+		})
+	}
+}
+
+func TestS3StoreErrors(t *testing.T) {
+	fake, srv := newFakeS3(t)
+	s := newTestS3Store(t, srv.URL)
+	ctx := context.Background()
+
+	fake.fail = true
+
+	err := s.Put(ctx, "blobs/ab/abcdef", strings.NewReader("x"), 1, "text/plain")
+	if err == nil || !strings.Contains(err.Error(), "500") {
+		t.Errorf("Put returned %v, want a 500 error", err)
+	}
+
+	_, err = s.Exists(ctx, "blobs/ab/abcdef")
+	if err == nil || errors.Is(err, ErrBlobNotFound) {
+		t.Errorf("Exists returned %v, want a server error", err)
+	}
+
+	// a wrong secret key is rejected by the store
+	fake.fail = false
+	s.secretKey = "wrong"
+
+	_, err = s.Get(ctx, "blobs/ab/abcdef")
+	if err == nil || !strings.Contains(err.Error(), "403") {
+		t.Errorf("Get with a wrong key returned %v, want a 403 error", err)
+	}
+}
+
+func TestS3StoreSignatureIsStable(t *testing.T) {
+	s := newTestS3Store(t, "https://s3.eu-west-1.amazonaws.com")
+
+	req, err := s.newRequest(context.Background(), http.MethodGet, "blobs/ab/abcdef", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Date(2024, 5, 1, 12, 30, 0, 0, time.UTC)
+	s.sign(req, now)
+	first := req.Header.Get("Authorization")
+	s.sign(req, now)
+
+	if got := req.Header.Get("Authorization"); got != first {
+		t.Errorf("signing twice gave %q and %q", first, got)
+	}
+	if got := req.Header.Get("X-Amz-Date"); got != "20240501T123000Z" {
+		t.Errorf("X-Amz-Date = %q, want 20240501T123000Z", got)
+	}
+	if !strings.HasPrefix(first, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20240501/eu-west-1/s3/aws4_request, ") {
+		t.Errorf("unexpected authorization header %q", first)
+	}
+}
+
+func TestNewS3Store(t *testing.T) {
+	tests := []struct {
+		name     string
+		endpoint string
+		bucket   string
+		wantErr  bool
+	}{
+		{"https endpoint", "https://s3.amazonaws.com", "attachments", false},
+		{"local stand-in", "http://localhost:9000/", "attachments", false},
+		{"missing scheme", "localhost:9000", "attachments", true},
+		{"unsupported scheme", "ftp://localhost", "attachments", true},
+		{"missing bucket", "https://s3.amazonaws.com", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewS3Store(tt.endpoint, testRegion, tt.bucket, testAccessKey, testSecretKey)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got error %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,94 @@
+package storage
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+
+	// register the decoders used by image.Decode
+	_ "image/gif"
+)
+
+// maxThumbnailSourcePixels guards against decompression bombs: images larger
+// than this are not decoded for a thumbnail.
+const maxThumbnailSourcePixels = 40_000_000
+
+// Thumbnail decodes a JPEG, PNG or GIF image and returns a copy scaled down so
+// that neither side exceeds maxSide, together with its content type. JPEG
+// sources produce JPEG thumbnails, everything else produces PNG.
+func Thumbnail(r io.ReadSeeker, maxSide int) ([]byte, string, error) {
+	cfg, format, err := image.DecodeConfig(r)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if cfg.Width*cfg.Height > maxThumbnailSourcePixels {
+		return nil, "", image.ErrFormat
+	}
+
+	_, err = r.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, "", err
+	}
+
+	src, _, err := image.Decode(r)
+	if err != nil {
+		return nil, "", err
+	}
+
+	dst := scaleDown(src, maxSide)
+
+	var buf bytes.Buffer
+	if format == "jpeg" {
+		err = jpeg.Encode(&buf, dst, &jpeg.Options{Quality: 80})
+		return buf.Bytes(), "image/jpeg", err
+	}
+
+	err = png.Encode(&buf, dst)
+	return buf.Bytes(), "image/png", err
+}
+
+// scaleDown resizes src with a box filter so its longest side is at most
+// maxSide. Images that already fit are returned unchanged.
+func scaleDown(src image.Image, maxSide int) image.Image {
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w <= maxSide && h <= maxSide {
+		return src
+	}
+
+	dw, dh := maxSide, h*maxSide/w
+	if h > w {
+		dw, dh = w*maxSide/h, maxSide
+	}
+	dw, dh = max(dw, 1), max(dh, 1)
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		y0, y1 := b.Min.Y+y*h/dh, b.Min.Y+max((y+1)*h/dh, y*h/dh+1)
+		for x := 0; x < dw; x++ {
+			x0, x1 := b.Min.X+x*w/dw, b.Min.X+max((x+1)*w/dw, x*w/dw+1)
+
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := src.At(sx, sy).RGBA()
+					r, g, bl, a = r+uint64(cr), g+uint64(cg), bl+uint64(cb), a+uint64(ca)
+					n++
+				}
+			}
+
+			dst.Set(x, y, color.RGBA64{
+				R: uint16(r / n),
+				G: uint16(g / n),
+				B: uint16(bl / n),
+				A: uint16(a / n),
+			})
+		}
+	}
+
+	return dst
+}
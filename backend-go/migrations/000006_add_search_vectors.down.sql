@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS comments_search_vector_idx;
+DROP INDEX IF EXISTS records_search_vector_idx;
+
+ALTER TABLE comments DROP COLUMN IF EXISTS search_vector;
+ALTER TABLE records DROP COLUMN IF EXISTS search_vector;
@@ -0,0 +1,6 @@
+DROP INDEX IF EXISTS records_user_id_occurred_at_idx;
+
+ALTER TABLE records DROP COLUMN IF EXISTS updated_at;
+ALTER TABLE records DROP COLUMN IF EXISTS timezone;
+ALTER TABLE records DROP COLUMN IF EXISTS has_time;
+ALTER TABLE records DROP COLUMN IF EXISTS occurred_at;
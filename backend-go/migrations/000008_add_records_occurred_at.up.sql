@@ -0,0 +1,10 @@
+ALTER TABLE records ADD COLUMN IF NOT EXISTS occurred_at TIMESTAMPTZ;
+UPDATE records SET occurred_at = created_at WHERE occurred_at IS NULL;
+ALTER TABLE records ALTER COLUMN occurred_at SET NOT NULL;
+ALTER TABLE records ALTER COLUMN occurred_at SET DEFAULT NOW();
+
+ALTER TABLE records ADD COLUMN IF NOT EXISTS has_time BOOLEAN NOT NULL DEFAULT TRUE;
+ALTER TABLE records ADD COLUMN IF NOT EXISTS timezone TEXT NOT NULL DEFAULT 'UTC';
+ALTER TABLE records ADD COLUMN IF NOT EXISTS updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW();
+
+CREATE INDEX IF NOT EXISTS records_user_id_occurred_at_idx ON records (user_id, occurred_at);
@@ -0,0 +1,22 @@
+CREATE TABLE IF NOT EXISTS record_revisions (
+    id            BIGSERIAL PRIMARY KEY,
+    record_id     INT         NOT NULL REFERENCES records (id) ON DELETE CASCADE,
+    version       INT         NOT NULL,
+    amount        INT         NOT NULL,
+    description   TEXT,
+    type_id       INT         NOT NULL,
+    currency_id   INT         NOT NULL,
+    occurred_at   TIMESTAMPTZ NOT NULL,
+    has_time      BOOLEAN     NOT NULL,
+    timezone      TEXT        NOT NULL,
+    restored_from INT,
+    changed_by    BIGINT      NOT NULL,
+    changed_at    TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    UNIQUE (record_id, version)
+);
+
+-- the current state of every record becomes its first known revision
+INSERT INTO record_revisions (record_id, version, amount, description, type_id, currency_id, occurred_at, has_time, timezone, changed_by, changed_at)
+SELECT id, version, amount, description, type_id, currency_id, occurred_at, has_time, timezone, user_id, updated_at
+FROM records
+ON CONFLICT (record_id, version) DO NOTHING;
@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS comments_deleted_at_idx;
+DROP INDEX IF EXISTS records_deleted_at_idx;
+
+ALTER TABLE comments DROP COLUMN IF EXISTS deleted_at;
+ALTER TABLE records DROP COLUMN IF EXISTS deleted_at;
@@ -0,0 +1,14 @@
+CREATE TABLE IF NOT EXISTS attachments (
+    id            BIGSERIAL PRIMARY KEY,
+    record_id     INT         NOT NULL REFERENCES records (id) ON DELETE CASCADE,
+    user_id       BIGINT      NOT NULL,
+    filename      TEXT        NOT NULL,
+    content_type  TEXT        NOT NULL,
+    size          BIGINT      NOT NULL,
+    sha256        TEXT        NOT NULL,
+    has_thumbnail BOOLEAN     NOT NULL DEFAULT FALSE,
+    created_at    TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    UNIQUE (record_id, sha256)
+);
+
+CREATE INDEX IF NOT EXISTS attachments_sha256_idx ON attachments (sha256);
@@ -0,0 +1,3 @@
+ALTER TABLE record_revisions DROP COLUMN IF EXISTS splits;
+
+DROP TABLE IF EXISTS record_splits;
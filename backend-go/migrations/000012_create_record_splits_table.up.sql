@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS record_splits (
+    id          BIGSERIAL PRIMARY KEY,
+    record_id   INT     NOT NULL REFERENCES records (id) ON DELETE CASCADE,
+    position    INT     NOT NULL,
+    amount      INT     NOT NULL CHECK (amount > 0),
+    type_id     INT     NOT NULL REFERENCES types (id),
+    description TEXT    NOT NULL DEFAULT '',
+    UNIQUE (record_id, position)
+);
+
+ALTER TABLE record_revisions ADD COLUMN IF NOT EXISTS splits JSONB NOT NULL DEFAULT '[]';
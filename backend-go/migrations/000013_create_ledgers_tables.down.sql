@@ -0,0 +1,7 @@
+DROP INDEX IF EXISTS records_ledger_id_occurred_at_idx;
+
+ALTER TABLE records DROP COLUMN IF EXISTS ledger_id;
+
+DROP TABLE IF EXISTS ledger_invitations;
+DROP TABLE IF EXISTS ledger_members;
+DROP TABLE IF EXISTS ledgers;
@@ -0,0 +1,58 @@
+CREATE TABLE IF NOT EXISTS ledgers (
+    id         BIGSERIAL PRIMARY KEY,
+    name       TEXT        NOT NULL,
+    personal   BOOLEAN     NOT NULL DEFAULT FALSE,
+    created_by BIGINT      NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    version    INT         NOT NULL DEFAULT 1
+);
+
+-- every user has exactly one personal ledger
+CREATE UNIQUE INDEX IF NOT EXISTS ledgers_personal_idx ON ledgers (created_by) WHERE personal;
+
+CREATE TABLE IF NOT EXISTS ledger_members (
+    ledger_id  BIGINT      NOT NULL REFERENCES ledgers (id) ON DELETE CASCADE,
+    user_id    BIGINT      NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    role       TEXT        NOT NULL CHECK (role IN ('owner', 'editor', 'viewer')),
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (ledger_id, user_id)
+);
+
+CREATE INDEX IF NOT EXISTS ledger_members_user_id_idx ON ledger_members (user_id);
+
+CREATE TABLE IF NOT EXISTS ledger_invitations (
+    id          BIGSERIAL PRIMARY KEY,
+    ledger_id   BIGINT      NOT NULL REFERENCES ledgers (id) ON DELETE CASCADE,
+    email       TEXT        NOT NULL,
+    role        TEXT        NOT NULL CHECK (role IN ('owner', 'editor', 'viewer')),
+    token_hash  BYTEA       NOT NULL UNIQUE,
+    invited_by  BIGINT      NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    expiry      TIMESTAMPTZ NOT NULL,
+    accepted_at TIMESTAMPTZ,
+    created_at  TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+INSERT INTO ledgers (name, personal, created_by)
+SELECT 'Personal', TRUE, id FROM users;
+
+INSERT INTO ledger_members (ledger_id, user_id, role)
+SELECT id, created_by, 'owner' FROM ledgers;
+
+ALTER TABLE records ADD COLUMN IF NOT EXISTS ledger_id BIGINT REFERENCES ledgers (id);
+
+UPDATE records
+SET ledger_id = ledgers.id
+FROM ledgers
+WHERE ledgers.created_by = records.user_id AND ledgers.personal;
+
+-- records of users deleted before records referenced users have no ledger to
+-- move to, and nobody could see them anymore
+DELETE FROM comments
+WHERE record_id IN (SELECT id FROM records WHERE ledger_id IS NULL);
+
+DELETE FROM records
+WHERE ledger_id IS NULL;
+
+ALTER TABLE records ALTER COLUMN ledger_id SET NOT NULL;
+
+CREATE INDEX IF NOT EXISTS records_ledger_id_occurred_at_idx ON records (ledger_id, occurred_at);
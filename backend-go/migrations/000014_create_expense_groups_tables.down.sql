@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS expense_shares;
+DROP TABLE IF EXISTS expenses;
+DROP TABLE IF EXISTS expense_participants;
+DROP TABLE IF EXISTS expense_groups;
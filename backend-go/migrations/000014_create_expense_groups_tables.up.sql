@@ -0,0 +1,47 @@
+CREATE TABLE IF NOT EXISTS expense_groups (
+    id          BIGSERIAL PRIMARY KEY,
+    ledger_id   BIGINT      NOT NULL REFERENCES ledgers (id) ON DELETE CASCADE,
+    name        TEXT        NOT NULL,
+    currency_id INT         NOT NULL REFERENCES currencies (id),
+    created_by  BIGINT      NOT NULL,
+    created_at  TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    version     INT         NOT NULL DEFAULT 1
+);
+
+CREATE INDEX IF NOT EXISTS expense_groups_ledger_id_idx ON expense_groups (ledger_id);
+
+-- a participant is either a registered user or a named guest
+CREATE TABLE IF NOT EXISTS expense_participants (
+    id         BIGSERIAL PRIMARY KEY,
+    group_id   BIGINT      NOT NULL REFERENCES expense_groups (id) ON DELETE CASCADE,
+    user_id    BIGINT      REFERENCES users (id) ON DELETE SET NULL,
+    name       TEXT        NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    UNIQUE (group_id, user_id)
+);
+
+CREATE TABLE IF NOT EXISTS expenses (
+    id           BIGSERIAL PRIMARY KEY,
+    group_id     BIGINT      NOT NULL REFERENCES expense_groups (id) ON DELETE CASCADE,
+    kind         TEXT        NOT NULL DEFAULT 'expense' CHECK (kind IN ('expense', 'repayment')),
+    description  TEXT        NOT NULL DEFAULT '',
+    amount       INT         NOT NULL CHECK (amount > 0),
+    paid_by      BIGINT      NOT NULL REFERENCES expense_participants (id),
+    split_method TEXT        NOT NULL CHECK (split_method IN ('equal', 'exact', 'percent', 'shares')),
+    record_id    INT         REFERENCES records (id) ON DELETE SET NULL,
+    occurred_at  TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    created_by   BIGINT      NOT NULL,
+    created_at   TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS expenses_group_id_idx ON expenses (group_id, occurred_at);
+
+-- value is what the split method was given for the participant (exact amount,
+-- percentage or number of shares), amount is the computed share
+CREATE TABLE IF NOT EXISTS expense_shares (
+    expense_id     BIGINT  NOT NULL REFERENCES expenses (id) ON DELETE CASCADE,
+    participant_id BIGINT  NOT NULL REFERENCES expense_participants (id),
+    value          NUMERIC NOT NULL DEFAULT 0,
+    amount         INT     NOT NULL CHECK (amount >= 0),
+    PRIMARY KEY (expense_id, participant_id)
+);
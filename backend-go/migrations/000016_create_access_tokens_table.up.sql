@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS access_tokens (
+    id           BIGSERIAL PRIMARY KEY,
+    user_id      BIGINT      NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    name         TEXT        NOT NULL,
+    token_hash   BYTEA       NOT NULL UNIQUE,
+    scopes       TEXT[]      NOT NULL,
+    expiry       TIMESTAMPTZ,
+    last_used_at TIMESTAMPTZ,
+    created_at   TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    UNIQUE (user_id, name)
+);
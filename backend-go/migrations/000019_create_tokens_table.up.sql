@@ -0,0 +1,12 @@
+-- single-use tokens sent by email; only the SHA-256 hash is stored
+CREATE TABLE IF NOT EXISTS tokens (
+    hash       BYTEA       PRIMARY KEY,
+    user_id    BIGINT      NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    scope      TEXT        NOT NULL,
+    email      TEXT        NOT NULL,
+    expiry     TIMESTAMPTZ NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS tokens_user_id_scope_idx ON tokens (user_id, scope);
+CREATE INDEX IF NOT EXISTS tokens_expiry_idx ON tokens (expiry);
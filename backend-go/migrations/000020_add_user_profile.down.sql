@@ -0,0 +1,3 @@
+ALTER TABLE users DROP COLUMN IF EXISTS token_epoch;
+ALTER TABLE users DROP COLUMN IF EXISTS currency_id;
+ALTER TABLE users DROP COLUMN IF EXISTS timezone;
@@ -0,0 +1,5 @@
+-- set when the user confirmed deleting their account; the account is purged
+-- once it has passed
+ALTER TABLE users ADD COLUMN IF NOT EXISTS delete_after TIMESTAMPTZ;
+
+CREATE INDEX IF NOT EXISTS users_delete_after_idx ON users (delete_after) WHERE delete_after IS NOT NULL;
@@ -0,0 +1,18 @@
+-- suspended users cannot log in and their tokens stop working
+ALTER TABLE users ADD COLUMN IF NOT EXISTS suspended_at TIMESTAMPTZ;
+-- set when an admin forces a password reset; login is refused until the
+-- emailed reset link is used
+ALTER TABLE users ADD COLUMN IF NOT EXISTS password_reset_required BOOLEAN NOT NULL DEFAULT FALSE;
+
+-- actor_id is not a foreign key so that events outlive deleted accounts
+CREATE TABLE IF NOT EXISTS audit_events (
+    id         BIGSERIAL PRIMARY KEY,
+    actor_id   BIGINT,
+    action     TEXT        NOT NULL,
+    entity     TEXT        NOT NULL,
+    entity_id  BIGINT,
+    details    JSONB       NOT NULL DEFAULT '{}',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS audit_events_entity_idx ON audit_events (entity, entity_id, created_at);
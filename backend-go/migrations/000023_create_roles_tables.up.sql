@@ -0,0 +1,51 @@
+CREATE TABLE IF NOT EXISTS permissions (
+    code        TEXT PRIMARY KEY,
+    description TEXT NOT NULL
+);
+
+-- built in roles cannot be deleted; superuser always has every permission
+CREATE TABLE IF NOT EXISTS roles (
+    name        TEXT PRIMARY KEY,
+    description TEXT        NOT NULL DEFAULT '',
+    builtin     BOOLEAN     NOT NULL DEFAULT FALSE,
+    created_at  TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    version     INTEGER     NOT NULL DEFAULT 1
+);
+
+CREATE TABLE IF NOT EXISTS role_permissions (
+    role       TEXT NOT NULL REFERENCES roles (name) ON DELETE CASCADE,
+    permission TEXT NOT NULL REFERENCES permissions (code) ON DELETE CASCADE,
+    PRIMARY KEY (role, permission)
+);
+
+INSERT INTO permissions (code, description) VALUES
+    ('currencies:write', 'create, change and delete currencies'),
+    ('recordtypes:write', 'create and delete record types'),
+    ('users:read', 'list users and see their details'),
+    ('users:manage', 'change roles, suspend, verify and reset users'),
+    ('roles:manage', 'create and change roles and their permissions')
+ON CONFLICT (code) DO NOTHING;
+
+INSERT INTO roles (name, description, builtin) VALUES
+    ('user', 'regular user without admin access', TRUE),
+    ('admin', 'manages users, currencies and record types', TRUE),
+    ('superuser', 'has every permission', TRUE)
+ON CONFLICT (name) DO NOTHING;
+
+INSERT INTO role_permissions (role, permission) VALUES
+    ('admin', 'currencies:write'),
+    ('admin', 'recordtypes:write'),
+    ('admin', 'users:read'),
+    ('admin', 'users:manage')
+ON CONFLICT DO NOTHING;
+
+INSERT INTO role_permissions (role, permission)
+SELECT 'superuser', code FROM permissions
+ON CONFLICT DO NOTHING;
+
+-- roles that were set by hand before become regular roles without permissions
+INSERT INTO roles (name)
+SELECT DISTINCT role FROM users
+ON CONFLICT (name) DO NOTHING;
+
+ALTER TABLE users ADD CONSTRAINT users_role_fkey FOREIGN KEY (role) REFERENCES roles (name);
@@ -0,0 +1,7 @@
+INSERT INTO permissions (code, description) VALUES
+    ('users:impersonate', 'act as another user to see what they see')
+ON CONFLICT (code) DO NOTHING;
+
+INSERT INTO role_permissions (role, permission) VALUES
+    ('superuser', 'users:impersonate')
+ON CONFLICT DO NOTHING;
@@ -0,0 +1,18 @@
+DELETE FROM permissions WHERE code = 'audit:read';
+
+DROP TRIGGER IF EXISTS audit_events_no_truncate ON audit_events;
+DROP TRIGGER IF EXISTS audit_events_append_only ON audit_events;
+DROP TRIGGER IF EXISTS audit_events_chain ON audit_events;
+DROP FUNCTION IF EXISTS audit_events_append_only();
+DROP FUNCTION IF EXISTS audit_events_chain();
+DROP FUNCTION IF EXISTS audit_event_hash(audit_events);
+
+DROP INDEX IF EXISTS audit_events_request_idx;
+DROP INDEX IF EXISTS audit_events_actor_idx;
+
+ALTER TABLE audit_events DROP COLUMN IF EXISTS hash;
+ALTER TABLE audit_events DROP COLUMN IF EXISTS prev_hash;
+ALTER TABLE audit_events DROP COLUMN IF EXISTS request_id;
+ALTER TABLE audit_events DROP COLUMN IF EXISTS ip;
+ALTER TABLE audit_events DROP COLUMN IF EXISTS after;
+ALTER TABLE audit_events DROP COLUMN IF EXISTS before;
@@ -0,0 +1,71 @@
+ALTER TABLE audit_events ADD COLUMN IF NOT EXISTS before     JSONB;
+ALTER TABLE audit_events ADD COLUMN IF NOT EXISTS after      JSONB;
+ALTER TABLE audit_events ADD COLUMN IF NOT EXISTS ip         TEXT NOT NULL DEFAULT '';
+ALTER TABLE audit_events ADD COLUMN IF NOT EXISTS request_id TEXT NOT NULL DEFAULT '';
+ALTER TABLE audit_events ADD COLUMN IF NOT EXISTS prev_hash  TEXT NOT NULL DEFAULT '';
+ALTER TABLE audit_events ADD COLUMN IF NOT EXISTS hash       TEXT NOT NULL DEFAULT '';
+
+CREATE INDEX IF NOT EXISTS audit_events_actor_idx ON audit_events (actor_id, created_at);
+CREATE INDEX IF NOT EXISTS audit_events_request_idx ON audit_events (request_id);
+
+-- the hash covers every column and the hash of the row before, so changing,
+-- inserting or removing a row breaks the chain from there on
+CREATE OR REPLACE FUNCTION audit_event_hash(e audit_events) RETURNS TEXT AS $$
+    SELECT encode(sha256(convert_to(jsonb_build_array(
+        e.prev_hash, e.id, e.actor_id, e.action, e.entity, e.entity_id,
+        e.before, e.after, e.details, e.ip, e.request_id,
+        to_char(e.created_at AT TIME ZONE 'UTC', 'YYYY-MM-DD"T"HH24:MI:SS.US"Z"')
+    )::text, 'UTF8')), 'hex')
+$$ LANGUAGE sql STABLE;
+
+-- existing events are chained in the order they were written
+DO $$
+DECLARE
+    e    audit_events;
+    prev TEXT := '';
+BEGIN
+    FOR e IN SELECT * FROM audit_events ORDER BY id LOOP
+        e.prev_hash := prev;
+        prev := audit_event_hash(e);
+        UPDATE audit_events SET prev_hash = e.prev_hash, hash = prev WHERE id = e.id;
+    END LOOP;
+END
+$$;
+
+-- inserts are serialised so every row links to the one written before it.
+-- The id is taken under the lock, so ids follow the order of the chain.
+CREATE OR REPLACE FUNCTION audit_events_chain() RETURNS TRIGGER AS $$
+BEGIN
+    PERFORM pg_advisory_xact_lock(hashtext('audit_events'));
+    NEW.id := nextval('audit_events_id_seq');
+    NEW.prev_hash := coalesce((SELECT hash FROM audit_events ORDER BY id DESC LIMIT 1), '');
+    NEW.hash := audit_event_hash(NEW);
+    RETURN NEW;
+END
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER audit_events_chain
+    BEFORE INSERT ON audit_events
+    FOR EACH ROW EXECUTE FUNCTION audit_events_chain();
+
+CREATE OR REPLACE FUNCTION audit_events_append_only() RETURNS TRIGGER AS $$
+BEGIN
+    RAISE EXCEPTION 'audit_events is append-only';
+END
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER audit_events_append_only
+    BEFORE UPDATE OR DELETE ON audit_events
+    FOR EACH ROW EXECUTE FUNCTION audit_events_append_only();
+
+CREATE TRIGGER audit_events_no_truncate
+    BEFORE TRUNCATE ON audit_events
+    FOR EACH STATEMENT EXECUTE FUNCTION audit_events_append_only();
+
+INSERT INTO permissions (code, description) VALUES
+    ('audit:read', 'read and verify the audit log')
+ON CONFLICT (code) DO NOTHING;
+
+INSERT INTO role_permissions (role, permission) VALUES
+    ('superuser', 'audit:read')
+ON CONFLICT DO NOTHING;
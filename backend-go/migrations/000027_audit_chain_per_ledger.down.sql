@@ -0,0 +1,21 @@
+CREATE OR REPLACE FUNCTION audit_events_chain() RETURNS TRIGGER AS $$
+BEGIN
+    PERFORM pg_advisory_xact_lock(hashtext('audit_events'));
+    NEW.id := nextval('audit_events_id_seq');
+    NEW.prev_hash := coalesce((SELECT hash FROM audit_events ORDER BY id DESC LIMIT 1), '');
+    NEW.hash := audit_event_hash(NEW);
+    RETURN NEW;
+END
+$$ LANGUAGE plpgsql;
+
+CREATE OR REPLACE FUNCTION audit_event_hash(e audit_events) RETURNS TEXT AS $$
+    SELECT encode(sha256(convert_to(jsonb_build_array(
+        e.prev_hash, e.id, e.actor_id, e.action, e.entity, e.entity_id,
+        e.before, e.after, e.details, e.ip, e.request_id,
+        to_char(e.created_at AT TIME ZONE 'UTC', 'YYYY-MM-DD"T"HH24:MI:SS.US"Z"')
+    )::text, 'UTF8')), 'hex')
+$$ LANGUAGE sql STABLE;
+
+DROP INDEX IF EXISTS audit_events_chain_idx;
+
+ALTER TABLE audit_events DROP COLUMN IF EXISTS ledger_id;
@@ -0,0 +1,32 @@
+ALTER TABLE audit_events ADD COLUMN IF NOT EXISTS ledger_id BIGINT;
+
+CREATE INDEX IF NOT EXISTS audit_events_chain_idx ON audit_events (ledger_id, id);
+
+-- the ledger is part of the hash, so an event cannot be moved to another
+-- chain. Events outside a ledger, including every event written before this
+-- migration, hash exactly as they did before.
+CREATE OR REPLACE FUNCTION audit_event_hash(e audit_events) RETURNS TEXT AS $$
+    SELECT encode(sha256(convert_to((jsonb_build_array(
+        e.prev_hash, e.id, e.actor_id, e.action, e.entity, e.entity_id,
+        e.before, e.after, e.details, e.ip, e.request_id,
+        to_char(e.created_at AT TIME ZONE 'UTC', 'YYYY-MM-DD"T"HH24:MI:SS.US"Z"')
+    ) || CASE WHEN e.ledger_id IS NULL THEN '[]'::jsonb ELSE jsonb_build_array(e.ledger_id) END)::text, 'UTF8')), 'hex')
+$$ LANGUAGE sql STABLE;
+
+-- every ledger has a chain of its own and events outside a ledger share one.
+-- An insert only waits for inserts into the same chain until its transaction
+-- ends, so audited writes to different ledgers no longer wait for each other.
+-- The id is taken under the lock, so ids follow the order within a chain.
+CREATE OR REPLACE FUNCTION audit_events_chain() RETURNS TRIGGER AS $$
+BEGIN
+    PERFORM pg_advisory_xact_lock(hashtextextended('audit_events:' || coalesce(NEW.ledger_id::text, ''), 0));
+    NEW.id := nextval('audit_events_id_seq');
+    IF NEW.ledger_id IS NULL THEN
+        NEW.prev_hash := coalesce((SELECT hash FROM audit_events WHERE ledger_id IS NULL ORDER BY id DESC LIMIT 1), '');
+    ELSE
+        NEW.prev_hash := coalesce((SELECT hash FROM audit_events WHERE ledger_id = NEW.ledger_id ORDER BY id DESC LIMIT 1), '');
+    END IF;
+    NEW.hash := audit_event_hash(NEW);
+    RETURN NEW;
+END
+$$ LANGUAGE plpgsql;
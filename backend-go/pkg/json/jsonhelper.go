@@ -84,11 +84,15 @@ func WriteJSON(w http.ResponseWriter, status int, data Envelope, headers http.He
 }
 
 func ReadIDParam(r *http.Request) (int64, error) {
-	idStr := chi.URLParam(r, "id")
+	return ReadIDURLParam(r, "id")
+}
+
+func ReadIDURLParam(r *http.Request, key string) (int64, error) {
+	idStr := chi.URLParam(r, key)
 
 	id, err := strconv.ParseInt(idStr, 10, 64)
 	if err != nil || id < 1 {
-		return 0, errors.New("invalid id parameter")
+		return 0, fmt.Errorf("invalid %s parameter", key)
 	}
 
 	return id, nil
@@ -115,6 +119,21 @@ func ReadIntParam(r *http.Request, key string, defaultValue int, v *validator.Va
 	return intValue
 }
 
+// ReadBoolParam returns nil if the parameter is missing, so callers can tell
+// it apart from false.
+func ReadBoolParam(r *http.Request, key string, v *validator.Validator) *bool {
+	value := r.URL.Query().Get(key)
+	if value == "" {
+		return nil
+	}
+	boolValue, err := strconv.ParseBool(value)
+	if err != nil {
+		v.AddError(key, "invalid bool parameter")
+		return nil
+	}
+	return &boolValue
+}
+
 func ReadTimeParam(r *http.Request, key string, defaultValue time.Time, isDefault bool, v *validator.Validator) time.Time {
 	value := r.URL.Query().Get(key)
 	if value == "" {
@@ -0,0 +1,395 @@
+package validator
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Filter expressions are a compact query syntax for list endpoints, e.g.
+//
+//	amount>=100 and (type_id in (1,2) or not has_comments)
+//	description~"hardware" and not currency_id=3
+//
+// Conditions are combined with and / or / not and grouped with parentheses.
+// Supported operators are =, !=, <, <=, >, >=, ~ (contains) and in (...).
+// A bare boolean field such as has_comments is shorthand for has_comments=true.
+
+const (
+	maxFilterLength     = 1000
+	maxFilterDepth      = 10
+	maxFilterConditions = 50
+	maxFilterListValues = 100
+)
+
+type FilterKind int
+
+const (
+	FilterNumber FilterKind = iota
+	FilterString
+	FilterBool
+)
+
+// FilterField describes a field that may appear in a filter expression and the
+// operators it accepts. Bits is the size of the column behind a number field,
+// so values it cannot hold are rejected; 0 means 64.
+type FilterField struct {
+	Kind      FilterKind
+	Operators []string
+	Bits      int
+}
+
+// FilterExpr is a node of a parsed filter expression. It is one of FilterAnd,
+// FilterOr, FilterNot or FilterCondition.
+type FilterExpr interface {
+	filterExpr()
+}
+
+type FilterAnd struct {
+	Terms []FilterExpr
+}
+
+type FilterOr struct {
+	Terms []FilterExpr
+}
+
+type FilterNot struct {
+	Expr FilterExpr
+}
+
+// FilterCondition compares a field against one or more values. Values hold
+// int64, string or bool depending on the field kind.
+type FilterCondition struct {
+	Field    string
+	Operator string
+	Values   []interface{}
+}
+
+func (FilterAnd) filterExpr()       {}
+func (FilterOr) filterExpr()        {}
+func (FilterNot) filterExpr()       {}
+func (FilterCondition) filterExpr() {}
+
+// ParseFilter parses and validates a filter expression against the allowed
+// fields. Any problem is added to the validator under key and nil is returned.
+// An empty input yields a nil expression.
+func ParseFilter(v *Validator, key, input string, fields map[string]FilterField) FilterExpr {
+	input = strings.TrimSpace(input)
+	if input == "" {
+		return nil
+	}
+
+	if len(input) > maxFilterLength {
+		v.AddError(key, fmt.Sprintf("must be at most %d characters long", maxFilterLength))
+		return nil
+	}
+
+	tokens, err := lexFilter(input)
+	if err != nil {
+		v.AddError(key, err.Error())
+		return nil
+	}
+
+	p := &filterParser{tokens: tokens, fields: fields}
+	expr, err := p.parseOr(0)
+	if err == nil && p.peek().kind != tokenEOF {
+		err = fmt.Errorf("unexpected %q at position %d", p.peek().text, p.peek().pos)
+	}
+	if err != nil {
+		v.AddError(key, err.Error())
+		return nil
+	}
+
+	return expr
+}
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenIdent
+	tokenNumber
+	tokenString
+	tokenOperator
+	tokenLParen
+	tokenRParen
+	tokenComma
+)
+
+type filterToken struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+func lexFilter(input string) ([]filterToken, error) {
+	var tokens []filterToken
+	runes := []rune(input)
+
+	for i := 0; i < len(runes); {
+		c := runes[i]
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '(':
+			tokens = append(tokens, filterToken{tokenLParen, "(", i})
+			i++
+		case c == ')':
+			tokens = append(tokens, filterToken{tokenRParen, ")", i})
+			i++
+		case c == ',':
+			tokens = append(tokens, filterToken{tokenComma, ",", i})
+			i++
+		case c == '=' || c == '~':
+			tokens = append(tokens, filterToken{tokenOperator, string(c), i})
+			i++
+		case c == '!' || c == '<' || c == '>':
+			if i+1 < len(runes) && runes[i+1] == '=' {
+				tokens = append(tokens, filterToken{tokenOperator, string(runes[i : i+2]), i})
+				i += 2
+				continue
+			}
+			if c == '!' {
+				return nil, fmt.Errorf("unexpected %q at position %d", c, i)
+			}
+			tokens = append(tokens, filterToken{tokenOperator, string(c), i})
+			i++
+		case c == '"' || c == '\'':
+			start := i
+			var sb strings.Builder
+			i++
+			for ; i < len(runes) && runes[i] != c; i++ {
+				if runes[i] == '\\' && i+1 < len(runes) {
+					i++
+				}
+				sb.WriteRune(runes[i])
+			}
+			if i >= len(runes) {
+				return nil, fmt.Errorf("unterminated string starting at position %d", start)
+			}
+			i++
+			tokens = append(tokens, filterToken{tokenString, sb.String(), start})
+		case c == '-' || unicode.IsDigit(c):
+			start := i
+			i++
+			for i < len(runes) && unicode.IsDigit(runes[i]) {
+				i++
+			}
+			tokens = append(tokens, filterToken{tokenNumber, string(runes[start:i]), start})
+		case c == '_' || unicode.IsLetter(c):
+			start := i
+			for i < len(runes) && (runes[i] == '_' || unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i])) {
+				i++
+			}
+			tokens = append(tokens, filterToken{tokenIdent, string(runes[start:i]), start})
+		default:
+			return nil, fmt.Errorf("unexpected %q at position %d", c, i)
+		}
+	}
+
+	return append(tokens, filterToken{tokenEOF, "end of filter", len(runes)}), nil
+}
+
+type filterParser struct {
+	tokens     []filterToken
+	pos        int
+	fields     map[string]FilterField
+	conditions int
+}
+
+func (p *filterParser) peek() filterToken {
+	return p.tokens[p.pos]
+}
+
+func (p *filterParser) next() filterToken {
+	tok := p.tokens[p.pos]
+	if tok.kind != tokenEOF {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *filterParser) keyword(word string) bool {
+	tok := p.peek()
+	return tok.kind == tokenIdent && strings.EqualFold(tok.text, word)
+}
+
+func (p *filterParser) parseOr(depth int) (FilterExpr, error) {
+	if depth > maxFilterDepth {
+		return nil, fmt.Errorf("must not be nested more than %d levels deep", maxFilterDepth)
+	}
+
+	left, err := p.parseAnd(depth)
+	if err != nil {
+		return nil, err
+	}
+
+	terms := []FilterExpr{left}
+	for p.keyword("or") {
+		p.next()
+		right, err := p.parseAnd(depth)
+		if err != nil {
+			return nil, err
+		}
+		terms = append(terms, right)
+	}
+
+	if len(terms) == 1 {
+		return left, nil
+	}
+	return FilterOr{Terms: terms}, nil
+}
+
+func (p *filterParser) parseAnd(depth int) (FilterExpr, error) {
+	left, err := p.parseUnary(depth)
+	if err != nil {
+		return nil, err
+	}
+
+	terms := []FilterExpr{left}
+	for p.keyword("and") {
+		p.next()
+		right, err := p.parseUnary(depth)
+		if err != nil {
+			return nil, err
+		}
+		terms = append(terms, right)
+	}
+
+	if len(terms) == 1 {
+		return left, nil
+	}
+	return FilterAnd{Terms: terms}, nil
+}
+
+func (p *filterParser) parseUnary(depth int) (FilterExpr, error) {
+	if p.keyword("not") {
+		p.next()
+		expr, err := p.parseUnary(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		return FilterNot{Expr: expr}, nil
+	}
+
+	if p.peek().kind == tokenLParen {
+		p.next()
+		expr, err := p.parseOr(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		if tok := p.next(); tok.kind != tokenRParen {
+			return nil, fmt.Errorf("expected \")\" at position %d", tok.pos)
+		}
+		return expr, nil
+	}
+
+	return p.parseCondition()
+}
+
+func (p *filterParser) parseCondition() (FilterExpr, error) {
+	tok := p.next()
+	if tok.kind != tokenIdent {
+		return nil, fmt.Errorf("expected a field name at position %d", tok.pos)
+	}
+
+	name := strings.ToLower(tok.text)
+	field, ok := p.fields[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown field %q", tok.text)
+	}
+
+	p.conditions++
+	if p.conditions > maxFilterConditions {
+		return nil, fmt.Errorf("must not contain more than %d conditions", maxFilterConditions)
+	}
+
+	var operator string
+	switch {
+	case p.peek().kind == tokenOperator:
+		operator = p.next().text
+	case p.keyword("in"):
+		p.next()
+		operator = "in"
+	case field.Kind == FilterBool:
+		// a bare boolean field means field=true
+		return FilterCondition{Field: name, Operator: "=", Values: []interface{}{true}}, nil
+	default:
+		return nil, fmt.Errorf("expected an operator after %q", tok.text)
+	}
+
+	if !In(operator, field.Operators...) {
+		return nil, fmt.Errorf("operator %q is not supported for %q", operator, name)
+	}
+
+	if operator != "in" {
+		value, err := p.parseValue(name, field)
+		if err != nil {
+			return nil, err
+		}
+		return FilterCondition{Field: name, Operator: operator, Values: []interface{}{value}}, nil
+	}
+
+	if open := p.next(); open.kind != tokenLParen {
+		return nil, fmt.Errorf("expected \"(\" after in at position %d", open.pos)
+	}
+
+	var values []interface{}
+	for {
+		value, err := p.parseValue(name, field)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+		if len(values) > maxFilterListValues {
+			return nil, fmt.Errorf("in lists must not contain more than %d values", maxFilterListValues)
+		}
+
+		sep := p.next()
+		if sep.kind == tokenRParen {
+			break
+		}
+		if sep.kind != tokenComma {
+			return nil, fmt.Errorf("expected \",\" or \")\" at position %d", sep.pos)
+		}
+	}
+
+	return FilterCondition{Field: name, Operator: operator, Values: values}, nil
+}
+
+func (p *filterParser) parseValue(name string, field FilterField) (interface{}, error) {
+	tok := p.next()
+
+	switch field.Kind {
+	case FilterNumber:
+		if tok.kind != tokenNumber {
+			return nil, fmt.Errorf("%q must be compared with a number", name)
+		}
+		bits := field.Bits
+		if bits == 0 {
+			bits = 64
+		}
+		n, err := strconv.ParseInt(tok.text, 10, bits)
+		if errors.Is(err, strconv.ErrRange) {
+			return nil, fmt.Errorf("number %s is out of range for %q", tok.text, name)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q", tok.text)
+		}
+		return n, nil
+	case FilterString:
+		if tok.kind != tokenString {
+			return nil, fmt.Errorf("%q must be compared with a quoted string", name)
+		}
+		return tok.text, nil
+	case FilterBool:
+		if tok.kind == tokenIdent && (strings.EqualFold(tok.text, "true") || strings.EqualFold(tok.text, "false")) {
+			return strings.EqualFold(tok.text, "true"), nil
+		}
+		return nil, fmt.Errorf("%q must be compared with true or false", name)
+	}
+
+	return nil, errors.New("unsupported field type")
+}
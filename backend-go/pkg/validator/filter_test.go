@@ -0,0 +1,154 @@
+package validator
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var testFilterFields = map[string]FilterField{
+	"amount":       {Kind: FilterNumber, Operators: []string{"=", "!=", "<", "<=", ">", ">=", "in"}, Bits: 32},
+	"type_id":      {Kind: FilterNumber, Operators: []string{"=", "!=", "in"}},
+	"description":  {Kind: FilterString, Operators: []string{"=", "!=", "~"}},
+	"has_comments": {Kind: FilterBool, Operators: []string{"=", "!="}},
+}
+
+func TestParseFilter(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  FilterExpr
+	}{
+		{
+			name:  "empty",
+			input: "   ",
+			want:  nil,
+		},
+		{
+			name:  "comparison",
+			input: "amount>=100",
+			want:  FilterCondition{Field: "amount", Operator: ">=", Values: []interface{}{int64(100)}},
+		},
+		{
+			name:  "negative number",
+			input: "amount < -5",
+			want:  FilterCondition{Field: "amount", Operator: "<", Values: []interface{}{int64(-5)}},
+		},
+		{
+			name:  "largest number the column holds",
+			input: "amount<=2147483647",
+			want:  FilterCondition{Field: "amount", Operator: "<=", Values: []interface{}{int64(2147483647)}},
+		},
+		{
+			name:  "field names are case insensitive",
+			input: "Type_ID != 2",
+			want:  FilterCondition{Field: "type_id", Operator: "!=", Values: []interface{}{int64(2)}},
+		},
+		{
+			name:  "quoted string with escapes",
+			input: `description~"say \"hi\""`,
+			want:  FilterCondition{Field: "description", Operator: "~", Values: []interface{}{`say "hi"`}},
+		},
+		{
+			name:  "single quotes",
+			input: "description='rent'",
+			want:  FilterCondition{Field: "description", Operator: "=", Values: []interface{}{"rent"}},
+		},
+		{
+			name:  "bare boolean",
+			input: "has_comments",
+			want:  FilterCondition{Field: "has_comments", Operator: "=", Values: []interface{}{true}},
+		},
+		{
+			name:  "boolean comparison",
+			input: "has_comments = FALSE",
+			want:  FilterCondition{Field: "has_comments", Operator: "=", Values: []interface{}{false}},
+		},
+		{
+			name:  "in list",
+			input: "type_id in (1, 2,3)",
+			want:  FilterCondition{Field: "type_id", Operator: "in", Values: []interface{}{int64(1), int64(2), int64(3)}},
+		},
+		{
+			name:  "and binds tighter than or",
+			input: "amount=1 or amount=2 and type_id=3",
+			want: FilterOr{Terms: []FilterExpr{
+				FilterCondition{Field: "amount", Operator: "=", Values: []interface{}{int64(1)}},
+				FilterAnd{Terms: []FilterExpr{
+					FilterCondition{Field: "amount", Operator: "=", Values: []interface{}{int64(2)}},
+					FilterCondition{Field: "type_id", Operator: "=", Values: []interface{}{int64(3)}},
+				}},
+			}},
+		},
+		{
+			name:  "parentheses and not",
+			input: "amount>=100 AND (type_id in (1,2) OR NOT has_comments)",
+			want: FilterAnd{Terms: []FilterExpr{
+				FilterCondition{Field: "amount", Operator: ">=", Values: []interface{}{int64(100)}},
+				FilterOr{Terms: []FilterExpr{
+					FilterCondition{Field: "type_id", Operator: "in", Values: []interface{}{int64(1), int64(2)}},
+					FilterNot{Expr: FilterCondition{Field: "has_comments", Operator: "=", Values: []interface{}{true}}},
+				}},
+			}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := NewValidator()
+			got := ParseFilter(v, "filter", tt.input, testFilterFields)
+
+			if !v.Valid() {
+				t.Fatalf("unexpected errors: %v", v.Errors)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseFilterErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{"unknown field", "owner=1", `unknown field "owner"`},
+		{"unsupported operator", "type_id>1", `operator ">" is not supported for "type_id"`},
+		{"missing operator", "amount", `expected an operator after "amount"`},
+		{"number field with string", `amount="1"`, `"amount" must be compared with a number`},
+		{"string field with number", "description=1", `"description" must be compared with a quoted string`},
+		{"boolean field with number", "has_comments=1", `"has_comments" must be compared with true or false`},
+		{"number out of range", "type_id=99999999999999999999", `number 99999999999999999999 is out of range for "type_id"`},
+		{"number out of column range", "amount>3000000000", `number 3000000000 is out of range for "amount"`},
+		{"negative number out of column range", "amount>-2147483649", `number -2147483649 is out of range for "amount"`},
+		{"number out of range in list", "amount in (1, 2147483648)", `number 2147483648 is out of range for "amount"`},
+		{"unterminated string", `description="rent`, "unterminated string starting at position 12"},
+		{"lone bang", "amount!1", `unexpected '!' at position 6`},
+		{"stray character", "amount=1 & amount=2", `unexpected '&' at position 9`},
+		{"unclosed parenthesis", "(amount=1", `expected ")" at position 9`},
+		{"trailing tokens", "amount=1 amount=2", `unexpected "amount" at position 9`},
+		{"bad in list", "type_id in (1 2)", `expected "," or ")" at position 14`},
+		{"in without list", "type_id in 1", `expected "(" after in at position 11`},
+		{"dangling and", "amount=1 and", "expected a field name at position 12"},
+		{"too long", "amount=" + strings.Repeat("1", maxFilterLength), "must be at most 1000 characters long"},
+		{"too deep", strings.Repeat("(", maxFilterDepth+1) + "amount=1" + strings.Repeat(")", maxFilterDepth+1), "must not be nested more than 10 levels deep"},
+		{"too many conditions", strings.TrimSuffix(strings.Repeat("amount=1 or ", maxFilterConditions+1), " or "), "must not contain more than 50 conditions"},
+		{"too many in values", "type_id in (" + strings.TrimSuffix(strings.Repeat("1,", maxFilterListValues+1), ",") + ")", "in lists must not contain more than 100 values"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := NewValidator()
+			got := ParseFilter(v, "filter", tt.input, testFilterFields)
+
+			if got != nil {
+				t.Errorf("got %#v, want nil", got)
+			}
+			if v.Errors["filter"] != tt.want {
+				t.Errorf("got error %q, want %q", v.Errors["filter"], tt.want)
+			}
+		})
+	}
+}
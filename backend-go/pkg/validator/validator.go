@@ -40,3 +40,11 @@ func In(value string, list ...string) bool {
 	}
 	return false
 }
+
+func Unique(values []string) bool {
+	uniqueValues := make(map[string]bool)
+	for _, value := range values {
+		uniqueValues[value] = true
+	}
+	return len(values) == len(uniqueValues)
+}